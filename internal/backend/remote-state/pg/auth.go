@@ -0,0 +1,163 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/cloudsqlconn"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	authMethodPassword    = "password"
+	authMethodRDSIAM      = "rds-iam"
+	authMethodCloudSQLIAM = "cloudsql-iam"
+)
+
+const (
+	cloudSQLAdminScope = "https://www.googleapis.com/auth/sqlservice.admin"
+	cloudSQLLoginScope = "https://www.googleapis.com/auth/sqlservice.login"
+)
+
+// rdsAuthTokenBuilder builds a short-lived RDS IAM authentication token for
+// the given database endpoint (host:port), AWS region and database user.
+type rdsAuthTokenBuilder func(ctx context.Context, endpoint, region, user string) (string, error)
+
+// newRDSAuthTokenBuilder returns an rdsAuthTokenBuilder signing the tokens
+// with the credentials of the default AWS credential chain, along with the
+// region configured for that chain, if any.
+func newRDSAuthTokenBuilder(ctx context.Context) (rdsAuthTokenBuilder, string, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load the AWS configuration: %w", err)
+	}
+
+	build := func(ctx context.Context, endpoint, region, user string) (string, error) {
+		return auth.BuildAuthToken(ctx, endpoint, region, user, cfg.Credentials)
+	}
+	return build, cfg.Region, nil
+}
+
+// rdsIAMPassword returns a function building a new RDS IAM authentication
+// token each time it is called, which is meant to be used as the password of
+// each new connection since the tokens are only valid for 15 minutes.
+//
+// The endpoint and user the token is built for are taken from the connection
+// string or the libpq environment variables. The region is derived from the
+// RDS host name, defaultRegion is used for hosts that don't include it.
+func rdsIAMPassword(connStr, defaultRegion string, build rdsAuthTokenBuilder) (func(ctx context.Context) (string, error), error) {
+	params, err := parseConnStr(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	host := firstNonEmpty(params["host"], os.Getenv("PGHOST"))
+	port := firstNonEmpty(params["port"], os.Getenv("PGPORT"), "5432")
+	user := firstNonEmpty(params["user"], os.Getenv("PGUSER"))
+	if host == "" || strings.HasPrefix(host, "/") {
+		return nil, fmt.Errorf("RDS IAM authentication requires the host name of the database")
+	}
+	if user == "" {
+		return nil, fmt.Errorf("RDS IAM authentication requires the database user")
+	}
+
+	region := firstNonEmpty(rdsRegionFromHost(host), defaultRegion)
+	if region == "" {
+		return nil, fmt.Errorf("cannot determine the AWS region of %q for RDS IAM authentication; set the AWS_REGION environment variable", host)
+	}
+
+	endpoint := net.JoinHostPort(host, port)
+	return func(ctx context.Context) (string, error) {
+		return build(ctx, endpoint, region, user)
+	}, nil
+}
+
+// rdsRegionFromHost extracts the AWS region from an RDS host name such as
+// mydb.123456789012.us-east-1.rds.amazonaws.com. An empty string is returned
+// for host names that don't follow this pattern.
+func rdsRegionFromHost(host string) string {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	for i := 1; i+1 < len(labels); i++ {
+		if labels[i] == "rds" && labels[i+1] == "amazonaws" {
+			return labels[i-1]
+		}
+	}
+	return ""
+}
+
+// cloudSQLDialer establishes connections to Cloud SQL instances, as
+// cloudsqlconn.Dialer does.
+type cloudSQLDialer interface {
+	Dial(ctx context.Context, instance string, opts ...cloudsqlconn.DialOption) (net.Conn, error)
+}
+
+// newCloudSQLDialer returns a Cloud SQL dialer using IAM database
+// authentication, along with the token source of the access tokens to log in
+// with. Both use the Application Default Credentials.
+func newCloudSQLDialer(ctx context.Context) (cloudSQLDialer, oauth2.TokenSource, error) {
+	apiTokens, err := google.DefaultTokenSource(ctx, cloudSQLAdminScope)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get the Google Application Default Credentials: %w", err)
+	}
+	loginTokens, err := google.DefaultTokenSource(ctx, cloudSQLLoginScope)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get the Google Application Default Credentials: %w", err)
+	}
+
+	dialer, err := cloudsqlconn.NewDialer(ctx, cloudsqlconn.WithIAMAuthNTokenSources(apiTokens, loginTokens))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create the Cloud SQL dialer: %w", err)
+	}
+	return dialer, loginTokens, nil
+}
+
+// cloudSQLConnector returns a connector reaching the given Cloud SQL
+// instance, identified by its connection name (project:region:instance),
+// through dialer and authenticating with an access token of tokens.
+//
+// The Cloud SQL dialer encrypts the connections itself, so SSL is disabled
+// at the Postgres protocol level. The tokens are expected to be cached and
+// refreshed by the token source, as the ones of the oauth2 package are, so
+// each new connection of the pool gets a valid token.
+func cloudSQLConnector(connStr, instance string, dialer cloudSQLDialer, tokens oauth2.TokenSource) (*connector, error) {
+	if instance == "" {
+		return nil, fmt.Errorf("Cloud SQL IAM authentication requires the connection name of the instance in \"cloudsql_instance\"")
+	}
+
+	connStr, err := overrideConnStr(connStr, map[string]string{"sslmode": "disable"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &connector{
+		connStr: connStr,
+		password: func(ctx context.Context) (string, error) {
+			token, err := tokens.Token()
+			if err != nil {
+				return "", fmt.Errorf("failed to get a Google access token: %w", err)
+			}
+			return token.AccessToken, nil
+		},
+		dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.Dial(ctx, instance)
+		},
+	}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
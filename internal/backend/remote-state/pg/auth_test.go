@@ -0,0 +1,147 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"golang.org/x/oauth2"
+)
+
+func TestRDSRegionFromHost(t *testing.T) {
+	testCases := map[string]string{
+		"mydb.123456789012.us-east-1.rds.amazonaws.com":           "us-east-1",
+		"mydb.cluster-abcdefghijkl.eu-west-3.rds.amazonaws.com":   "eu-west-3",
+		"myproxy.proxy-abcdefghijkl.ap-south-1.rds.amazonaws.com": "ap-south-1",
+		"mydb.123456789012.cn-north-1.rds.amazonaws.com.cn":       "cn-north-1",
+		"db.example.com": "",
+		"localhost":      "",
+	}
+
+	for host, want := range testCases {
+		t.Run(host, func(t *testing.T) {
+			if got := rdsRegionFromHost(host); got != want {
+				t.Fatalf("wrong region %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRDSIAMPassword(t *testing.T) {
+	t.Run("missing-region", func(t *testing.T) {
+		_, err := rdsIAMPassword("host=db.example.com user=tofu", "", nil)
+		if err == nil || !strings.Contains(err.Error(), "cannot determine the AWS region") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("missing-user", func(t *testing.T) {
+		t.Setenv("PGUSER", "")
+		_, err := rdsIAMPassword("host=mydb.123456789012.us-east-1.rds.amazonaws.com", "", nil)
+		if err == nil || !strings.Contains(err.Error(), "requires the database user") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("unix-socket", func(t *testing.T) {
+		_, err := rdsIAMPassword("host=/var/run/postgresql user=tofu", "us-east-1", nil)
+		if err == nil || !strings.Contains(err.Error(), "requires the host name") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestRDSIAMPasswordPerConnection(t *testing.T) {
+	var calls []string
+	build := func(ctx context.Context, endpoint, region, user string) (string, error) {
+		calls = append(calls, fmt.Sprintf("%s %s %s", endpoint, region, user))
+		return fmt.Sprintf("token-%d", len(calls)), nil
+	}
+
+	// Nothing listens on this port, so the connections fail right after
+	// the password has been requested.
+	connStr := "host=127.0.0.1 port=1 user=tofu sslmode=disable connect_timeout=1"
+	password, err := rdsIAMPassword(connStr, "eu-west-1", build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &connector{connStr: connStr, password: password}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Connect(context.Background()); err == nil {
+			t.Fatal("expected the connection to fail")
+		}
+	}
+
+	if len(calls) != 3 {
+		t.Fatalf("the token was built %d times for 3 connections", len(calls))
+	}
+	for _, call := range calls {
+		if want := "127.0.0.1:1 eu-west-1 tofu"; call != want {
+			t.Fatalf("token built for %q; want %q", call, want)
+		}
+	}
+}
+
+type fakeCloudSQLDialer struct {
+	instances []string
+}
+
+func (d *fakeCloudSQLDialer) Dial(ctx context.Context, instance string, opts ...cloudsqlconn.DialOption) (net.Conn, error) {
+	d.instances = append(d.instances, instance)
+	return nil, errors.New("fake dialer")
+}
+
+type fakeTokenSource struct {
+	calls int
+}
+
+func (ts *fakeTokenSource) Token() (*oauth2.Token, error) {
+	ts.calls++
+	return &oauth2.Token{AccessToken: fmt.Sprintf("token-%d", ts.calls)}, nil
+}
+
+func TestCloudSQLConnector(t *testing.T) {
+	t.Run("missing-instance", func(t *testing.T) {
+		_, err := cloudSQLConnector("user=tofu@example.iam dbname=tofu", "", &fakeCloudSQLDialer{}, &fakeTokenSource{})
+		if err == nil || !strings.Contains(err.Error(), `"cloudsql_instance"`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	dialer := &fakeCloudSQLDialer{}
+	tokens := &fakeTokenSource{}
+	const instance = "my-project:europe-west1:my-instance"
+	c, err := cloudSQLConnector("user=tofu@example.iam dbname=tofu sslmode=verify-full", instance, dialer, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sslMode := effectiveSSLMode(c.connStr); sslMode != "disable" {
+		t.Fatalf("wrong sslmode %q; want %q", sslMode, "disable")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "fake dialer") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if tokens.calls != 2 {
+		t.Fatalf("the token was requested %d times for 2 connections", tokens.calls)
+	}
+	if len(dialer.instances) != 2 {
+		t.Fatalf("the dialer was called %d times for 2 connections", len(dialer.instances))
+	}
+	for _, got := range dialer.instances {
+		if got != instance {
+			t.Fatalf("dialed %q; want %q", got, instance)
+		}
+	}
+}
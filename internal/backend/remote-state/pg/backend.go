@@ -5,19 +5,34 @@ package pg
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/lib/pq"
 	"github.com/opentofu/opentofu/internal/backend"
 	"github.com/opentofu/opentofu/internal/legacy/helper/schema"
 )
 
 const (
+	// statesTableName and statesIndexName are the default names of the
+	// table holding the states and of its index on the workspace name.
 	statesTableName = "states"
 	statesIndexName = "states_by_name"
+
+	// defaultConnStrEnv is the environment variable the connection string
+	// is read from when conn_str is empty, unless conn_str_env names another
+	// one.
+	defaultConnStrEnv = "PG_CONN_STR"
 )
 
 func defaultBoolFunc(k string, dv bool) schema.SchemaDefaultFunc {
@@ -30,6 +45,109 @@ func defaultBoolFunc(k string, dv bool) schema.SchemaDefaultFunc {
 	}
 }
 
+func validateNonNegativeInt(v interface{}, k string) ([]string, []error) {
+	if v.(int) < 0 {
+		return nil, []error{fmt.Errorf("%q cannot be negative: %d", k, v.(int))}
+	}
+	return nil, nil
+}
+
+func validateAuthMethod(v interface{}, k string) ([]string, []error) {
+	switch v.(string) {
+	case authMethodPassword, authMethodRDSIAM, authMethodCloudSQLIAM:
+		return nil, nil
+	default:
+		return nil, []error{fmt.Errorf("%q must be one of %q, %q or %q, got %q", k, authMethodPassword, authMethodRDSIAM, authMethodCloudSQLIAM, v.(string))}
+	}
+}
+
+func validateChannelBinding(v interface{}, k string) ([]string, []error) {
+	switch v.(string) {
+	case "", "disable", "prefer", "require":
+		return nil, nil
+	default:
+		return nil, []error{fmt.Errorf("%q must be one of \"disable\", \"prefer\" or \"require\", got %q", k, v.(string))}
+	}
+}
+
+func validateSSLMode(v interface{}, k string) ([]string, []error) {
+	switch v.(string) {
+	case "", "disable", "require", "verify-ca", "verify-full":
+		return nil, nil
+	default:
+		return nil, []error{fmt.Errorf("%q must be one of \"disable\", \"require\", \"verify-ca\" or \"verify-full\", got %q", k, v.(string))}
+	}
+}
+
+// isolationLevels are the isolation levels of the isolation_level option.
+var isolationLevels = map[string]sql.IsolationLevel{
+	"read committed":  sql.LevelReadCommitted,
+	"repeatable read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
+
+func validateIsolationLevel(v interface{}, k string) ([]string, []error) {
+	if _, ok := isolationLevels[v.(string)]; !ok && v.(string) != "" {
+		return nil, []error{fmt.Errorf("%q must be one of \"read committed\", \"repeatable read\" or \"serializable\", got %q", k, v.(string))}
+	}
+	return nil, nil
+}
+
+func validateStateColumnType(v interface{}, k string) ([]string, []error) {
+	switch v.(string) {
+	case "", "text", "bytea":
+		return nil, nil
+	default:
+		return nil, []error{fmt.Errorf("%q must be one of \"text\" or \"bytea\", got %q", k, v.(string))}
+	}
+}
+
+func validateStorage(v interface{}, k string) ([]string, []error) {
+	switch v.(string) {
+	case "inline", "largeobject":
+		return nil, nil
+	default:
+		return nil, []error{fmt.Errorf("%q must be one of \"inline\" or \"largeobject\", got %q", k, v.(string))}
+	}
+}
+
+func validateRegexp(v interface{}, k string) ([]string, []error) {
+	if _, err := regexp.Compile(v.(string)); err != nil {
+		return nil, []error{fmt.Errorf("%q must be a regular expression: %w", k, err)}
+	}
+	return nil, nil
+}
+
+func validateDuration(v interface{}, k string) ([]string, []error) {
+	if v.(string) == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(v.(string))
+	if err != nil {
+		return nil, []error{fmt.Errorf("%q must be a duration such as \"5m\": %w", k, err)}
+	}
+	if d < 0 {
+		return nil, []error{fmt.Errorf("%q cannot be negative: %s", k, d)}
+	}
+	return nil, nil
+}
+
+// durationAttr returns the duration stored in the given attribute, or zero if
+// it is unset.
+func durationAttr(data *schema.ResourceData, k string) time.Duration {
+	v := data.Get(k).(string)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		// This should never happen because the schema should have
+		// already validated the duration.
+		panic(fmt.Sprintf("invalid duration %q: %s", v, err))
+	}
+	return d
+}
+
 // New creates a new backend for Postgres remote state.
 func New() backend.Backend {
 	s := &schema.Backend{
@@ -38,7 +156,86 @@ func New() backend.Backend {
 				Type:        schema.TypeString,
 				Optional:    true,
 				Description: "Postgres connection string; a `postgres://` URL",
-				DefaultFunc: schema.EnvDefaultFunc("PG_CONN_STR", nil),
+			},
+
+			"conn_str_env": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Name of the environment variable the connection string is read from when `conn_str` is empty",
+				Default:     defaultConnStrEnv,
+			},
+
+			"read_conn_str": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Connection string of a read replica listing the workspaces and reading the states, the primary given by `conn_str` serves everything if empty",
+				Default:     "",
+			},
+
+			"service": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Name of the connection service of the service file whose parameters complete `conn_str`, as the `service` parameter of libpq",
+				Default:     "",
+			},
+
+			"service_file": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Path of the connection service file, `~/.pg_service.conf` if empty",
+				Default:     "",
+			},
+
+			"auth_method": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "How to authenticate to Postgres, one of `password`, `rds-iam` or `cloudsql-iam`",
+				Default:      authMethodPassword,
+				ValidateFunc: validateAuthMethod,
+			},
+
+			"cloudsql_instance": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Connection name of the Cloud SQL instance (`project:region:instance`) used with the `cloudsql-iam` authentication method",
+			},
+
+			"set_role": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Role the connections switch to with `SET ROLE` once logged in, so the states are written as that role; the login role must be a member of it",
+			},
+
+			"sslmode": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "SSL mode used to connect to Postgres, one of `disable`, `require`, `verify-ca` or `verify-full`",
+				ValidateFunc: validateSSLMode,
+			},
+
+			"channel_binding": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Whether the SCRAM authentication is bound to the SSL channel, one of `disable`, `prefer` or `require`",
+				ValidateFunc: validateChannelBinding,
+			},
+
+			"sslcert": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Path to the client certificate presented to Postgres",
+			},
+
+			"sslkey": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Path to the private key of the client certificate",
+			},
+
+			"sslrootcert": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Path to the certificate authorities used to verify the Postgres server certificate",
 			},
 
 			"schema_name": {
@@ -48,6 +245,56 @@ func New() backend.Backend {
 				DefaultFunc: schema.EnvDefaultFunc("PG_SCHEMA_NAME", "terraform_remote_state"),
 			},
 
+			"fallback_schema_names": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Schemas searched in order, after schema_name, for the workspaces whose state isn't in schema_name, such as the schemas the states were migrated from. Their states are listed and read, but written into schema_name",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+
+			"table_name": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Name of the automatically managed Postgres table to store state",
+				DefaultFunc: schema.EnvDefaultFunc("PG_TABLE_NAME", statesTableName),
+			},
+
+			"name_column": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Name of the column of the states table holding the names of the workspaces",
+				Default:     "name",
+			},
+
+			"data_column": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Name of the column of the states table holding the states",
+				Default:     "data",
+			},
+
+			"hash_partitions": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Number of partitions of the states table by the hash of the workspace names, set when the table is created; it isn't partitioned if `0`",
+				Default:      0,
+				ValidateFunc: validateNonNegativeInt,
+			},
+
+			"tablespace": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Tablespace the states table and its index are created in, the default one of the database if empty",
+				Default:     "",
+			},
+
+			"unlogged": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "If set to `true`, the states table is created UNLOGGED, which makes the writes faster but loses the states if Postgres crashes, for disposable environments only",
+				DefaultFunc: defaultBoolFunc("PG_UNLOGGED", false),
+			},
+
 			"skip_schema_creation": {
 				Type:        schema.TypeBool,
 				Optional:    true,
@@ -68,6 +315,289 @@ func New() backend.Backend {
 				Description: "If set to `true`, OpenTofu won't try to create the Postgres index",
 				DefaultFunc: defaultBoolFunc("PG_SKIP_INDEX_CREATION", false),
 			},
+
+			"max_open_connections": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Maximum number of open connections to Postgres, unlimited if `0`",
+				Default:      0,
+				ValidateFunc: validateNonNegativeInt,
+			},
+
+			"max_idle_connections": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Maximum number of idle connections kept in the pool, the driver default is used if `0`",
+				Default:      0,
+				ValidateFunc: validateNonNegativeInt,
+			},
+
+			"conn_max_lifetime": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Maximum amount of time a connection may be reused, such as `5m`",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"conn_max_idle_time": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Maximum amount of time a connection may be idle before being closed, such as `1m`",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"statement_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Maximum duration of each statement run by the backend, such as `30s`, after which Postgres cancels it",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"application_name": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Name of the application of the connections, shown in `pg_stat_activity`. Defaults to the one of the connection string, or `opentofu`",
+				DefaultFunc: schema.EnvDefaultFunc("PG_APPLICATION_NAME", ""),
+			},
+
+			"connect_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "How long to wait for each connection to Postgres to be established, such as `10s`, after which the attempt fails",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"socks5_proxy": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "URL of a SOCKS5 proxy the connections to Postgres go through, such as `socks5://bastion:1080`",
+				DefaultFunc: schema.EnvDefaultFunc("PG_SOCKS5_PROXY", ""),
+			},
+
+			"lock_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "How long to wait for a state lock held by someone else, such as `30s`",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"lock_ttl": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "How long a lock is kept without a heartbeat of its holder before another client may take it over, such as `5m`",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"lock_heartbeat_interval": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "How often the holder of a lock extends it when lock_ttl is set, such as `1m`, a third of lock_ttl by default",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"history_limit": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Number of versions of each state kept in the history table, no history is kept if `0`",
+				Default:      0,
+				ValidateFunc: validateNonNegativeInt,
+			},
+
+			"soft_delete_retention": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "How long the deleted workspaces can be recovered before being purged, such as `720h`, they are deleted right away if empty",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"isolation_level": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Isolation level of the transactions writing the states, one of `read committed`, `repeatable read` or `serializable`, the default of the database if empty",
+				Default:      "",
+				ValidateFunc: validateIsolationLevel,
+			},
+
+			"list_operation_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Maximum duration of the listings of the workspaces when the caller sets no deadline, such as `1m`, `0` for none",
+				Default:      "1m",
+				ValidateFunc: validateDuration,
+			},
+
+			"read_operation_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Maximum duration of the reads of the states when the caller sets no deadline, such as `5m`, `0` for none",
+				Default:      "5m",
+				ValidateFunc: validateDuration,
+			},
+
+			"write_operation_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Maximum duration of the writes and deletions of the states when the caller sets no deadline, such as `5m`, `0` for none",
+				Default:      "5m",
+				ValidateFunc: validateDuration,
+			},
+
+			"lock_operation_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Maximum duration of the locking and unlocking of the states when the caller sets no deadline, on top of lock_timeout, such as `1m`, `0` for none",
+				Default:      "1m",
+				ValidateFunc: validateDuration,
+			},
+
+			"slow_query_threshold": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Duration beyond which the operations on the states are logged as slow, e.g. `2s`, they never are if empty",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"max_retries": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Number of times the operations failing with a transient error, such as a dropped connection, are retried",
+				Default:      0,
+				ValidateFunc: validateNonNegativeInt,
+			},
+
+			"verify_connection": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "If set to `true`, OpenTofu checks that Postgres is reachable when configuring the backend",
+				DefaultFunc: defaultBoolFunc("PG_VERIFY_CONNECTION", false),
+			},
+
+			"compress": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "If set to `true`, the states are gzip-compressed when they are written",
+				DefaultFunc: defaultBoolFunc("PG_COMPRESS", false),
+			},
+
+			"state_column_type": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Type of the column storing the states, `text` or `bytea`, the type of the existing column if empty, `text` for a new table",
+				Default:      "",
+				ValidateFunc: validateStateColumnType,
+			},
+
+			"storage": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Where the states are written, `inline` in the data column or `largeobject` in Postgres large objects referenced by the data_oid column",
+				Default:      "inline",
+				ValidateFunc: validateStorage,
+			},
+
+			"encryption_key": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Sensitive:    true,
+				Description:  "Base64-encoded 32-byte key the states are encrypted with, using AES-256-GCM, they are stored in clear if empty",
+				DefaultFunc:  schema.EnvDefaultFunc("PG_ENCRYPTION_KEY", ""),
+				ValidateFunc: validateEncryptionKey,
+			},
+
+			"pgbouncer_compatible": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "If set to `true`, the backend avoids the session-level features, so it can be used through PgBouncer in transaction pooling mode",
+				DefaultFunc: defaultBoolFunc("PG_PGBOUNCER_COMPATIBLE", false),
+			},
+
+			"prepared_statements": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "If set to `true`, the hot queries are prepared once per connection, which is the default unless `pgbouncer_compatible` is set",
+				DefaultFunc: func() (interface{}, error) {
+					// Left unset, the default depends on pgbouncer_compatible.
+					if v := os.Getenv("PG_PREPARED_STATEMENTS"); v != "" {
+						return strconv.ParseBool(v)
+					}
+					return nil, nil
+				},
+			},
+
+			"create_missing": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "If set to `false`, using a workspace that doesn't exist is an error instead of creating it",
+				DefaultFunc: defaultBoolFunc("PG_CREATE_MISSING", true),
+			},
+
+			"default_workspace": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Name of the workspace used as the default one, which can't be deleted. Defaults to `default`",
+				Default:     "",
+			},
+
+			"workspace_name_pattern": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Regular expression the names of the new workspaces must match, e.g. `^[a-z0-9-]+$`",
+				Default:      "",
+				ValidateFunc: validateRegexp,
+			},
+
+			"read_only": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "If set to `true`, the states can be read but not written, locked or deleted",
+				DefaultFunc: defaultBoolFunc("PG_READ_ONLY", false),
+			},
+
+			"allow_lineage_change": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "If set to `true`, a state of another lineage than the stored one can be written over it, which is otherwise refused",
+				DefaultFunc: defaultBoolFunc("PG_ALLOW_LINEAGE_CHANGE", false),
+			},
+
+			"allow_state_downgrade": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "If set to `true`, a state of an older format or written by an older OpenTofu than the stored one can be written over it, which is otherwise refused",
+				DefaultFunc: defaultBoolFunc("PG_ALLOW_STATE_DOWNGRADE", false),
+			},
+
+			"workspaces_cache_ttl": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "How long the listing of the workspaces is cached, e.g. `30s`, it isn't cached if empty",
+				Default:      "",
+				ValidateFunc: validateDuration,
+			},
+
+			"notify_channel": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Name of a Postgres notification channel signaled with the name of the workspace each time a state is written",
+				Default:     "",
+			},
+
+			"max_state_bytes": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Maximum size in bytes of the stored states, after compression, 0 means unlimited",
+				Default:      0,
+				ValidateFunc: validateNonNegativeInt,
+			},
 		},
 	}
 
@@ -83,26 +613,576 @@ type Backend struct {
 	db         *sql.DB
 	configData *schema.ResourceData
 	connStr    string
+	host       string
 	schemaName string
+	tableName  string
+	indexName  string
+
+	// tablespace is the quoted tablespace the states table and its index
+	// are created in, empty for the default one.
+	tablespace string
+
+	// unlogged is set when the states table is created UNLOGGED.
+	unlogged bool
+
+	// nameColumn and dataColumn are the columns of the states table holding
+	// the names of the workspaces and the states, "name" and "data" if
+	// empty, see nameCol and dataCol.
+	nameColumn string
+	dataColumn string
+
+	// hasTimestamps is set when the states table has the created_at and
+	// updated_at columns.
+	hasTimestamps bool
+
+	// hasChecksum is set when the states table has the checksum column.
+	hasChecksum bool
+
+	// hasSerial is set when the states table has the serial column.
+	hasSerial bool
+
+	// hasLineage is set when the states table has the lineage column.
+	hasLineage bool
+
+	// hasStateVersion is set when the states table has the state_version
+	// and terraform_version columns.
+	hasStateVersion bool
+
+	// hasWriter is set when the states table has the writer_version and
+	// writer_host columns.
+	hasWriter bool
+
+	// hasWriteToken is set when the states table has the write_token
+	// column.
+	hasWriteToken bool
+
+	// hasDataOid is set when the states table has the data_oid column, the
+	// states stored in large objects are then read.
+	hasDataOid bool
+
+	// hasDeletedAt is set when the states table has the deleted_at column,
+	// the tombstones of the soft-deleted workspaces are then skipped.
+	hasDeletedAt bool
+
+	historyTableName string
+	historyLimit     int
+
+	// softDeleteRetention is how long the soft-deleted workspaces are kept
+	// before being purged, the workspaces are deleted right away if zero.
+	softDeleteRetention time.Duration
+
+	lockTimeout time.Duration
+
+	// connectTimeout bounds the establishment of each connection, which
+	// isn't bounded if zero.
+	connectTimeout time.Duration
+
+	// lockTTL is how long a lock is kept without a heartbeat of its holder,
+	// the locks never expire if zero. lockHeartbeatInterval is the time
+	// between two heartbeats.
+	lockTTL               time.Duration
+	lockHeartbeatInterval time.Duration
+
+	// lockTableName is the table recording who holds the locks, empty if
+	// the table doesn't exist.
+	lockTableName string
+
+	// tableLocks is set when the locks are the rows of the lock table rather
+	// than advisory locks, which are bound to the sessions.
+	tableLocks bool
+
+	// lockDB is the pool of the connections holding the advisory locks, nil
+	// with tableLocks. It is apart from db, so the workspaces locked, which
+	// each hold a connection, don't use up max_open_connections and leave
+	// the states locked unreadable.
+	lockDB *sql.DB
+
+	// stmts holds the prepared statements, nil unless prepared_statements
+	// is set.
+	stmts *statementCache
+
+	// lockAuditTableName is the table recording the locks released by
+	// ForceUnlock.
+	lockAuditTableName string
+
+	maxRetries int
+
+	// isolation is the isolation level of the transactions writing the
+	// states, sql.LevelDefault to use the one of the database.
+	isolation sql.IsolationLevel
+
+	// compress is set when the states are written gzip-compressed.
+	compress bool
+
+	// bytea is set when the data column of the states table is bytea
+	// rather than text, set by state_column_type or detected on the
+	// existing table.
+	bytea bool
+
+	// largeObjects is set when the states are written in large objects,
+	// storage being "largeobject".
+	largeObjects bool
+
+	// aead encrypts the states when encryption_key is set, nil otherwise.
+	aead cipher.AEAD
+
+	// maxStateBytes is the size limit of the stored states, 0 if unlimited.
+	maxStateBytes int
+
+	// requireExisting is set when StateMgr fails for the workspaces that
+	// don't exist instead of creating them, create_missing being false.
+	requireExisting bool
+
+	// defaultWorkspaceName is the name of the default workspace set by
+	// default_workspace, empty for backend.DefaultStateName.
+	defaultWorkspaceName string
+
+	// workspaceNamePattern is the pattern the names of the new workspaces
+	// must match, set by workspace_name_pattern, nil if unset.
+	workspaceNamePattern *regexp.Regexp
+
+	// readOnly is set when the operations writing to the database fail.
+	readOnly bool
+
+	// allowLineageChange is set when the states can be written over the
+	// ones of another lineage.
+	allowLineageChange bool
+
+	// allowStateDowngrade is set when the states can be written over the
+	// ones of a newer format or OpenTofu version.
+	allowStateDowngrade bool
+
+	// notifyChannel is the notification channel signaled when a state is
+	// written, if any.
+	notifyChannel string
+
+	// statePersisted are the callbacks registered with OnStatePersisted.
+	statePersisted []StatePersistedFunc
+
+	// logger logs the operations if set with SetLogger.
+	logger *slog.Logger
+
+	// fallbackTables are the states tables of fallback_schema_names, in
+	// order, searched for the workspaces that aren't in the states table.
+	fallbackTables []fallbackTable
+
+	// workspacesCache caches the result of Workspaces, it is nil when
+	// workspaces_cache_ttl isn't set.
+	workspacesCache *workspacesCache
+
+	// replica is the read replica listing the workspaces and reading the
+	// states, nil when read_conn_str isn't set.
+	replica *readReplica
+
+	// health holds the outcome of the checks started by StartHealthChecks.
+	health healthChecker
+
+	// connector opens the connections of db, it is also used to open the
+	// connections listening to the notifications.
+	connector *connector
+
+	// credentials is set by SetCredentialsProvider.
+	credentials CredentialsProvider
+
+	// dialer is set by SetDialer.
+	dialer DialFunc
+
+	// metrics is set by RegisterMetrics.
+	metrics *metrics
+
+	// slowQueryThreshold is the duration beyond which the operations are
+	// logged as slow, they never are if zero.
+	slowQueryThreshold time.Duration
+
+	// timeouts are the default timeouts of the operations.
+	timeouts operationTimeouts
+
+	// operations tracks the operations in flight, which Close waits for.
+	operations *operationTracker
+
+	// connectionOnly is set by TestConnection, configure then only checks
+	// the connections and closes them.
+	connectionOnly bool
 }
 
-func (b *Backend) configure(ctx context.Context) error {
+func (b *Backend) configure(ctx context.Context) (err error) {
 	// Grab the resource data
 	b.configData = schema.FromContextBackendConfig(ctx)
 	data := b.configData
 
-	b.connStr = data.Get("conn_str").(string)
-	b.schemaName = pq.QuoteIdentifier(data.Get("schema_name").(string))
+	// The connection string given explicitly takes precedence over the one
+	// of the environment. Without them, the libpq environment variables and
+	// defaults are used, unless another variable than PG_CONN_STR is
+	// expected to hold it.
+	rawConnStr := data.Get("conn_str").(string)
+	if rawConnStr == "" {
+		connStrEnv := data.Get("conn_str_env").(string)
+		rawConnStr = os.Getenv(connStrEnv)
+		if rawConnStr == "" && connStrEnv != defaultConnStrEnv {
+			return fmt.Errorf("no connection string: conn_str is not set and the %s environment variable is empty", connStrEnv)
+		}
+	}
+
+	// The connection string may end up in the errors, its credentials are
+	// masked, including the ones of its connection service.
+	defer func() {
+		secrets := append(connStrSecrets(rawConnStr), connStrSecrets(b.connStr)...)
+		err = redactError(err, append(secrets, connStrSecrets(data.Get("read_conn_str").(string))...)...)
+	}()
 
-	db, err := sql.Open("postgres", b.connStr)
+	for _, env := range serviceEnvs {
+		if _, ok := os.LookupEnv(env); ok {
+			return fmt.Errorf("the %s environment variable is not supported by the Postgres driver, set service and service_file instead", env)
+		}
+	}
+	serviceFile := data.Get("service_file").(string)
+
+	// The SSL settings given explicitly take precedence over the ones
+	// found in the connection string, which themselves take precedence over
+	// the libpq environment variables.
+	overrides := map[string]string{
+		"sslmode":     data.Get("sslmode").(string),
+		"sslcert":     data.Get("sslcert").(string),
+		"sslkey":      data.Get("sslkey").(string),
+		"sslrootcert": data.Get("sslrootcert").(string),
+	}
+	if d := durationAttr(data, "statement_timeout"); d > 0 {
+		// Set for the whole session of each connection, as a run-time
+		// parameter of the startup message, in milliseconds.
+		overrides["statement_timeout"] = strconv.FormatInt(max(d.Milliseconds(), 1), 10)
+	}
+	if b.connectTimeout = durationAttr(data, "connect_timeout"); b.connectTimeout > 0 {
+		// Bounds both the TCP connection and the startup of each
+		// connection, in whole seconds as libpq does.
+		overrides["connect_timeout"] = strconv.FormatInt(int64((b.connectTimeout+time.Second-1)/time.Second), 10)
+	}
+	b.tableLocks = data.Get("pgbouncer_compatible").(bool)
+	preparedStatements := !b.tableLocks
+	if v, ok := data.GetOkExists("prepared_statements"); ok {
+		preparedStatements = v.(bool)
+	}
+	b.stmts = nil
+	if preparedStatements {
+		b.stmts = newStatementCache()
+	}
+	if b.tableLocks || !preparedStatements {
+		// The statements are parsed, bound and executed in a single round
+		// trip, so they don't rely on an unnamed prepared statement
+		// surviving between two transactions of PgBouncer.
+		overrides["binary_parameters"] = "yes"
+	}
+	// The pq driver cannot parse the URLs whose host is the directory of a
+	// Unix domain socket, they are rewritten with the host as a parameter.
+	connStr, err := serviceConnStr(socketHostURL(rawConnStr), data.Get("service").(string), serviceFile)
+	if err != nil {
+		return fmt.Errorf("invalid connection string: %w", err)
+	}
+	connStr, err = overrideConnStr(connStr, overrides)
 	if err != nil {
+		return fmt.Errorf("invalid connection string: %w", err)
+	}
+	// The pq driver doesn't implement SCRAM-SHA-256-PLUS, so the
+	// connections are never channel-bound. require is refused rather than
+	// silently authenticating without it.
+	connStr, channelBindingMode, err := channelBinding(connStr, data.Get("channel_binding").(string))
+	if err != nil {
+		return fmt.Errorf("invalid connection string: %w", err)
+	}
+	if channelBindingMode == "require" {
+		return errChannelBindingRequired
+	}
+	if connStr, err = applicationName(connStr, data.Get("application_name").(string)); err != nil {
+		return fmt.Errorf("invalid connection string: %w", err)
+	}
+	b.connStr = connStr
+	b.host = hostForConnStr(connStr)
+	readConnStr := data.Get("read_conn_str").(string)
+	if readConnStr != "" {
+		if data.Get("auth_method").(string) == authMethodCloudSQLIAM {
+			return fmt.Errorf("read_conn_str cannot be used with auth_method %q", authMethodCloudSQLIAM)
+		}
+		readConnStr, err = serviceConnStr(socketHostURL(readConnStr), "", serviceFile)
+		if err != nil {
+			return fmt.Errorf("invalid read_conn_str: %w", err)
+		}
+		readConnStr, err = overrideConnStr(readConnStr, overrides)
+		if err != nil {
+			return fmt.Errorf("invalid read_conn_str: %w", err)
+		}
+		readConnStr, channelBindingMode, err = channelBinding(readConnStr, data.Get("channel_binding").(string))
+		if err != nil {
+			return fmt.Errorf("invalid read_conn_str: %w", err)
+		}
+		if channelBindingMode == "require" {
+			return errChannelBindingRequired
+		}
+		if readConnStr, err = applicationName(readConnStr, data.Get("application_name").(string)); err != nil {
+			return fmt.Errorf("invalid read_conn_str: %w", err)
+		}
+	}
+	b.historyLimit = data.Get("history_limit").(int)
+	b.softDeleteRetention = durationAttr(data, "soft_delete_retention")
+	b.lockTimeout = durationAttr(data, "lock_timeout")
+	b.lockTTL = durationAttr(data, "lock_ttl")
+	b.lockHeartbeatInterval = durationAttr(data, "lock_heartbeat_interval")
+	switch {
+	case b.lockTTL > 0 && !b.tableLocks:
+		return fmt.Errorf("lock_ttl requires pgbouncer_compatible, the advisory locks are released as soon as the session of their holder ends")
+	case b.lockTTL > 0 && b.lockHeartbeatInterval == 0:
+		b.lockHeartbeatInterval = b.lockTTL / 3
+	case b.lockTTL > 0 && b.lockHeartbeatInterval >= b.lockTTL:
+		return fmt.Errorf("lock_heartbeat_interval must be shorter than lock_ttl")
+	case b.lockTTL == 0 && b.lockHeartbeatInterval > 0:
+		return fmt.Errorf("lock_heartbeat_interval requires lock_ttl")
+	}
+	b.maxRetries = data.Get("max_retries").(int)
+	b.slowQueryThreshold = durationAttr(data, "slow_query_threshold")
+	b.timeouts = operationTimeouts{
+		list:  durationAttr(data, "list_operation_timeout"),
+		read:  durationAttr(data, "read_operation_timeout"),
+		write: durationAttr(data, "write_operation_timeout"),
+		lock:  durationAttr(data, "lock_operation_timeout"),
+	}
+	if b.timeouts.lock > 0 {
+		// Waiting for a lock held by someone else isn't cut short.
+		b.timeouts.lock += b.lockTimeout
+	}
+	b.isolation = isolationLevels[data.Get("isolation_level").(string)]
+	b.compress = data.Get("compress").(bool)
+	b.largeObjects = data.Get("storage").(string) == "largeobject"
+	if b.aead, err = newStateCipher(data.Get("encryption_key").(string)); err != nil {
 		return err
 	}
+	b.maxStateBytes = data.Get("max_state_bytes").(int)
+	b.requireExisting = !data.Get("create_missing").(bool)
+	b.readOnly = data.Get("read_only").(bool)
+	b.allowLineageChange = data.Get("allow_lineage_change").(bool)
+	b.allowStateDowngrade = data.Get("allow_state_downgrade").(bool)
+	b.defaultWorkspaceName = data.Get("default_workspace").(string)
+	b.workspaceNamePattern = nil
+	if pattern := data.Get("workspace_name_pattern").(string); pattern != "" {
+		// The schema has already validated the pattern.
+		b.workspaceNamePattern = regexp.MustCompile(pattern)
+	}
+	b.workspacesCache = nil
+	if ttl := durationAttr(data, "workspaces_cache_ttl"); ttl > 0 {
+		b.workspacesCache = newWorkspacesCache(ttl)
+	}
+	b.notifyChannel = data.Get("notify_channel").(string)
+	if b.notifyChannel != "" {
+		if _, err := quoteIdentifier(b.notifyChannel); err != nil {
+			return fmt.Errorf("invalid notify_channel: %w", err)
+		}
+	}
+
+	// All the names interpolated in the statements are quoted.
+	tableName := data.Get("table_name").(string)
+	lockTableName := tableName + "_locks"
+	var quotedLockTableName, historyIndexName string
+	// They are checked before connecting, so a malformed name fails here,
+	// naming the attribute it comes from, rather than with a syntax error of
+	// the first statement.
+	type identifier struct {
+		attr   string
+		name   string
+		quoted *string
+	}
+	identifiers := []identifier{
+		{"schema_name", data.Get("schema_name").(string), &b.schemaName},
+		{"table_name", tableName, &b.tableName},
+		{"table_name", indexNameForTable(tableName), &b.indexName},
+		{"table_name", lockTableName, &quotedLockTableName},
+		{"table_name", tableName + "_lock_audit", &b.lockAuditTableName},
+		{"name_column", data.Get("name_column").(string), &b.nameColumn},
+		{"data_column", data.Get("data_column").(string), &b.dataColumn},
+	}
+	b.tablespace = ""
+	if tablespace := data.Get("tablespace").(string); tablespace != "" {
+		identifiers = append(identifiers, identifier{"tablespace", tablespace, &b.tablespace})
+	}
+	if b.historyLimit > 0 {
+		identifiers = append(identifiers,
+			identifier{"table_name", tableName + "_history", &b.historyTableName},
+			identifier{"table_name", tableName + "_history_by_name", &historyIndexName},
+		)
+	}
+	b.unlogged = data.Get("unlogged").(bool)
+	partitions := make([]string, data.Get("hash_partitions").(int))
+	if b.unlogged && len(partitions) > 0 {
+		return fmt.Errorf("unlogged can't be used with hash_partitions, as a partitioned table can't be unlogged")
+	}
+	if b.unlogged && readConnStr != "" {
+		return fmt.Errorf("unlogged can't be used with read_conn_str, as an unlogged table can't be read on a replica")
+	}
+	for i := range partitions {
+		identifiers = append(identifiers, identifier{"table_name", partitionName(tableName, i), &partitions[i]})
+	}
+	for _, id := range identifiers {
+		if *id.quoted, err = quoteIdentifier(id.name); err != nil {
+			return fmt.Errorf("invalid schema, table or column name set by %s: %w", id.attr, err)
+		}
+	}
+
+	// The statements qualify the tables with the schema, which is also the
+	// search_path of the sessions, set as a run-time parameter of the
+	// startup message for any name that isn't. It is left as is with
+	// pgbouncer_compatible, as a pooler may not forward it to the server
+	// connections it shares.
+	if !b.tableLocks {
+		searchPath := map[string]string{"search_path": b.schemaName}
+		if b.connStr, err = overrideConnStr(b.connStr, searchPath); err != nil {
+			return fmt.Errorf("invalid connection string: %w", err)
+		}
+		if readConnStr != "" {
+			if readConnStr, err = overrideConnStr(readConnStr, searchPath); err != nil {
+				return fmt.Errorf("invalid read_conn_str: %w", err)
+			}
+		}
+	}
+
+	conn := &connector{connStr: b.connStr, credentials: b.credentials}
+	var readConn *connector
+	if readConnStr != "" {
+		readConn = &connector{connStr: readConnStr, credentials: b.credentials}
+	}
+	if authMethod := data.Get("auth_method").(string); b.credentials != nil && authMethod != authMethodPassword {
+		return fmt.Errorf("a credentials provider cannot be used with auth_method %q", authMethod)
+	}
+	switch data.Get("auth_method").(string) {
+	case authMethodRDSIAM:
+		build, region, err := newRDSAuthTokenBuilder(ctx)
+		if err != nil {
+			return err
+		}
+		conn.password, err = rdsIAMPassword(b.connStr, region, build)
+		if err != nil {
+			return err
+		}
+		if readConn != nil {
+			// The tokens are signed for the host of the replica.
+			readConn.password, err = rdsIAMPassword(readConnStr, region, build)
+			if err != nil {
+				return err
+			}
+		}
+	case authMethodCloudSQLIAM:
+		dialer, tokens, err := newCloudSQLDialer(ctx)
+		if err != nil {
+			return err
+		}
+		conn, err = cloudSQLConnector(b.connStr, data.Get("cloudsql_instance").(string), dialer, tokens)
+		if err != nil {
+			return err
+		}
+		b.host = data.Get("cloudsql_instance").(string)
+	}
+	dial := dialerFunc(b.dialer)
+	if proxyURL := data.Get("socks5_proxy").(string); proxyURL != "" {
+		if b.dialer != nil {
+			return fmt.Errorf("socks5_proxy cannot be used with a dialer set by SetDialer")
+		}
+		if dial, err = socks5Dialer(proxyURL); err != nil {
+			return err
+		}
+	}
+	if dial != nil {
+		if conn.dial != nil {
+			return fmt.Errorf("a proxy or a custom dialer cannot be used with auth_method %q, which dials the connections itself", authMethodCloudSQLIAM)
+		}
+		conn.dial = dial
+		if readConn != nil {
+			readConn.dial = dial
+		}
+	}
+	if role := data.Get("set_role").(string); role != "" {
+		if b.tableLocks {
+			return fmt.Errorf("set_role cannot be used with pgbouncer_compatible, as PgBouncer in transaction pooling mode doesn't keep the role of the sessions")
+		}
+		conn.role = role
+		if readConn != nil {
+			readConn.role = role
+		}
+	}
+	b.connector = conn
+	db := sql.OpenDB(conn)
+	tunePool(db, data)
+
+	if b.connectionOnly {
+		defer db.Close()
+		create := !data.Get("skip_schema_creation").(bool) && !b.readOnly
+		if err := b.checkConnection(ctx, db, b.host, effectiveSSLMode(b.connStr), create); err != nil {
+			return err
+		}
+		if readConn == nil {
+			return nil
+		}
+		readDB := sql.OpenDB(readConn)
+		defer readDB.Close()
+		return b.checkConnection(ctx, readDB, hostForConnStr(readConnStr), effectiveSSLMode(readConnStr), false)
+	}
+
+	// The pools are only kept by the backend once it is configured.
+	var readDB *sql.DB
+	defer func() {
+		if err != nil {
+			db.Close()
+			if readDB != nil {
+				readDB.Close()
+			}
+		}
+	}()
+
+	// When the server certificate must be verified, connect right away so
+	// that a verification failure is reported as such.
+	if sslMode := effectiveSSLMode(b.connStr); sslMode == "verify-ca" || sslMode == "verify-full" {
+		if err := db.PingContext(ctx); err != nil {
+			return tlsVerificationError(sslMode, err)
+		}
+	}
+
+	if data.Get("verify_connection").(bool) {
+		if err := b.ping(ctx, db); err != nil {
+			return err
+		}
+	}
+
+	// The replica only serves reads, the schema is prepared on the primary.
+	if readConn != nil {
+		readDB = sql.OpenDB(readConn)
+		tunePool(readDB, data)
+
+		if sslMode := effectiveSSLMode(readConnStr); sslMode == "verify-ca" || sslMode == "verify-full" {
+			if err := readDB.PingContext(ctx); err != nil {
+				return tlsVerificationError(sslMode, err)
+			}
+		}
+		if data.Get("verify_connection").(bool) {
+			if err := readDB.PingContext(ctx); err != nil {
+				return fmt.Errorf("failed to connect to the Postgres read replica at %s (schema %s): %w", hostForConnStr(readConnStr), b.schemaName, err)
+			}
+		}
+	}
 
 	// Prepare database schema, tables, & indexes.
 	var query string
 
-	if !data.Get("skip_schema_creation").(bool) {
+	// The type of the data column is never changed here, switching it
+	// requires migrating the states.
+	columnType, err := b.stateColumnType(ctx, db, data.Get("schema_name").(string), data.Get("table_name").(string), data.Get("state_column_type").(string))
+	if err != nil {
+		return err
+	}
+	b.bytea = columnType == "bytea"
+
+	// The tables migrated by a newer version are refused even when nothing
+	// is created.
+	version, err := b.tableVersion(ctx, db, tableName)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is created in read-only mode.
+	if !data.Get("skip_schema_creation").(bool) && !b.readOnly {
 		// list all schemas to see if it exists
 		var count int
 		query = `select count(1) from information_schema.schemata where schema_name = $1`
@@ -116,36 +1196,331 @@ func (b *Backend) configure(ctx context.Context) error {
 		if count < 1 {
 			// tries to create the schema
 			query = `CREATE SCHEMA IF NOT EXISTS %s`
-			if _, err := db.Exec(fmt.Sprintf(query, b.schemaName)); err != nil {
+			if err := execIfNotExists(ctx, db, fmt.Sprintf(query, b.schemaName)); err != nil {
 				return err
 			}
 		}
 	}
 
-	if !data.Get("skip_table_creation").(bool) {
-		if _, err := db.Exec("CREATE SEQUENCE IF NOT EXISTS public.global_states_id_seq AS bigint"); err != nil {
+	if !data.Get("skip_table_creation").(bool) && !b.readOnly {
+		if err := execIfNotExists(ctx, db, "CREATE SEQUENCE IF NOT EXISTS public.global_states_id_seq AS bigint"); err != nil {
+			return err
+		}
+
+		if len(partitions) > 0 {
+			if err := b.createPartitionedStatesTable(ctx, db, columnType, partitions); err != nil {
+				return err
+			}
+		} else if err := b.createStatesTable(ctx, db, columnType); err != nil {
+			return err
+		}
+		if err := b.checkUnlogged(ctx, db); err != nil {
+			return err
+		}
+
+		// The data_oid column is only added once large objects are used,
+		// it isn't part of the versioned layout.
+		if b.largeObjects {
+			query = `ALTER TABLE %s.%s ADD COLUMN IF NOT EXISTS data_oid oid`
+			if err := execIfNotExists(ctx, db, fmt.Sprintf(query, b.schemaName, b.tableName)); err != nil {
+				return err
+			}
+		}
+
+		query = `CREATE TABLE IF NOT EXISTS %s.%s (
+			name text PRIMARY KEY,
+			info text NOT NULL,
+			created_at timestamptz NOT NULL DEFAULT now()
+			)`
+		if err := execIfNotExists(ctx, db, fmt.Sprintf(query, b.schemaName, quotedLockTableName)); err != nil {
+			return err
+		}
+
+		// The columns added since the tables were first created.
+		if err := b.migrateTables(ctx, db, tableName, quotedLockTableName, version); err != nil {
 			return err
 		}
 
 		query = `CREATE TABLE IF NOT EXISTS %s.%s (
-			id bigint NOT NULL DEFAULT nextval('public.global_states_id_seq') PRIMARY KEY,
-			name text UNIQUE,
-			data text
+			id bigserial PRIMARY KEY,
+			name text NOT NULL,
+			lock_id text NOT NULL,
+			previous_info text,
+			reason text NOT NULL,
+			unlocked_by text NOT NULL,
+			db_user text NOT NULL DEFAULT current_user,
+			unlocked_at timestamptz NOT NULL DEFAULT now()
 			)`
-		if _, err := db.Exec(fmt.Sprintf(query, b.schemaName, statesTableName)); err != nil {
+		if err := execIfNotExists(ctx, db, fmt.Sprintf(query, b.schemaName, b.lockAuditTableName)); err != nil {
 			return err
 		}
+
+		if b.historyLimit > 0 {
+			query = `CREATE TABLE IF NOT EXISTS %s.%s (
+				id bigserial PRIMARY KEY,
+				name text NOT NULL,
+				serial bigint NOT NULL,
+				data %s,
+				written_at timestamptz NOT NULL DEFAULT now()
+				)`
+			if err := execIfNotExists(ctx, db, fmt.Sprintf(query, b.schemaName, b.historyTableName, columnType)); err != nil {
+				return err
+			}
+			query = `CREATE INDEX IF NOT EXISTS %s ON %s.%s (name, id)`
+			if err := execIfNotExists(ctx, db, fmt.Sprintf(query, historyIndexName, b.schemaName, b.historyTableName)); err != nil {
+				return err
+			}
+		}
 	}
 
-	if !data.Get("skip_index_creation").(bool) {
-		query = `CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s.%s (name)`
-		if _, err := db.Exec(fmt.Sprintf(query, statesIndexName, b.schemaName, statesTableName)); err != nil {
+	if !data.Get("skip_index_creation").(bool) && !b.readOnly {
+		// Like the schema, the index is only created if it doesn't exist,
+		// as creating it requires owning the table even when it exists.
+		var exists bool
+		query = `SELECT to_regclass($1) IS NOT NULL`
+		if err := db.QueryRow(query, fmt.Sprintf("%s.%s", b.schemaName, b.indexName)).Scan(&exists); err != nil {
 			return err
 		}
+		if !exists {
+			query = `CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s.%s (%s)%s`
+			if err := execIfNotExists(ctx, db, fmt.Sprintf(query, b.indexName, b.schemaName, b.tableName, b.nameCol(), b.tablespaceClause())); err != nil {
+				return classifyError(b.tablespaceError(err))
+			}
+		}
+	}
+
+	// The table may have been created by an administrator, or by an older
+	// version, without the optional columns.
+	columns, err := tableColumns(ctx, db, data.Get("schema_name").(string), data.Get("table_name").(string))
+	if err != nil {
+		return err
+	}
+	b.hasTimestamps = columns["created_at"] && columns["updated_at"]
+	b.hasChecksum = columns["checksum"]
+	b.hasSerial = columns["serial"]
+	b.hasLineage = columns["lineage"]
+	b.hasStateVersion = columns["state_version"] && columns["terraform_version"]
+	b.hasWriter = columns["writer_version"] && columns["writer_host"]
+	b.hasWriteToken = columns["write_token"]
+	b.hasDataOid = columns["data_oid"]
+	b.hasDeletedAt = columns["deleted_at"]
+	if b.largeObjects && !b.hasDataOid {
+		return fmt.Errorf(`storage = "largeobject" requires the data_oid column of %s.%s, which doesn't exist; it is added unless skip_table_creation is set`, b.schemaName, b.tableName)
+	}
+	if b.softDeleteRetention > 0 && !b.hasDeletedAt {
+		return fmt.Errorf("soft_delete_retention requires the deleted_at column of %s.%s, which doesn't exist; it is added unless skip_table_creation is set", b.schemaName, b.tableName)
+	}
+
+	lockColumns, err := tableColumns(ctx, db, data.Get("schema_name").(string), lockTableName)
+	if err != nil {
+		return err
+	}
+	if len(lockColumns) > 0 {
+		b.lockTableName = quotedLockTableName
+	} else if b.tableLocks {
+		return fmt.Errorf("pgbouncer_compatible requires the %s table to lock the states, which doesn't exist; it is created unless skip_table_creation is set", quotedLockTableName)
+	}
+	if b.lockTTL > 0 && !lockColumns["expires_at"] {
+		return fmt.Errorf("lock_ttl requires the expires_at column of the %s table, which doesn't exist; it is added unless skip_table_creation is set", quotedLockTableName)
+	}
+
+	b.fallbackTables = nil
+	for _, name := range data.Get("fallback_schema_names").([]interface{}) {
+		table, err := b.newFallbackTable(ctx, db, data.Get("schema_name").(string), name.(string), tableName)
+		if err != nil {
+			return fmt.Errorf("invalid fallback_schema_names: %w", err)
+		}
+		for _, other := range b.fallbackTables {
+			if other.schemaName == table.schemaName {
+				return fmt.Errorf("invalid fallback_schema_names: schema %s is listed twice", table.schemaName)
+			}
+		}
+		b.fallbackTables = append(b.fallbackTables, table)
+	}
+	if b.softDeleteRetention > 0 && len(b.fallbackTables) > 0 {
+		// The workspaces deleted from the fallback tables would have no
+		// tombstone to recover them from.
+		return fmt.Errorf("soft_delete_retention can't be used with fallback_schema_names")
 	}
 
 	// Assign db after its schema is prepared.
 	b.db = db
+	b.lockDB = nil
+	if !b.tableLocks {
+		b.lockDB = sql.OpenDB(conn)
+		tunePool(b.lockDB, data)
+		// Unbounded, each workspace locked holds one of its connections.
+		b.lockDB.SetMaxOpenConns(0)
+	}
+	b.replica = nil
+	if readDB != nil {
+		b.replica = newReadReplica(readDB)
+	}
+	b.operations = newOperationTracker()
+
+	return nil
+}
+
+// tunePool tunes the given connection pool, anything left unset keeps the
+// database/sql defaults.
+func tunePool(db *sql.DB, data *schema.ResourceData) {
+	if v := data.Get("max_open_connections").(int); v > 0 {
+		db.SetMaxOpenConns(v)
+	}
+	if v := data.Get("max_idle_connections").(int); v > 0 {
+		db.SetMaxIdleConns(v)
+	}
+	if v := durationAttr(data, "conn_max_lifetime"); v > 0 {
+		db.SetConnMaxLifetime(v)
+	}
+	if v := durationAttr(data, "conn_max_idle_time"); v > 0 {
+		db.SetConnMaxIdleTime(v)
+	}
+}
+
+// stateColumnType returns the type of the data column of the given states
+// table, "text" or "bytea": the configured one if any, or else the one of
+// the existing table, "text" for a new table. Any other type of an existing
+// column is handled as text. The configured type must be the one of the
+// existing table.
+func (b *Backend) stateColumnType(ctx context.Context, db *sql.DB, schemaName, tableName, configured string) (string, error) {
+	var existing string
+	query := `SELECT data_type FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 AND column_name = $3`
+	switch err := db.QueryRowContext(ctx, query, schemaName, tableName, unquoteIdentifier(b.dataCol())).Scan(&existing); {
+	case err == sql.ErrNoRows:
+		if configured == "" {
+			return "text", nil
+		}
+		return configured, nil
+	case err != nil:
+		return "", err
+	}
+
+	if existing != "bytea" {
+		existing = "text"
+	}
+	if configured != "" && configured != existing {
+		using := fmt.Sprintf("convert_to(%s, 'UTF8')", b.dataCol())
+		if configured == "text" {
+			using = fmt.Sprintf("convert_from(%s, 'UTF8')", b.dataCol())
+		}
+		return "", fmt.Errorf("state_column_type is %q but the data column of %s.%s is %s, the states must be migrated first, e.g. with ALTER TABLE %s.%s ALTER COLUMN %s TYPE %s USING %s",
+			configured, b.schemaName, b.tableName, existing, b.schemaName, b.tableName, b.dataCol(), configured, using)
+	}
+	return existing, nil
+}
+
+// tableColumns returns the set of the columns of the given table.
+func tableColumns(ctx context.Context, db *sql.DB, schemaName, tableName string) (map[string]bool, error) {
+	query := `SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2`
+	rows, err := db.QueryContext(ctx, query, schemaName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns[column] = true
+	}
+	return columns, rows.Err()
+}
+
+// Ping checks that Postgres is reachable, honoring the cancellation of ctx.
+// The returned error names the host and schema the backend is configured
+// with, but never the credentials of the connection string.
+func (b *Backend) Ping(ctx context.Context) error {
+	return b.ping(ctx, b.db)
+}
+
+// PoolStats are the statistics of the connection pools of the backend.
+type PoolStats struct {
+	Primary sql.DBStats
+
+	// Replica are the statistics of the pool of the read replica, nil when
+	// read_conn_str isn't set.
+	Replica *sql.DBStats
+
+	// Locks are the statistics of the pool of the connections holding the
+	// advisory locks, nil with pgbouncer_compatible.
+	Locks *sql.DBStats
+}
 
+// PoolStats returns the statistics of the connection pools of the backend,
+// such as the number of open, idle and in-use connections and how long the
+// operations waited for one. It must be called once the backend is
+// configured.
+func (b *Backend) PoolStats() PoolStats {
+	stats := PoolStats{Primary: b.db.Stats()}
+	if b.replica != nil {
+		replica := b.replica.db.Stats()
+		stats.Replica = &replica
+	}
+	if b.lockDB != nil {
+		locks := b.lockDB.Stats()
+		stats.Locks = &locks
+	}
+	return stats
+}
+
+func (b *Backend) ping(ctx context.Context, db *sql.DB) error {
+	if err := db.PingContext(ctx); err != nil {
+		var netErr net.Error
+		if b.connectTimeout > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+			return fmt.Errorf("failed to connect to Postgres at %s (schema %s) within connect_timeout %s: %w", b.host, b.schemaName, b.connectTimeout, err)
+		}
+		return fmt.Errorf("failed to connect to Postgres at %s (schema %s): %w", b.host, b.schemaName, err)
+	}
 	return nil
 }
+
+// hostForConnStr describes the server the given connection string points
+// to, for error messages.
+func hostForConnStr(connStr string) string {
+	params, err := parseConnStr(connStr)
+	if err != nil {
+		params = map[string]string{}
+	}
+	host := firstNonEmpty(params["host"], os.Getenv("PGHOST"), "localhost")
+	if strings.HasPrefix(host, "/") {
+		return host
+	}
+	return net.JoinHostPort(host, firstNonEmpty(params["port"], os.Getenv("PGPORT"), "5432"))
+}
+
+// indexNameForTable returns the name of the index on the workspace name for
+// the given states table. Index names share a namespace with tables within a
+// schema, so each states table gets its own index name.
+func indexNameForTable(tableName string) string {
+	if tableName == statesTableName {
+		return statesIndexName
+	}
+	return tableName + "_by_name"
+}
+
+// effectiveSSLMode returns the sslmode the pq driver will use for the given
+// connection string.
+func effectiveSSLMode(connStr string) string {
+	if params, err := parseConnStr(connStr); err == nil && params["sslmode"] != "" {
+		return params["sslmode"]
+	}
+	return os.Getenv("PGSSLMODE")
+}
+
+// tlsVerificationError makes the failure to verify the certificate of the
+// Postgres server explicit, other errors are returned as-is.
+func tlsVerificationError(sslMode string, err error) error {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var verificationErr *tls.CertificateVerificationError
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) || errors.As(err, &verificationErr) {
+		return fmt.Errorf("failed to verify the certificate of the Postgres server with sslmode %q: %w", sslMode, err)
+	}
+	return err
+}
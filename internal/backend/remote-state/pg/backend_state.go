@@ -4,116 +4,1165 @@
 package pg
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/lib/pq"
 	"github.com/opentofu/opentofu/internal/backend"
 	"github.com/opentofu/opentofu/internal/states"
 	"github.com/opentofu/opentofu/internal/states/remote"
+	"github.com/opentofu/opentofu/internal/states/statefile"
 	"github.com/opentofu/opentofu/internal/states/statemgr"
 )
 
-func (b *Backend) Workspaces(ctx context.Context) ([]string, error) {
-	query := `SELECT name FROM %s.%s WHERE name != 'default' ORDER BY name`
-	rows, err := b.db.QueryContext(ctx, fmt.Sprintf(query, b.schemaName, statesTableName))
+// ErrWorkspaceAlreadyExists is returned when a workspace cannot be created
+// under a name because another workspace already uses it.
+var ErrWorkspaceAlreadyExists = errors.New("workspace already exists")
+
+// ErrWorkspaceNotFound is returned when a workspace that doesn't exist is
+// used while it can't be created.
+var ErrWorkspaceNotFound = errors.New("workspace not found")
+
+// ErrStateVersionNotFound is returned by StateAt when no version of the
+// state is kept in the history for the given time.
+var ErrStateVersionNotFound = errors.New("state version not found")
+
+// ErrInvalidWorkspaceName is returned when a workspace is created or renamed
+// under a name that doesn't match workspace_name_pattern.
+var ErrInvalidWorkspaceName = errors.New("invalid workspace name")
+
+// ErrReadOnly is returned by the operations writing to the database when
+// read_only is set, before any statement is sent.
+var ErrReadOnly = errors.New("backend is read-only")
+
+// defaultWorkspace returns the name of the default workspace, which always
+// exists and can't be deleted: default_workspace, or backend.DefaultStateName
+// if unset.
+func (b *Backend) defaultWorkspace() string {
+	return firstNonEmpty(b.defaultWorkspaceName, backend.DefaultStateName)
+}
+
+// notDefaultWorkspace returns the condition excluding the default workspace
+// from the rows of the given name column.
+func (b *Backend) notDefaultWorkspace(column string) string {
+	return fmt.Sprintf("%s != %s", column, pq.QuoteLiteral(b.defaultWorkspace()))
+}
+
+func (b *Backend) Workspaces(ctx context.Context) (_ []string, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "workspaces", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	names, generation, ok := b.workspacesCache.get()
+	if ok {
+		return names, nil
+	}
+	names, err = b.WorkspacesPage(ctx, 0, 0)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	// The default workspace is listed whether it has a row or not.
+	op.setRows(int64(len(names) - 1))
+	b.workspacesCache.set(names, generation)
+	return names, nil
+}
+
+// WorkspacesPage returns a page of the workspaces listed by Workspaces,
+// skipping the first offset ones and returning at most limit of them, or all
+// the remaining ones if limit is 0. The listing is ordered by name, except for
+// the default workspace which always comes first, so it is only part of the
+// first page.
+func (b *Backend) WorkspacesPage(ctx context.Context, limit, offset int) (_ []string, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "workspaces_page", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	if limit < 0 || offset < 0 {
+		return nil, fmt.Errorf("invalid workspaces page: limit %d and offset %d cannot be negative", limit, offset)
+	}
 
-	result := []string{
-		backend.DefaultStateName,
+	var result []string
+	if offset == 0 {
+		result = append(result, b.defaultWorkspace())
+		if limit == 1 {
+			return result, nil
+		}
+		if limit > 0 {
+			limit--
+		}
+	} else {
+		offset--
 	}
 
+	// A NULL limit returns all the rows.
+	var sqlLimit interface{}
+	if limit > 0 {
+		sqlLimit = limit
+	}
+
+	query := `SELECT name FROM %s WHERE %s ORDER BY name LIMIT $1 OFFSET $2`
+	return b.queryWorkspaces(ctx, b.replica.workspacesDB(b.db), result, fmt.Sprintf(query, b.workspacesTable(), b.notDefaultWorkspace("name")), sqlLimit, offset)
+}
+
+// WorkspacesWithPrefix returns the workspaces whose name starts with prefix,
+// ordered by name. The prefix is matched literally, and the default
+// workspace is only listed when prefix is empty, so an empty prefix returns
+// the same workspaces as Workspaces.
+func (b *Backend) WorkspacesWithPrefix(ctx context.Context, prefix string) (_ []string, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "workspaces_with_prefix", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	if prefix == "" {
+		return b.Workspaces(ctx)
+	}
+
+	query := `SELECT name FROM %s WHERE %s AND name LIKE ($1 || '%%') ESCAPE '\' ORDER BY name`
+	return b.queryWorkspaces(ctx, b.replica.workspacesDB(b.db), nil, fmt.Sprintf(query, b.workspacesTable(), b.notDefaultWorkspace("name")), escapeLike(prefix))
+}
+
+// queryWorkspaces appends to result the workspace names returned by query,
+// run on db.
+func (b *Backend) queryWorkspaces(ctx context.Context, db *sql.DB, result []string, query string, args ...interface{}) ([]string, error) {
+	var names []string
+	err := retry(ctx, b.maxRetries, func() error {
+		var err error
+		names, err = queryNames(ctx, b.stmts, db, query, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(result, names...), nil
+}
+
+// queryNames returns the names returned by query, run on db with the
+// statement prepared by stmts, if any.
+func queryNames(ctx context.Context, stmts *statementCache, db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := stmts.queryContext(ctx, db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
 	for rows.Next() {
 		var name string
 		if err := rows.Scan(&name); err != nil {
 			return nil, err
 		}
-		result = append(result, name)
+		names = append(names, name)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	return names, nil
 }
 
-func (b *Backend) DeleteWorkspace(ctx context.Context, name string, _ bool) error {
-	if name == backend.DefaultStateName || name == "" {
-		return fmt.Errorf("can't delete default state")
+// escapeLike escapes the wildcards of a LIKE pattern, using backslash as the
+// escape character, so s is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// CountWorkspaces returns the number of workspaces listed by Workspaces,
+// without listing them. The default workspace is always counted, once,
+// whether its state is stored or not, so the count is at least 1 even if the
+// table is empty. The cached workspaces are counted if the listing is
+// cached.
+func (b *Backend) CountWorkspaces(ctx context.Context) (_ int, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "count_workspaces", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	if names, _, ok := b.workspacesCache.get(); ok {
+		return len(names), nil
 	}
 
-	query := `DELETE FROM %s.%s WHERE name = $1`
-	_, err := b.db.ExecContext(ctx, fmt.Sprintf(query, b.schemaName, statesTableName), name)
+	var count int
+	query := fmt.Sprintf(`SELECT count(1) FROM %s WHERE %s`, b.workspacesTable(), b.notDefaultWorkspace("name"))
+	db := b.replica.workspacesDB(b.db)
+	err = retry(ctx, b.maxRetries, func() error {
+		return db.QueryRowContext(ctx, query).Scan(&count)
+	})
 	if err != nil {
+		return 0, err
+	}
+	return count + 1, nil
+}
+
+// WorkspaceExists reports whether the given workspace exists, without
+// listing all of them. The default workspace always exists, as it is always
+// part of the result of Workspaces. The cached workspaces are used if the
+// listing is cached.
+func (b *Backend) WorkspaceExists(ctx context.Context, name string) (bool, error) {
+	if name == b.defaultWorkspace() {
+		return true, nil
+	}
+	if found, ok := b.workspacesCache.contains(name); ok {
+		return found, nil
+	}
+	return b.stateExists(ctx, name)
+}
+
+// stateExists reports whether the state of the given workspace is stored,
+// in the states table or a fallback table, which isn't the case of the
+// default workspace until it is written.
+func (b *Backend) stateExists(ctx context.Context, name string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM %s WHERE name = $1)`
+	if err := b.stmts.queryRowContext(ctx, b.db, fmt.Sprintf(query, b.workspacesTable()), name).Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// DeleteWorkspace deletes the state of the given workspace. The workspace is
+// locked while it is deleted, waiting for the lock as Lock does, so a state
+// being written is not deleted; the lock is then released, which removes its
+// row from the lock table.
+//
+// With force, the workspace is deleted even if someone else holds its lock,
+// and the row of that lock is deleted along with the state, to recover a
+// workspace whose lock was left behind. The advisory lock of another session
+// is not released, as it is by ForceUnlock, but no longer locks anything.
+//
+// With soft_delete_retention, the state is only tombstoned, so it can be
+// recovered by RecoverWorkspace until it is purged, see PurgeWorkspace.
+func (b *Backend) DeleteWorkspace(ctx context.Context, name string, force bool) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "delete_workspace", tableAttrs(b.schemaName, b.tableName, name)...)
+	defer op.end(&err)
+
+	if err := b.removeWorkspace(ctx, name, force, b.softDeleteRetention == 0); err != nil {
+		return err
+	}
+	if b.softDeleteRetention > 0 {
+		// The expired tombstones are purged along the way, so they don't
+		// pile up when PurgeDeletedWorkspaces is never called.
+		if _, err := b.purgeDeletedWorkspaces(ctx); err != nil {
+			log.Printf("[WARN] pg: failed to purge the deleted workspaces: %s", err)
+		}
+	}
+	return nil
+}
+
+// removeWorkspace deletes the state of the given workspace as DeleteWorkspace
+// does, tombstoning it unless purge is set.
+func (b *Backend) removeWorkspace(ctx context.Context, name string, force, purge bool) error {
+	if name == b.defaultWorkspace() || name == "" {
+		return fmt.Errorf("can't delete default state %q", b.defaultWorkspace())
+	}
+	if b.readOnly {
+		return fmt.Errorf("can't delete state %q: %w", name, ErrReadOnly)
+	}
+	if force {
+		return b.deleteWorkspace(ctx, name, true, purge)
+	}
+
+	client := b.remoteClient(name)
+	lockInfo := statemgr.NewLockInfo()
+	lockInfo.Operation = "delete"
+	lockID, err := client.LockContext(ctx, lockInfo)
+	if err != nil {
+		return fmt.Errorf("can't delete state %q while it is locked, unless forced: %w", name, err)
+	}
+
+	err = b.deleteWorkspace(ctx, name, false, purge)
+	if unlockErr := client.UnlockContext(context.WithoutCancel(ctx), lockID); unlockErr != nil && err == nil {
+		err = fmt.Errorf("error unlocking Postgres state: %w", unlockErr)
+	}
+	return err
+}
+
+// deleteWorkspace deletes the state of the given workspace, and the row of
+// its lock in the same statement if deleteLock is set. The state is
+// tombstoned unless purge is set.
+func (b *Backend) deleteWorkspace(ctx context.Context, name string, deleteLock, purge bool) error {
+	// Invalidated once the workspace is deleted, so it isn't cached again
+	// by a concurrent listing.
+	defer b.workspacesCache.invalidate()
+	b.replica.wroteStates(name)
+	b.replica.changedWorkspaces()
+
+	var locks []string
+	if deleteLock && b.lockTableName != "" {
+		locks = append(locks, fmt.Sprintf(`deleted_lock AS (DELETE FROM %s.%s WHERE name = $1)`, b.schemaName, b.lockTableName))
+	}
+	query := b.deleteStatesQuery(fmt.Sprintf(`%s = $1`, b.nameCol()), locks)
+	if !purge {
+		query = b.softDeleteStatesQuery(fmt.Sprintf(`%s = $1`, b.nameCol()), locks)
+	}
+	return retry(ctx, b.maxRetries, func() error {
+		_, err := b.db.ExecContext(ctx, query, name)
 		return err
+	})
+}
+
+// deleteStatesQuery returns the statement deleting the states matching
+// condition, preceded by the given common table expressions, and returning
+// the names of the deleted workspaces. The workspaces are also deleted from
+// the fallback tables, so they aren't listed anymore, and the large objects
+// of their states are unlinked and their history deleted by the same
+// statement.
+func (b *Backend) deleteStatesQuery(condition string, ctes []string) string {
+	query := fmt.Sprintf(`DELETE FROM %s.%s WHERE %s RETURNING %s`, b.schemaName, b.tableName, condition, b.nameCol())
+	if len(b.fallbackTables) == 0 && !b.hasDataOid && b.historyTableName == "" {
+		if len(ctes) > 0 {
+			query = fmt.Sprintf(`WITH %s %s`, strings.Join(ctes, ", "), query)
+		}
+		return query
+	}
+
+	var selects, names []string
+	deleted := func(name, schemaName string, hasDataOid bool) {
+		returning := b.nameCol()
+		if hasDataOid {
+			returning += ", data_oid"
+		}
+		ctes = append(ctes, fmt.Sprintf(`%s AS (DELETE FROM %s.%s WHERE %s RETURNING %s)`, name, schemaName, b.tableName, condition, returning))
+		selects = append(selects, unlinkDeleted(name, b.nameCol(), hasDataOid))
+		names = append(names, fmt.Sprintf(`SELECT %s FROM %s`, b.nameCol(), name))
+	}
+	deleted("deleted", b.schemaName, b.hasDataOid)
+	for i, table := range b.fallbackTables {
+		deleted(fmt.Sprintf("deleted_fallback_%d", i), table.schemaName, table.hasDataOid)
+	}
+	if b.historyTableName != "" {
+		ctes = append(ctes, deleteHistoryCTE(b.schemaName, b.historyTableName, strings.Join(names, " UNION ")))
 	}
+	return fmt.Sprintf(`WITH %s %s`, strings.Join(ctes, ", "), strings.Join(selects, " UNION "))
+}
+
+// deleteHistoryCTE returns the common table expression deleting the history
+// of the workspaces whose names are returned by the given query, so a
+// workspace created later under the same name doesn't inherit it.
+func deleteHistoryCTE(schemaName, historyTableName, names string) string {
+	return fmt.Sprintf(`deleted_history AS (DELETE FROM %s.%s WHERE name IN (%s))`, schemaName, historyTableName, names)
+}
 
+// DeleteWorkspaces deletes all the workspaces whose name matches the given
+// glob pattern, where `*` matches any sequence of characters and `?` any
+// single character, and returns the names of the deleted workspaces ordered
+// by name. The default workspace is never deleted, and an empty pattern or a
+// pattern that would match the default workspace is refused unless force is
+// set, in which case an empty pattern matches all the workspaces.
+//
+// With dryRun, the workspaces that would be deleted are returned, read from
+// the primary, but nothing is deleted. With soft_delete_retention, the
+// states are tombstoned as by DeleteWorkspace.
+func (b *Backend) DeleteWorkspaces(ctx context.Context, pattern string, force, dryRun bool) (_ []string, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "delete_workspaces", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	if b.readOnly {
+		return nil, fmt.Errorf("can't delete the states matching %q: %w", pattern, ErrReadOnly)
+	}
+	if !force {
+		if pattern == "" {
+			return nil, fmt.Errorf("refusing to delete all the states without force")
+		}
+		if globMatch(pattern, b.defaultWorkspace()) {
+			return nil, fmt.Errorf("refusing to delete the states matching %q without force, as it matches the default state", pattern)
+		}
+	}
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	// The condition is on the name column of workspacesTable for a dry run,
+	// and on the configured name column of the states tables otherwise.
+	condition := func(column string) string {
+		return fmt.Sprintf(`%s AND %s LIKE $1 ESCAPE '\'`, b.notDefaultWorkspace(column), column)
+	}
+	if dryRun {
+		query := fmt.Sprintf(`SELECT name FROM %s WHERE %s`, b.workspacesTable(), condition("name"))
+		names, err := b.queryWorkspaces(ctx, b.db, nil, query, globToLike(pattern))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(names)
+		op.setRows(int64(len(names)))
+		return names, nil
+	}
+
+	defer b.workspacesCache.invalidate()
+	b.replica.changedWorkspaces()
+
+	query := b.deleteStatesQuery(condition(b.nameCol()), nil)
+	if b.softDeleteRetention > 0 {
+		query = b.softDeleteStatesQuery(condition(b.nameCol()), nil)
+	}
+	deleted, err := b.queryWorkspaces(ctx, b.db, nil, query, globToLike(pattern))
+	b.replica.wroteStates(deleted...)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(deleted)
+	op.setRows(int64(len(deleted)))
+	return deleted, nil
+}
+
+// globToLike translates a glob pattern to the equivalent LIKE pattern,
+// matching every other character literally.
+func globToLike(pattern string) string {
+	var like strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			like.WriteString("%")
+		case '?':
+			like.WriteString("_")
+		default:
+			like.WriteString(escapeLike(string(r)))
+		}
+	}
+	return like.String()
+}
+
+// globMatch reports whether name matches the glob pattern, with the same
+// semantics as globToLike.
+func globMatch(pattern, name string) bool {
+	var re strings.Builder
+	re.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			re.WriteString("(?s:.*)")
+		case '?':
+			re.WriteString("(?s:.)")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.MustCompile(re.String()).MatchString(name)
+}
+
+// checkWorkspaceName returns an error wrapping ErrInvalidWorkspaceName if
+// the given name of a new workspace doesn't match workspace_name_pattern.
+// The existing workspaces are never checked, so they can still be used and
+// deleted once the pattern is set.
+func (b *Backend) checkWorkspaceName(name string) error {
+	if b.workspaceNamePattern == nil || b.workspaceNamePattern.MatchString(name) {
+		return nil
+	}
+	return fmt.Errorf("%w: %q doesn't match workspace_name_pattern %q", ErrInvalidWorkspaceName, name, b.workspaceNamePattern.String())
+}
+
+// RenameWorkspace renames the oldName workspace to newName. The workspace is
+// locked while it is renamed, and the rename is a single transaction so the
+// original workspace is left intact on failure. An error wrapping
+// ErrWorkspaceAlreadyExists is returned if newName is already used.
+func (b *Backend) RenameWorkspace(ctx context.Context, oldName, newName string) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "rename_workspace", tableAttrs(b.schemaName, b.tableName, oldName)...)
+	defer op.end(&err)
+
+	if oldName == b.defaultWorkspace() || oldName == "" {
+		return fmt.Errorf("can't rename default state")
+	}
+	if newName == b.defaultWorkspace() || newName == "" {
+		return fmt.Errorf("can't rename a state to the default state")
+	}
+	if err := b.checkWorkspaceName(newName); err != nil {
+		return fmt.Errorf("can't rename state %q: %w", oldName, err)
+	}
+	if b.readOnly {
+		return fmt.Errorf("can't rename state %q: %w", oldName, ErrReadOnly)
+	}
+
+	client := b.remoteClient(oldName)
+	lockInfo := statemgr.NewLockInfo()
+	lockInfo.Operation = "rename"
+	lockID, err := client.LockContext(ctx, lockInfo)
+	if err != nil {
+		return fmt.Errorf("failed to lock state in Postgres: %w", err)
+	}
+
+	err = b.renameWorkspace(ctx, oldName, newName)
+	if unlockErr := client.UnlockContext(context.WithoutCancel(ctx), lockID); unlockErr != nil && err == nil {
+		err = fmt.Errorf("error unlocking Postgres state: %w", unlockErr)
+	}
+	return err
+}
+
+func (b *Backend) renameWorkspace(ctx context.Context, oldName, newName string) error {
+	defer b.workspacesCache.invalidate()
+	b.replica.wroteStates(oldName, newName)
+	b.replica.changedWorkspaces()
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM %s.%s WHERE %s = $1)`
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(query, b.schemaName, b.tableName, b.nameCol()), newName).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("can't rename state %q to %q: %w", oldName, newName, ErrWorkspaceAlreadyExists)
+	}
+
+	query = `UPDATE %[1]s.%[2]s SET %[3]s = $2 WHERE %[3]s = $1%[4]s`
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(query, b.schemaName, b.tableName, b.nameCol(), notDeleted(b.hasDeletedAt)), oldName, newName)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			// unique_violation, newName was created concurrently
+			return fmt.Errorf("can't rename state %q to %q: %w", oldName, newName, ErrWorkspaceAlreadyExists)
+		}
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("can't rename state %q: it does not exist", oldName)
+	}
+
+	// The history follows the workspace, under its new name.
+	if b.historyTableName != "" {
+		query = `UPDATE %s.%s SET name = $2 WHERE name = $1`
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(query, b.schemaName, b.historyTableName), oldName, newName); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CopyWorkspace copies the state of the source workspace to the new dest
+// workspace. The copy gets a fresh lineage, so the two workspaces don't share
+// their history. The source workspace is read while it is locked, and an
+// error wrapping ErrWorkspaceAlreadyExists is returned if dest already
+// exists.
+func (b *Backend) CopyWorkspace(ctx context.Context, source, dest string) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "copy_workspace", tableAttrs(b.schemaName, b.tableName, source)...)
+	defer op.end(&err)
+
+	if dest == b.defaultWorkspace() || dest == "" {
+		return fmt.Errorf("can't copy a state to the default state")
+	}
+	if err := b.checkWorkspaceName(dest); err != nil {
+		return fmt.Errorf("can't copy state %q: %w", source, err)
+	}
+	if b.readOnly {
+		return fmt.Errorf("can't copy state %q: %w", source, ErrReadOnly)
+	}
+
+	client := b.remoteClient(source)
+	lockInfo := statemgr.NewLockInfo()
+	lockInfo.Operation = "copy"
+	lockID, err := client.LockContext(ctx, lockInfo)
+	if err != nil {
+		return fmt.Errorf("failed to lock state in Postgres: %w", err)
+	}
+
+	err = b.copyWorkspace(ctx, client, dest)
+	if unlockErr := client.UnlockContext(context.WithoutCancel(ctx), lockID); unlockErr != nil && err == nil {
+		err = fmt.Errorf("error unlocking Postgres state: %w", unlockErr)
+	}
+	return err
+}
+
+func (b *Backend) copyWorkspace(ctx context.Context, source *RemoteClient, dest string) error {
+	payload, err := source.Get()
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return fmt.Errorf("can't copy state %q: it does not exist", source.Name)
+	}
+
+	data, err := withNewLineage(payload.Data)
+	if err != nil {
+		return fmt.Errorf("can't copy state %q: %w", source.Name, err)
+	}
+	defer b.workspacesCache.invalidate()
+	created, err := b.remoteClient(dest).create(ctx, data)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("can't copy state %q to %q: %w", source.Name, dest, ErrWorkspaceAlreadyExists)
+	}
 	return nil
 }
 
-func (b *Backend) StateMgr(ctx context.Context, name string) (statemgr.Full, error) {
-	// Build the state client
-	var stateMgr statemgr.Full = &remote.State{
-		Client: &RemoteClient{
-			Client:     b.db,
-			Name:       name,
-			SchemaName: b.schemaName,
-		},
+// withNewLineage returns the given state file with a newly generated lineage.
+// An empty state is returned as-is.
+func withNewLineage(data []byte) ([]byte, error) {
+	f, err := statefile.Read(bytes.NewReader(data))
+	if errors.Is(err, statefile.ErrNoState) {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// Check to see if this state already exists.
-	// If the state doesn't exist, we have to assume this
-	// is a normal create operation, and take the lock at that point.
-	existing, err := b.Workspaces(ctx)
+	f.Lineage, err = uuid.GenerateUUID()
 	if err != nil {
 		return nil, err
 	}
 
-	exists := false
-	for _, s := range existing {
-		if s == name {
-			exists = true
+	var buf bytes.Buffer
+	if err := statefile.Write(f, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WorkspaceInfo describes a workspace stored in Postgres.
+type WorkspaceInfo struct {
+	Name string
+
+	// CreatedAt and UpdatedAt are the times the workspace was created and
+	// its state last written. They are zero when unknown, as for the
+	// workspaces created before these times were recorded.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Size is the size of the stored state, in bytes.
+	Size int64
+
+	// WriterVersion and WriterHost are the version of OpenTofu and the host
+	// that last wrote the state. They are empty when unknown, as for the
+	// states written before they were recorded.
+	WriterVersion string
+	WriterHost    string
+}
+
+// WorkspaceInfo returns the metadata of the given workspace, read from the
+// first table holding it, the states table or a fallback table.
+func (b *Backend) WorkspaceInfo(ctx context.Context, name string) (_ *WorkspaceInfo, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "workspace_info", tableAttrs(b.schemaName, b.tableName, name)...)
+	defer op.end(&err)
+
+	var createdAt, updatedAt sql.NullTime
+	var writerVersion, writerHost sql.NullString
+	info := &WorkspaceInfo{Name: name}
+	err = sql.ErrNoRows
+	for _, table := range b.remoteClient(name).stateTables() {
+		columns := "NULL, NULL"
+		if table.hasTimestamps {
+			columns = "created_at, updated_at"
+		}
+		writerColumns := "NULL, NULL"
+		if table.hasWriter {
+			writerColumns = "writer_version, writer_host"
+		}
+		query := `SELECT %s, %s, %s FROM %s.%s WHERE %s = $1%s`
+		err = b.db.QueryRowContext(ctx, fmt.Sprintf(query, columns, stateSizeColumn(b.dataCol(), table.hasDataOid), writerColumns, table.schemaName, b.tableName, b.nameCol(), notDeleted(table.hasDeletedAt)), name).Scan(&createdAt, &updatedAt, &info.Size, &writerVersion, &writerHost)
+		if err != sql.ErrNoRows {
 			break
 		}
 	}
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, fmt.Errorf("state %q does not exist", name)
+	case err != nil:
+		return nil, err
+	}
+	info.CreatedAt = createdAt.Time
+	info.UpdatedAt = updatedAt.Time
+	info.WriterVersion = writerVersion.String
+	info.WriterHost = writerHost.String
 
-	// Grab a lock, we use this to write an empty state if one doesn't
-	// exist already. We have to write an empty state as a sentinel value
-	// so Workspaces() knows it exists.
-	if !exists {
-		lockInfo := statemgr.NewLockInfo()
-		lockInfo.Operation = "init"
-		lockId, err := stateMgr.Lock(lockInfo)
+	return info, nil
+}
+
+// WorkspaceSizes returns the size of the stored state of each workspace,
+// in bytes, by name. It is the size of the states as they are stored, once
+// compressed and encrypted if they were written so, read with a single
+// query without reading the states. The default workspace is missing until
+// its state is written.
+func (b *Backend) WorkspaceSizes(ctx context.Context) (_ map[string]int64, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "workspace_sizes", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	query := fmt.Sprintf(`SELECT %s, %s FROM %s.%s`, b.nameCol(), stateSizeColumn(b.dataCol(), b.hasDataOid), b.schemaName, b.tableName)
+	if b.hasDeletedAt {
+		query += ` WHERE deleted_at IS NULL`
+	}
+	var sizes map[string]int64
+	err = retry(ctx, b.maxRetries, func() error {
+		rows, err := b.db.QueryContext(ctx, query)
 		if err != nil {
-			return nil, fmt.Errorf("failed to lock state in Postgres: %w", err)
+			return err
 		}
+		defer rows.Close()
 
-		// Local helper function so we can call it multiple places
-		lockUnlock := func(parent error) error {
-			if err := stateMgr.Unlock(lockId); err != nil {
-				return fmt.Errorf("error unlocking Postgres state: %w", err)
+		sizes = map[string]int64{}
+		for rows.Next() {
+			var name string
+			var size int64
+			if err := rows.Scan(&name, &size); err != nil {
+				return err
 			}
-			return parent
+			sizes[name] = size
 		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	op.setRows(int64(len(sizes)))
+	return sizes, nil
+}
 
-		if v := stateMgr.State(); v == nil {
-			if err := stateMgr.WriteState(states.NewState()); err != nil {
-				err = lockUnlock(err)
-				return nil, err
+// TotalSize returns the total size of the stored states, in bytes, the sum
+// of the sizes reported by WorkspaceSizes.
+func (b *Backend) TotalSize(ctx context.Context) (_ int64, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "total_size", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	var total int64
+	query := fmt.Sprintf(`SELECT coalesce(sum(%s), 0) FROM %s.%s`, stateSizeColumn(b.dataCol(), b.hasDataOid), b.schemaName, b.tableName)
+	if b.hasDeletedAt {
+		query += ` WHERE deleted_at IS NULL`
+	}
+	err = retry(ctx, b.maxRetries, func() error {
+		return b.db.QueryRowContext(ctx, query).Scan(&total)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// StateVersion is a version of a state kept in the history.
+type StateVersion struct {
+	Serial    uint64
+	WrittenAt time.Time
+}
+
+// StateHistory returns the versions of the state of the given workspace kept
+// in the history, from the oldest to the latest. The history is only kept
+// when history_limit is set.
+func (b *Backend) StateHistory(ctx context.Context, name string) (_ []StateVersion, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "state_history", tableAttrs(b.schemaName, b.tableName, name)...)
+	defer op.end(&err)
+
+	if b.historyLimit <= 0 {
+		return nil, fmt.Errorf("the history of the states is not kept, history_limit is not set")
+	}
+
+	query := `SELECT serial, written_at FROM %s.%s WHERE name = $1 ORDER BY id`
+	rows, err := b.db.QueryContext(ctx, fmt.Sprintf(query, b.schemaName, b.historyTableName), name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []StateVersion
+	for rows.Next() {
+		var v StateVersion
+		if err := rows.Scan(&v.Serial, &v.WrittenAt); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// StateAt returns the state of the given workspace as it was at the given
+// time, the latest version of its history written at or before at. It
+// returns an error wrapping ErrStateVersionNotFound if no version kept in
+// the history was written by then, if that version is of another lineage
+// than the current state, or if the history is not kept, as history_limit
+// is not set.
+func (b *Backend) StateAt(ctx context.Context, name string, at time.Time) (_ *states.State, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "state_at", tableAttrs(b.schemaName, b.tableName, name)...)
+	defer op.end(&err)
+	if b.historyLimit <= 0 {
+		return nil, fmt.Errorf("%w: the history of the states is not kept, history_limit is not set", ErrStateVersionNotFound)
+	}
+
+	var data []byte
+	query := `SELECT data FROM %s.%s WHERE name = $1 AND written_at <= $2 ORDER BY written_at DESC, id DESC LIMIT 1`
+	err = b.db.QueryRowContext(ctx, fmt.Sprintf(query, b.schemaName, b.historyTableName), name, at).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, fmt.Errorf("%w: no version of state %q written at or before %s is kept in the history", ErrStateVersionNotFound, name, at.Format(time.RFC3339))
+	case err != nil:
+		return nil, err
+	}
+	client := b.remoteClient(name)
+	if data, err = client.decodeState(data); err != nil {
+		return nil, fmt.Errorf("can't read state %q at %s: %w", name, at.Format(time.RFC3339), err)
+	}
+	file, err := statefile.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("can't read state %q at %s: %w", name, at.Format(time.RFC3339), err)
+	}
+
+	// The history of a workspace deleted and created again under the same
+	// name, or reset, is of another lineage, and is not its history.
+	current, err := client.readState(ctx)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, fmt.Errorf("%w: state %q does not exist", ErrStateVersionNotFound, name)
+	case err != nil:
+		return nil, err
+	}
+	if lineage := stateLineage(current); lineage != file.Lineage {
+		return nil, fmt.Errorf("%w: the version of state %q written at or before %s is of lineage %q, not of the lineage %q of the current state", ErrStateVersionNotFound, name, at.Format(time.RFC3339), file.Lineage, lineage)
+	}
+	return file.State, nil
+}
+
+// RollbackWorkspace restores the version of the state of the given workspace
+// with the given serial from the history. The restored state is written as a
+// new version, with the next serial, so the rollback is itself recorded in
+// the history. A version of another lineage than the current state, such as
+// one written before the workspace was reset, is refused.
+func (b *Backend) RollbackWorkspace(ctx context.Context, name string, serial uint64) error {
+	if b.historyLimit <= 0 {
+		return fmt.Errorf("can't roll back state %q: the history of the states is not kept, history_limit is not set", name)
+	}
+	if b.readOnly {
+		return fmt.Errorf("can't roll back state %q: %w", name, ErrReadOnly)
+	}
+
+	client := b.remoteClient(name)
+	lockInfo := statemgr.NewLockInfo()
+	lockInfo.Operation = "rollback"
+	lockID, err := client.LockContext(ctx, lockInfo)
+	if err != nil {
+		return fmt.Errorf("failed to lock state in Postgres: %w", err)
+	}
+
+	err = b.rollbackWorkspace(ctx, client, serial)
+	if unlockErr := client.UnlockContext(context.WithoutCancel(ctx), lockID); unlockErr != nil && err == nil {
+		err = fmt.Errorf("error unlocking Postgres state: %w", unlockErr)
+	}
+	return err
+}
+
+func (b *Backend) rollbackWorkspace(ctx context.Context, client *RemoteClient, serial uint64) error {
+	var data []byte
+	query := `SELECT data FROM %s.%s WHERE name = $1 AND serial = $2 ORDER BY id DESC LIMIT 1`
+	err := b.db.QueryRowContext(ctx, fmt.Sprintf(query, b.schemaName, b.historyTableName), client.Name, serial).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return fmt.Errorf("can't roll back state %q: serial %d is not in its history", client.Name, serial)
+	case err != nil:
+		return err
+	}
+	data, err = client.decodeState(data)
+	if err != nil {
+		return fmt.Errorf("can't roll back state %q to serial %d: %w", client.Name, serial, err)
+	}
+	previous, err := statefile.Read(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("can't roll back state %q to serial %d: %w", client.Name, serial, err)
+	}
+
+	payload, err := client.Get()
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return fmt.Errorf("can't roll back state %q: it does not exist", client.Name)
+	}
+	current, err := statefile.Read(bytes.NewReader(payload.Data))
+	if err != nil {
+		return fmt.Errorf("can't roll back state %q: %w", client.Name, err)
+	}
+
+	if previous.Lineage != current.Lineage {
+		return fmt.Errorf("can't roll back state %q to serial %d: the version is of lineage %q, not of the lineage %q of the current state", client.Name, serial, previous.Lineage, current.Lineage)
+	}
+	previous.Serial = current.Serial + 1
+
+	var buf bytes.Buffer
+	if err := statefile.Write(previous, &buf); err != nil {
+		return err
+	}
+	return client.Put(buf.Bytes())
+}
+
+// ResetWorkspace resets the state of the given workspace to an empty state
+// with a new lineage and the serial following the current one, keeping the
+// workspace, unlike DeleteWorkspace. The workspace is locked while it is
+// reset, so it can't be reset while someone else holds its lock.
+//
+// With force, the workspace is reset even if someone else holds its lock,
+// which is left as it is.
+func (b *Backend) ResetWorkspace(ctx context.Context, name string, force bool) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "reset_workspace", tableAttrs(b.schemaName, b.tableName, name)...)
+	defer op.end(&err)
+	if b.readOnly {
+		return fmt.Errorf("can't reset state %q: %w", name, ErrReadOnly)
+	}
+
+	client := b.remoteClient(name)
+	client.ctx = ctx
+	client.replacesLineage = true
+	if force {
+		return b.resetWorkspace(client)
+	}
+	lockInfo := statemgr.NewLockInfo()
+	lockInfo.Operation = "reset"
+	lockID, err := client.LockContext(ctx, lockInfo)
+	if err != nil {
+		return fmt.Errorf("can't reset state %q while it is locked, unless forced: %w", name, err)
+	}
+
+	err = b.resetWorkspace(client)
+	if unlockErr := client.UnlockContext(context.WithoutCancel(ctx), lockID); unlockErr != nil && err == nil {
+		err = fmt.Errorf("error unlocking Postgres state: %w", unlockErr)
+	}
+	return err
+}
+
+func (b *Backend) resetWorkspace(client *RemoteClient) error {
+	payload, err := client.Get()
+	if err != nil {
+		return err
+	}
+	var serial uint64
+	switch {
+	case payload != nil:
+		current, err := statefile.Read(bytes.NewReader(payload.Data))
+		if err != nil && !errors.Is(err, statefile.ErrNoState) {
+			return fmt.Errorf("can't reset state %q: %w", client.Name, err)
+		}
+		if current != nil {
+			serial = current.Serial
+		}
+	case client.Name != b.defaultWorkspace():
+		// The default workspace exists before its state is written.
+		return fmt.Errorf("%w: can't reset state %q", ErrWorkspaceNotFound, client.Name)
+	}
+
+	lineage, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := statefile.Write(statefile.New(states.NewState(), lineage, serial+1), &buf); err != nil {
+		return err
+	}
+	return client.Put(buf.Bytes())
+}
+
+func (b *Backend) StateMgr(ctx context.Context, name string) (_ statemgr.Full, err error) {
+	callerCtx := ctx
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "state_mgr", tableAttrs(b.schemaName, b.tableName, name)...)
+	defer op.end(&err)
+
+	// Build the state client. The operations made to initialize the state
+	// are part of this one, the later ones belong to the caller.
+	client := b.remoteClient(name)
+	client.ctx = ctx
+	defer func() { client.ctx = callerCtx }()
+	var stateMgr statemgr.Full = &remote.State{
+		Client: client,
+	}
+
+	// Check to see if this state already exists.
+	// If the state doesn't exist, we have to assume this
+	// is a normal create operation.
+	exists, err := b.WorkspaceExists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if b.requireExisting {
+		// Even the default workspace must have been written.
+		if exists, err = b.stateExists(ctx, name); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("%w: %q, and create_missing is false", ErrWorkspaceNotFound, name)
+		}
+	}
+
+	// Write an empty state if one doesn't exist already. We have to write
+	// an empty state as a sentinel value so Workspaces() knows it exists.
+	// It is only inserted if the workspace still doesn't exist, so
+	// concurrent callers creating the same workspace don't conflict.
+	if !exists {
+		if err := b.checkWorkspaceName(name); err != nil {
+			return nil, err
+		}
+		_, err := client.createEmpty(ctx)
+		b.workspacesCache.invalidate()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create state in Postgres: %w", err)
+		}
+	}
+
+	return stateMgr, nil
+}
+
+// StateMgrForRead returns the state manager of the given workspace for the
+// callers that only read its state, such as `tofu state show`. Unlike
+// StateMgr, a missing workspace is not created: an error wrapping
+// ErrWorkspaceNotFound is returned instead, and nothing is written nor
+// locked. The default workspace always exists, its state being empty until
+// it is written.
+func (b *Backend) StateMgrForRead(ctx context.Context, name string) (_ statemgr.Full, err error) {
+	callerCtx := ctx
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "state_mgr_read", tableAttrs(b.schemaName, b.tableName, name)...)
+	defer op.end(&err)
+
+	exists, err := b.WorkspaceExists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrWorkspaceNotFound, name)
+	}
+	client := b.remoteClient(name)
+	client.ctx = callerCtx
+	return &remote.State{Client: client}, nil
+}
+
+// StateMgrs returns the state managers of the given workspaces, by name, as
+// StateMgr returns them for each workspace. Which of them exist is checked
+// with a single query instead of one per workspace, and the missing ones are
+// then created, unless create_missing is false.
+func (b *Backend) StateMgrs(ctx context.Context, names []string) (_ map[string]statemgr.Full, err error) {
+	callerCtx := ctx
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "state_mgrs", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	exists := map[string]bool{}
+	if len(names) > 0 {
+		query := fmt.Sprintf(`SELECT name FROM %s WHERE name = ANY($1)`, b.workspacesTable())
+		found, err := b.queryWorkspaces(ctx, b.db, nil, query, pq.Array(names))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range found {
+			exists[name] = true
+		}
+	}
+	if b.requireExisting {
+		for _, name := range names {
+			// Even the default workspace must have been written.
+			if !exists[name] {
+				return nil, fmt.Errorf("%w: %q, and create_missing is false", ErrWorkspaceNotFound, name)
 			}
-			if err := stateMgr.PersistState(nil); err != nil {
-				err = lockUnlock(err)
+		}
+	}
+	// None of the workspaces is created if one of them can't be.
+	for _, name := range names {
+		if !exists[name] && name != b.defaultWorkspace() {
+			if err := b.checkWorkspaceName(name); err != nil {
 				return nil, err
 			}
 		}
+	}
+
+	mgrs := make(map[string]statemgr.Full, len(names))
+	var created bool
+	defer func() {
+		if created {
+			b.workspacesCache.invalidate()
+		}
+	}()
+	for _, name := range names {
+		if _, ok := mgrs[name]; ok {
+			continue
+		}
+		client := b.remoteClient(name)
+		client.ctx = callerCtx
 
-		// Unlock, the state should now be initialized
-		if err := lockUnlock(nil); err != nil {
-			return nil, err
+		// The default workspace exists whether its state is written or
+		// not, as for StateMgr.
+		if !exists[name] && name != b.defaultWorkspace() {
+			_, err := client.createEmpty(ctx)
+			created = true
+			if err != nil {
+				return nil, fmt.Errorf("failed to create state %q in Postgres: %w", name, err)
+			}
 		}
+		mgrs[name] = &remote.State{Client: client}
 	}
+	return mgrs, nil
+}
 
-	return stateMgr, nil
+// emptyStateFile returns an empty state file with a new lineage, written as
+// a sentinel value so Workspaces knows a new workspace exists.
+func emptyStateFile() ([]byte, error) {
+	lineage, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := statefile.Write(statefile.New(states.NewState(), lineage, 1), &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// remoteClient returns the client of the state of the given workspace.
+func (b *Backend) remoteClient(name string) *RemoteClient {
+	return &RemoteClient{
+		Client:          b.db,
+		Name:            name,
+		SchemaName:      b.schemaName,
+		TableName:       b.tableName,
+		nameColumn:      b.nameColumn,
+		dataColumn:      b.dataColumn,
+		hasTimestamps:   b.hasTimestamps,
+		hasChecksum:     b.hasChecksum,
+		hasSerial:       b.hasSerial,
+		hasLineage:      b.hasLineage,
+		hasStateVersion: b.hasStateVersion,
+		hasWriter:       b.hasWriter,
+		hasWriteToken:   b.hasWriteToken,
+		hasDataOid:      b.hasDataOid,
+		hasDeletedAt:    b.hasDeletedAt,
+		largeObjects:    b.largeObjects,
+
+		historyTableName: b.historyTableName,
+		historyLimit:     b.historyLimit,
+
+		fallbackTables: b.fallbackTables,
+
+		lockAuditTableName: b.lockAuditTableName,
+
+		lockTTL:               b.lockTTL,
+		lockHeartbeatInterval: b.lockHeartbeatInterval,
+
+		lockTimeout:   b.lockTimeout,
+		lockTableName: b.lockTableName,
+		tableLocks:    b.tableLocks,
+		lockDB:        b.lockDB,
+		stmts:         b.stmts,
+		readOnly:      b.readOnly,
+
+		allowLineageChange:  b.allowLineageChange,
+		allowStateDowngrade: b.allowStateDowngrade,
+		maxRetries:          b.maxRetries,
+		isolation:           b.isolation,
+		compress:            b.compress,
+		bytea:               b.bytea,
+		aead:                b.aead,
+		maxStateBytes:       b.maxStateBytes,
+		notifyChannel:       b.notifyChannel,
+		replica:             b.replica,
+		metrics:             b.metrics,
+
+		slowQueryThreshold: b.slowQueryThreshold,
+		timeouts:           b.timeouts,
+		operations:         b.operations,
+		statePersisted:     b.statePersisted,
+		logger:             b.logger,
+	}
 }
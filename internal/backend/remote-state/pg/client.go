@@ -4,60 +4,739 @@
 package pg
 
 import (
+	"bufio"
 	"context"
+	"crypto/cipher"
 	"crypto/md5"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
 
 	uuid "github.com/hashicorp/go-uuid"
 	_ "github.com/lib/pq"
 	"github.com/opentofu/opentofu/internal/states/remote"
 	"github.com/opentofu/opentofu/internal/states/statemgr"
+	"github.com/opentofu/opentofu/version"
 )
 
+// ErrStateIntegrity is returned when a state doesn't match the checksum
+// written along with it.
+var ErrStateIntegrity = errors.New("state integrity check failed")
+
+// ErrStateConflict is returned when writing a state over a newer one, which
+// happens when several writers don't lock the state.
+var ErrStateConflict = errors.New("state conflict")
+
+// ErrLineageMismatch is returned when writing a state over one of another
+// lineage, which happens when a workspace is shared by mistake by unrelated
+// configurations.
+var ErrLineageMismatch = errors.New("state lineage mismatch")
+
 // RemoteClient is a remote client that stores data in a Postgres database
 type RemoteClient struct {
 	Client     *sql.DB
 	Name       string
 	SchemaName string
+	TableName  string
+
+	// nameColumn and dataColumn are the columns of the table holding the
+	// names of the workspaces and the states, "name" and "data" if empty,
+	// see nameCol and dataCol.
+	nameColumn string
+	dataColumn string
+
+	// hasTimestamps is set when the table has the created_at and
+	// updated_at columns.
+	hasTimestamps bool
+
+	// historyTableName is the table where the last historyLimit versions of
+	// the state are kept when historyLimit is positive.
+	historyTableName string
+	historyLimit     int
+
+	// lockTimeout is how long Lock waits for a lock held by someone else,
+	// it fails right away if zero.
+	lockTimeout time.Duration
+
+	// lockTableName is the table where the information of the locks is
+	// recorded, if any.
+	lockTableName string
+
+	// tableLocks is set when the locks are the rows of the lock table rather
+	// than advisory locks. They are not released when the session ends, so
+	// they work through a pooler sharing the sessions, but are left behind
+	// by a client that crashes.
+	tableLocks bool
+
+	// lockConn is the connection of the session holding the advisory locks
+	// of the workspace while it is locked, nil otherwise. An advisory lock
+	// belongs to the session taking it and is dropped when the session ends,
+	// so it is taken and released on a connection kept out of the pool, which
+	// would otherwise close or hand it out as it pleases.
+	lockConn *sql.Conn
+
+	// lockDB is the pool lockConn is taken from, Client if nil.
+	lockDB *sql.DB
+
+	// stmts holds the prepared statements, nil if they aren't prepared.
+	stmts *statementCache
+
+	// lockTTL is how long a table lock is kept without a heartbeat, after
+	// which another client may take it over. The locks never expire if
+	// zero. The holder of the lock extends it every lockHeartbeatInterval.
+	lockTTL               time.Duration
+	lockHeartbeatInterval time.Duration
+
+	// stopHeartbeat stops the heartbeat of the lock held, if any.
+	stopHeartbeat func()
+
+	// lockAuditTableName is the table recording the locks released by
+	// force, with who released them and why.
+	lockAuditTableName string
+
+	// maxRetries is the number of times the operations failing with a
+	// transient error are retried.
+	maxRetries int
+
+	// isolation is the isolation level of the transactions writing the
+	// state, sql.LevelDefault to use the one of the database.
+	isolation sql.IsolationLevel
+
+	// hasChecksum is set when the table has the checksum column, the
+	// checksums of the states are then written and verified.
+	hasChecksum bool
+
+	// hasWriter is set when the table has the writer_version and
+	// writer_host columns, the version of OpenTofu and the host writing
+	// the states are then recorded along with them.
+	hasWriter bool
+
+	// hasWriteToken is set when the table has the write_token column, each
+	// write then records a token of its own, so a write retried after its
+	// commit has been lost is recognized instead of being applied again.
+	hasWriteToken bool
+
+	// hasDataOid is set when the table has the data_oid column, the states
+	// stored in large objects are then read, and their large objects
+	// unlinked once they are written over or deleted.
+	hasDataOid bool
+
+	// hasDeletedAt is set when the table has the deleted_at column, the
+	// tombstones of the soft-deleted workspaces are then neither read nor
+	// written over.
+	hasDeletedAt bool
+
+	// largeObjects is set when the states are written in large objects
+	// rather than in the data column, storage being "largeobject".
+	largeObjects bool
+
+	// readOnly is set when the states cannot be written or locked.
+	readOnly bool
+
+	// hasSerial is set when the table has the serial column, the states are
+	// then only written over older ones.
+	hasSerial bool
+
+	// hasLineage is set when the table has the lineage column, the states
+	// are then only written over the ones of the same lineage, unless
+	// allowLineageChange is set.
+	hasLineage         bool
+	allowLineageChange bool
+
+	// hasStateVersion is set when the table has the state_version and
+	// terraform_version columns, the states are then only written over the
+	// ones of the same or an older format and OpenTofu version, unless
+	// allowStateDowngrade is set.
+	hasStateVersion     bool
+	allowStateDowngrade bool
+
+	// replacesLineage is set when the states written deliberately replace
+	// the lineage of the stored one, their lineage is then not checked.
+	replacesLineage bool
+
+	// compress is set when the states are written gzip-compressed, the
+	// states are read whatever the way they were written.
+	compress bool
+
+	// bytea is set when the data column is bytea rather than text, the
+	// compressed states are then stored without base64.
+	bytea bool
+
+	// aead encrypts the states when encryption_key is set, the states
+	// stored in clear are still read.
+	aead cipher.AEAD
+
+	// fallbackTables are searched in order for the state when it isn't in
+	// the states table, it is still written there.
+	fallbackTables []fallbackTable
+
+	// maxStateBytes is the size limit of the stored states, after
+	// compression, 0 if unlimited.
+	maxStateBytes int
+
+	// notifyChannel is the notification channel signaled with the name of
+	// the workspace when its state is written, if any.
+	notifyChannel string
+
+	// statePersisted are called once Put has committed a state.
+	statePersisted []StatePersistedFunc
+
+	// logger logs the operations, if not nil.
+	logger *slog.Logger
+
+	// replica serves the reads of the state while it isn't locked nor
+	// written by this process, if read_conn_str is set.
+	replica *readReplica
+
+	metrics *metrics
+
+	// slowQueryThreshold is the duration beyond which the operations are
+	// logged as slow, they never are if zero.
+	slowQueryThreshold time.Duration
+
+	// timeouts are the default timeouts of the operations.
+	timeouts operationTimeouts
+
+	// operations tracks the operations in flight, shared with the backend.
+	operations *operationTracker
+
+	// ctx is the parent context of the spans of the operations made through
+	// the remote.Client methods, as they don't take a context.
+	ctx context.Context
 
 	info *statemgr.LockInfo
 }
 
-func (c *RemoteClient) Get() (*remote.Payload, error) {
-	query := `SELECT data FROM %s.%s WHERE name = $1`
-	row := c.Client.QueryRow(fmt.Sprintf(query, c.SchemaName, statesTableName), c.Name)
-	var data []byte
-	err := row.Scan(&data)
+// Get returns the state of the workspace, or nil if it has none, which is
+// how remote.State tells a new workspace, so a missing workspace is not an
+// error here; StateMetadata returns an error wrapping ErrWorkspaceNotFound
+// for it instead. The other failures are the errors of the driver.
+func (c *RemoteClient) Get() (payload *remote.Payload, err error) {
+	ctx, op := c.startOperation(c.context(), "get")
+	defer op.end(&err)
+
+	data, err := c.readState(ctx)
 	switch {
 	case err == sql.ErrNoRows:
 		// No existing state returns empty.
 		return nil, nil
 	case err != nil:
 		return nil, err
-	default:
-		md5 := md5.Sum(data)
-		return &remote.Payload{
-			Data: data,
-			MD5:  md5[:],
-		}, nil
 	}
+	op.setStateSize(len(data))
+	md5 := md5.Sum(data)
+	return &remote.Payload{
+		Data: data,
+		MD5:  md5[:],
+	}, nil
 }
 
-func (c *RemoteClient) Put(data []byte) error {
-	query := `INSERT INTO %s.%s (name, data) VALUES ($1, $2)
-		ON CONFLICT (name) DO UPDATE
-		SET data = $2 WHERE %s.name = $1`
-	_, err := c.Client.Exec(fmt.Sprintf(query, c.SchemaName, statesTableName, statesTableName), c.Name, data)
+// readState returns the state data of the workspace, decoded and verified
+// against its checksum, or sql.ErrNoRows if it has none.
+func (c *RemoteClient) readState(ctx context.Context) ([]byte, error) {
+	// The state read while it is locked is the one written over, it must
+	// be the latest.
+	db := c.Client
+	if c.info == nil {
+		db = c.replica.stateDB(db, c.Name)
+	}
+	data, checksum, err := c.queryState(ctx, db, c.SchemaName, c.hasChecksum, c.hasDataOid)
+	for _, table := range c.fallbackTables {
+		if err != sql.ErrNoRows {
+			break
+		}
+		data, checksum, err = c.queryState(ctx, db, table.schemaName, table.hasChecksum, table.hasDataOid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = c.decodeState(data)
+	if err != nil {
+		return nil, err
+	}
+	// The states written before the checksums were introduced have none,
+	// it is set the next time they are written.
+	if checksum.Valid {
+		if sum := stateChecksum(data); sum != checksum.String {
+			return nil, fmt.Errorf("%w for workspace %q: the checksum of the stored state is %s, expected %s", ErrStateIntegrity, c.Name, sum, checksum.String)
+		}
+	}
+	return data, nil
+}
+
+// queryState reads the stored state of the workspace, and its checksum if
+// hasChecksum is set, from the table of the given schema. If hasDataOid is
+// set, the state stored in a large object is read by the same statement, so
+// it is the one of the row.
+func (c *RemoteClient) queryState(ctx context.Context, db *sql.DB, schemaName string, hasChecksum, hasDataOid bool) (data []byte, checksum sql.NullString, err error) {
+	var large []byte
+	columns := []string{c.dataCol()}
+	dest := []interface{}{&data}
+	if hasDataOid {
+		columns = append(columns, "lo_get(data_oid)")
+		dest = append(dest, &large)
+	}
+	if hasChecksum {
+		columns = append(columns, "checksum")
+		dest = append(dest, &checksum)
+	}
+	// The fallback tables are never soft-deleted from.
+	query := `SELECT %s FROM %s.%s WHERE %s = $1%s`
+	deleted := notDeleted(c.hasDeletedAt && schemaName == c.SchemaName)
+	err = retry(ctx, c.maxRetries, func() error {
+		row := c.stmts.queryRowContext(ctx, db, fmt.Sprintf(query, strings.Join(columns, ", "), schemaName, c.TableName, c.nameCol(), deleted), c.Name)
+		return row.Scan(dest...)
+	})
+	if large != nil {
+		data = large
+	}
+	return data, checksum, err
+}
+
+func (c *RemoteClient) Put(data []byte) (err error) {
+	ctx, op := c.startOperation(c.context(), "put")
+	defer op.end(&err)
+	if c.readOnly {
+		return fmt.Errorf("can't write state %q: %w", c.Name, ErrReadOnly)
+	}
+	op.setStateSize(len(data))
+	c.metrics.observeStateSize(len(data))
+
+	stored, err := c.encodeState(data)
+	if err != nil {
+		return err
+	}
+	// The token is the same for all the attempts of the write, so an
+	// attempt that failed after being committed isn't applied again.
+	var token string
+	if c.hasWriteToken {
+		if token, err = uuid.GenerateUUID(); err != nil {
+			return err
+		}
+	}
+	c.replica.wroteStates(c.Name)
+	var affected int64
+	err = retryWrite(ctx, c.maxRetries, c.isolation, func() error {
+		var err error
+		affected, err = c.put(ctx, data, stored, token)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	op.setRows(affected)
+	c.persisted(c.context(), stateSerial(data))
 	return nil
 }
 
-func (c *RemoteClient) Delete(ctx context.Context) error {
-	query := `DELETE FROM %s.%s WHERE name = $1`
-	_, err := c.Client.ExecContext(ctx, fmt.Sprintf(query, c.SchemaName, statesTableName), c.Name)
+// encodeState returns the representation of the state data stored in the
+// database, encrypted if aead is set, checking it is within the size limit.
+func (c *RemoteClient) encodeState(data []byte) ([]byte, error) {
+	// The encrypted states are base64-encoded whatever the type of the
+	// column, which spares encoding the compressed states twice.
+	stored, err := encodeState(data, c.compress, c.bytea || c.aead != nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.aead != nil {
+		if stored, err = sealState(c.aead, stored); err != nil {
+			return nil, err
+		}
+	}
+	if c.maxStateBytes > 0 && len(stored) > c.maxStateBytes {
+		return nil, fmt.Errorf("the state of workspace %q is %d bytes, which exceeds the limit of %d bytes set by max_state_bytes", c.Name, len(stored), c.maxStateBytes)
+	}
+	return stored, nil
+}
+
+// decodeState returns the state data stored as stored by encodeState.
+func (c *RemoteClient) decodeState(stored []byte) ([]byte, error) {
+	data, err := openState(c.aead, stored)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(data)
+}
+
+// decodeStateReader is decodeState for a stored state read from r.
+func (c *RemoteClient) decodeStateReader(r *bufio.Reader) (io.Reader, error) {
+	r, err := openStateReader(c.aead, r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStateReader(r)
+}
+
+// put writes stored, the encoded representation of the state data, and
+// returns the number of rows affected. The write is recorded with token,
+// unless empty, and skipped if an earlier attempt with the same token has
+// been applied.
+func (c *RemoteClient) put(ctx context.Context, data, stored []byte, token string) (int64, error) {
+	columns, args := c.stateRow(data, stored, false)
+	if token != "" {
+		columns = append(columns, "write_token")
+		args = append(args, token)
+	}
+	var set []string
+	for _, column := range columns[1:] {
+		set = append(set, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+	}
+	if c.hasTimestamps {
+		set = append(set, "updated_at = now()")
+	}
+	where := fmt.Sprintf("%s.%s = $1", c.TableName, c.nameCol())
+	if c.hasSerial {
+		// Someone else wrote a newer state since it was read, unless the
+		// same state is written again, e.g. when retrying.
+		where += fmt.Sprintf(` AND (%[1]s.serial IS NULL OR EXCLUDED.serial IS NULL
+			OR %[1]s.serial < EXCLUDED.serial OR %[1]s.%[2]s = EXCLUDED.%[2]s`, c.TableName, c.dataCol())
+		if c.largeObjects && c.hasChecksum {
+			// The states stored in large objects have no data to compare.
+			where += fmt.Sprintf(` OR %s.checksum = EXCLUDED.checksum`, c.TableName)
+		}
+		if c.hasLineage && (c.allowLineageChange || c.replacesLineage) {
+			// The serials of different lineages don't compare.
+			where += fmt.Sprintf(` OR %s.lineage <> EXCLUDED.lineage`, c.TableName)
+		}
+		where += ")"
+	}
+	if c.hasDeletedAt {
+		where += fmt.Sprintf(` AND %s.deleted_at IS NULL`, c.TableName)
+	}
+	query := fmt.Sprintf(`INSERT INTO %s.%s (%s) VALUES (%s)
+		ON CONFLICT (%s) DO UPDATE
+		SET %s WHERE %s`, c.SchemaName, c.TableName, strings.Join(columns, ", "), placeholders(len(columns)), c.nameCol(), strings.Join(set, ", "), where)
+	stmt := c.stmts.prepared(ctx, c.Client, query)
+
+	// The history is updated in the same transaction as the state, so it
+	// always ends with the current state.
+	tx, err := c.Client.BeginTx(ctx, &sql.TxOptions{Isolation: c.isolation})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if token != "" {
+		// An earlier attempt of this write has been committed, but its
+		// outcome was lost.
+		applied, err := c.writeApplied(ctx, tx, token)
+		if err != nil || applied {
+			return 1, err
+		}
+	}
+
+	if c.hasLineage && !c.replacesLineage {
+		if err := c.checkLineage(ctx, tx, stateLineage(data)); err != nil {
+			return 0, err
+		}
+	}
+	if c.hasStateVersion {
+		if err := c.checkStateVersion(ctx, tx, data); err != nil {
+			return 0, err
+		}
+	}
+
+	// The large object of the state written over is unlinked once it is no
+	// longer referenced.
+	previous, err := c.previousLargeObject(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.storeLargeObject(ctx, tx, args); err != nil {
+		return 0, err
+	}
+
+	res, err := txExecContext(ctx, tx, stmt, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		if err := c.checkNotDeleted(ctx, tx); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%w: a state with a serial of %d or more has been written for workspace %q since it was read", ErrStateConflict, stateSerial(data), c.Name)
+	}
+	if err := unlinkLargeObject(ctx, tx, previous); err != nil {
+		return 0, err
+	}
+	if c.historyLimit > 0 {
+		if err := c.putHistory(tx, stateSerial(data), stored); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.notify(tx); err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// checkLineage returns an error wrapping ErrLineageMismatch if the stored
+// state of the workspace is of another lineage than the given one, unless
+// allowLineageChange is set, in which case it is only logged. The states
+// whose lineage is unknown, written before the lineage column was added or
+// unreadable, match any lineage.
+func (c *RemoteClient) checkLineage(ctx context.Context, tx *sql.Tx, lineage string) error {
+	if lineage == "" {
+		return nil
+	}
+	var stored sql.NullString
+	query := `SELECT lineage FROM %s.%s WHERE %s = $1%s`
+	err := tx.QueryRowContext(ctx, fmt.Sprintf(query, c.SchemaName, c.TableName, c.nameCol(), notDeleted(c.hasDeletedAt)), c.Name).Scan(&stored)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	case !stored.Valid || stored.String == lineage:
+		return nil
+	}
+	if c.allowLineageChange {
+		log.Printf("[WARN] pg: writing a state of lineage %s over the state of lineage %s of workspace %q, as allow_lineage_change is set", lineage, stored.String, c.Name)
+		return nil
+	}
+	return fmt.Errorf("%w: workspace %q holds a state of lineage %s, the state written is of lineage %s; the workspace may be used by mistake by another configuration, set allow_lineage_change to write it anyway",
+		ErrLineageMismatch, c.Name, stored.String, lineage)
+}
+
+// writeApplied reports whether the write of the given token is the last one
+// applied to the state of the workspace.
+func (c *RemoteClient) writeApplied(ctx context.Context, tx *sql.Tx, token string) (bool, error) {
+	var applied bool
+	query := `SELECT EXISTS(SELECT 1 FROM %s.%s WHERE %s = $1 AND write_token = $2)`
+	err := tx.QueryRowContext(ctx, fmt.Sprintf(query, c.SchemaName, c.TableName, c.nameCol()), c.Name, token).Scan(&applied)
+	return applied, err
+}
+
+// stateRow returns the columns and arguments of a statement inserting the
+// state data of the workspace, stored as stored. The lineage and versions of
+// the empty state of a new workspace, if empty is set, are recorded as
+// unknown. The name of the workspace always comes first.
+func (c *RemoteClient) stateRow(data, stored []byte, empty bool) (columns []string, args []interface{}) {
+	columns = []string{c.nameCol(), c.dataCol()}
+	args = []interface{}{c.Name, stored}
+	if c.hasChecksum {
+		columns = append(columns, "checksum")
+		args = append(args, stateChecksum(data))
+	}
+	if c.hasSerial {
+		// The states whose serial cannot be read are written without.
+		serial := sql.NullInt64{Int64: int64(stateSerial(data))}
+		serial.Valid = serial.Int64 > 0
+		columns = append(columns, "serial")
+		args = append(args, serial)
+	}
+	if c.hasLineage {
+		var lineage string
+		if !empty {
+			lineage = stateLineage(data)
+		}
+		columns = append(columns, "lineage")
+		args = append(args, sql.NullString{String: lineage, Valid: lineage != ""})
+	}
+	if c.hasStateVersion {
+		// The versions that cannot be read are written as unknown.
+		var format int
+		var tofu string
+		if !empty {
+			format, tofu = stateVersions(data)
+		}
+		columns = append(columns, "state_version", "terraform_version")
+		args = append(args, sql.NullInt64{Int64: int64(format), Valid: format > 0}, sql.NullString{String: tofu, Valid: tofu != ""})
+	}
+	if c.hasWriter {
+		columns = append(columns, "writer_version", "writer_host")
+		args = append(args, version.String(), writerHost())
+	}
+	if c.hasDataOid {
+		// Set by storeLargeObject, the inline states have no large object.
+		columns = append(columns, "data_oid")
+		args = append(args, nil)
+	}
+	return columns, args
+}
+
+// writerHost returns the name of the host writing the states, NULL if it
+// cannot be determined.
+func writerHost() sql.NullString {
+	host, err := os.Hostname()
+	return sql.NullString{String: host, Valid: err == nil && host != ""}
+}
+
+// placeholders returns the placeholders of n arguments, "$1, $2, ..., $n".
+func placeholders(n int) string {
+	values := make([]string, n)
+	for i := range values {
+		values[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return strings.Join(values, ", ")
+}
+
+// create stores data as the state of the workspace, unless it already
+// exists. It reports whether the state has been stored.
+func (c *RemoteClient) create(ctx context.Context, data []byte) (bool, error) {
+	return c.createState(ctx, data, false)
+}
+
+// createEmpty creates the workspace with an empty state, unless it already
+// exists. The lineage and versions of the empty state aren't recorded, so
+// the first state written to the workspace, e.g. migrated from another
+// backend or by an older OpenTofu, decides them.
+func (c *RemoteClient) createEmpty(ctx context.Context) (bool, error) {
+	data, err := emptyStateFile()
+	if err != nil {
+		return false, err
+	}
+	return c.createState(ctx, data, true)
+}
+
+// createState is create, recording the lineage and versions of data unless
+// empty is set, as for createEmpty.
+func (c *RemoteClient) createState(ctx context.Context, data []byte, empty bool) (created bool, err error) {
+	ctx, op := c.startOperation(ctx, "create")
+	defer op.end(&err)
+	if c.readOnly {
+		return false, fmt.Errorf("can't create state %q: %w", c.Name, ErrReadOnly)
+	}
+	op.setStateSize(len(data))
+
+	stored, err := c.encodeState(data)
+	if err != nil {
+		return false, err
+	}
+
+	c.replica.wroteStates(c.Name)
+	c.replica.changedWorkspaces()
+
+	query := `INSERT INTO %s.%s (%s) VALUES (%s) ON CONFLICT (%s) DO NOTHING`
+	err = retryWrite(ctx, c.maxRetries, c.isolation, func() error {
+		tx, err := c.Client.BeginTx(ctx, &sql.TxOptions{Isolation: c.isolation})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		columns, args := c.stateRow(data, stored, empty)
+		if err := c.storeLargeObject(ctx, tx, args); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(query, c.SchemaName, c.TableName, strings.Join(columns, ", "), placeholders(len(columns)), c.nameCol()), args...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		created = n > 0
+		if !created {
+			// Nothing has been written but the large object of the state,
+			// which is discarded by rolling back.
+			return c.checkNotDeleted(ctx, tx)
+		}
+		if c.historyLimit > 0 {
+			if err := c.putHistory(tx, stateSerial(data), stored); err != nil {
+				return err
+			}
+		}
+		if err := c.notify(tx); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	return created && err == nil, err
+}
+
+// putHistory records stored, the encoded state of the given serial, as the
+// latest version of the state in the history table, and prunes the versions
+// beyond the history limit.
+func (c *RemoteClient) putHistory(tx *sql.Tx, serial uint64, stored []byte) error {
+	query := `INSERT INTO %s.%s (name, serial, data) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(fmt.Sprintf(query, c.SchemaName, c.historyTableName), c.Name, serial, stored); err != nil {
+		return err
+	}
+
+	query = `DELETE FROM %s.%s WHERE name = $1 AND id NOT IN (
+		SELECT id FROM %s.%s WHERE name = $1 ORDER BY id DESC LIMIT $2
+		)`
+	if _, err := tx.Exec(fmt.Sprintf(query, c.SchemaName, c.historyTableName, c.SchemaName, c.historyTableName), c.Name, c.historyLimit); err != nil {
+		return err
+	}
+	return nil
+}
+
+// notify signals the listeners of the notification channel, if any, that
+// the state of the workspace changed. The notification is only sent once tx
+// is committed.
+func (c *RemoteClient) notify(tx *sql.Tx) error {
+	if c.notifyChannel == "" {
+		return nil
+	}
+	_, err := tx.Exec(`SELECT pg_notify($1, $2)`, c.notifyChannel, c.Name)
+	return err
+}
+
+// stateSerial returns the serial of the given state file, or 0 if it cannot
+// be read.
+func stateSerial(data []byte) uint64 {
+	var state struct {
+		Serial uint64 `json:"serial"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0
+	}
+	return state.Serial
+}
+
+// stateLineage returns the lineage of the given state data, empty if it
+// cannot be read.
+func stateLineage(data []byte) string {
+	var state struct {
+		Lineage string `json:"lineage"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return ""
+	}
+	return state.Lineage
+}
+
+func (c *RemoteClient) Delete(ctx context.Context) (err error) {
+	ctx, op := c.startOperation(ctx, "delete")
+	defer op.end(&err)
+	if c.readOnly {
+		return fmt.Errorf("can't delete state %q: %w", c.Name, ErrReadOnly)
+	}
+	c.replica.wroteStates(c.Name)
+	c.replica.changedWorkspaces()
+
+	query := fmt.Sprintf(`DELETE FROM %s.%s WHERE %s = $1`, c.SchemaName, c.TableName, c.nameCol())
+	if c.hasDataOid || c.historyTableName != "" {
+		returning := c.nameCol()
+		if c.hasDataOid {
+			returning += ", data_oid"
+		}
+		ctes := []string{fmt.Sprintf(`deleted AS (%s RETURNING %s)`, query, returning)}
+		if c.historyTableName != "" {
+			ctes = append(ctes, deleteHistoryCTE(c.SchemaName, c.historyTableName, fmt.Sprintf(`SELECT %s FROM deleted`, c.nameCol())))
+		}
+		query = fmt.Sprintf(`WITH %s %s`, strings.Join(ctes, ", "), unlinkDeleted("deleted", c.nameCol(), c.hasDataOid))
+	}
+	_, err = c.Client.ExecContext(ctx, query, c.Name)
 	if err != nil {
 		return err
 	}
@@ -65,7 +744,18 @@ func (c *RemoteClient) Delete(ctx context.Context) error {
 }
 
 func (c *RemoteClient) Lock(info *statemgr.LockInfo) (string, error) {
-	var err error
+	return c.LockContext(c.context(), info)
+}
+
+// LockContext is Lock, giving up waiting for the lock as soon as ctx is
+// done.
+func (c *RemoteClient) LockContext(ctx context.Context, info *statemgr.LockInfo) (_ string, err error) {
+	ctx, op := c.startOperation(ctx, "lock")
+	defer op.end(&err)
+	if c.readOnly {
+		return "", &statemgr.LockError{Info: info, Err: fmt.Errorf("can't lock state %q: %w", c.Name, ErrReadOnly)}
+	}
+
 	var lockID string
 
 	if info.ID == "" {
@@ -76,68 +766,323 @@ func (c *RemoteClient) Lock(info *statemgr.LockInfo) (string, error) {
 		info.ID = lockID
 	}
 
-	// Local helper function so we can call it multiple places
-	//
-	lockUnlock := func(pgLockId string) error {
-		query := `SELECT pg_advisory_unlock(%s)`
-		row := c.Client.QueryRow(fmt.Sprintf(query, pgLockId))
-		var didUnlock []byte
-		err := row.Scan(&didUnlock)
-		if err != nil {
-			return &statemgr.LockError{Info: info, Err: err}
+	// Retry while the lock is held by someone else, until the lock timeout
+	// expires. Without a timeout a single attempt is made.
+	deadline := time.Now().Add(c.lockTimeout)
+	for attempt := 0; ; attempt++ {
+		var conflict bool
+		err := retry(ctx, c.maxRetries, func() error {
+			var err error
+			conflict, err = c.tryLock(ctx, info)
+			return err
+		})
+		if err == nil {
+			break
+		}
+		remaining := time.Until(deadline)
+		if !conflict {
+			return "", &statemgr.LockError{Info: info, Err: err}
+		}
+		if remaining <= 0 {
+			if c.lockTimeout > 0 {
+				err = fmt.Errorf("timed out after %s waiting for the lock: %w", c.lockTimeout, err)
+			}
+			// Report who holds the lock when it is known.
+			holder, infoErr := c.readLockInfo(ctx)
+			if infoErr != nil || holder == nil {
+				holder = info
+			}
+			return "", &statemgr.LockError{Info: holder, Err: err}
+		}
+		timer := time.NewTimer(min(lockRetryDelay(attempt), remaining))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", &statemgr.LockError{Info: info, Err: ctx.Err()}
+		case <-timer.C:
 		}
-		return nil
 	}
 
+	if !c.tableLocks {
+		if err := c.writeLockInfo(ctx, info); err != nil {
+			c.releaseAdvisory(context.WithoutCancel(ctx), info.Path)
+			return "", &statemgr.LockError{Info: info, Err: err}
+		}
+	} else if c.lockTTL > 0 {
+		c.startHeartbeat(context.WithoutCancel(ctx), info.ID)
+	}
+	c.info = info
+
+	return info.ID, nil
+}
+
+const (
+	// lockRetryMinInterval is the time waited after the first attempt to
+	// take a lock held by someone else, doubled after each of the following
+	// ones up to lockRetryMaxInterval.
+	lockRetryMinInterval = 100 * time.Millisecond
+	lockRetryMaxInterval = 2 * time.Second
+)
+
+// lockRetryDelay returns the time to wait after the given failed attempt to
+// take a lock held by someone else, counted from 0. The delay grows
+// exponentially, and half of it is random so the runs waiting for the same
+// lock spread out their attempts instead of retrying in lockstep.
+func lockRetryDelay(attempt int) time.Duration {
+	delay := lockRetryMaxInterval
+	if attempt < 5 {
+		delay = min(lockRetryMinInterval<<attempt, lockRetryMaxInterval)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// tryLock makes a single attempt to lock the workspace. When the lock is held
+// by someone else, the returned conflict is true.
+func (c *RemoteClient) tryLock(ctx context.Context, info *statemgr.LockInfo) (conflict bool, err error) {
+	if c.tableLocks {
+		return c.tryTableLock(ctx, info)
+	}
+	if c.lockConn != nil {
+		return false, fmt.Errorf("Workspace is already locked by this client: %s", c.Name)
+	}
+
+	// The locks are taken by the session of conn, which is kept until they
+	// are released, and given back to the pool right away if none is taken.
+	lockDB := c.lockDB
+	if lockDB == nil {
+		lockDB = c.Client
+	}
+	conn, err := lockDB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		} else {
+			c.lockConn = conn
+		}
+	}()
+
 	// Try to acquire locks for the existing row `id` and the creation lock `-1`.
-	query := `SELECT %s.id, pg_try_advisory_lock(%s.id), pg_try_advisory_lock(-1) FROM %s.%s WHERE %s.name = $1`
-	row := c.Client.QueryRow(fmt.Sprintf(query, statesTableName, statesTableName, c.SchemaName, statesTableName, statesTableName), c.Name)
+	query := `SELECT %s.id, pg_try_advisory_lock(%s.id), pg_try_advisory_lock(-1) FROM %s.%s WHERE %s.%s = $1`
+	row := conn.QueryRowContext(ctx, fmt.Sprintf(query, c.TableName, c.TableName, c.SchemaName, c.TableName, c.TableName, c.nameCol()), c.Name)
 	var pgLockId, didLock, didLockForCreate []byte
 	err = row.Scan(&pgLockId, &didLock, &didLockForCreate)
 	switch {
 	case err == sql.ErrNoRows:
 		// No rows means we're creating the workspace. Take the creation lock.
-		innerRow := c.Client.QueryRow(`SELECT pg_try_advisory_lock(-1)`)
+		innerRow := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(-1)`)
 		var innerDidLock []byte
 		err := innerRow.Scan(&innerDidLock)
 		if err != nil {
-			return "", &statemgr.LockError{Info: info, Err: err}
+			return false, err
 		}
 		if string(innerDidLock) == "false" {
-			return "", &statemgr.LockError{Info: info, Err: fmt.Errorf("Already locked for workspace creation: %s", c.Name)}
+			return true, fmt.Errorf("Already locked for workspace creation: %s", c.Name)
 		}
 		info.Path = "-1"
 	case err != nil:
-		return "", &statemgr.LockError{Info: info, Err: err}
+		return false, err
 	case string(didLock) == "false":
 		// Existing workspace is already locked. Release the attempted creation lock.
-		lockUnlock("-1")
-		return "", &statemgr.LockError{Info: info, Err: fmt.Errorf("Workspace is already locked: %s", c.Name)}
+		c.unlockAdvisory(ctx, conn, "-1")
+		return true, fmt.Errorf("Workspace is already locked: %s", c.Name)
 	case string(didLockForCreate) == "false":
 		// Someone has the creation lock already. Release the existing workspace because it might not be safe to touch.
-		lockUnlock(string(pgLockId))
-		return "", &statemgr.LockError{Info: info, Err: fmt.Errorf("Cannot lock workspace; already locked for workspace creation: %s", c.Name)}
+		c.unlockAdvisory(ctx, conn, string(pgLockId))
+		return true, fmt.Errorf("Cannot lock workspace; already locked for workspace creation: %s", c.Name)
 	default:
 		// Existing workspace is now locked. Release the attempted creation lock.
-		lockUnlock("-1")
+		c.unlockAdvisory(ctx, conn, "-1")
 		info.Path = string(pgLockId)
 	}
-	c.info = info
 
-	return info.ID, nil
+	return false, nil
+}
+
+// tryTableLock is tryLock with the locks of the lock table: the workspace is
+// locked by inserting its row.
+//
+// With a lock TTL, the row of an expired lock is taken over. The expiry is
+// checked by the statement replacing the row, so only one of the clients
+// trying to take the lock over at the same time succeeds.
+func (c *RemoteClient) tryTableLock(ctx context.Context, info *statemgr.LockInfo) (conflict bool, err error) {
+	query := `INSERT INTO %[1]s.%[2]s (name, info) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING`
+	args := []interface{}{c.Name, string(info.Marshal())}
+	if c.lockTTL > 0 {
+		query = `INSERT INTO %[1]s.%[2]s (name, info, expires_at) VALUES ($1, $2, now() + $3 * interval '1 millisecond')
+			ON CONFLICT (name) DO UPDATE
+			SET info = EXCLUDED.info, created_at = now(), expires_at = EXCLUDED.expires_at
+			WHERE %[2]s.expires_at < now()`
+		args = append(args, c.lockTTL.Milliseconds())
+	}
+	res, err := c.Client.ExecContext(ctx, fmt.Sprintf(query, c.SchemaName, c.lockTableName), args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return true, fmt.Errorf("Workspace is already locked: %s", c.Name)
+	}
+	return false, nil
+}
+
+// unlockTable releases the lock of the lock table with the given ID. Unlike
+// the advisory locks, it can be released by another client, which is how
+// force-unlock releases the locks left behind.
+func (c *RemoteClient) unlockTable(ctx context.Context, id string) error {
+	query := `DELETE FROM %s.%s WHERE name = $1 AND info::jsonb->>'ID' = $2`
+	res, err := c.Client.ExecContext(ctx, fmt.Sprintf(query, c.SchemaName, c.lockTableName), c.Name, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("lock %s is not held on workspace %s", id, c.Name)
+	}
+	return nil
+}
+
+// startOperation starts a client operation on the workspace.
+func (c *RemoteClient) startOperation(ctx context.Context, name string) (context.Context, *operation) {
+	return startOperation(ctx, c.operations, c.logger, c.metrics, c.slowQueryThreshold, c.timeouts, name, tableAttrs(c.SchemaName, c.TableName, c.Name)...)
+}
+
+// context returns the context of the operations of the remote.Client
+// interface, which have no way to be canceled. It only carries the spans of
+// the parent context.
+func (c *RemoteClient) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return context.WithoutCancel(c.ctx)
 }
 
 func (c *RemoteClient) getLockInfo() (*statemgr.LockInfo, error) {
 	return c.info, nil
 }
 
+// writeLockInfo records the information of the lock just taken, so the
+// other clients can tell who holds it.
+func (c *RemoteClient) writeLockInfo(ctx context.Context, info *statemgr.LockInfo) error {
+	if c.lockTableName == "" {
+		return nil
+	}
+
+	query := `INSERT INTO %s.%s (name, info) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE
+		SET info = $2, created_at = now()`
+	_, err := c.Client.ExecContext(ctx, fmt.Sprintf(query, c.SchemaName, c.lockTableName), c.Name, string(info.Marshal()))
+	return err
+}
+
+// readLockInfo returns the information recorded by the current holder of the
+// lock, or nil if there is none. With a lock TTL, an expired lock is none.
+func (c *RemoteClient) readLockInfo(ctx context.Context) (*statemgr.LockInfo, error) {
+	if c.lockTableName == "" {
+		return nil, nil
+	}
+
+	var data []byte
+	query := `SELECT info FROM %s.%s WHERE name = $1`
+	if c.lockTTL > 0 {
+		query += ` AND (expires_at IS NULL OR expires_at >= now())`
+	}
+	err := c.Client.QueryRowContext(ctx, fmt.Sprintf(query, c.SchemaName, c.lockTableName), c.Name).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	info := &statemgr.LockInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// deleteLockInfo removes the information of the lock about to be released.
+func (c *RemoteClient) deleteLockInfo(ctx context.Context) error {
+	if c.lockTableName == "" {
+		return nil
+	}
+
+	query := `DELETE FROM %s.%s WHERE name = $1`
+	_, err := c.Client.ExecContext(ctx, fmt.Sprintf(query, c.SchemaName, c.lockTableName), c.Name)
+	return err
+}
+
+// unlockAdvisory releases the given advisory lock of the session of conn.
+func (c *RemoteClient) unlockAdvisory(ctx context.Context, conn *sql.Conn, pgLockId string) error {
+	query := `SELECT pg_advisory_unlock(%s)`
+	row := conn.QueryRowContext(ctx, fmt.Sprintf(query, pgLockId))
+	var didUnlock []byte
+	return row.Scan(&didUnlock)
+}
+
+// releaseAdvisory releases the given advisory lock held by the client, then
+// gives the connection of its session back to the pool. If the lock cannot
+// be released, the connection is closed instead, which ends the session and
+// drops the lock, rather than leaving the lock to the next user of the
+// connection.
+func (c *RemoteClient) releaseAdvisory(ctx context.Context, pgLockId string) error {
+	conn := c.lockConn
+	if conn == nil {
+		return nil
+	}
+	c.lockConn = nil
+
+	err := c.unlockAdvisory(ctx, conn, pgLockId)
+	if err != nil {
+		conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	conn.Close()
+	return err
+}
+
 func (c *RemoteClient) Unlock(id string) error {
+	return c.UnlockContext(c.context(), id)
+}
+
+// UnlockContext is Unlock, with the statements releasing the lock canceled
+// when ctx is done.
+func (c *RemoteClient) UnlockContext(ctx context.Context, id string) (err error) {
+	ctx, op := c.startOperation(ctx, "unlock")
+	defer op.end(&err)
+	if c.readOnly {
+		return &statemgr.LockError{Info: &statemgr.LockInfo{ID: id}, Err: fmt.Errorf("can't unlock state %q: %w", c.Name, ErrReadOnly)}
+	}
+
+	if c.tableLocks {
+		if c.stopHeartbeat != nil {
+			c.stopHeartbeat()
+			c.stopHeartbeat = nil
+		}
+		if err := c.unlockTable(ctx, id); err != nil {
+			info := c.info
+			if info == nil {
+				info = &statemgr.LockInfo{ID: id}
+			}
+			return &statemgr.LockError{Info: info, Err: err}
+		}
+		c.info = nil
+		return nil
+	}
+
 	if c.info != nil && c.info.Path != "" {
-		query := `SELECT pg_advisory_unlock(%s)`
-		row := c.Client.QueryRow(fmt.Sprintf(query, c.info.Path))
-		var didUnlock []byte
-		err := row.Scan(&didUnlock)
-		if err != nil {
+		if err := c.deleteLockInfo(ctx); err != nil {
+			return &statemgr.LockError{Info: c.info, Err: err}
+		}
+		if err := c.releaseAdvisory(ctx, c.info.Path); err != nil {
 			return &statemgr.LockError{Info: c.info, Err: err}
 		}
 		c.info = nil
@@ -7,13 +7,30 @@ package pg
 // TF_ACC=1 GO111MODULE=on go test -v -mod=vendor -timeout=2m -parallel=4 github.com/opentofu/opentofu/backend/remote-state/pg
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/opentofu/opentofu/internal/addrs"
 	"github.com/opentofu/opentofu/internal/backend"
+	"github.com/opentofu/opentofu/internal/states"
 	"github.com/opentofu/opentofu/internal/states/remote"
+	"github.com/opentofu/opentofu/internal/states/statefile"
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+	"github.com/zclconf/go-cty/cty"
 )
 
 func TestRemoteClient_impl(t *testing.T) {
@@ -82,3 +99,1568 @@ func TestRemoteLocks(t *testing.T) {
 
 	remote.TestRemoteLocks(t, s1.(*remote.State).Client, s2.(*remote.State).Client)
 }
+
+func TestStateSerial(t *testing.T) {
+	testCases := map[string]uint64{
+		`{"version": 4, "serial": 42, "lineage": "foo"}`: 42,
+		`{"version": 4}`: 0,
+		``:               0,
+		`not a state`:    0,
+	}
+	for data, want := range testCases {
+		if got := stateSerial([]byte(data)); got != want {
+			t.Errorf("stateSerial(%q) = %d; want %d", data, got, want)
+		}
+	}
+}
+
+func TestRemoteClientHistory(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":      connStr,
+		"schema_name":   schemaName,
+		"history_limit": 3,
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	ctx := context.Background()
+
+	client := b.remoteClient("foo")
+	serials := func() []uint64 {
+		t.Helper()
+		versions, err := b.StateHistory(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var serials []uint64
+		for i, v := range versions {
+			if v.WrittenAt.IsZero() {
+				t.Fatalf("version %d has no time", v.Serial)
+			}
+			if i > 0 && v.WrittenAt.Before(versions[i-1].WrittenAt) {
+				t.Fatalf("the versions are not ordered: %v", versions)
+			}
+			serials = append(serials, v.Serial)
+		}
+		return serials
+	}
+
+	for serial := 1; serial <= 5; serial++ {
+		data := fmt.Sprintf(`{"version": 4, "serial": %d, "lineage": "foo"}`, serial)
+		if err := client.Put([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The history is pruned once it holds more than 3 versions.
+		var want []uint64
+		for s := serial - 2; s <= serial; s++ {
+			if s > 0 {
+				want = append(want, uint64(s))
+			}
+		}
+		if got := serials(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("wrong history after writing serial %d\ngot:  %v\nwant: %v", serial, got, want)
+		}
+	}
+
+	// The current state is the latest version of the history.
+	payload, err := client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stateSerial(payload.Data); got != 5 {
+		t.Fatalf("wrong current serial %d; want 5", got)
+	}
+
+	// Other workspaces have their own history.
+	if err := b.remoteClient("bar").Put([]byte(`{"version": 4, "serial": 1, "lineage": "bar"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := serials(); !reflect.DeepEqual(got, []uint64{3, 4, 5}) {
+		t.Fatalf("wrong history: %v", got)
+	}
+
+	// The history is deleted along with the workspace, so a workspace
+	// created again under the same name doesn't inherit it.
+	if err := b.DeleteWorkspace(ctx, "foo", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := serials(); len(got) != 0 {
+		t.Fatalf("the history of the deleted workspace is kept: %v", got)
+	}
+	if err := client.Put([]byte(`{"version": 4, "serial": 1, "lineage": "foo-again"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := serials(); !reflect.DeepEqual(got, []uint64{1}) {
+		t.Fatalf("wrong history of the workspace created again: %v", got)
+	}
+}
+
+func TestRemoteClientCompress(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	newBackend := func(compress bool) *Backend {
+		config := backend.TestWrapConfig(map[string]interface{}{
+			"conn_str":      connStr,
+			"schema_name":   schemaName,
+			"compress":      compress,
+			"history_limit": 2,
+		})
+		return backend.TestBackendConfig(t, New(), config).(*Backend)
+	}
+	storedData := func(table string) string {
+		t.Helper()
+		var data string
+		query := fmt.Sprintf(`SELECT data FROM %s.%s WHERE name = 'foo' ORDER BY id DESC LIMIT 1`, schemaName, table)
+		if err := dbCleaner.QueryRow(query).Scan(&data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// A state written before enabling compression
+	uncompressed := testStateFile(2)
+	if err := newBackend(false).remoteClient("foo").Put(uncompressed); err != nil {
+		t.Fatal(err)
+	}
+	if data := storedData("states"); data != string(uncompressed) {
+		t.Fatalf("the state is not stored as is: %.40q", data)
+	}
+
+	client := newBackend(true).remoteClient("foo")
+	payload, err := client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload.Data, uncompressed) {
+		t.Fatalf("wrong uncompressed state: %.40q", payload.Data)
+	}
+
+	// The new states are compressed, as their version in the history
+	compressed := bytes.Replace(uncompressed, []byte(`"serial": 1`), []byte(`"serial": 2`), 1)
+	if err := client.Put(compressed); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"states", "states_history"} {
+		if data := storedData(table); !strings.HasPrefix(data, gzipPrefix) || len(data) >= len(compressed) {
+			t.Fatalf("the state is not compressed in %s: %.40q", table, data)
+		}
+	}
+
+	// Reading doesn't depend on the option
+	for _, compress := range []bool{true, false} {
+		payload, err := newBackend(compress).remoteClient("foo").Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload.Data, compressed) {
+			t.Fatalf("wrong compressed state with compress=%t: %.40q", compress, payload.Data)
+		}
+	}
+	versions, err := newBackend(false).StateHistory(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].Serial != 2 {
+		t.Fatalf("wrong history: %v", versions)
+	}
+}
+
+func TestRemoteClientCompressedPayload(t *testing.T) {
+	var stored []byte
+	db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT data"):
+			return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{stored}}}, nil
+		case strings.HasPrefix(query, "INSERT"):
+			stored = args[1].Value.([]byte)
+			return &fakeRows{affected: 1}, nil
+		default:
+			return &fakeRows{affected: 1}, nil
+		}
+	})
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, compress: true}
+
+	state := testStateFile(5)
+	if err := c.Put(state); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored, []byte(gzipPrefix)) {
+		t.Fatalf("the state is not compressed: %.40q", stored)
+	}
+
+	payload, err := c.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload.Data, state) {
+		t.Fatalf("wrong state: %.40q", payload.Data)
+	}
+	if md5 := md5.Sum(state); !bytes.Equal(payload.MD5, md5[:]) {
+		t.Fatal("the checksum is not the one of the decompressed state")
+	}
+
+	// A corrupted state is an error rather than a garbage state
+	stored = []byte(gzipPrefix + "e30K")
+	if _, err := c.Get(); err == nil || !strings.Contains(err.Error(), "failed to decompress the state") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRemoteClientStateColumnType(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, columnType := range []string{"text", "bytea"} {
+		for _, compress := range []bool{false, true} {
+			schemaName := fmt.Sprintf("terraform_%s_%s_%t", t.Name(), columnType, compress)
+			t.Run(fmt.Sprintf("%s/compress=%t", columnType, compress), func(t *testing.T) {
+				defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+				config := backend.TestWrapConfig(map[string]interface{}{
+					"conn_str":          connStr,
+					"schema_name":       schemaName,
+					"compress":          compress,
+					"history_limit":     2,
+					"state_column_type": columnType,
+				})
+				b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+				for _, table := range []string{"states", "states_history"} {
+					var dataType string
+					query := `SELECT data_type FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 AND column_name = 'data'`
+					if err := dbCleaner.QueryRow(query, schemaName, table).Scan(&dataType); err != nil {
+						t.Fatal(err)
+					}
+					if dataType != columnType {
+						t.Fatalf("the data column of %s is %s; want %s", table, dataType, columnType)
+					}
+				}
+
+				// The states are read back byte for byte
+				state := testStateFile(5)
+				client := b.remoteClient("foo")
+				if err := client.Put(state); err != nil {
+					t.Fatal(err)
+				}
+				payload, err := client.Get()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(payload.Data, state) {
+					t.Fatalf("wrong state: %.80q", payload.Data)
+				}
+				r, err := client.GetReader(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				streamed, err := io.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(streamed, state) {
+					t.Fatalf("wrong streamed state: %.80q", streamed)
+				}
+
+				// The type of the existing column is detected
+				detected := backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+					"conn_str":    connStr,
+					"schema_name": schemaName,
+				})).(*Backend)
+				if detected.bytea != (columnType == "bytea") {
+					t.Fatalf("the %s column is detected as bytea: %t", columnType, detected.bytea)
+				}
+				payload, err = detected.remoteClient("foo").Get()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(payload.Data, state) {
+					t.Fatalf("wrong state read with the detected column type: %.80q", payload.Data)
+				}
+
+				// Switching the type requires migrating the states
+				other := map[string]string{"text": "bytea", "bytea": "text"}[columnType]
+				b = New().(*Backend)
+				obj, diags := hcldec.Decode(backend.TestWrapConfig(map[string]interface{}{
+					"conn_str":          connStr,
+					"schema_name":       schemaName,
+					"state_column_type": other,
+				}), b.ConfigSchema(context.Background()).DecoderSpec(), nil)
+				if diags.HasErrors() {
+					t.Fatal(diags.Error())
+				}
+				obj, valDiags := b.PrepareConfig(context.Background(), obj)
+				if valDiags.HasErrors() {
+					t.Fatal(valDiags.ErrWithWarnings())
+				}
+				confDiags := b.Configure(context.Background(), obj)
+				if !confDiags.HasErrors() || !strings.Contains(confDiags.ErrWithWarnings().Error(), "ALTER COLUMN data TYPE "+other) {
+					t.Fatalf("unexpected error: %v", confDiags.ErrWithWarnings())
+				}
+			})
+		}
+	}
+}
+
+func TestRemoteClientChecksum(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":    connStr,
+		"schema_name": schemaName,
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	client := b.remoteClient("foo")
+
+	state := []byte(`{"version": 4, "serial": 1, "lineage": "foo"}`)
+	if err := client.Put(state); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload.Data, state) {
+		t.Fatalf("wrong state: %s", payload.Data)
+	}
+
+	// A state modified behind the back of the backend fails the check
+	query := fmt.Sprintf(`UPDATE %s.states SET data = $1 WHERE name = 'foo'`, schemaName)
+	if _, err := dbCleaner.Exec(query, `{"version": 4, "serial": 1, "lineage": "bar"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(); !errors.Is(err, ErrStateIntegrity) {
+		t.Fatalf("expected an integrity error, got: %v", err)
+	}
+
+	// The states written without checksum are read, and get one when they
+	// are written again
+	query = fmt.Sprintf(`UPDATE %s.states SET checksum = NULL WHERE name = 'foo'`, schemaName)
+	if _, err := dbCleaner.Exec(query); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(state); err != nil {
+		t.Fatal(err)
+	}
+	var checksum sql.NullString
+	query = fmt.Sprintf(`SELECT checksum FROM %s.states WHERE name = 'foo'`, schemaName)
+	if err := dbCleaner.QueryRow(query).Scan(&checksum); err != nil {
+		t.Fatal(err)
+	}
+	if checksum.String != stateChecksum(state) {
+		t.Fatalf("the checksum has not been backfilled: %v", checksum)
+	}
+}
+
+func TestRemoteClientChecksumVerification(t *testing.T) {
+	state := []byte(`{"version": 4, "serial": 1, "lineage": "foo"}`)
+
+	testCases := map[string]struct {
+		Data        string
+		Checksum    driver.Value
+		ExpectError bool
+	}{
+		"valid":     {Data: string(state), Checksum: stateChecksum(state)},
+		"legacy":    {Data: string(state), Checksum: nil},
+		"corrupted": {Data: `{"version": 4, "serial": 1, "lineage": "bar"}`, Checksum: stateChecksum(state), ExpectError: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, _ := newFakeDB(t, func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+				return &fakeRows{columns: []string{"data", "checksum"}, values: [][]driver.Value{{[]byte(tc.Data), tc.Checksum}}}, nil
+			})
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasChecksum: true}
+
+			_, err := c.Get()
+			if tc.ExpectError {
+				if !errors.Is(err, ErrStateIntegrity) || !strings.Contains(err.Error(), "state integrity check failed") {
+					t.Fatalf("expected an integrity error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("put", func(t *testing.T) {
+		var args []driver.NamedValue
+		db, _ := newFakeDB(t, func(query string, a []driver.NamedValue) (*fakeRows, error) {
+			if strings.HasPrefix(query, "INSERT") {
+				args = a
+			}
+			return &fakeRows{affected: 1}, nil
+		})
+		c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasChecksum: true, compress: true}
+		if err := c.Put(state); err != nil {
+			t.Fatal(err)
+		}
+		// The checksum is the one of the state, not of its compressed form
+		if len(args) != 3 || args[2].Value != stateChecksum(state) {
+			t.Fatalf("wrong arguments: %v", args)
+		}
+	})
+}
+
+func TestRemoteClientSerialConflict(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":    connStr,
+		"schema_name": schemaName,
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	ctx := context.Background()
+
+	// Two writers read the same state, without locking it
+	writers := make([]statemgr.Full, 2)
+	for i := range writers {
+		s, err := b.StateMgr(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RefreshState(); err != nil {
+			t.Fatal(err)
+		}
+		writers[i] = s
+	}
+
+	write := func(s statemgr.Full, value string) error {
+		state := s.State()
+		state.SyncWrapper().SetOutputValue(addrs.OutputValue{Name: "foo"}.Absolute(addrs.RootModuleInstance), cty.StringVal(value), false)
+		if err := s.WriteState(state); err != nil {
+			return err
+		}
+		return s.PersistState(nil)
+	}
+
+	if err := write(writers[0], "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(writers[1], "second"); !errors.Is(err, ErrStateConflict) {
+		t.Fatalf("expected a conflict error, got: %v", err)
+	}
+
+	// The first write is kept, and a writer seeing it can write over it
+	s, err := b.StateMgr(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RefreshState(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.State().RootModule().OutputValues["foo"].Value; got != cty.StringVal("first") {
+		t.Fatalf("wrong output value %#v", got)
+	}
+	if err := write(s, "third"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing the same state again, as a retry does, is not a conflict
+	data := []byte(`{"version": 4, "serial": 10, "lineage": "foo"}`)
+	client := b.remoteClient("bar")
+	for i := 0; i < 2; i++ {
+		if err := client.Put(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Put([]byte(`{"version": 4, "serial": 10, "lineage": "foo", "outputs": {}}`)); !errors.Is(err, ErrStateConflict) {
+		t.Fatalf("expected a conflict error, got: %v", err)
+	}
+}
+
+func TestRemoteClientPutConflict(t *testing.T) {
+	var upsert string
+	db, _ := newFakeDB(t, func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "INSERT") {
+			// The state in the table is newer
+			upsert = query
+			return &fakeRows{affected: 0}, nil
+		}
+		return &fakeRows{affected: 1}, nil
+	})
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasSerial: true, historyLimit: 1}
+
+	err := c.Put([]byte(`{"version": 4, "serial": 3, "lineage": "foo"}`))
+	if !errors.Is(err, ErrStateConflict) {
+		t.Fatalf("expected a conflict error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "serial of 3 or more") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(upsert, `"states".serial < EXCLUDED.serial`) {
+		t.Fatalf("the serial is not checked:\n%s", upsert)
+	}
+}
+
+func TestRemoteClientLineageMismatch(t *testing.T) {
+	testCases := map[string]struct {
+		Stored             interface{}
+		AllowLineageChange bool
+		ExpectError        bool
+		ExpectWarning      bool
+	}{
+		"same-lineage": {
+			Stored: "foo",
+		},
+		"other-lineage": {
+			Stored:      "bar",
+			ExpectError: true,
+		},
+		"unknown-lineage": {
+			// Written before the lineage column was added
+			Stored: nil,
+		},
+		"new-workspace": {},
+		"allow-lineage-change": {
+			Stored:             "bar",
+			AllowLineageChange: true,
+			ExpectWarning:      true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var upsert string
+			db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+				switch {
+				case strings.HasPrefix(query, `SELECT lineage FROM "s"."states"`):
+					rows := &fakeRows{columns: []string{"lineage"}}
+					if name != "new-workspace" {
+						rows.values = [][]driver.Value{{tc.Stored}}
+					}
+					return rows, nil
+				case strings.HasPrefix(query, "INSERT"):
+					upsert = query
+					if got := args[len(args)-1].Value; got != (sql.NullString{String: "foo", Valid: true}) {
+						return nil, fmt.Errorf("wrong lineage %v", got)
+					}
+					return &fakeRows{affected: 1}, nil
+				default:
+					return nil, fmt.Errorf("unexpected statement: %s", query)
+				}
+			})
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasSerial: true, hasLineage: true, allowLineageChange: tc.AllowLineageChange}
+			logs := captureLog(t)
+
+			err := c.Put([]byte(`{"version": 4, "serial": 3, "lineage": "foo"}`))
+			if tc.ExpectError {
+				if !errors.Is(err, ErrLineageMismatch) {
+					t.Fatalf("expected a lineage mismatch error, got: %v", err)
+				}
+				if !strings.Contains(err.Error(), "lineage bar") || !strings.Contains(err.Error(), "allow_lineage_change") {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if upsert != "" {
+					t.Fatal("the state has been written over the one of another lineage")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			warned := strings.Contains(logs.String(), `[WARN] pg: writing a state of lineage foo over the state of lineage bar of workspace "foo"`)
+			if warned != tc.ExpectWarning {
+				t.Fatalf("warning logged: %t; want %t\n%s", warned, tc.ExpectWarning, logs)
+			}
+			// The serials of different lineages don't compare
+			if got := strings.Contains(upsert, `"states".lineage <> EXCLUDED.lineage`); got != tc.AllowLineageChange {
+				t.Fatalf("the serial check is bypassed across lineages: %t; want %t", got, tc.AllowLineageChange)
+			}
+		})
+	}
+
+	// The lineage of the empty state of a new workspace isn't recorded, so
+	// the first state written decides it
+	var lineage interface{}
+	db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		lineage = args[len(args)-1].Value
+		return &fakeRows{affected: 1}, nil
+	})
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasLineage: true}
+	if _, err := c.createEmpty(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lineage != (sql.NullString{}) {
+		t.Fatalf("the lineage of the empty state has been recorded: %v", lineage)
+	}
+}
+
+func TestRemoteClientStateDowngrade(t *testing.T) {
+	testCases := map[string]struct {
+		StoredFormat        interface{}
+		StoredTofu          interface{}
+		AllowStateDowngrade bool
+		ExpectError         string
+		ExpectWarning       bool
+	}{
+		"same-versions": {
+			StoredFormat: int64(4),
+			StoredTofu:   "1.7.0",
+		},
+		"older-versions": {
+			StoredFormat: int64(3),
+			StoredTofu:   "1.6.2",
+		},
+		"newer-format": {
+			StoredFormat: int64(5),
+			StoredTofu:   "1.7.0",
+			ExpectError:  `holds a state of format version 5 written by OpenTofu 1.7.0, the state written is of format version 4 written by OpenTofu 1.7.0`,
+		},
+		"newer-tofu": {
+			StoredFormat: int64(4),
+			StoredTofu:   "1.8.0-beta1",
+			ExpectError:  `holds a state of format version 4 written by OpenTofu 1.8.0-beta1, the state written is of format version 4 written by OpenTofu 1.7.0`,
+		},
+		"unknown-versions": {
+			// Written before the version columns were added
+		},
+		"unparseable-tofu": {
+			StoredFormat: int64(4),
+			StoredTofu:   "dev",
+		},
+		"new-workspace": {},
+		"allow-state-downgrade": {
+			StoredFormat:        int64(4),
+			StoredTofu:          "1.8.0",
+			AllowStateDowngrade: true,
+			ExpectWarning:       true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var written []interface{}
+			db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+				switch {
+				case strings.HasPrefix(query, `SELECT state_version, terraform_version FROM "s"."states"`):
+					rows := &fakeRows{columns: []string{"state_version", "terraform_version"}}
+					if name != "new-workspace" {
+						rows.values = [][]driver.Value{{tc.StoredFormat, tc.StoredTofu}}
+					}
+					return rows, nil
+				case strings.HasPrefix(query, "INSERT"):
+					for _, arg := range args[len(args)-2:] {
+						written = append(written, arg.Value)
+					}
+					return &fakeRows{affected: 1}, nil
+				default:
+					return nil, fmt.Errorf("unexpected statement: %s", query)
+				}
+			})
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasStateVersion: true, allowStateDowngrade: tc.AllowStateDowngrade}
+			logs := captureLog(t)
+
+			err := c.Put([]byte(`{"version": 4, "terraform_version": "1.7.0", "serial": 3, "lineage": "foo"}`))
+			if tc.ExpectError != "" {
+				if !errors.Is(err, ErrStateDowngrade) {
+					t.Fatalf("expected a state downgrade error, got: %v", err)
+				}
+				if !strings.Contains(err.Error(), tc.ExpectError) || !strings.Contains(err.Error(), "allow_state_downgrade") {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if written != nil {
+					t.Fatal("the state has been downgraded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []interface{}{sql.NullInt64{Int64: 4, Valid: true}, sql.NullString{String: "1.7.0", Valid: true}}
+			if !reflect.DeepEqual(written, want) {
+				t.Fatalf("wrong versions written %v; want %v", written, want)
+			}
+			warned := strings.Contains(logs.String(), `[WARN] pg: writing a state of format version 4 written by OpenTofu 1.7.0 over the state of format version 4 written by OpenTofu 1.8.0 of workspace "foo"`)
+			if warned != tc.ExpectWarning {
+				t.Fatalf("warning logged: %t; want %t\n%s", warned, tc.ExpectWarning, logs)
+			}
+		})
+	}
+
+	// The versions of the empty state of a new workspace aren't recorded, so
+	// any OpenTofu can write the first state
+	var written []interface{}
+	db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		for _, arg := range args[len(args)-2:] {
+			written = append(written, arg.Value)
+		}
+		return &fakeRows{affected: 1}, nil
+	})
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasStateVersion: true}
+	if _, err := c.createEmpty(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{sql.NullInt64{}, sql.NullString{}}; !reflect.DeepEqual(written, want) {
+		t.Fatalf("the versions of the empty state have been recorded: %v", written)
+	}
+}
+
+func TestBackendRollbackWorkspace(t *testing.T) {
+	t.Run("no-history", func(t *testing.T) {
+		b := &Backend{}
+		if err := b.RollbackWorkspace(context.Background(), "foo", 1); err == nil || !strings.Contains(err.Error(), "history_limit") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("other-lineage", func(t *testing.T) {
+		// The version of serial 1 is of another lineage than the current
+		// state, as when it was written before the workspace was reset
+		db, fake := newFakeDB(t, func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+			switch {
+			case strings.Contains(query, "pg_try_advisory_lock(-1) FROM"):
+				return &fakeRows{columns: []string{"id", "lock", "lock"}, values: [][]driver.Value{{[]byte("1"), []byte("true"), []byte("true")}}}, nil
+			case strings.Contains(query, "pg_advisory_unlock"):
+				return &fakeRows{columns: []string{"unlock"}, values: [][]driver.Value{{[]byte("true")}}}, nil
+			case strings.HasPrefix(query, `SELECT data FROM "s"."states_history"`):
+				return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{[]byte(`{"version": 4, "serial": 1, "lineage": "other"}`)}}}, nil
+			case strings.HasPrefix(query, `SELECT data FROM "s"."states"`):
+				return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{[]byte(`{"version": 4, "serial": 3, "lineage": "current"}`)}}}, nil
+			default:
+				return nil, fmt.Errorf("unexpected statement: %s", query)
+			}
+		})
+		b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, historyTableName: `"states_history"`, historyLimit: 10}
+		err := b.RollbackWorkspace(context.Background(), "foo", 1)
+		if err == nil || !strings.Contains(err.Error(), `the version is of lineage "other", not of the lineage "current" of the current state`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, query := range fake.Queries() {
+			if strings.HasPrefix(query, "INSERT") {
+				t.Fatalf("the state has been written: %s", query)
+			}
+		}
+	})
+
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":      connStr,
+		"schema_name":   schemaName,
+		"history_limit": 10,
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	ctx := context.Background()
+	client := b.remoteClient("foo")
+
+	output := addrs.OutputValue{Name: "version"}.Absolute(addrs.RootModuleInstance)
+	for serial := uint64(1); serial <= 3; serial++ {
+		state := states.BuildState(func(s *states.SyncState) {
+			s.SetOutputValue(output, cty.StringVal(fmt.Sprintf("v%d", serial)), false)
+		})
+		var buf bytes.Buffer
+		if err := statefile.Write(statefile.New(state, "lineage", serial), &buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Put(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.RollbackWorkspace(ctx, "foo", 42); err == nil || !strings.Contains(err.Error(), "serial 42") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := b.RollbackWorkspace(ctx, "foo", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := statefile.Read(bytes.NewReader(payload.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Serial != 4 {
+		t.Fatalf("wrong serial %d; want 4", current.Serial)
+	}
+	if current.Lineage != "lineage" {
+		t.Fatalf("wrong lineage %q", current.Lineage)
+	}
+	if got := current.State.OutputValue(output).Value; !got.RawEquals(cty.StringVal("v1")) {
+		t.Fatalf("wrong output value %#v; want v1", got)
+	}
+
+	versions, err := b.StateHistory(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 4 || versions[3].Serial != 4 {
+		t.Fatalf("the rollback was not recorded in the history: %v", versions)
+	}
+}
+
+// resetHandler is a fakeDB handler keeping the states of the workspaces,
+// whose advisory locks are held by someone else when locked is set.
+type resetHandler struct {
+	mu     sync.Mutex
+	states map[string][]byte
+	locked bool
+}
+
+func (h *resetHandler) handle(query string, args []driver.NamedValue) (*fakeRows, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case strings.Contains(query, "pg_try_advisory_lock(-1) FROM"):
+		if _, ok := h.states[args[0].Value.(string)]; !ok {
+			return &fakeRows{columns: []string{"id", "lock", "lock"}}, nil
+		}
+		lock := []byte(fmt.Sprint(!h.locked))
+		return &fakeRows{columns: []string{"id", "lock", "lock"}, values: [][]driver.Value{{[]byte("1"), lock, []byte("true")}}}, nil
+	case strings.Contains(query, "pg_try_advisory_lock"), strings.Contains(query, "pg_advisory_unlock"):
+		return &fakeRows{columns: []string{"lock"}, values: [][]driver.Value{{[]byte("true")}}}, nil
+	case strings.HasPrefix(query, "SELECT data FROM"):
+		data, ok := h.states[args[0].Value.(string)]
+		if !ok {
+			return &fakeRows{columns: []string{"data"}}, nil
+		}
+		return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{data}}}, nil
+	case strings.HasPrefix(query, "SELECT name FROM"):
+		rows := &fakeRows{columns: []string{"name"}}
+		for name := range h.states {
+			rows.values = append(rows.values, []driver.Value{name})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "INSERT INTO"):
+		h.states[args[0].Value.(string)] = args[1].Value.([]byte)
+		return &fakeRows{affected: 1}, nil
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	}
+}
+
+func TestBackendResetWorkspace(t *testing.T) {
+	output := addrs.OutputValue{Name: "version"}.Absolute(addrs.RootModuleInstance)
+	state := states.BuildState(func(s *states.SyncState) {
+		s.SetOutputValue(output, cty.StringVal("v1"), false)
+	})
+	var buf bytes.Buffer
+	if err := statefile.Write(statefile.New(state, "lineage", 3), &buf); err != nil {
+		t.Fatal(err)
+	}
+	h := &resetHandler{states: map[string][]byte{"foo": buf.Bytes()}}
+	db, _ := newFakeDB(t, h.handle)
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+	ctx := context.Background()
+
+	read := func() *statefile.File {
+		t.Helper()
+		file, err := statefile.Read(bytes.NewReader(h.states["foo"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	// Refused while someone else holds the lock, unless forced
+	h.locked = true
+	if err := b.ResetWorkspace(ctx, "foo", false); err == nil || !strings.Contains(err.Error(), "unless forced") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if file := read(); file.Serial != 3 || file.State.Empty() {
+		t.Fatalf("the state has been reset while locked: serial %d", file.Serial)
+	}
+	for _, force := range []bool{true, false} {
+		h.locked = force
+		if err := b.ResetWorkspace(ctx, "foo", force); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := read()
+	if !file.State.Empty() {
+		t.Fatal("the state is not empty")
+	}
+	if file.Lineage == "lineage" || file.Lineage == "" {
+		t.Fatalf("the lineage %q has not been changed", file.Lineage)
+	}
+	if file.Serial != 5 {
+		t.Fatalf("wrong serial %d; want 5", file.Serial)
+	}
+	workspaces, err := b.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{backend.DefaultStateName, "foo"}; !reflect.DeepEqual(workspaces, want) {
+		t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+	}
+
+	if err := b.ResetWorkspace(ctx, "bar", false); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	if _, ok := h.states["bar"]; ok {
+		t.Fatal("the missing workspace has been created")
+	}
+}
+
+func TestBackendStateAt(t *testing.T) {
+	t.Run("no-history", func(t *testing.T) {
+		b := &Backend{}
+		if _, err := b.StateAt(context.Background(), "foo", time.Now()); !errors.Is(err, ErrStateVersionNotFound) || !strings.Contains(err.Error(), "history_limit") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("lineage", func(t *testing.T) {
+		// The latest version of the history is of another lineage than the
+		// current state, as when the workspace was deleted and created again
+		testCases := map[string]struct {
+			Current   string
+			WantFound bool
+		}{
+			"same":    {Current: "old", WantFound: true},
+			"other":   {Current: "new"},
+			"missing": {},
+		}
+		for name, tc := range testCases {
+			t.Run(name, func(t *testing.T) {
+				db, _ := newFakeDB(t, func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+					switch {
+					case strings.HasPrefix(query, `SELECT data FROM "s"."states_history"`):
+						return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{[]byte(`{"version": 4, "serial": 1, "lineage": "old"}`)}}}, nil
+					case strings.HasPrefix(query, `SELECT data FROM "s"."states"`):
+						rows := &fakeRows{columns: []string{"data"}}
+						if tc.Current != "" {
+							rows.values = [][]driver.Value{{[]byte(fmt.Sprintf(`{"version": 4, "serial": 1, "lineage": %q}`, tc.Current))}}
+						}
+						return rows, nil
+					default:
+						return nil, fmt.Errorf("unexpected statement: %s", query)
+					}
+				})
+				b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, historyTableName: `"states_history"`, historyLimit: 10}
+				_, err := b.StateAt(context.Background(), "foo", time.Now())
+				if tc.WantFound {
+					if err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				if !errors.Is(err, ErrStateVersionNotFound) {
+					t.Fatalf("expected a not found error, got: %v", err)
+				}
+			})
+		}
+	})
+
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := "terraform_state_at"
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":      connStr,
+		"schema_name":   schemaName,
+		"history_limit": 10,
+		"compress":      true,
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	ctx := context.Background()
+	client := b.remoteClient("foo")
+
+	// The versions are written a day apart
+	output := addrs.OutputValue{Name: "version"}.Absolute(addrs.RootModuleInstance)
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for serial := uint64(1); serial <= 3; serial++ {
+		state := states.BuildState(func(s *states.SyncState) {
+			s.SetOutputValue(output, cty.StringVal(fmt.Sprintf("v%d", serial)), false)
+		})
+		var buf bytes.Buffer
+		if err := statefile.Write(statefile.New(state, "lineage", serial), &buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Put(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		query := fmt.Sprintf(`UPDATE %s.%s SET written_at = $1 WHERE name = 'foo' AND serial = $2`, b.schemaName, b.historyTableName)
+		if _, err := dbCleaner.Exec(query, first.AddDate(0, 0, int(serial)-1), serial); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := map[string]struct {
+		At   time.Time
+		Want string
+	}{
+		"before":        {At: first.Add(-time.Second)},
+		"first":         {At: first, Want: "v1"},
+		"between":       {At: first.Add(12 * time.Hour), Want: "v1"},
+		"just-before":   {At: first.AddDate(0, 0, 1).Add(-time.Microsecond), Want: "v1"},
+		"second":        {At: first.AddDate(0, 0, 1), Want: "v2"},
+		"after-the-end": {At: first.AddDate(1, 0, 0), Want: "v3"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			state, err := b.StateAt(ctx, "foo", tc.At)
+			if tc.Want == "" {
+				if !errors.Is(err, ErrStateVersionNotFound) {
+					t.Fatalf("expected a not found error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := state.OutputValue(output).Value; !got.RawEquals(cty.StringVal(tc.Want)) {
+				t.Fatalf("wrong output value %#v; want %s", got, tc.Want)
+			}
+		})
+	}
+
+	if _, err := b.StateAt(ctx, "bar", time.Now()); !errors.Is(err, ErrStateVersionNotFound) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+
+	// The workspace deleted and created again doesn't have the states of
+	// the deleted one
+	if err := b.DeleteWorkspace(ctx, "foo", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.remoteClient("foo").Put([]byte(`{"version": 4, "serial": 1, "lineage": "foo-again"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.StateAt(ctx, "foo", first.AddDate(0, 0, 1)); !errors.Is(err, ErrStateVersionNotFound) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+}
+
+func TestRemoteLockTimeout(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":     connStr,
+		"schema_name":  schemaName,
+		"lock_timeout": "1s",
+	})
+	ctx := context.Background()
+
+	b1 := backend.TestBackendConfig(t, New(), config).(*Backend)
+	s1, err := b1.StateMgr(ctx, backend.DefaultStateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockID, err := s1.Lock(statemgr.NewLockInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Unlock(lockID)
+
+	b2 := backend.TestBackendConfig(t, New(), config).(*Backend)
+	s2, err := b2.StateMgr(ctx, backend.DefaultStateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = s2.Lock(statemgr.NewLockInfo())
+	elapsed := time.Since(start)
+
+	var lockErr *statemgr.LockError
+	if !errors.As(err, &lockErr) {
+		t.Fatalf("expected a lock error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "timed out after 1s") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if elapsed < time.Second || elapsed > 3*time.Second {
+		t.Fatalf("the lock attempt took %s, expected about 1s", elapsed)
+	}
+}
+
+func TestLockRetryDelay(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		want := min(lockRetryMinInterval<<attempt, lockRetryMaxInterval)
+		delays := map[time.Duration]bool{}
+		for i := 0; i < 20; i++ {
+			delay := lockRetryDelay(attempt)
+			if delay < want/2 || delay > want {
+				t.Fatalf("attempt %d: delay %s not between %s and %s", attempt, delay, want/2, want)
+			}
+			delays[delay] = true
+		}
+		// The delays are jittered
+		if len(delays) < 2 {
+			t.Fatalf("attempt %d: always waits %v", attempt, delays)
+		}
+	}
+}
+
+func TestRemoteLockContention(t *testing.T) {
+	db, _ := newFakeDB(t, tableLocksHandler())
+	const runs = 5
+
+	var mu sync.Mutex
+	var holders int
+	var acquired []int
+	var wg sync.WaitGroup
+	errs := make(chan error, runs)
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, lockTableName: `"states_locks"`, tableLocks: true, lockTimeout: 10 * time.Second}
+			lockID, err := c.Lock(statemgr.NewLockInfo())
+			if err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			holders++
+			if holders > 1 {
+				errs <- fmt.Errorf("run %d holds the lock along with another one", i)
+			}
+			acquired = append(acquired, i)
+			mu.Unlock()
+
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			if err := c.Unlock(lockID); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	// Each run has acquired the lock in turn
+	if len(acquired) != runs {
+		t.Fatalf("the lock has been acquired by %v", acquired)
+	}
+}
+
+func TestRemoteLockHolderInfo(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":    connStr,
+		"schema_name": schemaName,
+	})
+	ctx := context.Background()
+
+	b1 := backend.TestBackendConfig(t, New(), config).(*Backend)
+	s1, err := b1.StateMgr(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2 := backend.TestBackendConfig(t, New(), config).(*Backend)
+	s2, err := b2.StateMgr(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holderInfo := statemgr.NewLockInfo()
+	holderInfo.Operation = "apply"
+	holderInfo.Who = "user@host"
+
+	locked := make(chan string)
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		lockID, err := s1.Lock(holderInfo)
+		if err != nil {
+			close(locked)
+			done <- err
+			return
+		}
+		locked <- lockID
+		<-release
+		done <- s1.Unlock(lockID)
+	}()
+
+	if _, ok := <-locked; !ok {
+		t.Fatal(<-done)
+	}
+
+	requesterInfo := statemgr.NewLockInfo()
+	requesterInfo.Operation = "plan"
+	requesterInfo.Who = "other@host"
+	_, err = s2.Lock(requesterInfo)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var lockErr *statemgr.LockError
+	if !errors.As(err, &lockErr) {
+		t.Fatalf("expected a lock error, got: %v", err)
+	}
+	got := lockErr.Info
+	if got == nil {
+		t.Fatal("the lock error has no lock info")
+	}
+	if got.ID != holderInfo.ID || got.Operation != "apply" || got.Who != "user@host" || got.Version != holderInfo.Version || !got.Created.Equal(holderInfo.Created) {
+		t.Fatalf("wrong lock holder info\ngot:  %#v\nwant: %#v", got, holderInfo)
+	}
+
+	// The information is removed once the lock is released.
+	info, err := b2.remoteClient("foo").readLockInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != nil {
+		t.Fatalf("the lock info was kept after unlocking: %#v", info)
+	}
+}
+
+func TestRemoteLockContextCanceled(t *testing.T) {
+	// The workspace is always locked by someone else.
+	db, _ := newFakeDB(t, func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock(-1) FROM"):
+			return &fakeRows{columns: []string{"id", "lock", "lock"}, values: [][]driver.Value{{[]byte("1"), []byte("false"), []byte("true")}}}, nil
+		case strings.Contains(query, "pg_advisory_unlock"):
+			return &fakeRows{columns: []string{"unlock"}, values: [][]driver.Value{{[]byte("true")}}}, nil
+		default:
+			return &fakeRows{affected: 1}, nil
+		}
+	})
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, lockTimeout: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := c.LockContext(ctx, statemgr.NewLockInfo())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the lock attempt took %s after the context was canceled", elapsed)
+	}
+
+	var lockErr *statemgr.LockError
+	if !errors.As(err, &lockErr) {
+		t.Fatalf("expected a lock error, got: %v", err)
+	}
+	if !errors.Is(lockErr.Err, context.Canceled) {
+		t.Fatalf("expected the context error, got: %v", lockErr.Err)
+	}
+}
+
+func TestRemoteLockSession(t *testing.T) {
+	testCases := map[string]struct {
+		unlockErr error
+	}{
+		"released":     {},
+		"unlock-fails": {unlockErr: errors.New("connection reset")},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, fake := newFakeDB(t, func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+				switch {
+				case strings.Contains(query, "pg_try_advisory_lock(-1) FROM"):
+					return &fakeRows{columns: []string{"id", "lock", "lock"}, values: [][]driver.Value{{[]byte("1"), []byte("true"), []byte("true")}}}, nil
+				case strings.Contains(query, "pg_advisory_unlock(1)"):
+					if tc.unlockErr != nil {
+						return nil, tc.unlockErr
+					}
+					return &fakeRows{columns: []string{"unlock"}, values: [][]driver.Value{{[]byte("true")}}}, nil
+				case strings.Contains(query, "pg_advisory_unlock"):
+					return &fakeRows{columns: []string{"unlock"}, values: [][]driver.Value{{[]byte("true")}}}, nil
+				default:
+					return &fakeRows{affected: 1}, nil
+				}
+			})
+			// The pool closes the connections as soon as they are idle
+			db.SetConnMaxIdleTime(time.Nanosecond)
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`}
+
+			id, err := c.Lock(statemgr.NewLockInfo())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The other statements run on other connections meanwhile
+			if _, err := db.Exec(`SELECT 1`); err != nil {
+				t.Fatal(err)
+			}
+			err = c.Unlock(id)
+			if tc.unlockErr == nil && err != nil {
+				t.Fatal(err)
+			}
+			if tc.unlockErr != nil && (err == nil || !strings.Contains(err.Error(), "connection reset")) {
+				t.Fatalf("expected the unlock error, got: %v", err)
+			}
+
+			queries, sessions := fake.Queries(), fake.Sessions()
+			var lockSession, unlockSession, otherSession int
+			for i, query := range queries {
+				switch {
+				case strings.Contains(query, "pg_try_advisory_lock(-1) FROM"):
+					lockSession = sessions[i]
+				case strings.Contains(query, "pg_advisory_unlock(1)"):
+					unlockSession = sessions[i]
+				case query == `SELECT 1`:
+					otherSession = sessions[i]
+				}
+			}
+			if lockSession == 0 || unlockSession != lockSession {
+				t.Fatalf("locked on connection %d, unlocked on connection %d:\n%s", lockSession, unlockSession, strings.Join(queries, "\n"))
+			}
+			if otherSession == lockSession {
+				t.Fatalf("the connection holding the lock has been handed out to another statement")
+			}
+			if c.lockConn != nil {
+				t.Fatal("the connection of the lock is still held")
+			}
+
+			// A lock that can't be released is dropped with its session
+			closed := slices.Contains(fake.Closed(), lockSession)
+			if tc.unlockErr != nil && !closed {
+				t.Fatalf("the connection holding the lock is still open, closed: %v", fake.Closed())
+			}
+		})
+	}
+}
+
+func TestRemoteLockPool(t *testing.T) {
+	handler := func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock(-1) FROM"):
+			return &fakeRows{columns: []string{"id", "lock", "lock"}, values: [][]driver.Value{{[]byte("1"), []byte("true"), []byte("true")}}}, nil
+		case strings.Contains(query, "pg_advisory_unlock"):
+			return &fakeRows{columns: []string{"unlock"}, values: [][]driver.Value{{[]byte("true")}}}, nil
+		default:
+			return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{testStateFile(1)}}}, nil
+		}
+	}
+	// The locks are held out of the pool of the states, which would be used
+	// up by the lock with a single connection
+	db, fake := newFakeDB(t, handler)
+	db.SetMaxOpenConns(1)
+	lockDB, lockFake := newFakeDB(t, handler)
+	c := &RemoteClient{Client: db, lockDB: lockDB, Name: "foo", SchemaName: `"s"`, TableName: `"states"`}
+
+	id, err := c.Lock(statemgr.NewLockInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Get()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the state can't be read while it is locked")
+	}
+	if err := c.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range fake.Queries() {
+		if strings.Contains(query, "advisory") {
+			t.Fatalf("lock statement run on the pool of the states: %s", query)
+		}
+	}
+	if queries := lockFake.Queries(); len(queries) == 0 {
+		t.Fatal("no statement run on the pool of the locks")
+	}
+}
+
+func TestRemoteClientMaxStateBytes(t *testing.T) {
+	// The size of the states is unlimited by default
+	if d := New().(*Backend).Schema["max_state_bytes"].Default; d != 0 {
+		t.Fatalf("wrong default limit %v", d)
+	}
+
+	state := testStateFile(20)
+	compressed, err := encodeState(state, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Name          string
+		MaxStateBytes int
+		Compress      bool
+		ExpectError   bool
+	}{
+		{Name: "unlimited", MaxStateBytes: 0},
+		{Name: "under", MaxStateBytes: len(state) + 1},
+		{Name: "at", MaxStateBytes: len(state)},
+		{Name: "over", MaxStateBytes: len(state) - 1, ExpectError: true},
+		{Name: "compressed-under", MaxStateBytes: len(compressed) + 1, Compress: true},
+		{Name: "compressed-at", MaxStateBytes: len(compressed), Compress: true},
+		{Name: "compressed-over", MaxStateBytes: len(compressed) - 1, Compress: true, ExpectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			db, fake := newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+				return &fakeRows{affected: 1}, nil
+			})
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, compress: tc.Compress, maxStateBytes: tc.MaxStateBytes}
+
+			err := c.Put(state)
+			if !tc.ExpectError {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			size := len(state)
+			if tc.Compress {
+				size = len(compressed)
+			}
+			want := fmt.Sprintf("is %d bytes, which exceeds the limit of %d bytes", size, tc.MaxStateBytes)
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Fatalf("expected an error containing %q, got: %v", want, err)
+			}
+			if queries := fake.Queries(); len(queries) != 0 {
+				t.Fatalf("the state has been sent: %q", queries)
+			}
+		})
+	}
+}
+
+// tableLocksHandler is a fakeDB handler keeping the rows of the lock table,
+// which are the locks with pgbouncer_compatible.
+func tableLocksHandler() func(string, []driver.NamedValue) (*fakeRows, error) {
+	var mu sync.Mutex
+	locks := make(map[string]*statemgr.LockInfo)
+	return func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		name := args[0].Value.(string)
+		switch {
+		case strings.Contains(query, "advisory"):
+			return nil, fmt.Errorf("advisory locks don't work through PgBouncer: %s", query)
+		case strings.HasPrefix(query, "INSERT INTO"):
+			if _, ok := locks[name]; ok {
+				return &fakeRows{affected: 0}, nil
+			}
+			info := &statemgr.LockInfo{}
+			if err := json.Unmarshal([]byte(args[1].Value.(string)), info); err != nil {
+				return nil, err
+			}
+			locks[name] = info
+			return &fakeRows{affected: 1}, nil
+		case strings.HasPrefix(query, "DELETE FROM"):
+			if info, ok := locks[name]; ok && info.ID == args[1].Value.(string) {
+				delete(locks, name)
+				return &fakeRows{affected: 1}, nil
+			}
+			return &fakeRows{affected: 0}, nil
+		case strings.HasPrefix(query, "SELECT info"):
+			info, ok := locks[name]
+			if !ok {
+				return &fakeRows{columns: []string{"info"}}, nil
+			}
+			return &fakeRows{columns: []string{"info"}, values: [][]driver.Value{{info.Marshal()}}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected query: %s", query)
+		}
+	}
+}
+
+func TestRemoteTableLocks(t *testing.T) {
+	db, _ := newFakeDB(t, tableLocksHandler())
+	newClient := func() *RemoteClient {
+		return &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, lockTableName: `"states_locks"`, tableLocks: true}
+	}
+
+	remote.TestRemoteLocks(t, newClient(), newClient())
+
+	// The holder of the lock is reported
+	a, b := newClient(), newClient()
+	infoA := statemgr.NewLockInfo()
+	infoA.Who = "clientA"
+	lockID, err := a.Lock(infoA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Lock(statemgr.NewLockInfo())
+	var lockErr *statemgr.LockError
+	if !errors.As(err, &lockErr) {
+		t.Fatalf("expected a lock error, got: %v", err)
+	}
+	if lockErr.Info.Who != "clientA" {
+		t.Fatalf("wrong lock holder %q", lockErr.Info.Who)
+	}
+
+	// Another client releases a lock with its ID only, as force-unlock does
+	if err := b.Unlock("wrong-id"); !errors.As(err, &lockErr) {
+		t.Fatalf("expected a lock error, got: %v", err)
+	}
+	if err := b.Unlock(lockID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Lock(statemgr.NewLockInfo()); err != nil {
+		t.Fatal(err)
+	}
+}
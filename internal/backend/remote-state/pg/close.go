@@ -0,0 +1,132 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrClosed is wrapped by the errors of the operations started once the
+// backend is closed.
+var ErrClosed = errors.New("backend closed")
+
+// closeTimeout is the time Close waits for the operations in flight before
+// closing the connection pools anyway.
+const closeTimeout = 30 * time.Second
+
+// Close closes the connection pools of the backend, once the operations in
+// flight are done or closeTimeout expires. The operations started
+// afterwards, by the backend or by its state managers, fail with an error
+// wrapping ErrClosed. Closing the backend again does nothing.
+func (b *Backend) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return b.close(ctx)
+}
+
+func (b *Backend) close(ctx context.Context) error {
+	if b.db == nil {
+		return nil
+	}
+	if !b.operations.close() {
+		return nil
+	}
+	b.health.stopChecks()
+	drainErr := b.operations.wait(ctx)
+
+	err := errors.Join(b.stmts.close(), b.db.Close())
+	if b.lockDB != nil {
+		err = errors.Join(err, b.lockDB.Close())
+	}
+	if b.replica != nil {
+		err = errors.Join(err, b.replica.db.Close())
+	}
+	return errors.Join(drainErr, err)
+}
+
+// operationTracker counts the operations in flight, so that the connection
+// pools are only closed once they are done. A nil tracker tracks nothing.
+type operationTracker struct {
+	mu      sync.Mutex
+	closed  bool
+	running int
+
+	// idle is closed once no operation runs anymore after the tracker is
+	// closed.
+	idle chan struct{}
+}
+
+func newOperationTracker() *operationTracker {
+	return &operationTracker{idle: make(chan struct{})}
+}
+
+// begin records the start of an operation, unless the tracker is closed.
+// It returns whether the operation can run, and must be followed by done
+// if it can.
+func (t *operationTracker) begin() bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.running++
+	return true
+}
+
+// done records the end of an operation.
+func (t *operationTracker) done() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.running--
+	if t.closed && t.running == 0 {
+		close(t.idle)
+	}
+}
+
+// close refuses the operations started from now on. It returns false if the
+// tracker was already closed.
+func (t *operationTracker) close() bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.closed = true
+	if t.running == 0 {
+		close(t.idle)
+	}
+	return true
+}
+
+// wait waits for the operations in flight once the tracker is closed,
+// until ctx is done.
+func (t *operationTracker) wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	select {
+	case <-t.idle:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return fmt.Errorf("closing with %d operations still running: %w", t.running, ctx.Err())
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingHandler returns a fakeDB handler listing the workspace foo, which
+// signals started and waits for release before answering.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) func(string, []driver.NamedValue) (*fakeRows, error) {
+	return func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		started <- struct{}{}
+		<-release
+		return &fakeRows{columns: []string{"name"}, values: [][]driver.Value{{"foo"}}}, nil
+	}
+}
+
+func TestBackendClose(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	db, fake := newFakeDB(t, blockingHandler(started, release))
+	lockDB, _ := newFakeDB(t, blockingHandler(started, release))
+	b := &Backend{db: db, lockDB: lockDB, schemaName: `"s"`, tableName: `"states"`, historyTableName: `"states_history"`, historyLimit: 10, operations: newOperationTracker()}
+	ctx := context.Background()
+
+	// The operation in flight is waited for
+	listed := make(chan error)
+	go func() {
+		_, err := b.Workspaces(ctx)
+		listed <- err
+	}()
+	<-started
+	closed := make(chan error)
+	go func() {
+		closed <- b.Close()
+	}()
+	select {
+	case err := <-closed:
+		t.Fatalf("closed with an operation in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-listed; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(); err == nil {
+		t.Fatal("the pool has not been closed")
+	}
+	if err := lockDB.Ping(); err == nil {
+		t.Fatal("the pool of the locks has not been closed")
+	}
+
+	// The operations started afterwards fail without running anything
+	n := len(fake.Queries())
+	operations := map[string]func() error{
+		"Workspaces":           func() error { _, err := b.Workspaces(ctx); return err },
+		"WorkspacesPage":       func() error { _, err := b.WorkspacesPage(ctx, 10, 0); return err },
+		"WorkspacesWithPrefix": func() error { _, err := b.WorkspacesWithPrefix(ctx, "f"); return err },
+		"StateMgr":             func() error { _, err := b.StateMgr(ctx, "foo"); return err },
+		"Get":                  func() error { _, err := b.remoteClient("foo").Get(); return err },
+		"DeleteWorkspaces":     func() error { _, err := b.DeleteWorkspaces(ctx, "f*", false, false); return err },
+		"RenameWorkspace":      func() error { return b.RenameWorkspace(ctx, "foo", "bar") },
+		"CopyWorkspace":        func() error { return b.CopyWorkspace(ctx, "foo", "bar") },
+		"WorkspaceInfo":        func() error { _, err := b.WorkspaceInfo(ctx, "foo"); return err },
+		"StateHistory":         func() error { _, err := b.StateHistory(ctx, "foo"); return err },
+		"StateMetadata":        func() error { _, err := b.StateMetadata(ctx, "foo"); return err },
+		"GetRaw":               func() error { _, _, _, err := b.GetRaw(ctx, "foo"); return err },
+	}
+	for name, operation := range operations {
+		if err := operation(); !errors.Is(err, ErrClosed) {
+			t.Fatalf("%s: expected an error wrapping ErrClosed, got %v", name, err)
+		}
+	}
+	if queries := fake.Queries()[n:]; len(queries) != 0 {
+		t.Fatalf("statements run once closed: %v", queries)
+	}
+
+	// Closing again does nothing
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackendCloseTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	db, _ := newFakeDB(t, blockingHandler(started, release))
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, operations: newOperationTracker()}
+
+	listed := make(chan error)
+	go func() {
+		_, err := b.Workspaces(context.Background())
+		listed <- err
+	}()
+	<-started
+	defer func() {
+		close(release)
+		<-listed
+	}()
+
+	// The pool is closed anyway once the deadline expires
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if err := db.Ping(); err == nil {
+		t.Fatal("the pool has not been closed")
+	}
+}
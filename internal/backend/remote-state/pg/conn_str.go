@@ -0,0 +1,233 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// parseConnStr parses a Postgres connection string, given either as a
+// `postgres://` URL or as a libpq key/value string, into its connection
+// parameters.
+func parseConnStr(connStr string) (map[string]string, error) {
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		var err error
+		connStr, err = pq.ParseURL(socketHostURL(connStr))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params := make(map[string]string)
+	s := []rune(connStr)
+	i := 0
+	next := func() (rune, bool) {
+		if i >= len(s) {
+			return 0, false
+		}
+		i++
+		return s[i-1], true
+	}
+	skipSpaces := func() (rune, bool) {
+		r, ok := next()
+		for ok && unicode.IsSpace(r) {
+			r, ok = next()
+		}
+		return r, ok
+	}
+
+	// This follows the parsing rules of conninfo_parse from libpq, as
+	// implemented by the pq driver.
+	for {
+		var key, value []rune
+
+		r, ok := skipSpaces()
+		if !ok {
+			break
+		}
+
+		for ok && !unicode.IsSpace(r) && r != '=' {
+			key = append(key, r)
+			r, ok = next()
+		}
+		if ok && r != '=' {
+			r, ok = skipSpaces()
+		}
+		if !ok || r != '=' {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection string", string(key))
+		}
+
+		if r, ok = skipSpaces(); !ok {
+			params[string(key)] = ""
+			break
+		}
+
+		if r != '\'' {
+			for ok && !unicode.IsSpace(r) {
+				if r == '\\' {
+					if r, ok = next(); !ok {
+						return nil, fmt.Errorf("missing character after backslash in connection string")
+					}
+				}
+				value = append(value, r)
+				r, ok = next()
+			}
+		} else {
+		quoted:
+			for {
+				if r, ok = next(); !ok {
+					return nil, fmt.Errorf("unterminated quoted string in connection string")
+				}
+				switch r {
+				case '\'':
+					break quoted
+				case '\\':
+					r, _ = next()
+					fallthrough
+				default:
+					value = append(value, r)
+				}
+			}
+		}
+
+		params[string(key)] = string(value)
+	}
+
+	return params, nil
+}
+
+// socketHostURL returns the given URL with its host moved to the host query
+// parameter when it is the percent-encoded directory of a Unix domain
+// socket, as in postgres://user@%2Fvar%2Frun%2Fpostgresql/db, which libpq
+// accepts but url.Parse rejects. Other connection strings are returned
+// as-is.
+func socketHostURL(connStr string) string {
+	if !strings.HasPrefix(connStr, "postgres://") && !strings.HasPrefix(connStr, "postgresql://") {
+		return connStr
+	}
+	i := strings.Index(connStr, "://") + len("://")
+	end := strings.IndexAny(connStr[i:], "/?#")
+	if end < 0 {
+		end = len(connStr) - i
+	}
+	authority, rest := connStr[i:i+end], connStr[i+end:]
+
+	userinfo, hostport := "", authority
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		userinfo, hostport = authority[:at+1], authority[at+1:]
+	}
+	if !strings.HasPrefix(strings.ToLower(hostport), "%2f") {
+		return connStr
+	}
+	host, port := hostport, ""
+	if colon := strings.LastIndex(hostport, ":"); colon >= 0 {
+		host, port = hostport[:colon], hostport[colon:]
+	}
+	host, err := url.PathUnescape(host)
+	if err != nil {
+		return connStr
+	}
+
+	path, query, _ := strings.Cut(rest, "?")
+	if query != "" {
+		query += "&"
+	}
+	query += "host=" + url.QueryEscape(host)
+	return connStr[:i] + userinfo + port + path + "?" + query
+}
+
+// formatConnStr renders connection parameters as a libpq key/value string.
+func formatConnStr(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	escaper := strings.NewReplacer(`'`, `\'`, `\`, `\\`)
+	kvs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, k+"='"+escaper.Replace(params[k])+"'")
+	}
+	return strings.Join(kvs, " ")
+}
+
+// overrideConnStr returns connStr with the non-empty values of overrides
+// replacing the matching parameters it contains. The connection string is
+// returned untouched when there is nothing to override, so the pq driver can
+// still apply its defaults.
+func overrideConnStr(connStr string, overrides map[string]string) (string, error) {
+	params, err := parseConnStr(connStr)
+	if err != nil {
+		return "", err
+	}
+
+	changed := false
+	for k, v := range overrides {
+		if v == "" {
+			continue
+		}
+		params[k] = v
+		changed = true
+	}
+	if !changed {
+		return connStr, nil
+	}
+
+	return formatConnStr(params), nil
+}
+
+// errChannelBindingRequired is returned when channel_binding is "require".
+var errChannelBindingRequired = errors.New(`channel_binding is "require", but the Postgres driver doesn't support SCRAM-SHA-256-PLUS channel binding, the connections would be authenticated without it`)
+
+// channelBinding returns connStr without its channel_binding parameter,
+// which the pq driver would send to the server as a run-time parameter, and
+// the channel binding mode: configured if not empty, otherwise the one of
+// connStr or of the PGCHANNELBINDING environment variable, as for libpq.
+func channelBinding(connStr, configured string) (string, string, error) {
+	params, err := parseConnStr(connStr)
+	if err != nil {
+		return "", "", err
+	}
+	mode := firstNonEmpty(configured, params["channel_binding"], os.Getenv("PGCHANNELBINDING"))
+	switch mode {
+	case "", "disable", "prefer", "require":
+	default:
+		return "", "", fmt.Errorf("channel_binding must be one of \"disable\", \"prefer\" or \"require\", got %q", mode)
+	}
+	if _, ok := params["channel_binding"]; !ok {
+		return connStr, mode, nil
+	}
+	delete(params, "channel_binding")
+	return formatConnStr(params), mode, nil
+}
+
+// defaultApplicationName is the application_name of the connections when
+// neither application_name nor the connection string set one.
+const defaultApplicationName = "opentofu"
+
+// applicationName returns connStr with its application_name parameter set,
+// which tells the connections of OpenTofu apart in pg_stat_activity:
+// configured if not empty, otherwise the one of connStr or of the PGAPPNAME
+// environment variable, as for libpq, or defaultApplicationName.
+func applicationName(connStr, configured string) (string, error) {
+	params, err := parseConnStr(connStr)
+	if err != nil {
+		return "", err
+	}
+	name := firstNonEmpty(configured, params["application_name"], os.Getenv("PGAPPNAME"), defaultApplicationName)
+	if params["application_name"] == name {
+		return connStr, nil
+	}
+	params["application_name"] = name
+	return formatConnStr(params), nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/lib/pq"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ErrAuthentication is wrapped by the errors of TestConnection when
+// Postgres refuses the credentials.
+var ErrAuthentication = errors.New("authentication failed")
+
+// ErrUnreachable is wrapped by the errors of TestConnection when Postgres
+// can't be reached.
+var ErrUnreachable = errors.New("server unreachable")
+
+// ErrPermission is wrapped by the errors of TestConnection when the role
+// can't use the schema, and matches the SetupError of the operations denied
+// a privilege.
+var ErrPermission = errors.New("permission denied")
+
+// TestConnection checks that Postgres can be used with the given backend
+// configuration, an object of the type of ConfigSchema, without configuring
+// a backend. The connections are opened and authenticated as Configure
+// would, the role must be able to use the schema, or to create it unless
+// skip_schema_creation or read_only is set, and they are closed. Nothing
+// is created.
+//
+// The error wraps ErrAuthentication, ErrUnreachable or ErrPermission when
+// the failure is one of them.
+func TestConnection(ctx context.Context, config cty.Value) error {
+	b := New().(*Backend)
+	b.connectionOnly = true
+	var err error
+	b.ConfigureFunc = func(ctx context.Context) error {
+		err = b.configure(ctx)
+		return err
+	}
+
+	config, diags := b.PrepareConfig(ctx, config)
+	if diags.HasErrors() {
+		return diags.Err()
+	}
+	if diags := b.Configure(ctx, config); diags.HasErrors() {
+		// The error of configure is returned as is, so it can be
+		// unwrapped.
+		if err != nil {
+			return err
+		}
+		return diags.Err()
+	}
+	return nil
+}
+
+// checkConnection checks that a connection of db to the given host can be
+// opened, and that the role can use the schema, or create it if create is
+// set.
+func (b *Backend) checkConnection(ctx context.Context, db *sql.DB, host, sslMode string, create bool) error {
+	var role, database string
+	var usage sql.NullBool
+	var creatable bool
+	query := `SELECT current_user, current_database(),
+		CASE WHEN to_regnamespace($1) IS NOT NULL THEN has_schema_privilege(to_regnamespace($1), 'USAGE') END,
+		has_database_privilege(current_database(), 'CREATE')`
+	if err := db.QueryRowContext(ctx, query, b.schemaName).Scan(&role, &database, &usage, &creatable); err != nil {
+		return connectionError(host, sslMode, err)
+	}
+
+	role, database = pq.QuoteIdentifier(role), pq.QuoteIdentifier(database)
+	switch {
+	case !usage.Valid && !create:
+		return fmt.Errorf("%w: schema %s does not exist on Postgres at %s; create it, or grant CREATE on the database to %s and unset skip_schema_creation so it is created", ErrPermission, b.schemaName, host, role)
+	case !usage.Valid && !creatable:
+		return fmt.Errorf("%w: schema %s does not exist on Postgres at %s and role %s can't create it; create it, or run GRANT CREATE ON DATABASE %s TO %s", ErrPermission, b.schemaName, host, role, database, role)
+	case usage.Valid && !usage.Bool:
+		return fmt.Errorf("%w: role %s has no USAGE privilege on schema %s on Postgres at %s; run GRANT USAGE ON SCHEMA %s TO %s", ErrPermission, role, b.schemaName, host, b.schemaName, role)
+	}
+	return nil
+}
+
+// connectionError tells why the connection to the given host failed.
+func connectionError(host, sslMode string, err error) error {
+	if verifyErr := tlsVerificationError(sslMode, err); verifyErr != err {
+		return verifyErr
+	}
+	var pqErr *pq.Error
+	var netErr net.Error
+	switch {
+	case errors.As(err, &pqErr) && pqErr.Code.Class() == "28": // invalid_authorization_specification
+		return fmt.Errorf("%w: Postgres at %s refused the credentials: %w; check the user and password of conn_str, or auth_method", ErrAuthentication, host, err)
+	case errors.As(err, &pqErr) && pqErr.Code == "42501": // insufficient_privilege
+		return fmt.Errorf("%w: Postgres at %s refused the connection: %w; grant CONNECT on the database to the role", ErrPermission, host, err)
+	case errors.As(err, &netErr):
+		return fmt.Errorf("%w: failed to connect to Postgres at %s: %w; check the host and port of conn_str, and that Postgres accepts the connections of this host", ErrUnreachable, host, err)
+	}
+	return fmt.Errorf("failed to connect to Postgres at %s: %w", host, err)
+}
@@ -0,0 +1,114 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/lib/pq"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// connectionConfig returns the given backend configuration as passed to
+// TestConnection.
+func connectionConfig(t *testing.T, config map[string]interface{}) cty.Value {
+	t.Helper()
+	spec := New().ConfigSchema(context.Background()).DecoderSpec()
+	obj, diags := hcldec.Decode(backend.TestWrapConfig(config), spec, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags.Error())
+	}
+	return obj
+}
+
+func TestConnectionAuthenticationFailure(t *testing.T) {
+	server := newFakeLoginServer(t)
+	host, port := server.addr()
+
+	// The fake server refuses the login
+	err := TestConnection(context.Background(), connectionConfig(t, map[string]interface{}{
+		"conn_str": fmt.Sprintf("host=%s port=%s user=tofu password=hunter22 sslmode=disable", host, port),
+	}))
+	if !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("expected an error wrapping ErrAuthentication, got %v", err)
+	}
+	if strings.Contains(err.Error(), "hunter22") {
+		t.Fatalf("the password is in the error: %s", err)
+	}
+	if len(server.Logins()) == 0 {
+		t.Fatal("no connection has been made")
+	}
+}
+
+func TestConnectionUnreachable(t *testing.T) {
+	// A port nothing listens on anymore
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	err = TestConnection(context.Background(), connectionConfig(t, map[string]interface{}{
+		"conn_str": fmt.Sprintf("host=%s port=%s user=tofu sslmode=disable", host, port),
+	}))
+	if !errors.Is(err, ErrUnreachable) || errors.Is(err, ErrAuthentication) {
+		t.Fatalf("expected an error wrapping ErrUnreachable, got %v", err)
+	}
+	if !strings.Contains(err.Error(), net.JoinHostPort(host, port)) {
+		t.Fatalf("the host is not in the error: %s", err)
+	}
+}
+
+func TestConnectionSchema(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+	ctx := context.Background()
+
+	schemaExists := func() bool {
+		t.Helper()
+		var exists bool
+		if err := dbCleaner.QueryRow(`SELECT to_regnamespace($1) IS NOT NULL`, pq.QuoteIdentifier(schemaName)).Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	// The schema can be created, but isn't
+	err = TestConnection(ctx, connectionConfig(t, map[string]interface{}{
+		"conn_str":    connStr,
+		"schema_name": schemaName,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schemaExists() {
+		t.Fatal("the schema has been created")
+	}
+
+	// It must exist when it isn't created
+	err = TestConnection(ctx, connectionConfig(t, map[string]interface{}{
+		"conn_str":             connStr,
+		"schema_name":          schemaName,
+		"skip_schema_creation": true,
+	}))
+	if !errors.Is(err, ErrPermission) || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected an error wrapping ErrPermission, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// connector opens the connections of the backend pool with the pq driver.
+//
+// Unlike a plain pq.Connector it is not limited to a fixed configuration:
+// credentials that expire, like IAM authentication tokens, are requested
+// again for each new physical connection so the pool stays usable for the
+// whole lifetime of the backend.
+type connector struct {
+	connStr string
+
+	// password, when set, is called each time a connection is opened to get
+	// the password to authenticate with.
+	password func(ctx context.Context) (string, error)
+
+	// credentials, when set, is called each time a connection is opened to
+	// get the user name and password to authenticate with.
+	credentials CredentialsProvider
+
+	// dial, when set, replaces the default dialer of the pq driver to
+	// establish the network connections.
+	dial dialerFunc
+
+	// role, when set, is the role the sessions switch to once logged in.
+	role string
+}
+
+var _ driver.Connector = (*connector)(nil)
+
+// Credentials are the user name and password to log in to Postgres with.
+type Credentials struct {
+	User     string
+	Password string
+}
+
+// CredentialsProvider returns the credentials of a new connection to
+// Postgres, such as the short-lived ones of a Vault database secrets engine.
+// An empty user name keeps the one of the connection string.
+type CredentialsProvider func(ctx context.Context) (Credentials, error)
+
+// SetCredentialsProvider makes the backend call provider each time it opens
+// a new connection to get the credentials to log in with, so the connections
+// opened by a long-running process keep getting valid credentials as they
+// are rotated. The connection attempt fails if provider returns an error.
+//
+// It must be called before the backend is configured, and only works with
+// the password authentication method.
+func (b *Backend) SetCredentialsProvider(provider CredentialsProvider) {
+	b.credentials = provider
+}
+
+// Connect implements driver.Connector.
+func (c *connector) Connect(ctx context.Context) (_ driver.Conn, err error) {
+	defer func() { err = redactError(err, connStrSecrets(c.connStr)...) }()
+
+	connStr, err := c.sessionConnStr(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = redactError(err, connStrSecrets(connStr)...) }()
+
+	pqConnector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, err
+	}
+	if c.dial != nil {
+		pqConnector.Dialer(c.dial)
+	}
+	conn, err := pqConnector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.role != "" {
+		if err := setRole(ctx, conn, c.role); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// setRole switches the session of conn to the given role, for the rest of
+// the session.
+func setRole(ctx context.Context, conn driver.Conn, role string) error {
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		return fmt.Errorf("the connection can't run SET ROLE")
+	}
+	quoted := pq.QuoteIdentifier(role)
+	_, err := execer.ExecContext(ctx, "SET ROLE "+quoted, nil)
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr) && pqErr.Code == "42501": // insufficient_privilege
+		return fmt.Errorf("failed to set role %s: %w; the login role must be a member of it, run GRANT %s TO the login role", quoted, err, quoted)
+	case errors.As(err, &pqErr) && pqErr.Code == "22023": // invalid_parameter_value
+		return fmt.Errorf("failed to set role %s: %w; check set_role", quoted, err)
+	case err != nil:
+		return fmt.Errorf("failed to set role %s: %w", quoted, err)
+	}
+	return nil
+}
+
+// sessionConnStr returns the connection string of a new connection, with the
+// credentials to log in with.
+func (c *connector) sessionConnStr(ctx context.Context) (string, error) {
+	connStr := c.connStr
+	if c.password != nil {
+		password, err := c.password(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get the Postgres password: %w", err)
+		}
+		connStr, err = overrideConnStr(connStr, map[string]string{"password": password})
+		if err != nil {
+			return "", err
+		}
+	}
+	if c.credentials != nil {
+		creds, err := c.credentials(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get the Postgres credentials: %w", err)
+		}
+		connStr, err = overrideConnStr(connStr, map[string]string{"user": creds.User, "password": creds.Password})
+		if err != nil {
+			return "", err
+		}
+	}
+	return connStr, nil
+}
+
+// Driver implements driver.Connector.
+func (c *connector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// dialerFunc adapts a dial function to the pq.Dialer and pq.DialerContext
+// interfaces.
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+var (
+	_ pq.Dialer        = dialerFunc(nil)
+	_ pq.DialerContext = dialerFunc(nil)
+)
+
+func (f dialerFunc) Dial(network, address string) (net.Conn, error) {
+	return f(context.Background(), network, address)
+}
+
+func (f dialerFunc) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return f(ctx, network, address)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
@@ -0,0 +1,263 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/lib/pq"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// fakeLoginServer is a Postgres server asking for a cleartext password and
+// recording the credentials and startup parameters each connection logs in
+// with, before refusing them.
+type fakeLoginServer struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	logins  []Credentials
+	startup []map[string]string
+}
+
+func newFakeLoginServer(t *testing.T) *fakeLoginServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeLogins(t, l)
+}
+
+// newFakeSocketLoginServer returns a fakeLoginServer listening on a Unix
+// domain socket for port 5432 in the returned directory.
+func newFakeSocketLoginServer(t *testing.T) (*fakeLoginServer, string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := net.Listen("unix", filepath.Join(dir, ".s.PGSQL.5432"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeLogins(t, l), dir
+}
+
+func serveFakeLogins(t *testing.T, l net.Listener) *fakeLoginServer {
+	s := &fakeLoginServer{listener: l}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeLoginServer) addr() (host, port string) {
+	host, port, _ = net.SplitHostPort(s.listener.Addr().String())
+	return host, port
+}
+
+func (s *fakeLoginServer) Logins() []Credentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Credentials(nil), s.logins...)
+}
+
+func (s *fakeLoginServer) StartupParams() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]string(nil), s.startup...)
+}
+
+func (s *fakeLoginServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// The startup message: its length, the protocol version and the
+	// parameters as null-terminated keys and values.
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return
+	}
+	startup := make([]byte, length-4)
+	if _, err := io.ReadFull(r, startup); err != nil {
+		return
+	}
+	params := bytes.Split(bytes.TrimRight(startup[4:], "\x00"), []byte{0})
+	startupParams := make(map[string]string)
+	for i := 0; i+1 < len(params); i += 2 {
+		startupParams[string(params[i])] = string(params[i+1])
+	}
+	creds := Credentials{User: startupParams["user"]}
+
+	// AuthenticationCleartextPassword, answered with a PasswordMessage.
+	conn.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 3})
+	if _, err := r.ReadByte(); err != nil {
+		return
+	}
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return
+	}
+	password := make([]byte, length-4)
+	if _, err := io.ReadFull(r, password); err != nil {
+		return
+	}
+	creds.Password = strings.TrimRight(string(password), "\x00")
+
+	s.mu.Lock()
+	s.logins = append(s.logins, creds)
+	s.startup = append(s.startup, startupParams)
+	s.mu.Unlock()
+
+	// ErrorResponse, invalid_password.
+	fields := "SFATAL\x00C28P01\x00Mfake login refused\x00\x00"
+	msg := []byte{'E', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(fields)))
+	conn.Write(append(msg, fields...))
+}
+
+func TestConnectorCredentialsProvider(t *testing.T) {
+	server := newFakeLoginServer(t)
+	host, port := server.addr()
+
+	var calls int
+	provider := func(ctx context.Context) (Credentials, error) {
+		calls++
+		// Each lease has its own user, as the Vault database secrets
+		// engine does.
+		return Credentials{
+			User:     fmt.Sprintf("v-token-tofu-%d", calls),
+			Password: fmt.Sprintf("secret-%d", calls),
+		}, nil
+	}
+	c := &connector{
+		connStr:     fmt.Sprintf("host=%s port=%s user=static password=static dbname=tofu sslmode=disable", host, port),
+		credentials: provider,
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Connect(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "fake login refused") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	logins := server.Logins()
+	if len(logins) != 3 {
+		t.Fatalf("%d logins for 3 connections", len(logins))
+	}
+	for i, got := range logins {
+		want := Credentials{User: fmt.Sprintf("v-token-tofu-%d", i+1), Password: fmt.Sprintf("secret-%d", i+1)}
+		if got != want {
+			t.Fatalf("connection %d logged in with %+v; want %+v", i, got, want)
+		}
+	}
+}
+
+func TestConnectorCredentialsProviderError(t *testing.T) {
+	server := newFakeLoginServer(t)
+	host, port := server.addr()
+
+	errLease := errors.New("lease expired")
+	c := &connector{
+		connStr: fmt.Sprintf("host=%s port=%s sslmode=disable", host, port),
+		credentials: func(ctx context.Context) (Credentials, error) {
+			return Credentials{}, errLease
+		},
+	}
+
+	_, err := c.Connect(context.Background())
+	if !errors.Is(err, errLease) || !strings.Contains(err.Error(), "failed to get the Postgres credentials") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logins := server.Logins(); len(logins) != 0 {
+		t.Fatalf("the connection has been attempted: %v", logins)
+	}
+}
+
+func TestBackendCredentialsProviderAuthMethod(t *testing.T) {
+	b := New().(*Backend)
+	b.SetCredentialsProvider(func(context.Context) (Credentials, error) {
+		return Credentials{}, nil
+	})
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":    "host=127.0.0.1 port=1 sslmode=disable",
+		"auth_method": authMethodRDSIAM,
+	})
+	spec := b.ConfigSchema(context.Background()).DecoderSpec()
+	obj, diags := hcldec.Decode(config, spec, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags.Error())
+	}
+	obj, valDiags := b.PrepareConfig(context.Background(), obj)
+	if valDiags.HasErrors() {
+		t.Fatal(valDiags.ErrWithWarnings())
+	}
+	confDiags := b.Configure(context.Background(), obj)
+	if !confDiags.HasErrors() || !strings.Contains(confDiags.ErrWithWarnings().Error(), "cannot be used with auth_method") {
+		t.Fatalf("unexpected result: %v", confDiags.ErrWithWarnings())
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	testCases := map[string]struct {
+		err     error
+		wantErr string
+	}{
+		"member":     {},
+		"not-member": {err: &pq.Error{Code: "42501", Message: `permission denied to set role "tofu owner"`}, wantErr: `run GRANT "tofu owner" TO the login role`},
+		"missing":    {err: &pq.Error{Code: "22023", Message: `role "tofu owner" does not exist`}, wantErr: "check set_role"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeDB{handler: func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+				return nil, tc.err
+			}}
+			conn, err := fake.Connect(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = setRole(context.Background(), conn, "tofu owner")
+			if queries := fake.Queries(); len(queries) != 1 || queries[0] != `SET ROLE "tofu owner"` {
+				t.Fatalf("wrong statements %q", queries)
+			}
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var pqErr *pq.Error
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) || !errors.As(err, &pqErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
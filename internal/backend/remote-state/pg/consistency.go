@@ -0,0 +1,278 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/opentofu/opentofu/internal/states/statefile"
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+// repairReason is the reason recorded in the lock audit table for the
+// orphaned locks released by Repair.
+const repairReason = "orphaned lock released by Repair"
+
+// ConsistencyReport lists the anomalies of the states table found by
+// CheckConsistency, by workspace.
+type ConsistencyReport struct {
+	// OrphanedLocks are the workspaces whose row in the lock table has no
+	// live holder: the session holding the advisory lock is gone, or the
+	// table lock has expired with lock_ttl. Without lock_ttl, the table
+	// locks are never reported, as a live holder cannot be told apart.
+	OrphanedLocks []string
+
+	// EmptyStates are the workspaces, other than the default one, whose
+	// state is still the empty one written when they were created.
+	EmptyStates []string
+
+	// SerialMismatches are the workspaces whose serial column differs from
+	// the serial of their state.
+	SerialMismatches []SerialMismatch
+}
+
+// SerialMismatch is a workspace whose serial column, Stored, differs from
+// the serial of its state, State.
+type SerialMismatch struct {
+	Workspace string
+	Stored    uint64
+	State     uint64
+}
+
+// RepairOptions selects the anomalies of ConsistencyReport fixed by Repair.
+type RepairOptions struct {
+	// OrphanedLocks releases the orphaned locks, recording each release in
+	// the lock audit table as ForceUnlock does.
+	OrphanedLocks bool
+
+	// EmptyStates deletes the workspaces whose state is empty.
+	EmptyStates bool
+
+	// SerialMismatches sets the serial column to the serial of the state.
+	SerialMismatches bool
+}
+
+// CheckConsistency reports the orphaned locks, the empty states and the
+// serial columns not matching their state, without changing anything. Each
+// state is read and decoded, so it takes a statement per workspace.
+func (b *Backend) CheckConsistency(ctx context.Context) (_ *ConsistencyReport, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "check_consistency", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+	return b.checkConsistency(ctx)
+}
+
+func (b *Backend) checkConsistency(ctx context.Context) (*ConsistencyReport, error) {
+	report := &ConsistencyReport{}
+	if condition := b.orphanedLockCondition(); condition != "" {
+		query := fmt.Sprintf(`SELECT k.name FROM %s.%s k WHERE %s ORDER BY k.name`, b.schemaName, b.lockTableName, condition)
+		names, err := queryNames(ctx, nil, b.db, query)
+		if err != nil {
+			return nil, err
+		}
+		report.OrphanedLocks = names
+	}
+
+	query := fmt.Sprintf(`SELECT %[1]s FROM %[2]s.%[3]s ORDER BY %[1]s`, b.nameCol(), b.schemaName, b.tableName)
+	names, err := queryNames(ctx, nil, b.db, query)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		file, stored, err := b.storedState(ctx, b.remoteClient(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to check the state of workspace %q: %w", name, err)
+		}
+		if file == nil {
+			// Deleted since it was listed.
+			continue
+		}
+		if b.isEmptyState(name, file) {
+			report.EmptyStates = append(report.EmptyStates, name)
+		}
+		if stored.Valid && uint64(stored.Int64) != file.Serial {
+			report.SerialMismatches = append(report.SerialMismatches, SerialMismatch{Workspace: name, Stored: uint64(stored.Int64), State: file.Serial})
+		}
+	}
+	return report, nil
+}
+
+// orphanedLockCondition returns the condition matching the rows k of the
+// lock table without a live holder, or an empty string if they cannot be
+// told apart.
+func (b *Backend) orphanedLockCondition() string {
+	switch {
+	case b.lockTableName == "":
+		return ""
+	case b.tableLocks && b.lockTTL > 0:
+		return `k.expires_at < now()`
+	case b.tableLocks:
+		return ""
+	}
+	return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM %s)`, advisoryLocks(b.schemaName, b.tableName, b.nameCol(), "k.name"))
+}
+
+// isEmptyState reports whether file is the empty state written when the
+// given workspace was created, which has never been written since.
+func (b *Backend) isEmptyState(name string, file *statefile.File) bool {
+	return name != b.defaultWorkspace() && file.Serial <= 1 && file.State.Empty()
+}
+
+// storedState returns the state of the workspace of client, read from the
+// primary, and its serial column, NULL without one. The state is nil if the
+// workspace doesn't exist.
+func (b *Backend) storedState(ctx context.Context, client *RemoteClient) (*statefile.File, sql.NullInt64, error) {
+	var stored sql.NullInt64
+	data, _, err := client.queryState(ctx, b.db, b.schemaName, false, b.hasDataOid)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, stored, nil
+	case err != nil:
+		return nil, stored, err
+	}
+	if data, err = client.decodeState(data); err != nil {
+		return nil, stored, err
+	}
+	file, err := statefile.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, stored, err
+	}
+	if b.hasSerial {
+		query := fmt.Sprintf(`SELECT serial FROM %s.%s WHERE %s = $1`, b.schemaName, b.tableName, b.nameCol())
+		if err := b.db.QueryRowContext(ctx, query, client.Name).Scan(&stored); err != nil && err != sql.ErrNoRows {
+			return nil, stored, err
+		}
+	}
+	return file, stored, nil
+}
+
+// Repair fixes the anomalies reported by CheckConsistency selected by opts.
+//
+// It is conservative, so it never clobbers a run in progress: an orphaned
+// lock is only released if it still has no live holder when it is deleted,
+// and each workspace is locked while it is fixed, without waiting for its
+// lock, and checked again once locked. The workspaces that are locked, or
+// that are no longer anomalous, are left as they are. The errors of the
+// workspaces that could not be fixed are returned together once the others
+// are.
+func (b *Backend) Repair(ctx context.Context, opts RepairOptions) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "repair", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+	if b.readOnly {
+		return fmt.Errorf("can't repair the states: %w", ErrReadOnly)
+	}
+
+	report, err := b.checkConsistency(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if opts.OrphanedLocks && len(report.OrphanedLocks) > 0 {
+		if err := b.releaseOrphanedLocks(ctx, report.OrphanedLocks); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release the orphaned locks: %w", err))
+		}
+	}
+	if opts.EmptyStates {
+		for _, name := range report.EmptyStates {
+			err := b.repairWorkspace(ctx, name, func(client *RemoteClient, file *statefile.File, _ sql.NullInt64) error {
+				if !b.isEmptyState(name, file) {
+					return nil
+				}
+				return b.deleteWorkspace(ctx, name, false, true)
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete the empty state %q: %w", name, err))
+			}
+		}
+	}
+	if opts.SerialMismatches {
+		for _, mismatch := range report.SerialMismatches {
+			err := b.repairWorkspace(ctx, mismatch.Workspace, func(client *RemoteClient, file *statefile.File, stored sql.NullInt64) error {
+				if !stored.Valid || uint64(stored.Int64) == file.Serial {
+					return nil
+				}
+				serial := sql.NullInt64{Int64: int64(file.Serial), Valid: file.Serial > 0}
+				query := fmt.Sprintf(`UPDATE %s.%s SET serial = $2 WHERE %s = $1`, b.schemaName, b.tableName, b.nameCol())
+				_, err := b.db.ExecContext(ctx, query, client.Name, serial)
+				return err
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to fix the serial of state %q: %w", mismatch.Workspace, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// repairWorkspace calls fix with the current state of the given workspace
+// and its serial column while the workspace is locked. The workspace is
+// skipped if it has been deleted, and is an error if it is locked by
+// someone else, as it is being used.
+func (b *Backend) repairWorkspace(ctx context.Context, name string, fix func(client *RemoteClient, file *statefile.File, stored sql.NullInt64) error) error {
+	client := b.remoteClient(name)
+	// A single attempt is made, the workspaces in use are not repaired.
+	client.lockTimeout = 0
+	lockInfo := statemgr.NewLockInfo()
+	lockInfo.Operation = "repair"
+	lockID, err := client.LockContext(ctx, lockInfo)
+	if err != nil {
+		return fmt.Errorf("skipped, as it is locked: %w", err)
+	}
+
+	file, stored, err := b.storedState(ctx, client)
+	if err == nil && file != nil {
+		err = fix(client, file, stored)
+	}
+	if unlockErr := client.UnlockContext(context.WithoutCancel(ctx), lockID); unlockErr != nil && err == nil {
+		err = fmt.Errorf("error unlocking Postgres state: %w", unlockErr)
+	}
+	return err
+}
+
+// releaseOrphanedLocks deletes the rows of the lock table of the given
+// workspaces that still have no live holder, and records their release in
+// the lock audit table, in a single transaction.
+func (b *Backend) releaseOrphanedLocks(ctx context.Context, names []string) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`DELETE FROM %s.%s k WHERE k.name = ANY($1) AND %s RETURNING k.name, k.info`, b.schemaName, b.lockTableName, b.orphanedLockCondition())
+	rows, err := tx.QueryContext(ctx, query, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	type released struct{ name, info string }
+	var locks []released
+	for rows.Next() {
+		var lock released
+		if err := rows.Scan(&lock.name, &lock.info); err != nil {
+			rows.Close()
+			return err
+		}
+		locks = append(locks, lock)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(`INSERT INTO %s.%s (name, lock_id, previous_info, reason, unlocked_by) VALUES ($1, $2, $3, $4, $5)`, b.schemaName, b.lockAuditTableName)
+	for _, lock := range locks {
+		var info statemgr.LockInfo
+		// The ID is left empty if the information cannot be read.
+		_ = json.Unmarshal([]byte(lock.info), &info)
+		if _, err := tx.ExecContext(ctx, query, lock.name, info.ID, lock.info, repairReason, statemgr.NewLockInfo().Who); err != nil {
+			return fmt.Errorf("failed to record the release of the lock of state %q: %w", lock.name, err)
+		}
+	}
+	return tx.Commit()
+}
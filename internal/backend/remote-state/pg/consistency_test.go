@@ -0,0 +1,245 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// consistencyState returns a state file of the given serial, empty unless
+// it has an output.
+func consistencyState(serial int, output bool) string {
+	outputs := "{}"
+	if output {
+		outputs = `{"foo": {"value": "bar", "type": "string"}}`
+	}
+	return fmt.Sprintf(`{"version": 4, "terraform_version": "1.6.0", "serial": %d, "lineage": "2c2b6c4e-8b1f-4f4e-9a61-5b0c1b43a7d2", "outputs": %s, "resources": []}`, serial, outputs)
+}
+
+type consistencyRow struct {
+	data   string
+	serial int64
+}
+
+type consistencyLock struct {
+	info    string
+	expired bool
+}
+
+// consistencyHandler is a fakeDB handler keeping the rows of the states
+// table, of the lock table with lock_ttl, and of the lock audit table.
+// onLock is called when a workspace gets locked.
+type consistencyHandler struct {
+	mu     sync.Mutex
+	states map[string]consistencyRow
+	locks  map[string]consistencyLock
+	audit  [][]interface{}
+	onLock func(name string)
+}
+
+func (h *consistencyHandler) handle(query string, args []driver.NamedValue) (*fakeRows, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	names := func(names []string) *fakeRows {
+		sort.Strings(names)
+		rows := &fakeRows{columns: []string{"name"}}
+		for _, name := range names {
+			rows.values = append(rows.values, []driver.Value{name})
+		}
+		return rows
+	}
+	switch {
+	case strings.HasPrefix(query, `SELECT k.name FROM "s"."states_locks" k WHERE k.expires_at < now()`):
+		var orphaned []string
+		for name, lock := range h.locks {
+			if lock.expired {
+				orphaned = append(orphaned, name)
+			}
+		}
+		return names(orphaned), nil
+	case strings.HasPrefix(query, `DELETE FROM "s"."states_locks" k WHERE k.name = ANY($1) AND k.expires_at < now()`):
+		rows := &fakeRows{columns: []string{"name", "info"}}
+		for _, name := range *args[0].Value.(*pq.StringArray) {
+			if lock, ok := h.locks[name]; ok && lock.expired {
+				delete(h.locks, name)
+				rows.values = append(rows.values, []driver.Value{name, lock.info})
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, `SELECT name FROM "s"."states" ORDER BY name`):
+		var all []string
+		for name := range h.states {
+			all = append(all, name)
+		}
+		return names(all), nil
+	case strings.HasPrefix(query, `SELECT data FROM "s"."states" WHERE name = $1`):
+		row, ok := h.states[args[0].Value.(string)]
+		if !ok {
+			return &fakeRows{columns: []string{"data"}}, nil
+		}
+		return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{row.data}}}, nil
+	case strings.HasPrefix(query, `SELECT serial FROM "s"."states" WHERE name = $1`):
+		row := h.states[args[0].Value.(string)]
+		var serial driver.Value
+		if row.serial > 0 {
+			serial = row.serial
+		}
+		return &fakeRows{columns: []string{"serial"}, values: [][]driver.Value{{serial}}}, nil
+	case strings.HasPrefix(query, `UPDATE "s"."states" SET serial = $2 WHERE name = $1`):
+		name := args[0].Value.(string)
+		row := h.states[name]
+		row.serial = args[1].Value.(sql.NullInt64).Int64
+		h.states[name] = row
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, `DELETE FROM "s"."states" WHERE name = $1`):
+		delete(h.states, args[0].Value.(string))
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, `INSERT INTO "s"."states_locks"`):
+		name := args[0].Value.(string)
+		if lock, ok := h.locks[name]; ok && !lock.expired {
+			return &fakeRows{affected: 0}, nil
+		}
+		h.locks[name] = consistencyLock{info: args[1].Value.(string)}
+		if h.onLock != nil {
+			h.onLock(name)
+		}
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, `DELETE FROM "s"."states_locks" WHERE name = $1`):
+		delete(h.locks, args[0].Value.(string))
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, `SELECT info FROM "s"."states_locks"`):
+		return &fakeRows{columns: []string{"info"}}, nil
+	case strings.HasPrefix(query, `INSERT INTO "s"."states_lock_audit"`):
+		var row []interface{}
+		for _, arg := range args {
+			row = append(row, arg.Value)
+		}
+		h.audit = append(h.audit, row)
+		return &fakeRows{affected: 1}, nil
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+}
+
+func TestBackendConsistency(t *testing.T) {
+	h := &consistencyHandler{
+		states: map[string]consistencyRow{
+			backend.DefaultStateName: {data: consistencyState(1, false), serial: 1},
+			"empty":                  {data: consistencyState(1, false), serial: 1},
+			"busy":                   {data: consistencyState(1, false), serial: 1},
+			"raced":                  {data: consistencyState(1, false), serial: 1},
+			"destroyed":              {data: consistencyState(4, false), serial: 4},
+			"used":                   {data: consistencyState(3, true), serial: 3},
+			"drifted":                {data: consistencyState(5, true), serial: 4},
+			"crashed":                {data: consistencyState(2, true), serial: 2},
+		},
+		locks: map[string]consistencyLock{
+			"busy":    {info: `{"ID": "busy-lock"}`},
+			"crashed": {info: `{"ID": "crashed-lock"}`, expired: true},
+		},
+	}
+	db, _ := newFakeDB(t, h.handle)
+	b := &Backend{
+		db:                    db,
+		schemaName:            `"s"`,
+		tableName:             `"states"`,
+		lockTableName:         `"states_locks"`,
+		lockAuditTableName:    `"states_lock_audit"`,
+		tableLocks:            true,
+		lockTTL:               time.Minute,
+		lockHeartbeatInterval: time.Hour,
+		hasSerial:             true,
+	}
+	ctx := context.Background()
+
+	report, err := b.CheckConsistency(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ConsistencyReport{
+		OrphanedLocks:    []string{"crashed"},
+		EmptyStates:      []string{"busy", "empty", "raced"},
+		SerialMismatches: []SerialMismatch{{Workspace: "drifted", Stored: 4, State: 5}},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("wrong report %+v; want %+v", report, want)
+	}
+
+	// The state of raced is written before it is repaired
+	h.onLock = func(name string) {
+		if name == "raced" {
+			h.states[name] = consistencyRow{data: consistencyState(2, true), serial: 2}
+		}
+	}
+	err = b.Repair(ctx, RepairOptions{OrphanedLocks: true, EmptyStates: true, SerialMismatches: true})
+	if err == nil || !strings.Contains(err.Error(), `"busy"`) || !strings.Contains(err.Error(), "locked") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The workspace in use and the one written since the check are kept
+	var kept []string
+	for name := range h.states {
+		kept = append(kept, name)
+	}
+	if _, ok := h.states["empty"]; ok {
+		t.Fatalf("empty has not been deleted: %v", kept)
+	}
+	for _, name := range []string{backend.DefaultStateName, "busy", "raced", "destroyed", "used", "drifted", "crashed"} {
+		if _, ok := h.states[name]; !ok {
+			t.Fatalf("%s has been deleted: %v", name, kept)
+		}
+	}
+	if got := h.states["drifted"].serial; got != 5 {
+		t.Fatalf("the serial of drifted is %d; want 5", got)
+	}
+
+	// Only the orphaned lock is released, and its release recorded
+	if _, ok := h.locks["crashed"]; ok {
+		t.Fatal("the orphaned lock has not been released")
+	}
+	if lock, ok := h.locks["busy"]; !ok || lock.info != `{"ID": "busy-lock"}` {
+		t.Fatalf("the live lock has been released: %v", h.locks)
+	}
+	if len(h.audit) != 1 || h.audit[0][0] != "crashed" || h.audit[0][1] != "crashed-lock" || h.audit[0][3] != repairReason {
+		t.Fatalf("wrong audit rows %v", h.audit)
+	}
+
+	// Nothing else is found once repaired, but the workspace in use
+	report, err = b.CheckConsistency(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &ConsistencyReport{EmptyStates: []string{"busy"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("wrong report %+v; want %+v", report, want)
+	}
+}
+
+func TestBackendRepairReadOnly(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	})
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, readOnly: true}
+	if err := b.Repair(context.Background(), RepairOptions{EmptyStates: true}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected a read-only error, got: %v", err)
+	}
+	if len(fake.Queries()) != 0 {
+		t.Fatalf("statements sent: %v", fake.Queries())
+	}
+}
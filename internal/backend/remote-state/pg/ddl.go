@@ -0,0 +1,47 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// isDuplicateObject reports whether err is caused by an object created by a
+// concurrent session. The statements creating objects IF NOT EXISTS fail
+// this way instead of doing nothing when they race with each other, as when
+// many runs configure the backend of a fresh database at once: the object
+// is then created, by the other session.
+func isDuplicateObject(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "42P06", // duplicate_schema
+		"42P07", // duplicate_table, also of the sequences and indexes
+		"42710", // duplicate_object
+		"42701": // duplicate_column
+		return true
+	case "23505": // unique_violation
+		// Of the system catalogs, such as pg_namespace_nspname_index.
+		return strings.HasPrefix(pqErr.Constraint, "pg_")
+	}
+	return false
+}
+
+// execIfNotExists runs query, a statement creating objects IF NOT EXISTS,
+// which succeeds if they are created by a concurrent session in the
+// meantime.
+func execIfNotExists(ctx context.Context, db *sql.DB, query string) error {
+	_, err := db.ExecContext(ctx, query)
+	if isDuplicateObject(err) {
+		return nil
+	}
+	return err
+}
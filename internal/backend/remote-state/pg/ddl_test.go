@@ -0,0 +1,121 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/lib/pq"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+func TestIsDuplicateObject(t *testing.T) {
+	testCases := map[string]struct {
+		err  error
+		want bool
+	}{
+		"schema":  {err: &pq.Error{Code: "42P06"}, want: true},
+		"table":   {err: fmt.Errorf("failed: %w", &pq.Error{Code: "42P07"}), want: true},
+		"column":  {err: &pq.Error{Code: "42701"}, want: true},
+		"catalog": {err: &pq.Error{Code: "23505", Constraint: "pg_namespace_nspname_index"}, want: true},
+		"row":     {err: &pq.Error{Code: "23505", Constraint: "states_name_key"}},
+		"denied":  {err: &pq.Error{Code: "42501"}},
+		"other":   {err: errors.New("connection refused")},
+		"none":    {},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := isDuplicateObject(tc.err); got != tc.want {
+				t.Fatalf("isDuplicateObject(%v) = %t; want %t", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackendMigrateTablesConcurrently(t *testing.T) {
+	// The columns and the meta table are created by a concurrent
+	// configuration as the migrations run
+	db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "ADD COLUMN IF NOT EXISTS write_token"):
+			return nil, &pq.Error{Code: "42701", Message: `column "write_token" of relation "states" already exists`}
+		case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS"):
+			return nil, &pq.Error{Code: "23505", Constraint: "pg_type_typname_nsp_index", Message: "duplicate key value violates unique constraint"}
+		default:
+			return &fakeRows{affected: 1}, nil
+		}
+	})
+	b := &Backend{schemaName: `"s"`, tableName: `"states"`}
+	if err := b.migrateTables(context.Background(), db, "states", `"states_locks"`, len(tableMigrations)-1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackendConcurrentConfigure(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := "terraform_concurrent_configure"
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Close()
+	defer dbCleaner.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+	if _, err := dbCleaner.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Many runs configure the backend of the empty database at once
+	const runs = 16
+	config := map[string]interface{}{
+		"conn_str":      connStr,
+		"schema_name":   schemaName,
+		"history_limit": 5,
+	}
+	errs := make([]error, runs)
+	var wg sync.WaitGroup
+	for i := 0; i < runs; i++ {
+		b := New().(*Backend)
+		obj, diags := hcldec.Decode(backend.TestWrapConfig(config), b.ConfigSchema(context.Background()).DecoderSpec(), nil)
+		if diags.HasErrors() {
+			t.Fatal(diags.Error())
+		}
+		obj, valDiags := b.PrepareConfig(context.Background(), obj)
+		if valDiags.HasErrors() {
+			t.Fatal(valDiags.ErrWithWarnings())
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = b.Configure(context.Background(), obj).ErrWithWarnings()
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("configuration %d failed: %s", i, err)
+		}
+	}
+
+	var schemas, tables int
+	if err := dbCleaner.QueryRow(`SELECT count(1) FROM pg_namespace WHERE nspname = $1`, schemaName).Scan(&schemas); err != nil {
+		t.Fatal(err)
+	}
+	query := `SELECT count(1) FROM pg_tables WHERE schemaname = $1 AND tablename IN ('states', 'states_locks', 'states_history', 'states_lock_audit', 'tofu_backend_meta')`
+	if err := dbCleaner.QueryRow(query, schemaName).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if schemas != 1 || tables != 5 {
+		t.Fatalf("%d schemas and %d tables; want 1 and 5", schemas, tables)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Diagnostic is the result of one of the checks made by Diagnose.
+type Diagnostic struct {
+	// Check names the check: "connectivity", "schema", "table",
+	// "table_privileges", and "advisory_locks" or "lock_table" depending
+	// on how the states are locked.
+	Check string
+
+	Passed bool
+
+	// Detail describes what was found, and Hint how to fix it when the
+	// check failed.
+	Detail string
+	Hint   string
+}
+
+// Diagnose checks that the backend can be used with its configuration:
+// that Postgres is reachable, that the schema and the states table exist,
+// that the current role has the privileges the backend needs on them, and
+// that the states can be locked unless read_only is set. The other checks
+// are skipped once Postgres can't be reached or the schema can't be used, as
+// they would all fail. The error is only returned if the checks could not be
+// made.
+func (b *Backend) Diagnose(ctx context.Context) (_ []Diagnostic, err error) {
+	if b.db == nil {
+		return nil, fmt.Errorf("the backend is not configured")
+	}
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "diagnose", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	d := &diagnosis{b: b}
+	if d.connectivity(ctx) && d.schema(ctx) {
+		if d.table(ctx, "table", b.schemaName+"."+b.tableName) {
+			d.privileges(ctx, "table_privileges", b.schemaName+"."+b.tableName, b.statePrivileges())
+		}
+		if !b.readOnly {
+			d.locks(ctx)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.diags, nil
+}
+
+// statePrivileges returns the privileges needed on the states table.
+func (b *Backend) statePrivileges() []string {
+	if b.readOnly {
+		return []string{"SELECT"}
+	}
+	return []string{"SELECT", "INSERT", "UPDATE", "DELETE"}
+}
+
+// diagnosis records the results of the checks of Diagnose.
+type diagnosis struct {
+	b     *Backend
+	diags []Diagnostic
+
+	// role is the quoted name of the current role.
+	role string
+}
+
+// add records the result of the given check, which failed if err isn't
+// nil. It reports whether the check passed.
+func (d *diagnosis) add(check string, err error, detail, hint string) bool {
+	diag := Diagnostic{Check: check, Passed: err == nil, Detail: detail}
+	if err != nil {
+		diag.Detail, diag.Hint = err.Error(), hint
+	}
+	d.diags = append(d.diags, diag)
+	return diag.Passed
+}
+
+func (d *diagnosis) connectivity(ctx context.Context) bool {
+	var role string
+	err := d.b.db.QueryRowContext(ctx, `SELECT current_user`).Scan(&role)
+	if err != nil {
+		err = fmt.Errorf("failed to connect to Postgres at %s: %w", d.b.host, err)
+	}
+	d.role = pq.QuoteIdentifier(role)
+	return d.add("connectivity", err,
+		fmt.Sprintf("connected to Postgres at %s as %s", d.b.host, d.role),
+		"check conn_str, and that Postgres accepts the connections of this host and role")
+}
+
+func (d *diagnosis) schema(ctx context.Context) bool {
+	schema := d.b.schemaName
+	var usage sql.NullBool
+	query := `SELECT CASE WHEN to_regnamespace($1) IS NOT NULL THEN has_schema_privilege(to_regnamespace($1), 'USAGE') END`
+	err := d.b.db.QueryRowContext(ctx, query, schema).Scan(&usage)
+	hint := ""
+	switch {
+	case err != nil:
+	case !usage.Valid:
+		err = fmt.Errorf("schema %s does not exist", schema)
+		hint = fmt.Sprintf("unset skip_schema_creation, or run CREATE SCHEMA %s", schema)
+	case !usage.Bool:
+		err = fmt.Errorf("role %s has no USAGE privilege on schema %s", d.role, schema)
+		hint = fmt.Sprintf("run GRANT USAGE ON SCHEMA %s TO %s", schema, d.role)
+	}
+	return d.add("schema", err, fmt.Sprintf("role %s can use schema %s", d.role, schema), hint)
+}
+
+// table checks that the given table exists.
+func (d *diagnosis) table(ctx context.Context, check, table string) bool {
+	var exists bool
+	err := d.b.db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists)
+	if err == nil && !exists {
+		err = fmt.Errorf("table %s does not exist", table)
+	}
+	return d.add(check, err, fmt.Sprintf("table %s exists", table), "unset skip_table_creation, so the table is created")
+}
+
+// privileges checks that the current role has the given privileges on the
+// given table.
+func (d *diagnosis) privileges(ctx context.Context, check, table string, privileges []string) bool {
+	var missing []string
+	for _, privilege := range privileges {
+		var granted bool
+		if err := d.b.db.QueryRowContext(ctx, `SELECT has_table_privilege($1, $2)`, table, privilege).Scan(&granted); err != nil {
+			return d.add(check, err, "", "")
+		}
+		if !granted {
+			missing = append(missing, privilege)
+		}
+	}
+
+	var err error
+	if len(missing) > 0 {
+		err = fmt.Errorf("role %s lacks the %s privileges on table %s", d.role, strings.Join(missing, ", "), table)
+	}
+	return d.add(check, err,
+		fmt.Sprintf("role %s has the %s privileges on table %s", d.role, strings.Join(privileges, ", "), table),
+		fmt.Sprintf("run GRANT %s ON %s TO %s", strings.Join(missing, ", "), table, d.role))
+}
+
+// locks checks that the states can be locked, with the lock table when
+// pgbouncer_compatible is set and with the advisory lock functions
+// otherwise. No lock is taken.
+func (d *diagnosis) locks(ctx context.Context) bool {
+	b := d.b
+	if b.tableLocks {
+		if b.lockTableName == "" {
+			// It is only known once it exists, which Configure checks.
+			return d.add("lock_table", fmt.Errorf("the lock table of %s.%s does not exist", b.schemaName, b.tableName), "", "unset skip_table_creation, so the table is created")
+		}
+		privileges := []string{"SELECT", "INSERT", "DELETE"}
+		if b.lockTTL > 0 {
+			privileges = append(privileges, "UPDATE")
+		}
+		return d.privileges(ctx, "lock_table", b.schemaName+"."+b.lockTableName, privileges)
+	}
+
+	var callable bool
+	query := `SELECT has_function_privilege('pg_try_advisory_lock(bigint)', 'EXECUTE') AND has_function_privilege('pg_advisory_unlock(bigint)', 'EXECUTE')`
+	err := b.db.QueryRowContext(ctx, query).Scan(&callable)
+	if err == nil && !callable {
+		err = fmt.Errorf("role %s can't call the advisory lock functions", d.role)
+	}
+	return d.add("advisory_locks", err, "the advisory lock functions are callable",
+		fmt.Sprintf("run GRANT EXECUTE ON FUNCTION pg_try_advisory_lock(bigint), pg_advisory_unlock(bigint) TO %s, or set pgbouncer_compatible to lock the states with a table", d.role))
+}
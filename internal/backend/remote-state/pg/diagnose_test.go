@@ -0,0 +1,290 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// provisioning describes the objects and privileges a fakeDB handler
+// reports to Diagnose.
+type provisioning struct {
+	Unreachable  bool
+	SchemaUsage  driver.Value // nil if the schema doesn't exist
+	TableMissing bool
+	Denied       map[string]bool // privileges denied on the tables, as "table privilege"
+	NoAdvisory   bool
+}
+
+func (p provisioning) handle(query string, args []driver.NamedValue) (*fakeRows, error) {
+	switch {
+	case query == `SELECT current_user`:
+		if p.Unreachable {
+			return nil, errors.New("connection refused")
+		}
+		return &fakeRows{columns: []string{"current_user"}, values: [][]driver.Value{{"tofu"}}}, nil
+	case strings.Contains(query, "has_schema_privilege"):
+		return &fakeRows{columns: []string{"usage"}, values: [][]driver.Value{{p.SchemaUsage}}}, nil
+	case strings.Contains(query, "to_regclass"):
+		return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{!p.TableMissing}}}, nil
+	case strings.Contains(query, "has_table_privilege"):
+		denied := p.Denied[fmt.Sprintf("%s %s", args[0].Value, args[1].Value)]
+		return &fakeRows{columns: []string{"granted"}, values: [][]driver.Value{{!denied}}}, nil
+	case strings.Contains(query, "has_function_privilege"):
+		return &fakeRows{columns: []string{"callable"}, values: [][]driver.Value{{!p.NoAdvisory}}}, nil
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	}
+}
+
+func TestBackendDiagnose(t *testing.T) {
+	testCases := map[string]struct {
+		Provisioning provisioning
+		TableLocks   bool
+		ReadOnly     bool
+
+		// Checks are the names of the checks made, and Failed the ones
+		// that failed with the hints containing the given string.
+		Checks []string
+		Failed map[string]string
+	}{
+		"provisioned": {
+			Provisioning: provisioning{SchemaUsage: true},
+			Checks:       []string{"connectivity", "schema", "table", "table_privileges", "advisory_locks"},
+		},
+		"unreachable": {
+			Provisioning: provisioning{Unreachable: true},
+			Checks:       []string{"connectivity"},
+			Failed:       map[string]string{"connectivity": "check conn_str"},
+		},
+		"no-schema": {
+			Provisioning: provisioning{},
+			Checks:       []string{"connectivity", "schema"},
+			Failed:       map[string]string{"schema": `CREATE SCHEMA "s"`},
+		},
+		"no-schema-usage": {
+			Provisioning: provisioning{SchemaUsage: false},
+			Checks:       []string{"connectivity", "schema"},
+			Failed:       map[string]string{"schema": `GRANT USAGE ON SCHEMA "s" TO "tofu"`},
+		},
+		"no-table": {
+			Provisioning: provisioning{SchemaUsage: true, TableMissing: true},
+			Checks:       []string{"connectivity", "schema", "table", "advisory_locks"},
+			Failed:       map[string]string{"table": "skip_table_creation"},
+		},
+		"missing-privileges": {
+			Provisioning: provisioning{SchemaUsage: true, Denied: map[string]bool{
+				`"s"."states" INSERT`: true,
+				`"s"."states" DELETE`: true,
+			}},
+			Checks: []string{"connectivity", "schema", "table", "table_privileges", "advisory_locks"},
+			Failed: map[string]string{"table_privileges": `GRANT INSERT, DELETE ON "s"."states" TO "tofu"`},
+		},
+		"no-advisory-locks": {
+			Provisioning: provisioning{SchemaUsage: true, NoAdvisory: true},
+			Checks:       []string{"connectivity", "schema", "table", "table_privileges", "advisory_locks"},
+			Failed:       map[string]string{"advisory_locks": "pgbouncer_compatible"},
+		},
+		"lock-table": {
+			Provisioning: provisioning{SchemaUsage: true, NoAdvisory: true, Denied: map[string]bool{
+				`"s"."states_locks" DELETE`: true,
+			}},
+			TableLocks: true,
+			Checks:     []string{"connectivity", "schema", "table", "table_privileges", "lock_table"},
+			Failed:     map[string]string{"lock_table": `GRANT DELETE ON "s"."states_locks" TO "tofu"`},
+		},
+		"read-only": {
+			Provisioning: provisioning{SchemaUsage: true, NoAdvisory: true, Denied: map[string]bool{
+				`"s"."states" INSERT`: true,
+			}},
+			ReadOnly: true,
+			Checks:   []string{"connectivity", "schema", "table", "table_privileges"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, _ := newFakeDB(t, tc.Provisioning.handle)
+			b := &Backend{db: db, host: "localhost", schemaName: `"s"`, tableName: `"states"`, tableLocks: tc.TableLocks, readOnly: tc.ReadOnly}
+			if tc.TableLocks {
+				b.lockTableName = `"states_locks"`
+			}
+
+			diags, err := b.Diagnose(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var checks []string
+			for _, d := range diags {
+				checks = append(checks, d.Check)
+				hint, failed := tc.Failed[d.Check]
+				if d.Passed == failed {
+					t.Errorf("check %s passed: %t; want %t (%s)", d.Check, d.Passed, !failed, d.Detail)
+				}
+				if failed && !strings.Contains(d.Hint, hint) {
+					t.Errorf("wrong hint of check %s: %q; want %q", d.Check, d.Hint, hint)
+				}
+				if d.Passed && d.Hint != "" {
+					t.Errorf("check %s passed with a hint: %q", d.Check, d.Hint)
+				}
+			}
+			if !reflect.DeepEqual(checks, tc.Checks) {
+				t.Fatalf("wrong checks %v; want %v", checks, tc.Checks)
+			}
+		})
+	}
+}
+
+func TestBackendDiagnoseNotConfigured(t *testing.T) {
+	if _, err := (&Backend{}).Diagnose(context.Background()); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBackendDiagnoseProvisioning(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	b := backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":    connStr,
+		"schema_name": schemaName,
+	})).(*Backend)
+	diags, err := b.Diagnose(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range diags {
+		if !d.Passed {
+			t.Errorf("check %s failed: %s", d.Check, d.Detail)
+		}
+	}
+
+	// A role that can only read the states
+	const role = "terraform_diagnose_reader"
+	dbCleaner.Exec(fmt.Sprintf("DROP OWNED BY %s", role))
+	dbCleaner.Exec(fmt.Sprintf("DROP ROLE IF EXISTS %s", role))
+	for _, query := range []string{
+		fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD 'reader'", role),
+		fmt.Sprintf("GRANT USAGE ON SCHEMA %s TO %s", b.schemaName, role),
+		fmt.Sprintf("GRANT SELECT ON %s.%s TO %s", b.schemaName, b.tableName, role),
+	} {
+		if _, err := dbCleaner.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer dbCleaner.Exec(fmt.Sprintf("DROP ROLE IF EXISTS %s", role))
+	defer dbCleaner.Exec(fmt.Sprintf("DROP OWNED BY %s", role))
+
+	readerConnStr, err := overrideConnStr(connStr, map[string]string{"user": role, "password": "reader"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":             readerConnStr,
+		"schema_name":          schemaName,
+		"skip_schema_creation": true,
+		"skip_table_creation":  true,
+		"skip_index_creation":  true,
+	})).(*Backend)
+	diags, err = reader.Diagnose(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed []string
+	for _, d := range diags {
+		if !d.Passed {
+			failed = append(failed, d.Check)
+			if want := fmt.Sprintf("GRANT INSERT, UPDATE, DELETE ON %s.%s TO %s", b.schemaName, b.tableName, pq.QuoteIdentifier(role)); !strings.Contains(d.Hint, want) {
+				t.Errorf("wrong hint %q; want %q", d.Hint, want)
+			}
+		}
+	}
+	if want := []string{"table_privileges"}; !reflect.DeepEqual(failed, want) {
+		t.Fatalf("wrong failed checks %v; want %v", failed, want)
+	}
+}
+
+func TestBackendSkipCreation(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	// A role that can write the states but not create anything, with the
+	// objects created by an administrator
+	admin := backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":    connStr,
+		"schema_name": schemaName,
+	})).(*Backend)
+	const role = "terraform_skip_creation_writer"
+	dbCleaner.Exec(fmt.Sprintf("DROP OWNED BY %s", role))
+	dbCleaner.Exec(fmt.Sprintf("DROP ROLE IF EXISTS %s", role))
+	for _, query := range []string{
+		fmt.Sprintf("CREATE ROLE %s LOGIN PASSWORD 'writer'", role),
+		fmt.Sprintf("GRANT USAGE ON SCHEMA %s TO %s", admin.schemaName, role),
+		fmt.Sprintf("GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA %s TO %s", admin.schemaName, role),
+		fmt.Sprintf("GRANT USAGE ON SEQUENCE public.global_states_id_seq TO %s", role),
+	} {
+		if _, err := dbCleaner.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer dbCleaner.Exec(fmt.Sprintf("DROP ROLE IF EXISTS %s", role))
+	defer dbCleaner.Exec(fmt.Sprintf("DROP OWNED BY %s", role))
+
+	writerConnStr, err := overrideConnStr(connStr, map[string]string{"user": role, "password": "writer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newWriter := func(schemaName string, skipIndexCreation bool) *Backend {
+		return backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+			"conn_str":             writerConnStr,
+			"schema_name":          schemaName,
+			"skip_schema_creation": true,
+			"skip_table_creation":  true,
+			"skip_index_creation":  skipIndexCreation,
+		})).(*Backend)
+	}
+
+	// The index exists, so it isn't created again
+	writer := newWriter(schemaName, false)
+	s, err := writer.StateMgr(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteState(testState()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PersistState(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The missing objects are reported when used
+	missing := newWriter(schemaName+"_missing", true)
+	_, err = missing.StateMgr(context.Background(), "foo")
+	if err == nil || !strings.Contains(err.Error(), "does not exist; create it") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
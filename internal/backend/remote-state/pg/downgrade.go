@@ -0,0 +1,92 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// ErrStateDowngrade is returned when writing a state over one of a newer
+// format or written by a newer OpenTofu, which happens when an outdated
+// OpenTofu uses a workspace that a newer one has already upgraded.
+var ErrStateDowngrade = errors.New("state downgrade")
+
+// stateVersions returns the format version of the given state data and the
+// version of OpenTofu that wrote it, zero and empty if they cannot be read.
+func stateVersions(data []byte) (format int, tofu string) {
+	var state struct {
+		Version          int    `json:"version"`
+		TerraformVersion string `json:"terraform_version"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, ""
+	}
+	return state.Version, state.TerraformVersion
+}
+
+// checkStateVersion returns an error wrapping ErrStateDowngrade if the
+// stored state of the workspace is of a newer format than the given state
+// data, or has been written by a newer OpenTofu, unless allowStateDowngrade
+// is set, in which case it is only logged. The versions that are unknown,
+// written before the columns were added or unreadable, match any version.
+func (c *RemoteClient) checkStateVersion(ctx context.Context, tx *sql.Tx, data []byte) error {
+	var storedFormat sql.NullInt64
+	var storedTofu sql.NullString
+	query := `SELECT state_version, terraform_version FROM %s.%s WHERE %s = $1%s`
+	err := tx.QueryRowContext(ctx, fmt.Sprintf(query, c.SchemaName, c.TableName, c.nameCol(), notDeleted(c.hasDeletedAt)), c.Name).Scan(&storedFormat, &storedTofu)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	format, tofu := stateVersions(data)
+	olderFormat := format > 0 && storedFormat.Valid && int64(format) < storedFormat.Int64
+	if !olderFormat && !olderVersion(tofu, storedTofu.String) {
+		return nil
+	}
+	written := describeStateVersions(int64(format), tofu)
+	stored := describeStateVersions(storedFormat.Int64, storedTofu.String)
+	if c.allowStateDowngrade {
+		log.Printf("[WARN] pg: writing a state of %s over the state of %s of workspace %q, as allow_state_downgrade is set", written, stored, c.Name)
+		return nil
+	}
+	return fmt.Errorf("%w: workspace %q holds a state of %s, the state written is of %s; upgrade OpenTofu to write it, or set allow_state_downgrade to write it anyway",
+		ErrStateDowngrade, c.Name, stored, written)
+}
+
+// olderVersion reports whether the OpenTofu version v is older than the
+// version than, false if either of them cannot be parsed.
+func olderVersion(v, than string) bool {
+	parsed, err := version.NewVersion(v)
+	if err != nil {
+		return false
+	}
+	parsedThan, err := version.NewVersion(than)
+	if err != nil {
+		return false
+	}
+	return parsed.LessThan(parsedThan)
+}
+
+// describeStateVersions describes the format version of a state and the
+// version of OpenTofu that wrote it, for the error messages.
+func describeStateVersions(format int64, tofu string) string {
+	desc := "an unknown format version"
+	if format > 0 {
+		desc = fmt.Sprintf("format version %d", format)
+	}
+	if tofu != "" {
+		desc += " written by OpenTofu " + tofu
+	}
+	return desc
+}
@@ -0,0 +1,132 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// gzipPrefix starts the states stored gzip-compressed in a text data
+// column, which cannot hold arbitrary bytes, so the compressed state follows
+// the prefix in base64. A state file is a JSON object, so the states stored
+// as is never start with it.
+const gzipPrefix = "tofu:gzip:"
+
+// gzipMagic starts the states stored gzip-compressed in a bytea data column,
+// which holds the compressed state as is.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// encodeState returns the representation of the state file data stored in
+// the database, gzip-compressed if compress is set. bytea is set when the
+// data column is bytea rather than text.
+func encodeState(data []byte, compress, bytea bool) ([]byte, error) {
+	if !compress {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser = nopWriteCloser{&buf}
+	if !bytea {
+		buf.WriteString(gzipPrefix)
+		w = base64.NewEncoder(base64.StdEncoding, &buf)
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// nopWriteCloser is a writer whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// decodeState returns the state file stored as data by encodeState, in
+// either type of data column. The states stored before compression was
+// enabled are returned as is.
+func decodeState(data []byte) ([]byte, error) {
+	var compressed io.Reader
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		compressed = bytes.NewReader(data)
+	case bytes.HasPrefix(data, []byte(gzipPrefix)):
+		compressed = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data[len(gzipPrefix):]))
+	default:
+		return data, nil
+	}
+
+	zr, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress the state: %w", err)
+	}
+	defer zr.Close()
+
+	state, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress the state: %w", err)
+	}
+	return state, nil
+}
+
+// decodeStateReader is decodeState for a stored state read from r.
+func decodeStateReader(r *bufio.Reader) (io.Reader, error) {
+	prefix, err := r.Peek(len(gzipPrefix))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var compressed io.Reader
+	switch {
+	case bytes.HasPrefix(prefix, gzipMagic):
+		compressed = r
+	case bytes.Equal(prefix, []byte(gzipPrefix)):
+		if _, err := r.Discard(len(gzipPrefix)); err != nil {
+			return nil, err
+		}
+		compressed = base64.NewDecoder(base64.StdEncoding, r)
+	default:
+		return r, nil
+	}
+
+	zr, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress the state: %w", err)
+	}
+	return &decompressReader{zr}, nil
+}
+
+// decompressReader reports the errors of the decompression of a state.
+type decompressReader struct {
+	r io.Reader
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("failed to decompress the state: %w", err)
+	}
+	return n, err
+}
+
+// stateChecksum returns the checksum of the state file data written along
+// with it, the hex-encoded SHA-256 of the state before compression.
+func stateChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,150 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEncodeState(t *testing.T) {
+	state := testStateFile(10)
+
+	for _, bytea := range []bool{false, true} {
+		for _, compress := range []bool{false, true} {
+			t.Run(fmt.Sprintf("bytea=%t/compress=%t", bytea, compress), func(t *testing.T) {
+				stored, err := encodeState(state, compress, bytea)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := bytes.HasPrefix(stored, []byte(gzipPrefix)); got != (compress && !bytea) {
+					t.Fatalf("wrong stored format: %.40q", stored)
+				}
+				if got := bytes.HasPrefix(stored, gzipMagic); got != (compress && bytea) {
+					t.Fatalf("wrong stored format: %.40q", stored)
+				}
+
+				got, err := decodeState(stored)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, state) {
+					t.Fatalf("wrong decoded state\ngot:  %.80q\nwant: %.80q", got, state)
+				}
+
+				r, err := decodeStateReader(bufio.NewReader(bytes.NewReader(stored)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err = io.ReadAll(r); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, state) {
+					t.Fatalf("wrong read state\ngot:  %.80q\nwant: %.80q", got, state)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeStateUncompressed(t *testing.T) {
+	// States written before compression was enabled are read as is
+	for _, stored := range []string{"", `{"version": 4, "serial": 1}`, "not a state"} {
+		got, err := decodeState([]byte(stored))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != stored {
+			t.Fatalf("wrong decoded state %q; want %q", got, stored)
+		}
+	}
+}
+
+func TestDecodeStateCorrupted(t *testing.T) {
+	stored, err := encodeState(testStateFile(1), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]string{
+		"not-base64": gzipPrefix + "!!!",
+		"not-gzip":   gzipPrefix + "e30K",
+		"truncated":  string(stored[:len(stored)-8]),
+	}
+	for name, stored := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := decodeState([]byte(stored))
+			if err == nil || !strings.Contains(err.Error(), "failed to decompress the state") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestStateChecksum(t *testing.T) {
+	got := stateChecksum([]byte("{}"))
+	if want := "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"; got != want {
+		t.Fatalf("wrong checksum %s; want %s", got, want)
+	}
+}
+
+func BenchmarkEncodeState(b *testing.B) {
+	state := testStateFile(1000)
+
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%t", compress), func(b *testing.B) {
+			var stored []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				if stored, err = encodeState(state, compress, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(stored)), "stored-bytes")
+			b.ReportMetric(float64(len(stored))/float64(len(state)), "stored/raw")
+		})
+	}
+}
+
+// testStateFile returns a state file with the given number of resources,
+// looking like the ones of a cloud infrastructure.
+func testStateFile(resources int) []byte {
+	var buf strings.Builder
+	buf.WriteString(`{"version": 4, "terraform_version": "1.6.0", "serial": 1, "lineage": "2c2b6c4e-8b1f-4f4e-9a61-5b0c1b43a7d2", "outputs": {}, "resources": [`)
+	for i := 0; i < resources; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `
+    {
+      "mode": "managed",
+      "type": "aws_instance",
+      "name": "web_%d",
+      "provider": "provider[\"registry.opentofu.org/hashicorp/aws\"]",
+      "instances": [
+        {
+          "schema_version": 1,
+          "attributes": {
+            "ami": "ami-0c55b159cbfafe1f0",
+            "arn": "arn:aws:ec2:eu-west-1:123456789012:instance/i-%017x",
+            "id": "i-%017x",
+            "instance_type": "t3.micro",
+            "private_ip": "10.0.%d.%d",
+            "subnet_id": "subnet-0bb1c79de3EXAMPLE",
+            "tags": {"Name": "web-%d", "Environment": "production"},
+            "vpc_security_group_ids": ["sg-0123456789abcdef0"]
+          },
+          "sensitive_attributes": [],
+          "private": "eyJzY2hlbWFfdmVyc2lvbiI6IjEifQ=="
+        }
+      ]
+    }`, i, i*7919, i*7919, i/256, i%256, i)
+	}
+	buf.WriteString("\n  ]\n}\n")
+	return []byte(buf.String())
+}
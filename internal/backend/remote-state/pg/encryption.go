@@ -0,0 +1,120 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrStateDecryption is returned when an encrypted state can't be
+// decrypted, because encryption_key is not set or is not the key it was
+// encrypted with.
+var ErrStateDecryption = errors.New("state decryption failed")
+
+// encryptedPrefix starts the states stored encrypted, followed by the nonce
+// and the sealed state in base64. A state file is a JSON object, so the
+// states stored in clear never start with it.
+const encryptedPrefix = "tofu:aes-gcm:"
+
+// encryptionKeySize is the size of the AES-256 keys of encryption_key.
+const encryptionKeySize = 32
+
+func validateEncryptionKey(v interface{}, k string) ([]string, []error) {
+	if v.(string) == "" {
+		return nil, nil
+	}
+	// The key itself is never part of the error.
+	if key, err := base64.StdEncoding.DecodeString(v.(string)); err != nil || len(key) != encryptionKeySize {
+		return nil, []error{fmt.Errorf("%q must be a base64-encoded %d-byte key", k, encryptionKeySize)}
+	}
+	return nil, nil
+}
+
+// newStateCipher returns the AES-256-GCM cipher of the given base64-encoded
+// key, nil if it is empty.
+func newStateCipher(key string) (cipher.AEAD, error) {
+	if key == "" {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption_key must be a base64-encoded %d-byte key", encryptionKeySize)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealState encrypts the stored representation of a state with a random
+// nonce, which is stored along with it.
+func sealState(aead cipher.AEAD, stored []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(stored)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to encrypt the state: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, stored, nil)
+
+	buf := make([]byte, len(encryptedPrefix)+base64.StdEncoding.EncodedLen(len(sealed)))
+	copy(buf, encryptedPrefix)
+	base64.StdEncoding.Encode(buf[len(encryptedPrefix):], sealed)
+	return buf, nil
+}
+
+// openState returns the stored representation of a state encrypted by
+// sealState. The states stored in clear, written before encryption was
+// enabled, are returned as is.
+func openState(aead cipher.AEAD, stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, []byte(encryptedPrefix)) {
+		return stored, nil
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: the state is encrypted but encryption_key is not set", ErrStateDecryption)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(string(stored[len(encryptedPrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStateDecryption, err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: the encrypted state is truncated", ErrStateDecryption)
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrong encryption_key or corrupted state", ErrStateDecryption)
+	}
+	return data, nil
+}
+
+// openStateReader is openState for a stored state read from r. An
+// encrypted state is read whole, as it is only authenticated at its end.
+func openStateReader(aead cipher.AEAD, r *bufio.Reader) (*bufio.Reader, error) {
+	prefix, err := r.Peek(len(encryptedPrefix))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(prefix, []byte(encryptedPrefix)) {
+		return r, nil
+	}
+
+	stored, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openState(aead, stored)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(bytes.NewReader(data)), nil
+}
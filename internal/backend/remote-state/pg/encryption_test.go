@@ -0,0 +1,267 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// testEncryptionKey returns a base64-encoded key made of the given byte.
+func testEncryptionKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, encryptionKeySize))
+}
+
+func testStateCipher(t *testing.T, b byte) cipher.AEAD {
+	t.Helper()
+	aead, err := newStateCipher(testEncryptionKey(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestValidateEncryptionKey(t *testing.T) {
+	testCases := map[string]bool{
+		"":                   true,
+		testEncryptionKey(1): true,
+		"not base64!":        false,
+		base64.StdEncoding.EncodeToString([]byte("too short")): false,
+	}
+	for key, valid := range testCases {
+		_, errs := validateEncryptionKey(key, "encryption_key")
+		if got := len(errs) == 0; got != valid {
+			t.Errorf("key %q valid: %t; want %t", key, got, valid)
+		}
+		for _, err := range errs {
+			if key != "" && strings.Contains(err.Error(), key) {
+				t.Errorf("the key is part of the error: %s", err)
+			}
+		}
+	}
+}
+
+func TestSealState(t *testing.T) {
+	aead := testStateCipher(t, 1)
+	state := testStateFile(10)
+
+	sealed, err := sealState(aead, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, []byte(encryptedPrefix)) {
+		t.Fatalf("wrong stored format: %.40q", sealed)
+	}
+	if bytes.Contains(sealed, []byte("aws_instance")) {
+		t.Fatal("the state is stored in clear")
+	}
+	// Each write gets its own nonce
+	if again, err := sealState(aead, state); err != nil || bytes.Equal(again, sealed) {
+		t.Fatalf("the state is sealed twice the same way: %v", err)
+	}
+
+	got, err := openState(aead, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, state) {
+		t.Fatalf("wrong decrypted state: %.80q", got)
+	}
+
+	r, err := openStateReader(aead, bufio.NewReader(bytes.NewReader(sealed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err = io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, state) {
+		t.Fatalf("wrong read state: %.80q", got)
+	}
+}
+
+func TestOpenStateFailures(t *testing.T) {
+	sealed, err := sealState(testStateCipher(t, 1), testStateFile(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		AEAD   cipher.AEAD
+		Stored string
+		Error  string
+	}{
+		"no-key":     {Stored: string(sealed), Error: "encryption_key is not set"},
+		"wrong-key":  {AEAD: testStateCipher(t, 2), Stored: string(sealed), Error: "wrong encryption_key"},
+		"tampered":   {AEAD: testStateCipher(t, 1), Stored: string(sealed[:len(sealed)-4]) + "AAAA", Error: "wrong encryption_key or corrupted state"},
+		"truncated":  {AEAD: testStateCipher(t, 1), Stored: encryptedPrefix + "AAAA", Error: "truncated"},
+		"not-base64": {AEAD: testStateCipher(t, 1), Stored: encryptedPrefix + "!!!", Error: "illegal base64"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := openState(tc.AEAD, []byte(tc.Stored))
+			if !errors.Is(err, ErrStateDecryption) || !strings.Contains(err.Error(), tc.Error) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenStateCleartext(t *testing.T) {
+	// States written before encryption was enabled are read as is
+	for _, stored := range []string{"", `{"version": 4, "serial": 1}`, gzipPrefix + "e30K"} {
+		got, err := openState(testStateCipher(t, 1), []byte(stored))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != stored {
+			t.Fatalf("wrong state %q; want %q", got, stored)
+		}
+	}
+}
+
+func TestRemoteClientEncryption(t *testing.T) {
+	var stored []byte
+	db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT data"):
+			return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{stored}}}, nil
+		case strings.HasPrefix(query, "INSERT"):
+			stored = args[1].Value.([]byte)
+			return &fakeRows{affected: 1}, nil
+		default:
+			return &fakeRows{affected: 1}, nil
+		}
+	})
+	newClient := func(aead cipher.AEAD, compress, bytea bool) *RemoteClient {
+		return &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, aead: aead, compress: compress, bytea: bytea}
+	}
+	expectState := func(c *RemoteClient, state []byte) {
+		t.Helper()
+		payload, err := c.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload.Data, state) {
+			t.Fatalf("wrong state: %.80q", payload.Data)
+		}
+	}
+
+	// A state written before enabling encryption
+	cleartext := testStateFile(2)
+	if err := newClient(nil, false, false).Put(cleartext); err != nil {
+		t.Fatal(err)
+	}
+	expectState(newClient(testStateCipher(t, 1), false, false), cleartext)
+
+	for _, bytea := range []bool{false, true} {
+		for _, compress := range []bool{false, true} {
+			t.Run(fmt.Sprintf("bytea=%t/compress=%t", bytea, compress), func(t *testing.T) {
+				// It is encrypted once written again
+				c := newClient(testStateCipher(t, 1), compress, bytea)
+				state := testStateFile(5)
+				if err := c.Put(state); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(stored, []byte(encryptedPrefix)) {
+					t.Fatalf("the state is not encrypted: %.40q", stored)
+				}
+				expectState(c, state)
+
+				for name, c := range map[string]*RemoteClient{
+					"no-key":    newClient(nil, compress, bytea),
+					"wrong-key": newClient(testStateCipher(t, 2), compress, bytea),
+				} {
+					if _, err := c.Get(); !errors.Is(err, ErrStateDecryption) {
+						t.Fatalf("unexpected error with %s: %v", name, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBackendEncryption(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	newBackend := func(key string) *Backend {
+		return backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+			"conn_str":       connStr,
+			"schema_name":    schemaName,
+			"encryption_key": key,
+		})).(*Backend)
+	}
+	storedData := func(name string) string {
+		t.Helper()
+		var data string
+		query := fmt.Sprintf(`SELECT data FROM %s.states WHERE name = $1`, schemaName)
+		if err := dbCleaner.QueryRow(query, name).Scan(&data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	encrypted := newBackend(testEncryptionKey(1))
+	backend.TestBackendStates(t, encrypted)
+
+	// A state written in clear, before enabling encryption
+	cleartext := testStateFile(2)
+	if err := newBackend("").remoteClient("clear").Put(cleartext); err != nil {
+		t.Fatal(err)
+	}
+	state := testStateFile(5)
+	if err := encrypted.remoteClient("secret").Put(state); err != nil {
+		t.Fatal(err)
+	}
+	if data := storedData("secret"); !strings.HasPrefix(data, encryptedPrefix) || strings.Contains(data, "aws_instance") {
+		t.Fatalf("the state is not encrypted: %.40q", data)
+	}
+
+	// Both rows are read with the key
+	for name, want := range map[string][]byte{"clear": cleartext, "secret": state} {
+		payload, err := encrypted.remoteClient(name).Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload.Data, want) {
+			t.Fatalf("wrong state of %s: %.80q", name, payload.Data)
+		}
+	}
+	meta, err := encrypted.StateMetadata(context.Background(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Serial != 1 {
+		t.Fatalf("wrong serial %d; want 1", meta.Serial)
+	}
+
+	// The encrypted one only with the key
+	for key, c := range map[string]*RemoteClient{
+		"no":    newBackend("").remoteClient("secret"),
+		"wrong": newBackend(testEncryptionKey(2)).remoteClient("secret"),
+	} {
+		if _, err := c.Get(); !errors.Is(err, ErrStateDecryption) {
+			t.Fatalf("unexpected error with %s key: %v", key, err)
+		}
+	}
+}
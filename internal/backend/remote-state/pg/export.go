@@ -0,0 +1,124 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"archive/tar"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ExportAll writes to w a tar archive of the states of the workspaces, with
+// an entry named after each workspace holding its state file as stored by
+// OpenTofu, decompressed and decrypted. The default workspace is skipped
+// unless includeDefault is set.
+//
+// The states are all read in the same read-only, repeatable read
+// transaction so the archive is a consistent snapshot, but one at a time so
+// they are never all loaded in memory at once.
+func (b *Backend) ExportAll(ctx context.Context, w io.Writer, includeDefault bool) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "export_all", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	tx, err := b.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT %[3]s FROM %[1]s.%[2]s%[4]s ORDER BY %[3]s`
+	live := ""
+	if b.hasDeletedAt {
+		live = ` WHERE deleted_at IS NULL`
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(query, b.schemaName, b.tableName, b.nameCol(), live))
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if name != b.defaultWorkspace() || includeDefault {
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	exportedAt := time.Now()
+	for _, name := range names {
+		if err := b.exportState(ctx, tx, tw, name, exportedAt); err != nil {
+			return fmt.Errorf("failed to export the state of workspace %q: %w", name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// exportState writes the tar entry of the state of the given workspace,
+// dated when it was last written if known and exportedAt otherwise.
+func (b *Backend) exportState(ctx context.Context, tx *sql.Tx, tw *tar.Writer, name string, exportedAt time.Time) error {
+	var data, large []byte
+	var checksum sql.NullString
+	var updatedAt sql.NullTime
+	columns := []string{b.dataCol()}
+	dest := []interface{}{&data}
+	if b.hasDataOid {
+		columns = append(columns, "lo_get(data_oid)")
+		dest = append(dest, &large)
+	}
+	if b.hasChecksum {
+		columns = append(columns, "checksum")
+		dest = append(dest, &checksum)
+	}
+	if b.hasTimestamps {
+		columns = append(columns, "updated_at")
+		dest = append(dest, &updatedAt)
+	}
+	query := `SELECT %s FROM %s.%s WHERE %s = $1`
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(query, strings.Join(columns, ", "), b.schemaName, b.tableName, b.nameCol()), name).Scan(dest...); err != nil {
+		return err
+	}
+	if large != nil {
+		data = large
+	}
+
+	c := b.remoteClient(name)
+	data, err := c.decodeState(data)
+	if err != nil {
+		return err
+	}
+	if checksum.Valid {
+		if sum := stateChecksum(data); sum != checksum.String {
+			return fmt.Errorf("%w: the checksum of the stored state is %s, expected %s", ErrStateIntegrity, sum, checksum.String)
+		}
+	}
+
+	modTime := exportedAt
+	if updatedAt.Valid {
+		modTime = updatedAt.Time
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o600,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
@@ -0,0 +1,165 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// readTar returns the contents of the entries of the given tar archive by
+// name, and their names in the order of the archive.
+func readTar(t *testing.T, archive []byte) (map[string][]byte, []string) {
+	t.Helper()
+	contents := make(map[string][]byte)
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return contents, names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[header.Name] = data
+		names = append(names, header.Name)
+	}
+}
+
+func TestBackendExportAll(t *testing.T) {
+	states := map[string][]byte{
+		backend.DefaultStateName: testStateFile(1),
+		"bar":                    testStateFile(2),
+		"foo":                    testStateFile(3),
+	}
+	stored := make(map[string][]byte)
+	for name, state := range states {
+		var err error
+		if stored[name], err = encodeState(state, name == "foo", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, fake := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT name"):
+			rows := &fakeRows{columns: []string{"name"}}
+			var names []string
+			for name := range stored {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				rows.values = append(rows.values, []driver.Value{name})
+			}
+			return rows, nil
+		case strings.HasPrefix(query, "SELECT data"):
+			name := args[0].Value.(string)
+			return &fakeRows{columns: []string{"data", "checksum"}, values: [][]driver.Value{{stored[name], stateChecksum(states[name])}}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected statement: %s", query)
+		}
+	})
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, hasChecksum: true}
+
+	for _, includeDefault := range []bool{false, true} {
+		t.Run(fmt.Sprintf("include-default=%t", includeDefault), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := b.ExportAll(context.Background(), &buf, includeDefault); err != nil {
+				t.Fatal(err)
+			}
+			contents, names := readTar(t, buf.Bytes())
+			want := []string{"bar", "foo"}
+			if includeDefault {
+				want = []string{"bar", backend.DefaultStateName, "foo"}
+			}
+			if !reflect.DeepEqual(names, want) {
+				t.Fatalf("wrong entries %v; want %v", names, want)
+			}
+			for name, data := range contents {
+				if !bytes.Equal(data, states[name]) {
+					t.Fatalf("wrong state of %s: %.80q", name, data)
+				}
+			}
+		})
+	}
+
+	// The states are read in a single snapshot
+	for _, opts := range fake.Transactions() {
+		if opts.Isolation != driver.IsolationLevel(sql.LevelRepeatableRead) || !opts.ReadOnly {
+			t.Fatalf("the states are not read in a read-only snapshot: %+v", opts)
+		}
+	}
+	if n := len(fake.Transactions()); n != 2 {
+		t.Fatalf("%d transactions; want 2", n)
+	}
+
+	// A state that doesn't match its checksum isn't exported
+	states["bar"] = testStateFile(4)
+	err := b.ExportAll(context.Background(), io.Discard, false)
+	if !errors.Is(err, ErrStateIntegrity) || !strings.Contains(err.Error(), `workspace "bar"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBackendExportAllStates(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	b := backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":    connStr,
+		"schema_name": schemaName,
+		"compress":    true,
+	})).(*Backend)
+
+	states := map[string][]byte{backend.DefaultStateName: testStateFile(1)}
+	for i := 0; i < 5; i++ {
+		states[fmt.Sprintf("workspace-%d", i)] = testStateFile(i + 2)
+	}
+	for name, state := range states {
+		if err := b.remoteClient(name).Put(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := b.ExportAll(context.Background(), &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := readTar(t, buf.Bytes())
+	if len(contents) != len(states) {
+		t.Fatalf("%d entries; want %d", len(contents), len(states))
+	}
+	for name, state := range states {
+		payload, err := b.remoteClient(name).Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(contents[name], state) || !bytes.Equal(contents[name], payload.Data) {
+			t.Fatalf("wrong state of %s: %.80q", name, contents[name])
+		}
+	}
+}
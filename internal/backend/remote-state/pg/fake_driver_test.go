@@ -0,0 +1,265 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is an in-memory database/sql driver answering the statements with a
+// handler, used to test the backend behavior without a Postgres server.
+type fakeDB struct {
+	mu        sync.Mutex
+	queries   []string
+	txs       []driver.TxOptions
+	deadlines []time.Time
+	commits   int
+	prepares  []string
+	sessions  []int
+	conns     int
+	closed    []int
+
+	// handler answers the statements, returning the rows of the queries.
+	handler func(query string, args []driver.NamedValue) (*fakeRows, error)
+
+	// commitErr, if set, returns the error of each commit. The statements
+	// of the transaction are applied by the handler whatever the error, as
+	// when the outcome of a commit is lost.
+	commitErr func() error
+
+	// pingErr, if set, returns the error of each ping.
+	pingErr func() error
+}
+
+// newFakeDB returns a *sql.DB using a fakeDB with the given handler.
+func newFakeDB(t testing.TB, handler func(query string, args []driver.NamedValue) (*fakeRows, error)) (*sql.DB, *fakeDB) {
+	t.Helper()
+	fake := &fakeDB{handler: handler}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+// Queries returns the statements run so far.
+func (f *fakeDB) Queries() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.queries...)
+}
+
+// Transactions returns the options of the transactions begun so far.
+func (f *fakeDB) Transactions() []driver.TxOptions {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]driver.TxOptions(nil), f.txs...)
+}
+
+// Deadlines returns the deadlines of the contexts of the statements run so
+// far, zero for the contexts without one.
+func (f *fakeDB) Deadlines() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]time.Time(nil), f.deadlines...)
+}
+
+// Prepares returns the statements prepared so far, once per connection
+// they have been prepared on.
+func (f *fakeDB) Prepares() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.prepares...)
+}
+
+// Sessions returns the connections, numbered from 1 in the order they were
+// opened, on which the statements run so far have been run.
+func (f *fakeDB) Sessions() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.sessions...)
+}
+
+// Closed returns the connections closed so far.
+func (f *fakeDB) Closed() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.closed...)
+}
+
+// Commits returns the number of transactions committed so far.
+func (f *fakeDB) Commits() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commits
+}
+
+func (f *fakeDB) run(ctx context.Context, session int, query string, args []driver.NamedValue) (*fakeRows, error) {
+	deadline, _ := ctx.Deadline()
+	f.mu.Lock()
+	f.queries = append(f.queries, query)
+	f.sessions = append(f.sessions, session)
+	f.deadlines = append(f.deadlines, deadline)
+	f.mu.Unlock()
+
+	rows, err := f.handler(query, args)
+	if rows == nil {
+		rows = &fakeRows{}
+	}
+	return rows, err
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conns++
+	return &fakeConn{db: f, id: f.conns}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver { return nil }
+
+type fakeConn struct {
+	db *fakeDB
+
+	// id numbers the connections in the order they were opened.
+	id int
+}
+
+var (
+	_ driver.QueryerContext     = (*fakeConn)(nil)
+	_ driver.ExecerContext      = (*fakeConn)(nil)
+	_ driver.ConnBeginTx        = (*fakeConn)(nil)
+	_ driver.NamedValueChecker  = (*fakeConn)(nil)
+	_ driver.ConnPrepareContext = (*fakeConn)(nil)
+	_ driver.Pinger             = (*fakeConn)(nil)
+)
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.mu.Lock()
+	c.db.prepares = append(c.db.prepares, query)
+	c.db.mu.Unlock()
+	return &fakeStmt{db: c.db, session: c.id, query: query}, nil
+}
+
+func (c *fakeConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Prepare(query)
+}
+
+func (c *fakeConn) Close() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.closed = append(c.db.closed, c.id)
+	return nil
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	c.db.mu.Lock()
+	pingErr := c.db.pingErr
+	c.db.mu.Unlock()
+	if pingErr != nil {
+		return pingErr()
+	}
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{db: c.db}, nil }
+
+func (c *fakeConn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.db.mu.Lock()
+	c.db.txs = append(c.db.txs, opts)
+	c.db.mu.Unlock()
+	return fakeTx{db: c.db}, nil
+}
+
+func (c *fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.db.run(ctx, c.id, query, args)
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	rows, err := c.db.run(ctx, c.id, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(rows.affected), nil
+}
+
+// fakeStmt is a statement prepared on a fakeConn, whose runs are recorded
+// and answered as the ones of the statements run without being prepared.
+type fakeStmt struct {
+	db      *fakeDB
+	session int
+	query   string
+}
+
+var (
+	_ driver.StmtQueryContext = (*fakeStmt)(nil)
+	_ driver.StmtExecContext  = (*fakeStmt)(nil)
+)
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("Exec is not supported, use ExecContext")
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("Query is not supported, use QueryContext")
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.db.run(ctx, s.session, s.query, args)
+}
+
+func (s *fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	rows, err := s.db.run(ctx, s.session, s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(rows.affected), nil
+}
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	tx.db.commits++
+	commitErr := tx.db.commitErr
+	tx.db.mu.Unlock()
+	if commitErr != nil {
+		return commitErr()
+	}
+	return nil
+}
+
+func (fakeTx) Rollback() error { return nil }
+
+// fakeRows are the rows returned by a fakeDB handler. The number of rows
+// affected by a statement is given by affected.
+type fakeRows struct {
+	columns  []string
+	values   [][]driver.Value
+	affected int64
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
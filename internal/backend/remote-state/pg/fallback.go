@@ -0,0 +1,108 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// fallbackTable is the states table of a schema of fallback_schema_names.
+// The states of the workspaces missing from the states table are read from
+// the first fallback table holding them, and written into the states table,
+// so a workspace moves there the first time it is written.
+type fallbackTable struct {
+	// schemaName is the quoted name of the schema, the table has the same
+	// name as the states table.
+	schemaName string
+
+	// hasChecksum is set when the table has the checksum column, which the
+	// tables of older versions of the backend may lack.
+	hasChecksum bool
+
+	// hasDataOid is set when the table has the data_oid column, the states
+	// of the table stored in large objects are then read.
+	hasDataOid bool
+
+	// hasTimestamps and hasWriter are set when the table has the
+	// created_at and updated_at columns, and the writer_version and
+	// writer_host columns.
+	hasTimestamps bool
+	hasWriter     bool
+
+	// hasDeletedAt is set for the states table when it has the deleted_at
+	// column, never for a fallback table, which isn't soft-deleted from.
+	hasDeletedAt bool
+}
+
+// newFallbackTable returns the fallback table of the given schema, which
+// must hold a states table of the given name, with the name and data columns
+// of the states table.
+func (b *Backend) newFallbackTable(ctx context.Context, db *sql.DB, schemaName, fallbackSchemaName, tableName string) (fallbackTable, error) {
+	quoted, err := quoteIdentifier(fallbackSchemaName)
+	if err != nil {
+		return fallbackTable{}, err
+	}
+	if fallbackSchemaName == schemaName {
+		return fallbackTable{}, fmt.Errorf("schema %s is schema_name", quoted)
+	}
+	columns, err := tableColumns(ctx, db, fallbackSchemaName, tableName)
+	if err != nil {
+		return fallbackTable{}, err
+	}
+	if !columns[unquoteIdentifier(b.nameCol())] || !columns[unquoteIdentifier(b.dataCol())] {
+		return fallbackTable{}, fmt.Errorf("schema %s has no states table %s, which is never created in a fallback schema", quoted, tableName)
+	}
+	return fallbackTable{
+		schemaName:    quoted,
+		hasChecksum:   columns["checksum"],
+		hasDataOid:    columns["data_oid"],
+		hasTimestamps: columns["created_at"] && columns["updated_at"],
+		hasWriter:     columns["writer_version"] && columns["writer_host"],
+	}, nil
+}
+
+// stateTables returns the tables the state of the workspace is searched in,
+// the states table and then the fallback tables, the state being read from
+// the first one holding the workspace.
+func (c *RemoteClient) stateTables() []fallbackTable {
+	tables := []fallbackTable{{
+		schemaName:    c.SchemaName,
+		hasChecksum:   c.hasChecksum,
+		hasDataOid:    c.hasDataOid,
+		hasTimestamps: c.hasTimestamps,
+		hasWriter:     c.hasWriter,
+		hasDeletedAt:  c.hasDeletedAt,
+	}}
+	return append(tables, c.fallbackTables...)
+}
+
+// workspacesTable returns the table listing the workspaces in the queries,
+// the states table, or the union of the names of the states table and the
+// fallback tables, which holds each workspace once. The names are always in
+// its name column, whatever name_column is.
+func (b *Backend) workspacesTable() string {
+	column := b.nameCol()
+	if unquoteIdentifier(column) != "name" {
+		column += " AS name"
+	}
+	// The tombstones of the soft-deleted workspaces aren't listed.
+	var where string
+	if b.hasDeletedAt {
+		where = " WHERE deleted_at IS NULL"
+	}
+	if len(b.fallbackTables) == 0 {
+		if column == b.nameCol() && where == "" {
+			return fmt.Sprintf("%s.%s", b.schemaName, b.tableName)
+		}
+		return fmt.Sprintf("(SELECT %s FROM %s.%s%s) AS workspaces", column, b.schemaName, b.tableName, where)
+	}
+	selects := []string{fmt.Sprintf("SELECT %s FROM %s.%s%s", column, b.schemaName, b.tableName, where)}
+	for _, table := range b.fallbackTables {
+		selects = append(selects, fmt.Sprintf("SELECT %s FROM %s.%s", column, table.schemaName, b.tableName))
+	}
+	return fmt.Sprintf("(%s) AS workspaces", strings.Join(selects, " UNION "))
+}
@@ -0,0 +1,231 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+func TestRemoteClientGetFallback(t *testing.T) {
+	// The states by table, foo being in both
+	tables := map[string]map[string][]byte{
+		`"v2"."states"`: {"foo": testStateFile(2)},
+		`"v1"."states"`: {"foo": testStateFile(1), "bar": testStateFile(3)},
+	}
+	db, fake := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		for table, states := range tables {
+			if strings.HasPrefix(query, fmt.Sprintf("SELECT data FROM %s ", table)) {
+				rows := &fakeRows{columns: []string{"data"}}
+				if data, ok := states[args[0].Value.(string)]; ok {
+					rows.values = [][]driver.Value{{data}}
+				}
+				return rows, nil
+			}
+		}
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	})
+	b := &Backend{db: db, schemaName: `"v2"`, tableName: `"states"`, fallbackTables: []fallbackTable{{schemaName: `"v1"`}}}
+
+	testCases := map[string]struct {
+		Expect  []byte
+		Queries int
+	}{
+		"foo":     {Expect: testStateFile(2), Queries: 1},
+		"bar":     {Expect: testStateFile(3), Queries: 2},
+		"missing": {Queries: 2},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			before := len(fake.Queries())
+			payload, err := b.remoteClient(name).Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tc.Expect == nil && payload != nil:
+				t.Fatalf("unexpected state %.80q", payload.Data)
+			case tc.Expect != nil && (payload == nil || !bytes.Equal(payload.Data, tc.Expect)):
+				t.Fatalf("wrong state %v; want %.80q", payload, tc.Expect)
+			}
+			if n := len(fake.Queries()) - before; n != tc.Queries {
+				t.Fatalf("%d statements; want %d", n, tc.Queries)
+			}
+		})
+	}
+}
+
+func TestBackendFallbackSchemas(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemaName := func(version int) string {
+		return fmt.Sprintf("terraform_%s_v%d", t.Name(), version)
+	}
+	newBackend := func(version int, fallbacks ...string) *Backend {
+		config := map[string]interface{}{
+			"conn_str":    connStr,
+			"schema_name": schemaName(version),
+		}
+		if len(fallbacks) > 0 {
+			var fallbackSchemaNames []interface{}
+			for _, name := range fallbacks {
+				fallbackSchemaNames = append(fallbackSchemaNames, name)
+			}
+			config["fallback_schema_names"] = fallbackSchemaNames
+		}
+		return backend.TestBackendConfig(t, New(), backend.TestWrapConfig(config)).(*Backend)
+	}
+	v1 := newBackend(1)
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName(1)))
+	v2 := newBackend(2, schemaName(1))
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName(2)))
+	ctx := context.Background()
+
+	put := func(b *Backend, name string, state []byte) {
+		t.Helper()
+		if err := b.remoteClient(name).Put(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(v1, "old", testStateFile(1))
+	put(v1, "moved", testStateFile(2))
+	put(v2, "moved", testStateFile(3))
+	put(v2, "new", testStateFile(4))
+
+	// The workspaces of both schemas are listed once
+	workspaces, err := v2.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{backend.DefaultStateName, "moved", "new", "old"}; !reflect.DeepEqual(workspaces, want) {
+		t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+	}
+	if count, err := v2.CountWorkspaces(ctx); err != nil || count != 4 {
+		t.Fatalf("counted %d workspaces, %v; want 4", count, err)
+	}
+	if exists, err := v2.WorkspaceExists(ctx, "old"); err != nil || !exists {
+		t.Fatalf("old should exist: %t, %v", exists, err)
+	}
+
+	// The states are read from the first schema holding them
+	expectState := func(b *Backend, name string, want []byte) {
+		t.Helper()
+		payload, err := b.remoteClient(name).Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload == nil || !bytes.Equal(payload.Data, want) {
+			t.Fatalf("wrong state of %s", name)
+		}
+	}
+	expectState(v2, "old", testStateFile(1))
+	expectState(v2, "moved", testStateFile(3))
+	expectState(v2, "new", testStateFile(4))
+
+	// And written into schema_name
+	s, err := v2.StateMgr(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RefreshState(); err != nil {
+		t.Fatal(err)
+	}
+	put(v2, "old", testStateFile(5))
+	expectState(v2, "old", testStateFile(5))
+	expectState(v1, "old", testStateFile(1))
+
+	// The deleted workspaces are deleted from both schemas
+	if err := v2.DeleteWorkspace(ctx, "moved", false); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := v2.DeleteWorkspaces(ctx, "o*", false, false); err != nil || !reflect.DeepEqual(deleted, []string{"old"}) {
+		t.Fatalf("wrong deleted workspaces %v, %v", deleted, err)
+	}
+	workspaces, err = v2.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{backend.DefaultStateName, "new"}; !reflect.DeepEqual(workspaces, want) {
+		t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+	}
+	if workspaces, err := v1.Workspaces(ctx); err != nil || len(workspaces) != 1 {
+		t.Fatalf("wrong workspaces left in the fallback schema %v, %v", workspaces, err)
+	}
+}
+
+func TestRemoteClientMetadataFallback(t *testing.T) {
+	// The workspace foo only exists in the fallback table, which records the
+	// writers unlike the states table
+	state := testStateFile(3)
+	db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, ` FROM "v2"."states" `):
+			if strings.HasPrefix(query, "SELECT substr(") {
+				return nil, fmt.Errorf("chunk read from the states table: %s", query)
+			}
+			return &fakeRows{columns: []string{"size"}}, nil
+		case !strings.Contains(query, ` FROM "v1"."states" `) || args[0].Value != "foo":
+			return nil, fmt.Errorf("unexpected statement: %s", query)
+		case strings.HasPrefix(query, "SELECT substr("):
+			offset, size := args[1].Value.(int), args[2].Value.(int)
+			start, end := min(offset-1, len(state)), min(offset-1+size, len(state))
+			return &fakeRows{columns: []string{"chunk"}, values: [][]driver.Value{{state[start:end]}}}, nil
+		case strings.HasPrefix(query, "SELECT NULL, NULL"):
+			return &fakeRows{columns: []string{"created_at", "updated_at", "size", "writer_version", "writer_host"}, values: [][]driver.Value{{nil, nil, int64(len(state)), "1.6.0", "ci"}}}, nil
+		case strings.Contains(query, "writer_version"):
+			return &fakeRows{columns: []string{"size", "writer_version", "writer_host"}, values: [][]driver.Value{{int64(len(state)), "1.6.0", "ci"}}}, nil
+		case strings.HasPrefix(query, "SELECT coalesce(octet_length(data), 0) FROM"):
+			return &fakeRows{columns: []string{"size"}, values: [][]driver.Value{{int64(len(state))}}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected statement: %s", query)
+		}
+	})
+	b := &Backend{db: db, schemaName: `"v2"`, tableName: `"states"`, fallbackTables: []fallbackTable{{schemaName: `"v1"`, hasWriter: true}}}
+	ctx := context.Background()
+
+	meta, err := b.StateMetadata(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Serial != 1 || meta.Lineage != "2c2b6c4e-8b1f-4f4e-9a61-5b0c1b43a7d2" || meta.Size != int64(len(state)) || meta.WriterHost != "ci" {
+		t.Fatalf("wrong metadata %#v", meta)
+	}
+
+	info, err := b.WorkspaceInfo(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(state)) || info.WriterVersion != "1.6.0" {
+		t.Fatalf("wrong workspace info %#v", info)
+	}
+
+	r, err := b.remoteClient("foo").GetReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil {
+		t.Fatal("no reader of the state of the fallback table")
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, state) {
+		t.Fatalf("wrong state %.80q", got)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+// ErrNotLocked is returned when force-unlocking a workspace that isn't
+// locked.
+var ErrNotLocked = errors.New("state is not locked")
+
+// GetLockInfo returns the information recorded by the holder of the lock of
+// the given workspace, or nil if it isn't locked, without trying to take the
+// lock. It is read from the lock table, so it requires one.
+func (b *Backend) GetLockInfo(ctx context.Context, name string) (*statemgr.LockInfo, error) {
+	if b.lockTableName == "" {
+		return nil, fmt.Errorf("can't read the lock of state %q: the lock table recording the locks doesn't exist; it is created unless skip_table_creation is set", name)
+	}
+	return b.remoteClient(name).lockInfo(ctx)
+}
+
+func (c *RemoteClient) lockInfo(ctx context.Context) (_ *statemgr.LockInfo, err error) {
+	ctx, op := c.startOperation(ctx, "lock_info")
+	defer op.end(&err)
+	return c.readLockInfo(ctx)
+}
+
+// ForceUnlock releases the lock of the given workspace whoever holds it, and
+// records in the lock audit table who released it, why, and the
+// information of the previous holder. lockID is the ID of the lock as known
+// to the caller; it is recorded, but the lock is released even if it is
+// stale, as long as the workspace is locked.
+//
+// An advisory lock can only be released by the session holding it, so that
+// session is terminated. This requires the pg_signal_backend role when it
+// belongs to another database user.
+func (b *Backend) ForceUnlock(ctx context.Context, name, lockID, reason string) error {
+	if b.readOnly {
+		return fmt.Errorf("can't unlock state %q: %w", name, ErrReadOnly)
+	}
+	if reason == "" {
+		return fmt.Errorf("can't unlock state %q: a reason is required to force-unlock it", name)
+	}
+	return b.remoteClient(name).forceUnlock(ctx, lockID, reason)
+}
+
+func (c *RemoteClient) forceUnlock(ctx context.Context, lockID, reason string) (err error) {
+	ctx, op := c.startOperation(ctx, "force_unlock")
+	defer op.end(&err)
+	_, err = c.releaseLock(ctx, lockID, reason)
+	return err
+}
+
+// unlockWorkspaceReason is the reason recorded in the lock audit table for
+// the locks released by UnlockWorkspace.
+const unlockWorkspaceReason = "lock released by UnlockWorkspace"
+
+// UnlockWorkspace releases the lock of the given workspace whoever holds it,
+// without requiring its ID, for administrative recovery. It returns the
+// information recorded by the previous holder, and nil without doing
+// anything if the workspace isn't locked. The release is recorded in the
+// lock audit table as with ForceUnlock, with the ID of the previous holder.
+//
+// The information of an advisory lock is nil if its holder recorded none,
+// even though the lock is released.
+func (b *Backend) UnlockWorkspace(ctx context.Context, name string) (*statemgr.LockInfo, error) {
+	if b.readOnly {
+		return nil, fmt.Errorf("can't unlock state %q: %w", name, ErrReadOnly)
+	}
+	return b.remoteClient(name).unlockWorkspace(ctx)
+}
+
+func (c *RemoteClient) unlockWorkspace(ctx context.Context) (_ *statemgr.LockInfo, err error) {
+	ctx, op := c.startOperation(ctx, "unlock_workspace")
+	defer op.end(&err)
+	info, err := c.releaseLock(ctx, "", unlockWorkspaceReason)
+	if errors.Is(err, ErrNotLocked) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// releaseLock releases the lock of the workspace, records the release in the
+// lock audit table under the given lock ID, or the one of the previous
+// holder if empty, and returns the information of the previous holder. It
+// fails with ErrNotLocked if the workspace isn't locked.
+func (c *RemoteClient) releaseLock(ctx context.Context, lockID, reason string) (*statemgr.LockInfo, error) {
+	tx, err := c.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var previous sql.NullString
+	if c.lockTableName != "" {
+		query := `DELETE FROM %s.%s WHERE name = $1 RETURNING info`
+		err := tx.QueryRowContext(ctx, fmt.Sprintf(query, c.SchemaName, c.lockTableName), c.Name).Scan(&previous)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	var info *statemgr.LockInfo
+	if previous.Valid {
+		info = &statemgr.LockInfo{}
+		// The information is returned as nil if it cannot be read.
+		if err := json.Unmarshal([]byte(previous.String), info); err != nil {
+			info = nil
+		} else if lockID == "" {
+			lockID = info.ID
+		}
+	}
+
+	// The audit row is written before the sessions holding the lock are
+	// terminated, which cannot be rolled back. The user releasing the lock
+	// is identified the same way as the lock holders.
+	query := `INSERT INTO %s.%s (name, lock_id, previous_info, reason, unlocked_by) VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(query, c.SchemaName, c.lockAuditTableName), c.Name, lockID, previous, reason, statemgr.NewLockInfo().Who)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record the unlock of state %q: %w", c.Name, err)
+	}
+
+	var terminated int
+	if !c.tableLocks {
+		query = `SELECT count(*) FILTER (WHERE pg_terminate_backend(l.pid))
+			FROM %s AND l.pid <> pg_backend_pid()`
+		if err := tx.QueryRowContext(ctx, fmt.Sprintf(query, advisoryLocks(c.SchemaName, c.TableName, c.nameCol(), "$1")), c.Name).Scan(&terminated); err != nil {
+			return nil, err
+		}
+	}
+
+	if !previous.Valid && terminated == 0 {
+		return nil, fmt.Errorf("can't unlock state %q: %w", c.Name, ErrNotLocked)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// advisoryLocks returns the FROM clause and the condition selecting the
+// granted advisory locks l of the workspace whose name is the given SQL
+// expression, in the states table t of the given schema.
+func advisoryLocks(schemaName, tableName, nameCol, workspace string) string {
+	// The advisory lock of a workspace is keyed by the id of its row, split
+	// by pg_locks into its high and low 32 bits.
+	return fmt.Sprintf(`pg_locks l, %s.%s t
+		WHERE t.%s = %s AND l.locktype = 'advisory' AND l.granted AND l.objsubid = 1
+		AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+		AND l.classid::bigint = t.id >> 32 AND l.objid::bigint = t.id & 4294967295`, schemaName, tableName, nameCol, workspace)
+}
@@ -0,0 +1,384 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/backend"
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+// lockAuditHandler is a fakeDB handler keeping the rows of the lock table
+// and of the lock audit table. The query terminating the sessions holding
+// an advisory lock reports terminated sessions.
+type lockAuditHandler struct {
+	mu         sync.Mutex
+	locks      map[string]string
+	audit      [][]interface{}
+	terminated int
+}
+
+func (h *lockAuditHandler) handle(query string, args []driver.NamedValue) (*fakeRows, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	name := args[0].Value.(string)
+	switch {
+	case strings.HasPrefix(query, `INSERT INTO "s"."states_locks"`):
+		if _, ok := h.locks[name]; ok {
+			return &fakeRows{affected: 0}, nil
+		}
+		h.locks[name] = args[1].Value.(string)
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, `DELETE FROM "s"."states_locks"`) && strings.Contains(query, "RETURNING info"):
+		info, ok := h.locks[name]
+		if !ok {
+			return &fakeRows{columns: []string{"info"}}, nil
+		}
+		delete(h.locks, name)
+		return &fakeRows{columns: []string{"info"}, values: [][]driver.Value{{info}}}, nil
+	case strings.HasPrefix(query, `SELECT info FROM "s"."states_locks"`):
+		info, ok := h.locks[name]
+		if !ok {
+			return &fakeRows{columns: []string{"info"}}, nil
+		}
+		return &fakeRows{columns: []string{"info"}, values: [][]driver.Value{{[]byte(info)}}}, nil
+	case strings.HasPrefix(query, `INSERT INTO "s"."states_lock_audit"`):
+		var row []interface{}
+		for _, arg := range args {
+			row = append(row, arg.Value)
+		}
+		h.audit = append(h.audit, row)
+		return &fakeRows{affected: 1}, nil
+	case strings.Contains(query, "pg_terminate_backend"):
+		return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{int64(h.terminated)}}}, nil
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+}
+
+func TestBackendForceUnlockChecks(t *testing.T) {
+	b := &Backend{readOnly: true}
+	if err := b.ForceUnlock(context.Background(), "foo", "id", "job died"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected a read-only error, got: %v", err)
+	}
+
+	b = &Backend{}
+	if err := b.ForceUnlock(context.Background(), "foo", "id", ""); err == nil || !strings.Contains(err.Error(), "a reason is required") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBackendGetLockInfo(t *testing.T) {
+	h := &lockAuditHandler{locks: make(map[string]string)}
+	db, fake := newFakeDB(t, h.handle)
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, lockTableName: `"states_locks"`, tableLocks: true}
+	ctx := context.Background()
+
+	// Unlocked
+	info, err := b.GetLockInfo(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != nil {
+		t.Fatalf("lock info of an unlocked workspace: %#v", info)
+	}
+
+	// Locked, the lock isn't taken by reading it
+	holder := statemgr.NewLockInfo()
+	holder.Operation = "apply"
+	if _, err := b.remoteClient("foo").Lock(holder); err != nil {
+		t.Fatal(err)
+	}
+	n := len(fake.Queries())
+	info, err = b.GetLockInfo(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.ID != holder.ID || info.Who != holder.Who || info.Operation != "apply" {
+		t.Fatalf("wrong lock info %#v; want %#v", info, holder)
+	}
+	for _, query := range fake.Queries()[n:] {
+		if !strings.HasPrefix(query, "SELECT") {
+			t.Fatalf("the lock has been written to read it: %s", query)
+		}
+	}
+
+	// Without lock table
+	b.lockTableName = ""
+	if _, err := b.GetLockInfo(ctx, "foo"); err == nil || !strings.Contains(err.Error(), "lock table") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRemoteClientForceUnlock(t *testing.T) {
+	h := &lockAuditHandler{locks: make(map[string]string)}
+	db, fake := newFakeDB(t, h.handle)
+	newClient := func() *RemoteClient {
+		return &RemoteClient{
+			Client:             db,
+			Name:               "foo",
+			SchemaName:         `"s"`,
+			TableName:          `"states"`,
+			lockTableName:      `"states_locks"`,
+			lockAuditTableName: `"states_lock_audit"`,
+			tableLocks:         true,
+		}
+	}
+
+	holder := statemgr.NewLockInfo()
+	holder.Operation = "apply"
+	if _, err := newClient().Lock(holder); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ID known to the operator is stale
+	if err := newClient().forceUnlock(context.Background(), "stale-id", "the CI job died"); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.locks) != 0 {
+		t.Fatal("the lock has not been released")
+	}
+	for _, query := range fake.Queries() {
+		if strings.Contains(query, "pg_terminate_backend") {
+			t.Fatalf("a session has been terminated with table locks: %s", query)
+		}
+	}
+
+	if len(h.audit) != 1 {
+		t.Fatalf("%d audit rows written; want 1", len(h.audit))
+	}
+	row := h.audit[0]
+	if row[0] != "foo" || row[1] != "stale-id" || row[3] != "the CI job died" || row[4] != statemgr.NewLockInfo().Who {
+		t.Fatalf("wrong audit row %v", row)
+	}
+	previous := &statemgr.LockInfo{}
+	if err := json.Unmarshal([]byte(row[2].(sql.NullString).String), previous); err != nil {
+		t.Fatal(err)
+	}
+	if previous.ID != holder.ID || previous.Who != holder.Who || previous.Operation != "apply" {
+		t.Fatalf("wrong previous holder %#v; want %#v", previous, holder)
+	}
+
+	// The workspace can be locked again
+	if _, err := newClient().Lock(statemgr.NewLockInfo()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteClientForceUnlockAdvisory(t *testing.T) {
+	testCases := map[string]struct {
+		LockInfo    bool
+		Terminated  int
+		ExpectError bool
+	}{
+		"holder-alive": {
+			LockInfo:   true,
+			Terminated: 1,
+		},
+		"holder-died": {
+			// The advisory lock has been released with the session of its
+			// holder, its information was left behind.
+			LockInfo: true,
+		},
+		"no-lock-info": {
+			Terminated: 1,
+		},
+		"not-locked": {
+			ExpectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			h := &lockAuditHandler{locks: make(map[string]string), terminated: tc.Terminated}
+			if tc.LockInfo {
+				h.locks["foo"] = string(statemgr.NewLockInfo().Marshal())
+			}
+			db, fake := newFakeDB(t, h.handle)
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, lockTableName: `"states_locks"`, lockAuditTableName: `"states_lock_audit"`}
+
+			err := c.forceUnlock(context.Background(), "id", "the CI job died")
+			if tc.ExpectError {
+				if !errors.Is(err, ErrNotLocked) {
+					t.Fatalf("expected a not locked error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var terminateQueries int
+			for _, query := range fake.Queries() {
+				if strings.Contains(query, "pg_terminate_backend") {
+					terminateQueries++
+				}
+			}
+			if terminateQueries != 1 {
+				t.Fatalf("the holder sessions have been terminated %d times; want 1", terminateQueries)
+			}
+		})
+	}
+}
+
+func TestBackendUnlockWorkspace(t *testing.T) {
+	h := &lockAuditHandler{locks: make(map[string]string)}
+	db, fake := newFakeDB(t, h.handle)
+	b := &Backend{
+		db:                 db,
+		schemaName:         `"s"`,
+		tableName:          `"states"`,
+		lockTableName:      `"states_locks"`,
+		lockAuditTableName: `"states_lock_audit"`,
+		tableLocks:         true,
+	}
+	ctx := context.Background()
+
+	// Unlocked, the audit row is rolled back
+	info, err := b.UnlockWorkspace(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != nil {
+		t.Fatalf("lock info of an unlocked workspace: %#v", info)
+	}
+	if got := fake.Commits(); got != 0 {
+		t.Fatalf("%d transactions committed for an unlocked workspace", got)
+	}
+	h.audit = nil
+
+	// Locked, the lock is released without its ID
+	holder := statemgr.NewLockInfo()
+	holder.Operation = "apply"
+	if _, err := b.remoteClient("foo").Lock(holder); err != nil {
+		t.Fatal(err)
+	}
+	info, err = b.UnlockWorkspace(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.ID != holder.ID || info.Who != holder.Who || info.Operation != "apply" {
+		t.Fatalf("wrong lock info %#v; want %#v", info, holder)
+	}
+	if len(h.locks) != 0 {
+		t.Fatal("the lock has not been released")
+	}
+	if len(h.audit) != 1 {
+		t.Fatalf("%d audit rows written; want 1", len(h.audit))
+	}
+	if row := h.audit[0]; row[0] != "foo" || row[1] != holder.ID || row[3] != unlockWorkspaceReason {
+		t.Fatalf("wrong audit row %v", row)
+	}
+
+	// The workspace can be locked again
+	if _, err := b.remoteClient("foo").Lock(statemgr.NewLockInfo()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackendForceUnlock(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tableLocks := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pgbouncer_compatible=%t", tableLocks), func(t *testing.T) {
+			schemaName := fmt.Sprintf("terraform_force_unlock_%t", tableLocks)
+			defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+			config := backend.TestWrapConfig(map[string]interface{}{
+				"conn_str":             connStr,
+				"schema_name":          schemaName,
+				"pgbouncer_compatible": tableLocks,
+			})
+			holderBackend := backend.TestBackendConfig(t, New(), config).(*Backend)
+			b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+			s, err := holderBackend.StateMgr(context.Background(), "foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			holder := statemgr.NewLockInfo()
+			holder.Operation = "apply"
+			if _, err := s.Lock(holder); err != nil {
+				t.Fatal(err)
+			}
+			info, err := b.GetLockInfo(context.Background(), "foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info == nil || info.ID != holder.ID || info.Operation != "apply" {
+				t.Fatalf("wrong lock info %#v; want %#v", info, holder)
+			}
+
+			if err := b.ForceUnlock(context.Background(), "foo", "stale-id", "the CI job died"); err != nil {
+				t.Fatal(err)
+			}
+
+			var lockID, previousInfo, reason, unlockedBy string
+			query := `SELECT lock_id, previous_info, reason, unlocked_by FROM %s.%s WHERE name = 'foo'`
+			if err := b.db.QueryRow(fmt.Sprintf(query, b.schemaName, b.lockAuditTableName)).Scan(&lockID, &previousInfo, &reason, &unlockedBy); err != nil {
+				t.Fatal(err)
+			}
+			previous := &statemgr.LockInfo{}
+			if err := json.Unmarshal([]byte(previousInfo), previous); err != nil {
+				t.Fatal(err)
+			}
+			if previous.ID != holder.ID || previous.Operation != "apply" {
+				t.Fatalf("wrong previous holder %#v; want %#v", previous, holder)
+			}
+			if lockID != "stale-id" || reason != "the CI job died" || unlockedBy == "" {
+				t.Fatalf("wrong audit row: %q, %q, %q", lockID, reason, unlockedBy)
+			}
+
+			// The workspace can be locked again, and isn't locked anymore
+			// once it is unlocked
+			s, err = b.StateMgr(context.Background(), "foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := s.Lock(statemgr.NewLockInfo())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Unlock(id); err != nil {
+				t.Fatal(err)
+			}
+			if info, err := b.GetLockInfo(context.Background(), "foo"); err != nil || info != nil {
+				t.Fatalf("lock info of an unlocked workspace: %#v, %v", info, err)
+			}
+			if err := b.ForceUnlock(context.Background(), "foo", id, "again"); !errors.Is(err, ErrNotLocked) {
+				t.Fatalf("expected a not locked error, got: %v", err)
+			}
+
+			// Without the lock ID
+			if _, err := holderBackend.remoteClient("foo").Lock(holder); err != nil {
+				t.Fatal(err)
+			}
+			info, err = b.UnlockWorkspace(context.Background(), "foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info == nil || info.ID != holder.ID {
+				t.Fatalf("wrong lock info %#v; want %#v", info, holder)
+			}
+			if info, err := b.UnlockWorkspace(context.Background(), "foo"); err != nil || info != nil {
+				t.Fatalf("unlocked an unlocked workspace: %#v, %v", info, err)
+			}
+		})
+	}
+}
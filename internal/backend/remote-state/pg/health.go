@@ -0,0 +1,144 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// HealthStatus is the outcome of the latest health check started by
+// StartHealthChecks.
+type HealthStatus struct {
+	// Healthy is set when the latest check succeeded.
+	Healthy bool
+
+	// LastError is the error of the latest check, nil if it succeeded.
+	LastError error
+
+	// LastCheck is the time of the latest check, zero until the first one
+	// is done.
+	LastCheck time.Time
+
+	// LastSuccess is the time of the latest check that succeeded, zero if
+	// none did.
+	LastSuccess time.Time
+}
+
+// healthChecker records the outcome of the health checks of a backend. The
+// zero value has no check running.
+type healthChecker struct {
+	mu     sync.Mutex
+	status HealthStatus
+
+	// stop stops the running checks and waits for them, nil if none runs.
+	stop func()
+}
+
+// StartHealthChecks pings the primary right away, then every interval, in
+// the background, until ctx is done or the backend is closed, each ping
+// being bounded by interval. The outcome of the latest ping is returned by
+// HealthStatus, for instance to report the readiness of a service embedding
+// the backend. The pings are operations like the others, so they are
+// recorded by the metrics and the logger, and a change of the health is
+// logged. The checks started before are stopped first, and their outcome
+// discarded.
+//
+// It must be called once the backend is configured.
+func (b *Backend) StartHealthChecks(ctx context.Context, interval time.Duration) error {
+	if b.db == nil {
+		return fmt.Errorf("the backend is not configured")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid health check interval %s, it must be positive", interval)
+	}
+	b.health.stopChecks()
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	b.health.mu.Lock()
+	b.health.status = HealthStatus{}
+	b.health.stop = func() {
+		cancel()
+		<-done
+	}
+	b.health.mu.Unlock()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			checkCtx, cancelCheck := context.WithTimeout(ctx, interval)
+			err := b.checkHealth(checkCtx)
+			cancelCheck()
+			if ctx.Err() != nil {
+				// Stopped while checking, which says nothing of the
+				// health of Postgres.
+				return
+			}
+			b.health.record(err, time.Now())
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// HealthStatus returns the outcome of the latest health check started by
+// StartHealthChecks, which is unhealthy with a zero LastCheck until the first
+// check is done.
+func (b *Backend) HealthStatus() HealthStatus {
+	b.health.mu.Lock()
+	defer b.health.mu.Unlock()
+	return b.health.status
+}
+
+func (b *Backend) checkHealth(ctx context.Context) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "health_check", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+	return b.ping(ctx, b.db)
+}
+
+// record records the outcome of a check done at now, logging the changes of
+// the health.
+func (h *healthChecker) record(err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	first := h.status.LastCheck.IsZero()
+	switch {
+	case err != nil && (first || h.status.Healthy):
+		log.Printf("[WARN] pg: Postgres is unhealthy: %s", err)
+	case err == nil && !first && !h.status.Healthy:
+		log.Printf("[INFO] pg: Postgres is healthy again")
+	}
+	h.status.Healthy = err == nil
+	h.status.LastError = err
+	h.status.LastCheck = now
+	if err == nil {
+		h.status.LastSuccess = now
+	}
+}
+
+// stopChecks stops the running checks, if any, once the check in flight is
+// done.
+func (h *healthChecker) stopChecks() {
+	h.mu.Lock()
+	stop := h.stop
+	h.stop = nil
+	h.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
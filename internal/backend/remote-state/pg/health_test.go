@@ -0,0 +1,118 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForHealth waits for the health status of b to satisfy cond.
+func waitForHealth(t *testing.T, b *Backend, cond func(HealthStatus) bool) HealthStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := b.HealthStatus()
+		if cond(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected health status: %+v", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackendHealthChecks(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		return nil, errors.New("unexpected statement")
+	})
+	var mu sync.Mutex
+	var pingErr error
+	setPingErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		pingErr = err
+	}
+	fake.pingErr = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return pingErr
+	}
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+	if status := b.HealthStatus(); status.Healthy || !status.LastCheck.IsZero() {
+		t.Fatalf("healthy before any check: %+v", status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := b.StartHealthChecks(ctx, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	healthy := waitForHealth(t, b, func(s HealthStatus) bool { return s.Healthy })
+	if healthy.LastError != nil || healthy.LastSuccess.IsZero() {
+		t.Fatalf("wrong healthy status: %+v", healthy)
+	}
+
+	// The failures are reported with their error, along with the last
+	// success
+	logs := captureLog(t)
+	setPingErr(errors.New("connection refused"))
+	unhealthy := waitForHealth(t, b, func(s HealthStatus) bool { return !s.Healthy })
+	if unhealthy.LastError == nil || !strings.Contains(unhealthy.LastError.Error(), "connection refused") {
+		t.Fatalf("wrong error: %v", unhealthy.LastError)
+	}
+	if unhealthy.LastSuccess.Before(healthy.LastSuccess) || !unhealthy.LastCheck.After(unhealthy.LastSuccess) {
+		t.Fatalf("wrong times of the unhealthy status: %+v", unhealthy)
+	}
+
+	setPingErr(nil)
+	recovered := waitForHealth(t, b, func(s HealthStatus) bool { return s.Healthy })
+	if recovered.LastError != nil || !recovered.LastSuccess.After(unhealthy.LastCheck) {
+		t.Fatalf("wrong recovered status: %+v", recovered)
+	}
+	for _, want := range []string{"[WARN] pg: Postgres is unhealthy", "[INFO] pg: Postgres is healthy again"} {
+		if got := logs.String(); strings.Count(got, want) != 1 {
+			t.Fatalf("expected the change of health to be logged once with %q, got:\n%s", want, got)
+		}
+	}
+
+	// No check is done once the context is canceled
+	cancel()
+	b.health.stopChecks()
+	stopped := b.HealthStatus()
+	time.Sleep(10 * time.Millisecond)
+	if status := b.HealthStatus(); status != stopped {
+		t.Fatalf("checked after being stopped: %+v", status)
+	}
+}
+
+func TestBackendHealthChecksClose(t *testing.T) {
+	db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		return nil, errors.New("unexpected statement")
+	})
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, operations: newOperationTracker()}
+	if err := b.StartHealthChecks(context.Background(), 0); err == nil || !strings.Contains(err.Error(), "must be positive") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.StartHealthChecks(context.Background(), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	waitForHealth(t, b, func(s HealthStatus) bool { return s.Healthy })
+
+	// The checks are stopped by Close
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b.health.mu.Lock()
+	defer b.health.mu.Unlock()
+	if b.health.stop != nil {
+		t.Fatal("the health checks are still running")
+	}
+}
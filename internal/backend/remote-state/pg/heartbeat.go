@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// startHeartbeat extends the expiry of the table lock with the given ID
+// every lockHeartbeatInterval until stopHeartbeat is called, so the lock
+// only expires once its holder stops, e.g. because it has been killed.
+func (c *RemoteClient) startHeartbeat(ctx context.Context, id string) {
+	if c.stopHeartbeat != nil {
+		c.stopHeartbeat()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(c.lockHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			held, err := c.heartbeat(ctx, id)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				// The lock expires if this keeps failing.
+				log.Printf("[WARN] pg: failed to extend the lock %s of workspace %q: %s", id, c.Name, err)
+			case !held:
+				log.Printf("[WARN] pg: the lock %s of workspace %q expired and has been taken over", id, c.Name)
+				return
+			}
+		}
+	}()
+
+	c.stopHeartbeat = func() {
+		cancel()
+		<-done
+	}
+}
+
+// heartbeat extends the expiry of the table lock with the given ID by the
+// lock TTL. It returns false if the lock isn't held anymore.
+func (c *RemoteClient) heartbeat(ctx context.Context, id string) (held bool, err error) {
+	ctx, op := c.startOperation(ctx, "lock_heartbeat")
+	defer op.end(&err)
+
+	query := `UPDATE %s.%s SET expires_at = now() + $3 * interval '1 millisecond'
+		WHERE name = $1 AND info::jsonb->>'ID' = $2`
+	res, err := c.Client.ExecContext(ctx, fmt.Sprintf(query, c.SchemaName, c.lockTableName), c.Name, id, c.lockTTL.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,222 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+
+	"github.com/opentofu/opentofu/internal/backend"
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+// expiringLocksHandler is a fakeDB handler keeping the rows of the lock
+// table with their expiry, taking over the expired ones as the lock_ttl
+// statements do.
+func expiringLocksHandler() func(string, []driver.NamedValue) (*fakeRows, error) {
+	type lock struct {
+		info      string
+		id        string
+		expiresAt time.Time
+	}
+	var mu sync.Mutex
+	locks := make(map[string]lock)
+	return func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		name := args[0].Value.(string)
+		switch {
+		case strings.HasPrefix(query, "INSERT INTO") && strings.Contains(query, "expires_at < now()"):
+			if l, ok := locks[name]; ok && time.Now().Before(l.expiresAt) {
+				return &fakeRows{affected: 0}, nil
+			}
+			info := &statemgr.LockInfo{}
+			if err := json.Unmarshal([]byte(args[1].Value.(string)), info); err != nil {
+				return nil, err
+			}
+			ttl := time.Duration(args[2].Value.(int64)) * time.Millisecond
+			locks[name] = lock{info: args[1].Value.(string), id: info.ID, expiresAt: time.Now().Add(ttl)}
+			return &fakeRows{affected: 1}, nil
+		case strings.HasPrefix(query, "UPDATE") && strings.Contains(query, "SET expires_at"):
+			l, ok := locks[name]
+			if !ok || l.id != args[1].Value.(string) {
+				return &fakeRows{affected: 0}, nil
+			}
+			l.expiresAt = time.Now().Add(time.Duration(args[2].Value.(int64)) * time.Millisecond)
+			locks[name] = l
+			return &fakeRows{affected: 1}, nil
+		case strings.HasPrefix(query, "DELETE FROM"):
+			if l, ok := locks[name]; ok && l.id == args[1].Value.(string) {
+				delete(locks, name)
+				return &fakeRows{affected: 1}, nil
+			}
+			return &fakeRows{affected: 0}, nil
+		case strings.HasPrefix(query, "SELECT info"):
+			l, ok := locks[name]
+			if !ok {
+				return &fakeRows{columns: []string{"info"}}, nil
+			}
+			return &fakeRows{columns: []string{"info"}, values: [][]driver.Value{{l.info}}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected query: %s", query)
+		}
+	}
+}
+
+func TestRemoteLockTTL(t *testing.T) {
+	db, _ := newFakeDB(t, expiringLocksHandler())
+	newClient := func() *RemoteClient {
+		return &RemoteClient{
+			Client:                db,
+			Name:                  "foo",
+			SchemaName:            `"s"`,
+			TableName:             `"states"`,
+			lockTableName:         `"states_locks"`,
+			tableLocks:            true,
+			lockTTL:               300 * time.Millisecond,
+			lockHeartbeatInterval: 50 * time.Millisecond,
+		}
+	}
+
+	holder := newClient()
+	holderID, err := holder.Lock(statemgr.NewLockInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is kept by the heartbeat of its holder beyond its TTL
+	other := newClient()
+	time.Sleep(2 * holder.lockTTL)
+	var lockErr *statemgr.LockError
+	if _, err := other.Lock(statemgr.NewLockInfo()); !errors.As(err, &lockErr) {
+		t.Fatalf("expected a lock error, got: %v", err)
+	}
+
+	// The holder dies without unlocking
+	holder.stopHeartbeat()
+	if _, err := other.Lock(statemgr.NewLockInfo()); !errors.As(err, &lockErr) {
+		t.Fatalf("expected a lock error before the lock expires, got: %v", err)
+	}
+	time.Sleep(holder.lockTTL + 100*time.Millisecond)
+	id, err := other.Lock(statemgr.NewLockInfo())
+	if err != nil {
+		t.Fatalf("the expired lock has not been taken over: %s", err)
+	}
+
+	// The lock isn't the one of the dead holder anymore
+	if err := newClient().Unlock(holderID); !errors.As(err, &lockErr) {
+		t.Fatalf("expected a lock error, got: %v", err)
+	}
+	if err := other.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+	if other.stopHeartbeat != nil {
+		t.Fatal("the heartbeat has not been stopped by Unlock")
+	}
+}
+
+func TestBackendConfigLockTTL(t *testing.T) {
+	testCases := map[string]struct {
+		Config map[string]interface{}
+		Error  string
+	}{
+		"advisory-locks": {
+			Config: map[string]interface{}{"lock_ttl": "5m"},
+			Error:  "lock_ttl requires pgbouncer_compatible",
+		},
+		"heartbeat-too-slow": {
+			Config: map[string]interface{}{"pgbouncer_compatible": true, "lock_ttl": "5m", "lock_heartbeat_interval": "5m"},
+			Error:  "lock_heartbeat_interval must be shorter than lock_ttl",
+		},
+		"heartbeat-without-ttl": {
+			Config: map[string]interface{}{"pgbouncer_compatible": true, "lock_heartbeat_interval": "1m"},
+			Error:  "lock_heartbeat_interval requires lock_ttl",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// The options are checked before connecting to the database
+			tc.Config["conn_str"] = "host=127.0.0.1 port=1 sslmode=disable"
+			config := backend.TestWrapConfig(tc.Config)
+
+			b := New().(*Backend)
+			spec := b.ConfigSchema(context.Background()).DecoderSpec()
+			obj, diags := hcldec.Decode(config, spec, nil)
+			if diags.HasErrors() {
+				t.Fatal(diags.Error())
+			}
+			obj, valDiags := b.PrepareConfig(context.Background(), obj)
+			if valDiags.HasErrors() {
+				t.Fatal(valDiags.ErrWithWarnings())
+			}
+
+			confDiags := b.Configure(context.Background(), obj)
+			if !confDiags.HasErrors() {
+				t.Fatal("error expected but got none")
+			}
+			if err := confDiags.ErrWithWarnings().Error(); !strings.Contains(err, tc.Error) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestBackendLockTTL(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":                connStr,
+		"schema_name":             schemaName,
+		"pgbouncer_compatible":    true,
+		"lock_ttl":                "1s",
+		"lock_heartbeat_interval": "200ms",
+	})
+	b1 := backend.TestBackendConfig(t, New(), config).(*Backend)
+	b2 := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	backend.TestBackendStateLocks(t, b1, b2)
+
+	holder := b1.remoteClient("foo")
+	if _, err := holder.Lock(statemgr.NewLockInfo()); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * time.Second)
+	var lockErr *statemgr.LockError
+	if _, err := b2.remoteClient("foo").Lock(statemgr.NewLockInfo()); !errors.As(err, &lockErr) {
+		t.Fatalf("expected a lock error, got: %v", err)
+	}
+
+	// The holder dies without unlocking, its lock is taken over once it
+	// expires
+	holder.stopHeartbeat()
+	time.Sleep(1500 * time.Millisecond)
+	other := b2.remoteClient("foo")
+	id, err := other.Lock(statemgr.NewLockInfo())
+	if err != nil {
+		t.Fatalf("the expired lock has not been taken over: %s", err)
+	}
+	if err := other.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// maxIdentifierLength is the maximum length in bytes of the Postgres
+// identifiers, the server silently truncates the longer ones.
+const maxIdentifierLength = 63
+
+// quoteIdentifier validates name as a Postgres identifier and quotes it, so it
+// can be interpolated in a statement. Embedded double quotes are escaped,
+// so any name the server accepts can be used, including names with
+// uppercase letters or spaces.
+func quoteIdentifier(name string) (string, error) {
+	switch {
+	case name == "":
+		return "", errors.New("identifier cannot be empty")
+	case strings.TrimSpace(name) == "":
+		return "", fmt.Errorf("identifier %q cannot be only whitespace", name)
+	case !utf8.ValidString(name):
+		return "", fmt.Errorf("identifier %q is not valid UTF-8", name)
+	case strings.ContainsRune(name, 0):
+		return "", fmt.Errorf("identifier %q cannot contain a NUL character", name)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		// Such as the line breaks of a name pasted with the rest of a
+		// statement.
+		return "", fmt.Errorf("identifier %q cannot contain control characters", name)
+	case len(name) > maxIdentifierLength:
+		return "", fmt.Errorf("identifier %q is longer than %d bytes", name, maxIdentifierLength)
+	}
+	return pq.QuoteIdentifier(name), nil
+}
+
+// unquoteIdentifier reverts quoteIdentifier.
+func unquoteIdentifier(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.ReplaceAll(s[1:len(s)-1], `""`, `"`)
+	}
+	return s
+}
+
+// nameCol returns the quoted column of the states table holding the names
+// of the workspaces.
+func (b *Backend) nameCol() string {
+	if b.nameColumn == "" {
+		return "name"
+	}
+	return b.nameColumn
+}
+
+// dataCol returns the quoted column of the states table holding the states.
+func (b *Backend) dataCol() string {
+	if b.dataColumn == "" {
+		return "data"
+	}
+	return b.dataColumn
+}
+
+// nameCol is Backend.nameCol for the table of the client.
+func (c *RemoteClient) nameCol() string {
+	if c.nameColumn == "" {
+		return "name"
+	}
+	return c.nameColumn
+}
+
+// dataCol is Backend.dataCol for the table of the client.
+func (c *RemoteClient) dataCol() string {
+	if c.dataColumn == "" {
+		return "data"
+	}
+	return c.dataColumn
+}
@@ -0,0 +1,301 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	testCases := []struct {
+		Name        string
+		Want        string
+		ExpectError string
+	}{
+		{Name: "states", Want: `"states"`},
+		{Name: "My Schema", Want: `"My Schema"`},
+		{Name: `it"s`, Want: `"it""s"`},
+		{Name: `x"; DROP TABLE states; --`, Want: `"x""; DROP TABLE states; --"`},
+		{Name: strings.Repeat("a", maxIdentifierLength), Want: `"` + strings.Repeat("a", maxIdentifierLength) + `"`},
+		{Name: " states", Want: `" states"`},
+		{Name: "", ExpectError: "cannot be empty"},
+		{Name: " \t ", ExpectError: "only whitespace"},
+		{Name: "states\n; DROP TABLE states; --", ExpectError: "control characters"},
+		{Name: "nul\x00", ExpectError: "NUL character"},
+		{Name: "\xff", ExpectError: "not valid UTF-8"},
+		{Name: strings.Repeat("a", maxIdentifierLength+1), ExpectError: "longer than 63 bytes"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			got, err := quoteIdentifier(tc.Name)
+			if tc.ExpectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.ExpectError) {
+					t.Fatalf("expected an error containing %q, got %v", tc.ExpectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.Want {
+				t.Fatalf("wrong quoted identifier %s; want %s", got, tc.Want)
+			}
+			if unquoted := unquoteIdentifier(got); unquoted != tc.Name {
+				t.Fatalf("wrong unquoted identifier %q; want %q", unquoted, tc.Name)
+			}
+		})
+	}
+}
+
+func TestBackendConfigInvalidIdentifier(t *testing.T) {
+	testCases := map[string]struct {
+		config map[string]interface{}
+		want   string
+	}{
+		"long-schema-name": {
+			config: map[string]interface{}{"schema_name": strings.Repeat("s", maxIdentifierLength+1)},
+			want:   "set by schema_name: identifier",
+		},
+		"empty-schema-name": {
+			config: map[string]interface{}{"schema_name": ""},
+			want:   "set by schema_name: identifier cannot be empty",
+		},
+		"whitespace-schema-name": {
+			config: map[string]interface{}{"schema_name": "  "},
+			want:   "set by schema_name: identifier \"  \" cannot be only whitespace",
+		},
+		"injection-schema-name": {
+			config: map[string]interface{}{"schema_name": "s;\nDROP SCHEMA public CASCADE;\n--"},
+			want:   "set by schema_name: identifier \"s;\\nDROP SCHEMA public CASCADE;\\n--\" cannot contain control characters",
+		},
+		"empty-table-name": {
+			config: map[string]interface{}{"table_name": ""},
+			want:   "set by table_name: identifier cannot be empty",
+		},
+		"long-derived-name": {
+			// The lock table is named after the states table
+			config: map[string]interface{}{"table_name": strings.Repeat("t", maxIdentifierLength-2)},
+			want:   "set by table_name: identifier",
+		},
+		"long-history-name": {
+			config: map[string]interface{}{"table_name": strings.Repeat("t", 50), "history_limit": 10},
+			want:   "set by table_name: identifier",
+		},
+		"empty-name-column": {
+			config: map[string]interface{}{"name_column": ""},
+			want:   "set by name_column: identifier cannot be empty",
+		},
+		"long-data-column": {
+			config: map[string]interface{}{"data_column": strings.Repeat("d", maxIdentifierLength+1)},
+			want:   "set by data_column: identifier",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// The names are checked before connecting to the database
+			cfg := map[string]interface{}{"conn_str": "host=127.0.0.1 port=1 sslmode=disable"}
+			for k, v := range tc.config {
+				cfg[k] = v
+			}
+			config := backend.TestWrapConfig(cfg)
+
+			b := New().(*Backend)
+			spec := b.ConfigSchema(context.Background()).DecoderSpec()
+			obj, diags := hcldec.Decode(config, spec, nil)
+			if diags.HasErrors() {
+				t.Fatal(diags.Error())
+			}
+			obj, valDiags := b.PrepareConfig(context.Background(), obj)
+			if valDiags.HasErrors() {
+				t.Fatal(valDiags.ErrWithWarnings())
+			}
+
+			confDiags := b.Configure(context.Background(), obj)
+			if !confDiags.HasErrors() {
+				t.Fatal("error expected but got none")
+			}
+			if err := confDiags.ErrWithWarnings().Error(); !strings.Contains(err, "invalid schema, table or column name "+tc.want) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+// customColumnsHandler is a fakeDB handler keeping in memory the states of a
+// table whose columns are "workspace" and "payload", failing the statements
+// referring to the default name and data columns as the server would.
+type customColumnsHandler struct {
+	mu     sync.Mutex
+	states map[string][]byte
+}
+
+var defaultColumnPattern = regexp.MustCompile(`\b(name|data)\b`)
+
+func (h *customColumnsHandler) handle(query string, args []driver.NamedValue) (*fakeRows, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The listings refer to the name column of the workspaces subquery.
+	const workspaces = `(SELECT "workspace" AS name FROM "s"."states") AS workspaces`
+	if column := defaultColumnPattern.FindString(query); column != "" && !strings.Contains(query, workspaces) {
+		return nil, fmt.Errorf("column %q does not exist: %s", column, query)
+	}
+
+	switch {
+	case strings.HasPrefix(query, "SELECT name FROM "+workspaces+" WHERE name != 'default' ORDER BY name"):
+		var names []string
+		for name := range h.states {
+			if name != backend.DefaultStateName {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		rows := &fakeRows{columns: []string{"name"}}
+		for _, name := range names {
+			rows.values = append(rows.values, []driver.Value{name})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT EXISTS(SELECT 1 FROM "+workspaces+" WHERE name = $1)"):
+		_, ok := h.states[args[0].Value.(string)]
+		return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{ok}}}, nil
+	case strings.HasPrefix(query, `INSERT INTO "s"."states" ("workspace", "payload") VALUES ($1, $2)`) && strings.Contains(query, `ON CONFLICT ("workspace")`):
+		h.states[args[0].Value.(string)] = args[1].Value.([]byte)
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, `SELECT "payload" FROM "s"."states" WHERE "workspace" = $1`):
+		rows := &fakeRows{columns: []string{"payload"}}
+		if state, ok := h.states[args[0].Value.(string)]; ok {
+			rows.values = [][]driver.Value{{state}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, `DELETE FROM "s"."states" WHERE "workspace" = $1`):
+		delete(h.states, args[0].Value.(string))
+		return &fakeRows{affected: 1}, nil
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	}
+}
+
+func TestBackendCustomColumnQueries(t *testing.T) {
+	h := &customColumnsHandler{states: map[string][]byte{}}
+	db, _ := newFakeDB(t, h.handle)
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, nameColumn: `"workspace"`, dataColumn: `"payload"`}
+	ctx := context.Background()
+
+	expectWorkspaces := func(want ...string) {
+		t.Helper()
+		workspaces, err := b.Workspaces(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append([]string{backend.DefaultStateName}, want...)
+		if !reflect.DeepEqual(workspaces, want) {
+			t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+		}
+	}
+
+	if _, err := b.StateMgr(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	expectWorkspaces("foo")
+
+	client := b.remoteClient("foo")
+	if err := client.Put(testStateFile(1)); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload == nil || !bytes.Equal(payload.Data, testStateFile(1)) {
+		t.Fatal("wrong state of foo")
+	}
+
+	if err := b.DeleteWorkspace(ctx, "foo", true); err != nil {
+		t.Fatal(err)
+	}
+	expectWorkspaces()
+}
+
+func TestBackendCustomColumns(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+	ctx := context.Background()
+
+	// A states table provisioned with other columns
+	if _, err := dbCleaner.Exec(fmt.Sprintf(`CREATE SCHEMA %s`, schemaName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbCleaner.Exec(fmt.Sprintf(`CREATE TABLE %s.states (id bigserial PRIMARY KEY, "Workspace" text UNIQUE, payload text)`, schemaName)); err != nil {
+		t.Fatal(err)
+	}
+	b := backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":            connStr,
+		"schema_name":         schemaName,
+		"skip_table_creation": true,
+		"name_column":         "Workspace",
+		"data_column":         "payload",
+	})).(*Backend)
+
+	if _, err := b.StateMgr(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.remoteClient("foo").Put(testStateFile(1)); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := b.remoteClient("foo").Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload == nil || !bytes.Equal(payload.Data, testStateFile(1)) {
+		t.Fatal("wrong state of foo")
+	}
+	workspaces, err := b.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{backend.DefaultStateName, "foo"}; !reflect.DeepEqual(workspaces, want) {
+		t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+	}
+
+	var stored string
+	query := `SELECT payload FROM %s.states WHERE "Workspace" = 'foo'`
+	if err := dbCleaner.QueryRow(fmt.Sprintf(query, schemaName)).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != string(testStateFile(1)) {
+		t.Fatal("the state is not stored in the payload column")
+	}
+
+	if err := b.DeleteWorkspace(ctx, "foo", false); err != nil {
+		t.Fatal(err)
+	}
+	if workspaces, err = b.Workspaces(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{backend.DefaultStateName}; !reflect.DeepEqual(workspaces, want) {
+		t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/opentofu/opentofu/internal/states/statefile"
+)
+
+// ImportAll recreates the workspaces of a tar archive written by ExportAll,
+// read from r. A workspace that already exists is an error wrapping
+// ErrWorkspaceAlreadyExists, unless overwrite is set.
+//
+// Each state is written in its own transaction, as OpenTofu writes it: it
+// must be a valid state file, and when it overwrites an existing state
+// without a higher serial it gets the serial following the current one, as
+// with RollbackWorkspace, so it is newer. The workspaces imported before an
+// error are kept, the one that failed is left as it was.
+func (b *Backend) ImportAll(ctx context.Context, r io.Reader, overwrite bool) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "import_all", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+	if b.readOnly {
+		return fmt.Errorf("can't import the states: %w", ErrReadOnly)
+	}
+
+	defer b.workspacesCache.invalidate()
+	b.replica.changedWorkspaces()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected entry %q in the archive, which should only hold the states of the workspaces", header.Name)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("failed to read the archive: %w", err)
+		}
+		if err := b.importState(ctx, header.Name, data, overwrite); err != nil {
+			return fmt.Errorf("failed to import the state of workspace %q: %w", header.Name, err)
+		}
+	}
+}
+
+// importState writes data as the state of the given workspace.
+func (b *Backend) importState(ctx context.Context, name string, data []byte, overwrite bool) error {
+	if name == "" {
+		return fmt.Errorf("the workspace has no name")
+	}
+	f, err := statefile.Read(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	client := b.remoteClient(name)
+	if !overwrite {
+		if name != b.defaultWorkspace() {
+			if err := b.checkWorkspaceName(name); err != nil {
+				return err
+			}
+		}
+		created, err := client.create(ctx, data)
+		if err != nil {
+			return err
+		}
+		if !created {
+			return ErrWorkspaceAlreadyExists
+		}
+		return nil
+	}
+
+	// The current state is read from the primary, as it is written over,
+	// whatever its lineage.
+	b.replica.wroteStates(name)
+	client.replacesLineage = true
+	payload, err := client.Get()
+	if err != nil {
+		return err
+	}
+	// An existing workspace is written over whatever its name, as its
+	// state can be written once workspace_name_pattern is set.
+	if payload == nil && name != b.defaultWorkspace() {
+		if err := b.checkWorkspaceName(name); err != nil {
+			return err
+		}
+	}
+	if payload != nil {
+		current, err := statefile.Read(bytes.NewReader(payload.Data))
+		if err == nil && f.Serial <= current.Serial {
+			f.Serial = current.Serial + 1
+			var buf bytes.Buffer
+			if err := statefile.Write(f, &buf); err != nil {
+				return err
+			}
+			data = buf.Bytes()
+		}
+	}
+	return client.Put(data)
+}
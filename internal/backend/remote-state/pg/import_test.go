@@ -0,0 +1,246 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// writeTar returns a tar archive with an entry for each of the given states,
+// in the order of their names.
+func writeTar(t *testing.T, states map[string][]byte) []byte {
+	t.Helper()
+	var names []string
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o600, Size: int64(len(states[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(states[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// memoryStates is a fakeDB handler keeping the states written in memory.
+type memoryStates struct {
+	mu     sync.Mutex
+	states map[string][]byte
+}
+
+func (m *memoryStates) handle(query string, args []driver.NamedValue) (*fakeRows, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(query, "SELECT data"):
+		rows := &fakeRows{columns: []string{"data"}}
+		if data, ok := m.states[args[0].Value.(string)]; ok {
+			rows.values = [][]driver.Value{{data}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "INSERT INTO"):
+		name := args[0].Value.(string)
+		if _, ok := m.states[name]; ok && strings.Contains(query, "DO NOTHING") {
+			return &fakeRows{affected: 0}, nil
+		}
+		m.states[name] = args[1].Value.([]byte)
+		return &fakeRows{affected: 1}, nil
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	}
+}
+
+func TestBackendImportAll(t *testing.T) {
+	// The state of foo stored before the import
+	existing := bytes.Replace(testStateFile(1), []byte(`"serial": 1`), []byte(`"serial": 5`), 1)
+	newer := bytes.Replace(testStateFile(3), []byte(`"serial": 1`), []byte(`"serial": 7`), 1)
+
+	testCases := map[string]struct {
+		Overwrite bool
+		Archive   map[string][]byte
+
+		// Expect are the states stored after the import, and Serial the
+		// serial of the state of foo when it is overwritten.
+		Expect map[string][]byte
+		Serial uint64
+		Error  string
+	}{
+		"fresh": {
+			Archive: map[string][]byte{"bar": testStateFile(2), "baz": testStateFile(3)},
+			Expect:  map[string][]byte{"foo": existing, "bar": testStateFile(2), "baz": testStateFile(3)},
+		},
+		"collision": {
+			// The workspaces are imported in order, until the collision
+			Archive: map[string][]byte{"bar": testStateFile(2), "foo": testStateFile(3), "qux": testStateFile(4)},
+			Expect:  map[string][]byte{"foo": existing, "bar": testStateFile(2)},
+			Error:   `workspace "foo": workspace already exists`,
+		},
+		"overwrite-newer": {
+			Overwrite: true,
+			Archive:   map[string][]byte{"bar": testStateFile(2), "foo": newer},
+			Expect:    map[string][]byte{"foo": newer, "bar": testStateFile(2)},
+			Serial:    7,
+		},
+		"overwrite-older": {
+			// The imported state gets the serial following the current one
+			Overwrite: true,
+			Archive:   map[string][]byte{"foo": testStateFile(3)},
+			Serial:    6,
+		},
+		"invalid": {
+			Archive: map[string][]byte{"bar": []byte("not a state")},
+			Expect:  map[string][]byte{"foo": existing},
+			Error:   `failed to import the state of workspace "bar"`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &memoryStates{states: map[string][]byte{"foo": existing}}
+			db, _ := newFakeDB(t, m.handle)
+			b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+
+			err := b.ImportAll(context.Background(), bytes.NewReader(writeTar(t, tc.Archive)), tc.Overwrite)
+			if tc.Error != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.Error) {
+					t.Fatalf("unexpected error: %v; want %q", err, tc.Error)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if name == "collision" && !errors.Is(err, ErrWorkspaceAlreadyExists) {
+				t.Fatalf("the error doesn't wrap ErrWorkspaceAlreadyExists: %v", err)
+			}
+
+			for name, want := range tc.Expect {
+				if !bytes.Equal(m.states[name], want) {
+					t.Errorf("wrong state of %s: %.80q", name, m.states[name])
+				}
+			}
+			if tc.Serial > 0 {
+				foo := m.states["foo"]
+				if got := stateSerial(foo); got != tc.Serial {
+					t.Errorf("wrong serial of foo: %d; want %d", got, tc.Serial)
+				}
+				if !strings.Contains(string(foo), `"web_2"`) {
+					t.Errorf("the state of foo is not the imported one: %.80q", foo)
+				}
+			}
+			if want := max(len(tc.Expect), 1); len(m.states) != want {
+				t.Errorf("%d states stored; want %d", len(m.states), want)
+			}
+		})
+	}
+}
+
+func TestBackendImportAllReadOnly(t *testing.T) {
+	db, fake := newFakeDB(t, (&memoryStates{states: map[string][]byte{}}).handle)
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, readOnly: true}
+
+	archive := writeTar(t, map[string][]byte{"foo": testStateFile(1)})
+	if err := b.ImportAll(context.Background(), bytes.NewReader(archive), true); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := len(fake.Queries()); n != 0 {
+		t.Fatalf("%d statements sent in read-only mode", n)
+	}
+}
+
+func TestBackendImportAllStates(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBackend := func(schemaName string) *Backend {
+		return backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+			"conn_str":      connStr,
+			"schema_name":   schemaName,
+			"history_limit": 2,
+		})).(*Backend)
+	}
+	source := newBackend(fmt.Sprintf("terraform_%s_source", t.Name()))
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS terraform_%s_source CASCADE", t.Name()))
+	dest := newBackend(fmt.Sprintf("terraform_%s_dest", t.Name()))
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS terraform_%s_dest CASCADE", t.Name()))
+	ctx := context.Background()
+
+	states := map[string][]byte{}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("workspace-%d", i)
+		states[name] = testStateFile(i + 1)
+		if err := source.remoteClient(name).Put(states[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var archive bytes.Buffer
+	if err := source.ExportAll(ctx, &archive, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fresh import
+	if err := dest.ImportAll(ctx, bytes.NewReader(archive.Bytes()), false); err != nil {
+		t.Fatal(err)
+	}
+	for name, state := range states {
+		payload, err := dest.remoteClient(name).Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload == nil || !bytes.Equal(payload.Data, state) {
+			t.Fatalf("wrong imported state of %s", name)
+		}
+	}
+
+	// Importing again collides with the imported workspaces
+	err = dest.ImportAll(ctx, bytes.NewReader(archive.Bytes()), false)
+	if !errors.Is(err, ErrWorkspaceAlreadyExists) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Unless they are overwritten, with newer states
+	if err := dest.ImportAll(ctx, bytes.NewReader(archive.Bytes()), true); err != nil {
+		t.Fatal(err)
+	}
+	for name := range states {
+		payload, err := dest.remoteClient(name).Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stateSerial(payload.Data); got != 2 {
+			t.Fatalf("wrong serial of %s: %d; want 2", name, got)
+		}
+	}
+	workspaces, err := dest.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workspaces) != len(states)+1 {
+		t.Fatalf("wrong workspaces %v", workspaces)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// With storage = "largeobject", the stored state is written in a Postgres
+// large object, whose OID is the data_oid column of the row of the
+// workspace, and the data column is NULL. The large objects are created and
+// unlinked in the transactions writing and deleting the rows, so a failed
+// write leaves none behind, and the rows with inline data are still read.
+
+// invRead is the INV_READ mode of lo_open.
+const invRead = 0x40000
+
+// stateSizeColumn returns the expression of the size of the stored state in
+// the queries, from the given data column or, if hasDataOid is set, from the
+// large object of the state, which is sought to its end rather than read.
+func stateSizeColumn(dataColumn string, hasDataOid bool) string {
+	if !hasDataOid {
+		return fmt.Sprintf("coalesce(octet_length(%s), 0)", dataColumn)
+	}
+	return fmt.Sprintf("coalesce(octet_length(%s), lo_lseek64(lo_open(data_oid, %d), 0, 2), 0)", dataColumn, invRead)
+}
+
+// writeLargeObject creates a large object holding stored in tx, by chunks
+// of stateChunkSize bytes, and returns its OID.
+func writeLargeObject(ctx context.Context, tx *sql.Tx, stored []byte) (int64, error) {
+	var oid int64
+	if err := tx.QueryRowContext(ctx, `SELECT lo_create(0)`).Scan(&oid); err != nil {
+		return 0, err
+	}
+	for offset := 0; offset < len(stored); offset += stateChunkSize {
+		chunk := stored[offset:min(offset+stateChunkSize, len(stored))]
+		if _, err := tx.ExecContext(ctx, `SELECT lo_put($1, $2, $3)`, oid, offset, chunk); err != nil {
+			return 0, err
+		}
+	}
+	return oid, nil
+}
+
+// storeLargeObject moves the stored state of args, the arguments returned by
+// stateRow, into a new large object written in tx when storage is
+// "largeobject". The data column is then NULL, and data_oid the OID of the
+// large object.
+func (c *RemoteClient) storeLargeObject(ctx context.Context, tx *sql.Tx, args []interface{}) error {
+	if !c.largeObjects {
+		return nil
+	}
+	oid, err := writeLargeObject(ctx, tx, args[1].([]byte))
+	if err != nil {
+		return err
+	}
+	// data_oid is the last column of stateRow.
+	args[1] = nil
+	args[len(args)-1] = oid
+	return nil
+}
+
+// previousLargeObject returns the OID of the large object of the state of
+// the workspace, NULL if it has none, locking its row in tx until it is
+// written over.
+func (c *RemoteClient) previousLargeObject(ctx context.Context, tx *sql.Tx) (sql.NullInt64, error) {
+	var oid sql.NullInt64
+	if !c.hasDataOid {
+		return oid, nil
+	}
+	query := `SELECT data_oid FROM %s.%s WHERE %s = $1 FOR UPDATE`
+	err := tx.QueryRowContext(ctx, fmt.Sprintf(query, c.SchemaName, c.TableName, c.nameCol()), c.Name).Scan(&oid)
+	if err != nil && err != sql.ErrNoRows {
+		return oid, err
+	}
+	return oid, nil
+}
+
+// unlinkLargeObject unlinks the large object of the given OID in tx, if not
+// NULL.
+func unlinkLargeObject(ctx context.Context, tx *sql.Tx, oid sql.NullInt64) error {
+	if !oid.Valid {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `SELECT lo_unlink($1)`, oid.Int64)
+	return err
+}
+
+// unlinkDeleted returns the query selecting the names of the rows deleted by
+// the common table expression of the given name, which returns their
+// nameColumn and data_oid if hasDataOid is set, unlinking their large
+// objects.
+func unlinkDeleted(name, nameColumn string, hasDataOid bool) string {
+	if !hasDataOid {
+		return fmt.Sprintf(`SELECT %s FROM %s`, nameColumn, name)
+	}
+	// lo_unlink is strict, it isn't called for the inline states.
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE data_oid IS NULL OR lo_unlink(data_oid) = 1`, nameColumn, name)
+}
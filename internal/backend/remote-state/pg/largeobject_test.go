@@ -0,0 +1,322 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// memoryLargeObjects is a fakeDB handler keeping in memory the rows of the
+// states table, with their data or the OID of their large object, and the
+// large objects.
+type memoryLargeObjects struct {
+	mu      sync.Mutex
+	rows    map[string]largeObjectRow
+	objects map[int64][]byte
+	nextOid int64
+	puts    int
+}
+
+type largeObjectRow struct {
+	data []byte
+	oid  int64
+}
+
+func (m *memoryLargeObjects) handle(query string, args []driver.NamedValue) (*fakeRows, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var name string
+	if len(args) > 0 {
+		name, _ = args[0].Value.(string)
+	}
+	row, found := m.rows[name]
+	oid := func() driver.Value {
+		if row.oid == 0 {
+			return nil
+		}
+		return row.oid
+	}
+
+	switch {
+	case strings.HasPrefix(query, "SELECT data_oid"):
+		rows := &fakeRows{columns: []string{"data_oid"}}
+		if found {
+			rows.values = [][]driver.Value{{oid()}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT lo_create(0)"):
+		m.nextOid++
+		m.objects[m.nextOid] = nil
+		return &fakeRows{columns: []string{"lo_create"}, values: [][]driver.Value{{m.nextOid}}}, nil
+	case strings.HasPrefix(query, "SELECT lo_put"):
+		oid, offset, chunk := args[0].Value.(int64), args[1].Value.(int), args[2].Value.([]byte)
+		if len(m.objects[oid]) != offset {
+			return nil, fmt.Errorf("chunk written at %d in a large object of %d bytes", offset, len(m.objects[oid]))
+		}
+		m.objects[oid] = append(m.objects[oid], chunk...)
+		m.puts++
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, "SELECT lo_unlink"):
+		delete(m.objects, args[0].Value.(int64))
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, "INSERT INTO"):
+		data, _ := args[1].Value.([]byte)
+		oid, _ := args[len(args)-1].Value.(int64)
+		m.rows[name] = largeObjectRow{data: data, oid: oid}
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, "SELECT data, lo_get(data_oid)"):
+		rows := &fakeRows{columns: []string{"data", "lo_get"}}
+		if found {
+			rows.values = [][]driver.Value{{row.data, m.objects[row.oid]}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT coalesce(octet_length(data), lo_lseek64"):
+		rows := &fakeRows{columns: []string{"size"}}
+		if found {
+			rows.values = [][]driver.Value{{int64(len(row.data) + len(m.objects[row.oid]))}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT substr(data, $2, $3), lo_get(data_oid, $2 - 1, $3)"):
+		offset, size := args[1].Value.(int)-1, args[2].Value.(int)
+		var inline, large []byte
+		if row.data != nil {
+			inline = row.data[min(offset, len(row.data)):min(offset+size, len(row.data))]
+		} else {
+			object := m.objects[row.oid]
+			large = object[min(offset, len(object)):min(offset+size, len(object))]
+		}
+		return &fakeRows{columns: []string{"substr", "lo_get"}, values: [][]driver.Value{{inline, large}}}, nil
+	case strings.HasPrefix(query, "WITH deleted AS (DELETE"):
+		if found {
+			delete(m.objects, row.oid)
+			delete(m.rows, name)
+		}
+		return &fakeRows{affected: 1}, nil
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	}
+}
+
+func TestRemoteClientLargeObject(t *testing.T) {
+	// A state of several megabytes, written by several chunks
+	state := testStateFile(5000)
+	m := &memoryLargeObjects{
+		rows:    map[string]largeObjectRow{"inline": {data: testStateFile(1)}},
+		objects: map[int64][]byte{},
+	}
+	db, _ := newFakeDB(t, m.handle)
+	newClient := func(name string) *RemoteClient {
+		return &RemoteClient{Client: db, Name: name, SchemaName: `"s"`, TableName: `"states"`, hasDataOid: true, largeObjects: true}
+	}
+	expectState := func(c *RemoteClient, want []byte) {
+		t.Helper()
+		payload, err := c.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload == nil || !bytes.Equal(payload.Data, want) {
+			t.Fatalf("wrong state of %s", c.Name)
+		}
+		r, err := c.GetReader(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		streamed, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(streamed, want) {
+			t.Fatalf("wrong streamed state of %s", c.Name)
+		}
+	}
+
+	foo := newClient("foo")
+	if err := foo.Put(state); err != nil {
+		t.Fatal(err)
+	}
+	if row := m.rows["foo"]; row.data != nil || row.oid == 0 {
+		t.Fatalf("the state is not stored in a large object: %d bytes of data and OID %d", len(row.data), row.oid)
+	}
+	if len(m.objects) != 1 || m.puts < 2 {
+		t.Fatalf("%d large objects written by %d chunks; want 1 by several", len(m.objects), m.puts)
+	}
+	expectState(foo, state)
+
+	// Writing over the state unlinks its previous large object
+	previous := m.rows["foo"].oid
+	state = bytes.Replace(state, []byte(`"serial": 1`), []byte(`"serial": 2`), 1)
+	if err := foo.Put(state); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.objects[previous]; ok || len(m.objects) != 1 {
+		t.Fatalf("the previous large object is left behind: %d large objects", len(m.objects))
+	}
+	expectState(foo, state)
+
+	// The inline states are still read, and moved into a large object when
+	// written
+	inline := newClient("inline")
+	expectState(inline, testStateFile(1))
+	if err := inline.Put(testStateFile(2)); err != nil {
+		t.Fatal(err)
+	}
+	if row := m.rows["inline"]; row.data != nil || len(m.objects) != 2 {
+		t.Fatalf("the state is not moved into a large object: %d large objects", len(m.objects))
+	}
+	expectState(inline, testStateFile(2))
+
+	// Deleting the states unlinks their large objects
+	for _, c := range []*RemoteClient{foo, inline} {
+		if err := c.Delete(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.rows) != 0 || len(m.objects) != 0 {
+		t.Fatalf("%d states and %d large objects left behind", len(m.rows), len(m.objects))
+	}
+}
+
+func TestBackendLargeObjectStorage(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+	ctx := context.Background()
+
+	newBackend := func(storage string) *Backend {
+		return backend.TestBackendConfig(t, New(), backend.TestWrapConfig(map[string]interface{}{
+			"conn_str":    connStr,
+			"schema_name": schemaName,
+			"storage":     storage,
+		})).(*Backend)
+	}
+
+	// A state written inline before switching to large objects
+	if err := newBackend("inline").remoteClient("inline").Put(testStateFile(1)); err != nil {
+		t.Fatal(err)
+	}
+	b := newBackend("largeobject")
+
+	// largeObjects returns the number of large objects of the database.
+	largeObjects := func() int {
+		t.Helper()
+		var count int
+		if err := b.db.QueryRow(`SELECT count(*) FROM pg_largeobject_metadata`).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	expectLargeObjects := func(want int) {
+		t.Helper()
+		if got := largeObjects(); got != want {
+			t.Fatalf("%d large objects; want %d", got, want)
+		}
+	}
+	expectState := func(name string, want []byte) {
+		t.Helper()
+		payload, err := b.remoteClient(name).Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload == nil || !bytes.Equal(payload.Data, want) {
+			t.Fatalf("wrong state of %s", name)
+		}
+		r, err := b.remoteClient(name).GetReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		streamed, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(streamed, want) {
+			t.Fatalf("wrong streamed state of %s", name)
+		}
+	}
+	before := largeObjects()
+
+	// A state of several megabytes
+	state := testStateFile(5000)
+	if err := b.remoteClient("foo").Put(state); err != nil {
+		t.Fatal(err)
+	}
+	var inline bool
+	query := `SELECT data IS NOT NULL OR data_oid IS NULL FROM %s.%s WHERE name = 'foo'`
+	if err := b.db.QueryRow(fmt.Sprintf(query, b.schemaName, b.tableName)).Scan(&inline); err != nil {
+		t.Fatal(err)
+	}
+	if inline {
+		t.Fatal("the state is not stored in a large object")
+	}
+	expectLargeObjects(before + 1)
+	expectState("foo", state)
+
+	meta, err := b.StateMetadata(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != int64(len(state)) || meta.Serial != 1 {
+		t.Fatalf("wrong metadata: size %d and serial %d; want %d and 1", meta.Size, meta.Serial, len(state))
+	}
+	info, err := b.WorkspaceInfo(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(state)) {
+		t.Fatalf("wrong size %d; want %d", info.Size, len(state))
+	}
+
+	// Writing over the state replaces its large object
+	state = bytes.Replace(state, []byte(`"serial": 1`), []byte(`"serial": 2`), 1)
+	if err := b.remoteClient("foo").Put(state); err != nil {
+		t.Fatal(err)
+	}
+	expectLargeObjects(before + 1)
+	expectState("foo", state)
+
+	// The inline state is still read, and moved into a large object when
+	// written
+	expectState("inline", testStateFile(1))
+	if err := b.remoteClient("inline").Put(testStateFile(2)); err != nil {
+		t.Fatal(err)
+	}
+	expectLargeObjects(before + 2)
+	expectState("inline", testStateFile(2))
+
+	if err := b.CopyWorkspace(ctx, "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	expectLargeObjects(before + 3)
+
+	// Deleting the workspaces leaves no large object behind
+	if err := b.DeleteWorkspace(ctx, "foo", false); err != nil {
+		t.Fatal(err)
+	}
+	expectLargeObjects(before + 2)
+	if _, err := b.DeleteWorkspaces(ctx, "ba*", false, false); err != nil {
+		t.Fatal(err)
+	}
+	expectLargeObjects(before + 1)
+	if err := b.remoteClient("inline").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectLargeObjects(before)
+}
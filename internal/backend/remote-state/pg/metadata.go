@@ -0,0 +1,181 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// stateHeaderChunkSize is the number of characters of a stored state read
+// at once by StateMetadata, the header of the state usually fits in the
+// first chunk.
+const stateHeaderChunkSize = 4 << 10
+
+// StateMeta is the metadata of the state of a workspace.
+type StateMeta struct {
+	Lineage string
+	Serial  uint64
+
+	// Size is the size of the stored state, in bytes.
+	Size int64
+
+	// UpdatedAt is the time the state was last written, zero when unknown.
+	UpdatedAt time.Time
+
+	// WriterVersion and WriterHost are the version of OpenTofu and the host
+	// that last wrote the state, empty when unknown.
+	WriterVersion string
+	WriterHost    string
+}
+
+// StateMetadata returns the metadata of the state of the given workspace.
+//
+// The lineage and serial are read from the beginning of the stored state,
+// where OpenTofu writes them, so the rest of the state is neither read nor
+// decoded. They are read from the first table holding the workspace, as the
+// state. It returns an error wrapping ErrWorkspaceNotFound if the workspace
+// doesn't exist.
+func (b *Backend) StateMetadata(ctx context.Context, name string) (*StateMeta, error) {
+	return b.remoteClient(name).stateMetadata(ctx)
+}
+
+func (c *RemoteClient) stateMetadata(ctx context.Context) (_ *StateMeta, err error) {
+	ctx, op := c.startOperation(ctx, "state_metadata")
+	defer op.end(&err)
+
+	// The header is read in the same transaction as the size, so they both
+	// come from the same version of the state.
+	tx, err := c.Client.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The metadata is read from the first table holding the workspace.
+	meta := &StateMeta{}
+	var updatedAt sql.NullTime
+	var writerVersion, writerHost sql.NullString
+	var table fallbackTable
+	err = sql.ErrNoRows
+	for _, table = range c.stateTables() {
+		columns := []string{stateSizeColumn(c.dataCol(), table.hasDataOid)}
+		dest := []interface{}{&meta.Size}
+		if table.hasTimestamps {
+			columns = append(columns, "updated_at")
+			dest = append(dest, &updatedAt)
+		}
+		if table.hasWriter {
+			columns = append(columns, "writer_version", "writer_host")
+			dest = append(dest, &writerVersion, &writerHost)
+		}
+		query := `SELECT %s FROM %s.%s WHERE %s = $1%s`
+		err = tx.QueryRowContext(ctx, fmt.Sprintf(query, strings.Join(columns, ", "), table.schemaName, c.TableName, c.nameCol(), notDeleted(table.hasDeletedAt)), c.Name).Scan(dest...)
+		if err != sql.ErrNoRows {
+			break
+		}
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, fmt.Errorf("%w: %q", ErrWorkspaceNotFound, c.Name)
+	case err != nil:
+		return nil, err
+	}
+	meta.UpdatedAt = updatedAt.Time
+	meta.WriterVersion = writerVersion.String
+	meta.WriterHost = writerHost.String
+	op.setStateSize(int(meta.Size))
+
+	// The encrypted states are read whole, by larger chunks.
+	chunkSize := stateHeaderChunkSize
+	if c.aead != nil {
+		chunkSize = stateChunkSize
+	}
+	chunks := &stateChunkReader{ctx: ctx, tx: tx, client: c, table: table, offset: 1, chunkSize: chunkSize}
+	r, err := c.decodeStateReader(bufio.NewReaderSize(chunks, stateHeaderChunkSize))
+	if err != nil {
+		return nil, err
+	}
+	meta.Serial, meta.Lineage, err = readStateHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the state of workspace %q: %w", c.Name, err)
+	}
+	return meta, nil
+}
+
+// GetRaw returns the state of the given workspace as it is stored, once
+// decompressed and decrypted, along with its serial and lineage, read from
+// the same state, so the three always match. It returns an error wrapping
+// ErrWorkspaceNotFound if the workspace has no state, as the default
+// workspace until its state is written.
+func (b *Backend) GetRaw(ctx context.Context, name string) (data []byte, serial uint64, lineage string, err error) {
+	return b.remoteClient(name).getRaw(ctx)
+}
+
+func (c *RemoteClient) getRaw(ctx context.Context) (data []byte, serial uint64, lineage string, err error) {
+	ctx, op := c.startOperation(ctx, "get_raw")
+	defer op.end(&err)
+
+	data, err = c.readState(ctx)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, 0, "", fmt.Errorf("%w: %q", ErrWorkspaceNotFound, c.Name)
+	case err != nil:
+		return nil, 0, "", err
+	}
+	op.setStateSize(len(data))
+	serial, lineage, err = readStateHeader(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to read the state of workspace %q: %w", c.Name, err)
+	}
+	return data, serial, lineage, nil
+}
+
+// readStateHeader reads the serial and lineage of the state file read from
+// r. It stops reading as soon as both have been found, the members of the
+// state before them are skipped, the ones after are not read at all. Zero
+// values are returned for an empty state.
+func readStateHeader(r io.Reader) (serial uint64, lineage string, err error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if tok != json.Delim('{') {
+		return 0, "", fmt.Errorf("the state is not a JSON object")
+	}
+
+	var hasSerial, hasLineage bool
+	for !(hasSerial && hasLineage) && dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, "", err
+		}
+		switch tok {
+		case "serial":
+			err = dec.Decode(&serial)
+			hasSerial = true
+		case "lineage":
+			err = dec.Decode(&lineage)
+			hasLineage = true
+		default:
+			var skipped json.RawMessage
+			err = dec.Decode(&skipped)
+		}
+		if err != nil {
+			return 0, "", err
+		}
+	}
+	return serial, lineage, nil
+}
@@ -0,0 +1,329 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/opentofu/opentofu/internal/backend"
+	"github.com/opentofu/opentofu/internal/states/statefile"
+	"github.com/opentofu/opentofu/version"
+)
+
+func TestReadStateHeader(t *testing.T) {
+	testCases := map[string]struct {
+		State       string
+		Serial      uint64
+		Lineage     string
+		ExpectError bool
+	}{
+		"empty": {
+			State: "",
+		},
+		"v4": {
+			State:   `{"version": 4, "terraform_version": "1.6.0", "serial": 3, "lineage": "abc", "outputs": {}, "resources": []}`,
+			Serial:  3,
+			Lineage: "abc",
+		},
+		"lineage-first": {
+			State:   `{"lineage": "abc", "modules": [{"path": ["root"]}], "serial": 7}`,
+			Serial:  7,
+			Lineage: "abc",
+		},
+		"no-lineage": {
+			State:  `{"version": 4, "serial": 2, "resources": []}`,
+			Serial: 2,
+		},
+		"not-an-object": {
+			State:       `[1, 2]`,
+			ExpectError: true,
+		},
+		"invalid-serial": {
+			State:       `{"serial": "one"}`,
+			ExpectError: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			serial, lineage, err := readStateHeader(strings.NewReader(tc.State))
+			if tc.ExpectError {
+				if err == nil {
+					t.Fatal("error expected but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if serial != tc.Serial || lineage != tc.Lineage {
+				t.Fatalf("wrong header: serial %d and lineage %q; want %d and %q", serial, lineage, tc.Serial, tc.Lineage)
+			}
+		})
+	}
+}
+
+func TestReadStateHeaderStops(t *testing.T) {
+	// Reading beyond the header fails
+	header := `{"version": 4, "serial": 5, "lineage": "abc", "resources": [`
+	r := io.MultiReader(strings.NewReader(header), failingReader{})
+
+	serial, lineage, err := readStateHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial != 5 || lineage != "abc" {
+		t.Fatalf("wrong header: serial %d and lineage %q", serial, lineage)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("read beyond the header")
+}
+
+func TestRemoteClientStateMetadata(t *testing.T) {
+	// A state of several megabytes
+	state := testStateFile(5000)
+	updatedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			stored, err := encodeState(state, compress, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, fake := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+				switch {
+				case strings.HasPrefix(query, "SELECT substr"):
+					start := min(args[1].Value.(int)-1, len(stored))
+					end := min(start+args[2].Value.(int), len(stored))
+					return &fakeRows{columns: []string{"substr"}, values: [][]driver.Value{{stored[start:end]}}}, nil
+				case strings.HasPrefix(query, "SELECT coalesce(octet_length(data), 0), updated_at"):
+					return &fakeRows{columns: []string{"size", "updated_at"}, values: [][]driver.Value{{int64(len(stored)), updatedAt}}}, nil
+				default:
+					return nil, fmt.Errorf("unexpected query: %s", query)
+				}
+			})
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasTimestamps: true}
+
+			meta, err := c.stateMetadata(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := StateMeta{Lineage: "2c2b6c4e-8b1f-4f4e-9a61-5b0c1b43a7d2", Serial: 1, Size: int64(len(stored)), UpdatedAt: updatedAt}
+			if *meta != want {
+				t.Fatalf("wrong metadata %#v; want %#v", *meta, want)
+			}
+
+			var chunks []string
+			for _, query := range fake.Queries() {
+				if strings.HasPrefix(query, "SELECT substr") {
+					chunks = append(chunks, query)
+				}
+			}
+			if len(chunks) != 1 {
+				t.Fatalf("%d chunks of the state have been read; want 1", len(chunks))
+			}
+		})
+	}
+}
+
+func TestRemoteClientStateWriter(t *testing.T) {
+	var written []driver.NamedValue
+	db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.HasPrefix(query, "INSERT INTO"):
+			for _, arg := range args {
+				if valuer, ok := arg.Value.(driver.Valuer); ok {
+					var err error
+					if arg.Value, err = valuer.Value(); err != nil {
+						return nil, err
+					}
+				}
+				written = append(written, arg)
+			}
+			return &fakeRows{affected: 1}, nil
+		case strings.HasPrefix(query, "SELECT substr"):
+			return &fakeRows{columns: []string{"substr"}, values: [][]driver.Value{{testStateFile(1)}}}, nil
+		case strings.HasPrefix(query, "SELECT coalesce(octet_length(data), 0), writer_version, writer_host"):
+			return &fakeRows{columns: []string{"size", "writer_version", "writer_host"}, values: [][]driver.Value{{int64(10), written[2].Value, written[3].Value}}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected query: %s", query)
+		}
+	})
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasWriter: true}
+
+	if err := c.Put(testStateFile(1)); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := c.stateMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := os.Hostname()
+	if meta.WriterVersion != version.String() || meta.WriterHost != host {
+		t.Fatalf("wrong writer %q on %q; want %q on %q", meta.WriterVersion, meta.WriterHost, version.String(), host)
+	}
+}
+
+func TestRemoteClientStateMetadataNotFound(t *testing.T) {
+	db, _ := newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+		return &fakeRows{columns: []string{"size"}}, nil
+	})
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`}
+
+	if _, err := c.stateMetadata(context.Background()); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+
+	// The failures of the queries are not mistaken for a missing workspace
+	denied := &pq.Error{Code: "42501", Message: "permission denied for table states"}
+	db, _ = newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+		return nil, denied
+	})
+	c.Client = db
+	_, err := c.stateMetadata(context.Background())
+	var pqErr *pq.Error
+	if errors.Is(err, ErrWorkspaceNotFound) || !errors.As(err, &pqErr) || pqErr.Code != denied.Code {
+		t.Fatalf("expected the driver error, got: %v", err)
+	}
+
+	// Get has no state for a missing workspace, as remote.Client requires
+	db, _ = newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+		return &fakeRows{columns: []string{"data"}}, nil
+	})
+	c.Client = db
+	if payload, err := c.Get(); payload != nil || err != nil {
+		t.Fatalf("expected no state, got: %v, %v", payload, err)
+	}
+}
+
+func TestRemoteClientGetRaw(t *testing.T) {
+	state := testStateFile(3)
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			stored, err := encodeState(state, compress, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, fake := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+				if strings.HasPrefix(query, "SELECT data, checksum") {
+					return &fakeRows{columns: []string{"data", "checksum"}, values: [][]driver.Value{{stored, stateChecksum(state)}}}, nil
+				}
+				return nil, fmt.Errorf("unexpected query: %s", query)
+			})
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasChecksum: true}
+
+			data, serial, lineage, err := c.getRaw(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, state) {
+				t.Fatalf("wrong state data:\n%s", data)
+			}
+			if serial != 1 || lineage != "2c2b6c4e-8b1f-4f4e-9a61-5b0c1b43a7d2" {
+				t.Fatalf("wrong serial %d and lineage %q", serial, lineage)
+			}
+			// The row is read once
+			if n := len(fake.Queries()); n != 1 {
+				t.Fatalf("%d queries; want 1", n)
+			}
+		})
+	}
+
+	db, _ := newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+		return &fakeRows{columns: []string{"data"}}, nil
+	})
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`}
+	if _, _, _, err := c.getRaw(context.Background()); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+}
+
+func TestBackendStateMetadata(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":    connStr,
+		"schema_name": schemaName,
+		"compress":    true,
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	if _, err := b.StateMetadata(context.Background(), "missing"); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+
+	s, err := b.StateMgr(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteState(testState()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PersistState(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	payload, err := b.remoteClient("foo").Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	persisted, err := statefile.Read(bytes.NewReader(payload.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := b.StateMetadata(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Serial != persisted.Serial || meta.Lineage != persisted.Lineage {
+		t.Fatalf("wrong metadata: serial %d and lineage %q; want %d and %q", meta.Serial, meta.Lineage, persisted.Serial, persisted.Lineage)
+	}
+	var size int64
+	if err := b.db.QueryRow(fmt.Sprintf(`SELECT octet_length(data) FROM %s.%s WHERE name = 'foo'`, b.schemaName, b.tableName)).Scan(&size); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != size {
+		t.Fatalf("wrong size %d; want %d", meta.Size, size)
+	}
+	if meta.UpdatedAt.IsZero() {
+		t.Fatal("the update time is unknown")
+	}
+
+	data, serial, lineage, err := b.GetRaw(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, payload.Data) || serial != persisted.Serial || lineage != persisted.Lineage {
+		t.Fatalf("wrong raw state: serial %d and lineage %q; want %d and %q", serial, lineage, persisted.Serial, persisted.Lineage)
+	}
+	if _, _, _, err := b.GetRaw(context.Background(), "missing"); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+}
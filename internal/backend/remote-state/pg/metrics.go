@@ -0,0 +1,92 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the Prometheus metrics recorded by the backend. A nil *metrics
+// records nothing, so the backend doesn't pay for the metrics unless
+// RegisterMetrics is called.
+type metrics struct {
+	operations *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	stateBytes prometheus.Histogram
+}
+
+// RegisterMetrics registers the metrics of the backend operations with reg
+// and starts recording them. The backends registering their metrics with the
+// same registry share them.
+func (b *Backend) RegisterMetrics(reg prometheus.Registerer) error {
+	m := &metrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pg_state_operations_total",
+			Help: "Number of operations on the states stored in Postgres.",
+		}, []string{"op", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pg_state_operation_duration_seconds",
+			Help:    "Duration of the operations on the states stored in Postgres.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op"}),
+		stateBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "pg_state_bytes",
+			Help:    "Size of the states written to Postgres.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		}),
+	}
+
+	var err error
+	if m.operations, err = registerCollector(reg, m.operations); err != nil {
+		return err
+	}
+	if m.duration, err = registerCollector(reg, m.duration); err != nil {
+		return err
+	}
+	if m.stateBytes, err = registerCollector(reg, m.stateBytes); err != nil {
+		return err
+	}
+
+	b.metrics = m
+	return nil
+}
+
+// registerCollector registers c with reg, or returns the equivalent collector
+// already registered.
+func registerCollector[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	err := reg.Register(c)
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		if existing, ok := registered.ExistingCollector.(C); ok {
+			return existing, nil
+		}
+	}
+	return c, err
+}
+
+// observe records an operation started at start, which failed if *err is
+// not nil. It is meant to be deferred.
+func (m *metrics) observe(op string, start time.Time, err *error) {
+	if m == nil {
+		return
+	}
+
+	status := "ok"
+	if *err != nil {
+		status = "error"
+	}
+	m.operations.WithLabelValues(op, status).Inc()
+	m.duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// observeStateSize records the size of a state written.
+func (m *metrics) observeStateSize(size int) {
+	if m == nil {
+		return
+	}
+	m.stateBytes.Observe(float64(size))
+}
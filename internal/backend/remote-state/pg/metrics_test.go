@@ -0,0 +1,73 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBackendMetrics(t *testing.T) {
+	db, _ := newFakeDB(t, func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+		if strings.Contains(query, "pg_try_advisory_lock") {
+			return nil, errors.New("lock failure")
+		}
+		return &fakeRows{affected: 1}, nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+	if err := b.RegisterMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another backend registering with the same registry shares the metrics.
+	other := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+	if err := other.RegisterMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	c := b.remoteClient("foo")
+	if err := c.Put([]byte(`{"version": 4}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.remoteClient("bar").Put([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Lock(statemgr.NewLockInfo()); err == nil {
+		t.Fatal("error expected but got none")
+	}
+
+	if got := testutil.ToFloat64(b.metrics.operations.WithLabelValues("put", "ok")); got != 2 {
+		t.Errorf("counted %v successful puts; want 2", got)
+	}
+	if got := testutil.ToFloat64(b.metrics.operations.WithLabelValues("lock", "error")); got != 1 {
+		t.Errorf("counted %v failed locks; want 1", got)
+	}
+	if got := testutil.ToFloat64(b.metrics.operations.WithLabelValues("lock", "ok")); got != 0 {
+		t.Errorf("counted %v successful locks; want 0", got)
+	}
+
+	if n, err := testutil.GatherAndCount(reg, "pg_state_bytes", "pg_state_operation_duration_seconds"); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Errorf("gathered %d series; want 3", n)
+	}
+}
+
+func TestBackendWithoutMetrics(t *testing.T) {
+	db, _ := newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+		return &fakeRows{affected: 1}, nil
+	})
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+	if err := b.remoteClient("foo").Put([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/opentofu/opentofu/internal/backend"
+	"github.com/opentofu/opentofu/internal/states/statefile"
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+// MigrationProgress reports the migration of a workspace by MigrateFrom.
+type MigrationProgress struct {
+	Workspace string
+
+	// Done is the number of workspaces migrated so far, this one included,
+	// out of Total.
+	Done  int
+	Total int
+
+	// Skipped is set when the workspace has not been written, because
+	// Postgres already holds its state or because it has none.
+	Skipped bool
+}
+
+// MigrateFrom copies the states of the workspaces of src into the backend,
+// under the same names and with the same lineages and serials, calling
+// progress, if not nil, once each workspace is migrated.
+//
+// The workspaces whose state is already stored with the same lineage and
+// serial are skipped, so an interrupted migration is resumed by running it
+// again, and the ones stored with an older serial of the same lineage are
+// updated. A workspace stored with another lineage or a higher serial is an
+// error wrapping ErrStateConflict, as it has diverged from src.
+func (b *Backend) MigrateFrom(ctx context.Context, src backend.Backend, progress func(MigrationProgress)) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "migrate_from", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+	if b.readOnly {
+		return fmt.Errorf("can't migrate the states: %w", ErrReadOnly)
+	}
+
+	names, err := src.Workspaces(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the workspaces to migrate: %w", err)
+	}
+
+	defer b.workspacesCache.invalidate()
+	b.replica.changedWorkspaces()
+
+	for i, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		skipped, err := b.migrateState(ctx, src, name)
+		if err != nil {
+			return fmt.Errorf("failed to migrate the state of workspace %q: %w", name, err)
+		}
+		if progress != nil {
+			progress(MigrationProgress{Workspace: name, Done: i + 1, Total: len(names), Skipped: skipped})
+		}
+	}
+	return nil
+}
+
+// migrateState copies the state of the given workspace of src, reporting
+// whether it was skipped.
+func (b *Backend) migrateState(ctx context.Context, src backend.Backend, name string) (skipped bool, err error) {
+	mgr, err := src.StateMgr(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if err := mgr.RefreshState(); err != nil {
+		return false, err
+	}
+	f := statemgr.Export(mgr)
+	if f.State == nil {
+		return true, nil
+	}
+	var buf bytes.Buffer
+	if err := statefile.Write(f, &buf); err != nil {
+		return false, err
+	}
+
+	// The current state is read from the primary, as it may be written
+	// over.
+	b.replica.wroteStates(name)
+	client := b.remoteClient(name)
+	payload, err := client.Get()
+	if err != nil {
+		return false, err
+	}
+	if payload == nil && name != b.defaultWorkspace() {
+		if err := b.checkWorkspaceName(name); err != nil {
+			return false, err
+		}
+	}
+	if payload != nil {
+		current, err := statefile.Read(bytes.NewReader(payload.Data))
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case current.Lineage == f.Lineage && current.Serial == f.Serial:
+			return true, nil
+		case current.Lineage != f.Lineage || current.Serial > f.Serial:
+			return false, fmt.Errorf("%w: Postgres holds the state of lineage %s and serial %d, the source the one of lineage %s and serial %d",
+				ErrStateConflict, current.Lineage, current.Serial, f.Lineage, f.Serial)
+		}
+	}
+	return false, client.Put(buf.Bytes())
+}
@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/backend"
+	"github.com/opentofu/opentofu/internal/backend/remote-state/inmem"
+	"github.com/opentofu/opentofu/internal/states"
+	"github.com/opentofu/opentofu/internal/states/statefile"
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+func TestBackendMigrateFrom(t *testing.T) {
+	defer inmem.Reset()
+	src := backend.TestBackendConfig(t, inmem.New(), backend.TestWrapConfig(map[string]interface{}{}))
+	ctx := context.Background()
+
+	// writeSource writes the given state of the given workspace of src.
+	writeSource := func(name string, state *states.State) {
+		t.Helper()
+		mgr, err := src.StateMgr(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.WriteState(state); err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.PersistState(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{backend.DefaultStateName, "bar", "foo"} {
+		writeSource(name, testState())
+	}
+	writeSource("foo", states.NewState())
+
+	m := &memoryStates{states: map[string][]byte{}}
+	db, fake := newFakeDB(t, m.handle)
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+
+	migrate := func() (migrated []string) {
+		t.Helper()
+		var done int
+		err := b.MigrateFrom(ctx, src, func(p MigrationProgress) {
+			done++
+			if p.Done != done || p.Total != 3 {
+				t.Errorf("wrong progress of %s: %d/%d", p.Workspace, p.Done, p.Total)
+			}
+			if !p.Skipped {
+				migrated = append(migrated, p.Workspace)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return migrated
+	}
+	expectMigrated := func() {
+		t.Helper()
+		for _, name := range []string{backend.DefaultStateName, "bar", "foo"} {
+			mgr, err := src.StateMgr(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mgr.RefreshState(); err != nil {
+				t.Fatal(err)
+			}
+			want := statemgr.Export(mgr)
+			got, err := statefile.Read(bytes.NewReader(m.states[name]))
+			if err != nil {
+				t.Fatalf("the state of %s has not been migrated: %s", name, err)
+			}
+			if got.Lineage != want.Lineage || got.Serial != want.Serial || !got.State.Equal(want.State) {
+				t.Fatalf("wrong state of %s: lineage %s and serial %d; want %s and %d", name, got.Lineage, got.Serial, want.Lineage, want.Serial)
+			}
+		}
+	}
+
+	if got, want := migrate(), []string{"bar", backend.DefaultStateName, "foo"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong migrated workspaces %v; want %v", got, want)
+	}
+	expectMigrated()
+
+	// Running it again skips the migrated workspaces
+	before := len(fake.Queries())
+	if got := migrate(); len(got) != 0 {
+		t.Fatalf("workspaces migrated again: %v", got)
+	}
+	for _, query := range fake.Queries()[before:] {
+		if strings.HasPrefix(query, "INSERT") {
+			t.Fatalf("a state has been written again: %s", query)
+		}
+	}
+
+	// Except the ones written since
+	writeSource("bar", states.NewState())
+	if got, want := migrate(), []string{"bar"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong migrated workspaces %v; want %v", got, want)
+	}
+	expectMigrated()
+
+	// A workspace that diverged is not written over
+	diverged := m.states["foo"]
+	m.states["foo"] = bytes.Replace(diverged, []byte(`"lineage": "`), []byte(`"lineage": "other-`), 1)
+	err := b.MigrateFrom(ctx, src, nil)
+	if !errors.Is(err, ErrStateConflict) || !strings.Contains(err.Error(), `workspace "foo"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBackendMigrateFromReadOnly(t *testing.T) {
+	defer inmem.Reset()
+	src := backend.TestBackendConfig(t, inmem.New(), backend.TestWrapConfig(map[string]interface{}{}))
+	db, _ := newFakeDB(t, (&memoryStates{states: map[string][]byte{}}).handle)
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, readOnly: true}
+
+	if err := b.MigrateFrom(context.Background(), src, nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// watchMinReconnect and watchMaxReconnect bound the delay before
+	// reconnecting a lost listening connection, doubled after each failed
+	// attempt.
+	watchMinReconnect = time.Second
+	watchMaxReconnect = time.Minute
+)
+
+// StatePersistedFunc is called with the name of a workspace and the serial of
+// its state once the state is written, 0 if the serial cannot be read.
+type StatePersistedFunc func(ctx context.Context, workspace string, serial uint64) error
+
+// OnStatePersisted registers fn to be called each time a state is written by
+// the state managers of the backend, once the transaction writing it is
+// committed, so fn never sees a state that may still be rolled back. The
+// callbacks are called in the order they are registered, and an error they
+// return is logged but doesn't fail the write.
+//
+// It must be called before the state managers are created with StateMgr.
+func (b *Backend) OnStatePersisted(fn StatePersistedFunc) {
+	b.statePersisted = append(b.statePersisted, fn)
+}
+
+// persisted calls the statePersisted callbacks for the state of the given
+// serial just written.
+func (c *RemoteClient) persisted(ctx context.Context, serial uint64) {
+	for _, fn := range c.statePersisted {
+		if err := fn(ctx, c.Name, serial); err != nil {
+			log.Printf("[WARN] pg: state persisted callback failed for workspace %q: %s", c.Name, err)
+		}
+	}
+}
+
+// WatchStateChanges listens to the given notification channel, the one set
+// as notify_channel, and sends the name of each workspace whose state is
+// written on the returned channel.
+//
+// The listening connection is reopened when it is lost, the states written
+// in the meantime are not reported. The returned channel is closed once ctx
+// is canceled.
+//
+// The notifications require a session of their own, so it doesn't work
+// through PgBouncer in transaction pooling mode.
+func (b *Backend) WatchStateChanges(ctx context.Context, channel string) (<-chan string, error) {
+	if b.connector == nil {
+		return nil, errors.New("the backend is not configured")
+	}
+	if _, err := quoteIdentifier(channel); err != nil {
+		return nil, fmt.Errorf("invalid notification channel: %w", err)
+	}
+
+	// The first connection is made right away, so a connection or
+	// permission error is returned to the caller.
+	l, err := b.listen(ctx, channel)
+	if err != nil {
+		return nil, redactError(err, connStrSecrets(b.connStr)...)
+	}
+
+	changes := make(chan string)
+	go func() {
+		defer close(changes)
+
+		delay := watchMinReconnect
+		for {
+			err := l.forward(ctx, changes)
+			if ctx.Err() != nil {
+				return
+			}
+			for {
+				log.Printf("[WARN] pg: lost the connection listening to %q, reconnecting in %s: %s", channel, delay, redactError(err, connStrSecrets(b.connStr)...))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				delay = min(2*delay, watchMaxReconnect)
+
+				if l, err = b.listen(ctx, channel); err == nil {
+					delay = watchMinReconnect
+					break
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// stateListener is a connection listening to a notification channel.
+type stateListener struct {
+	listener *pq.Listener
+
+	// lost receives the error the connection was lost with.
+	lost chan error
+}
+
+// listen opens a connection listening to channel.
+//
+// The connections are not reopened by the pq listener itself, they are
+// opened again through the backend connector so that each gets valid
+// credentials.
+func (b *Backend) listen(ctx context.Context, channel string) (*stateListener, error) {
+	connStr, err := b.connector.sessionConnStr(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &stateListener{lost: make(chan error, 1)}
+	events := func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			select {
+			case l.lost <- err:
+			default:
+			}
+		}
+	}
+	if b.connector.dial != nil {
+		l.listener = pq.NewDialListener(b.connector.dial, connStr, watchMinReconnect, watchMaxReconnect, events)
+	} else {
+		l.listener = pq.NewListener(connStr, watchMinReconnect, watchMaxReconnect, events)
+	}
+
+	// Listen blocks until the connection is made, which is never if it
+	// keeps failing.
+	listened := make(chan error, 1)
+	go func() { listened <- l.listener.Listen(channel) }()
+	select {
+	case err = <-listened:
+	case err = <-l.lost:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		l.listener.Close()
+		return nil, fmt.Errorf("failed to listen to %q: %w", channel, err)
+	}
+	return l, nil
+}
+
+// forward sends the payloads of the notifications, the workspace names, on
+// changes until the connection is lost or ctx is canceled, and closes the
+// connection.
+func (l *stateListener) forward(ctx context.Context, changes chan<- string) error {
+	defer l.listener.Close()
+
+	for {
+		select {
+		case n := <-l.listener.Notify:
+			// A nil notification is sent after the pq listener reconnects
+			// by itself.
+			if n == nil {
+				continue
+			}
+			select {
+			case changes <- n.Extra:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case err := <-l.lost:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
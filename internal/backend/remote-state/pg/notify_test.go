@@ -0,0 +1,236 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+func TestRemoteClientNotify(t *testing.T) {
+	testCases := map[string]struct {
+		Channel  string
+		Affected int64
+		Want     [][]interface{}
+	}{
+		"disabled": {
+			Affected: 1,
+		},
+		"written": {
+			Channel:  "tofu_states",
+			Affected: 1,
+			Want:     [][]interface{}{{"tofu_states", "foo"}},
+		},
+		"conflict": {
+			Channel:  "tofu_states",
+			Affected: 0,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var notified [][]interface{}
+			db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+				if strings.Contains(query, "pg_notify") {
+					mu.Lock()
+					defer mu.Unlock()
+					notified = append(notified, []interface{}{args[0].Value, args[1].Value})
+					return &fakeRows{columns: []string{"pg_notify"}, values: [][]driver.Value{{""}}}, nil
+				}
+				return &fakeRows{affected: tc.Affected}, nil
+			})
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasSerial: true, notifyChannel: tc.Channel}
+
+			c.Put(testStateFile(1))
+			if !reflect.DeepEqual(notified, tc.Want) {
+				t.Fatalf("wrong notifications %v; want %v", notified, tc.Want)
+			}
+		})
+	}
+}
+
+func TestBackendOnStatePersisted(t *testing.T) {
+	var affected int64 = 1
+	db, fake := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		return &fakeRows{affected: affected}, nil
+	})
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, hasSerial: true}
+
+	type call struct {
+		Workspace string
+		Serial    uint64
+		Committed bool
+	}
+	var calls []call
+	b.OnStatePersisted(func(_ context.Context, workspace string, serial uint64) error {
+		calls = append(calls, call{workspace, serial, fake.Commits() > 0})
+		return fmt.Errorf("policy scan unavailable")
+	})
+	b.OnStatePersisted(func(_ context.Context, workspace string, serial uint64) error {
+		calls = append(calls, call{workspace + " again", serial, fake.Commits() > 0})
+		return nil
+	})
+	logs := captureLog(t)
+
+	// The callbacks are called once the state is committed, and their
+	// errors don't fail the write
+	if err := b.remoteClient("foo").Put([]byte(`{"version": 4, "serial": 7, "lineage": "foo"}`)); err != nil {
+		t.Fatal(err)
+	}
+	want := []call{{"foo", 7, true}, {"foo again", 7, true}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("wrong calls %v; want %v", calls, want)
+	}
+	if !strings.Contains(logs.String(), `[WARN] pg: state persisted callback failed for workspace "foo": policy scan unavailable`) {
+		t.Fatalf("the error of the callback is not logged: %s", logs)
+	}
+
+	// They are not called when the state isn't written
+	calls = nil
+	affected = 0
+	if err := b.remoteClient("foo").Put(testStateFile(1)); err == nil {
+		t.Fatal("the conflicting state has been written")
+	}
+	if len(calls) != 0 {
+		t.Fatalf("called for a state not written: %v", calls)
+	}
+}
+
+func TestBackendConfigInvalidNotifyChannel(t *testing.T) {
+	// The channel name is checked before connecting to the database
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":       "host=127.0.0.1 port=1 sslmode=disable",
+		"notify_channel": strings.Repeat("c", maxIdentifierLength+1),
+	})
+
+	b := New().(*Backend)
+	spec := b.ConfigSchema(context.Background()).DecoderSpec()
+	obj, diags := hcldec.Decode(config, spec, nil)
+	if diags.HasErrors() {
+		t.Fatal(diags.Error())
+	}
+	obj, valDiags := b.PrepareConfig(context.Background(), obj)
+	if valDiags.HasErrors() {
+		t.Fatal(valDiags.ErrWithWarnings())
+	}
+
+	confDiags := b.Configure(context.Background(), obj)
+	if !confDiags.HasErrors() {
+		t.Fatal("error expected but got none")
+	}
+	if err := confDiags.ErrWithWarnings().Error(); !strings.Contains(err, "invalid notify_channel") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestBackendWatchStateChangesNotConfigured(t *testing.T) {
+	_, err := New().(*Backend).WatchStateChanges(context.Background(), "tofu_states")
+	if err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBackendWatchStateChanges(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	channel := strings.ToLower(schemaName)
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":       connStr,
+		"schema_name":    schemaName,
+		"notify_channel": channel,
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := b.WatchStateChanges(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeState := func(workspace string) {
+		t.Helper()
+		s, err := b.StateMgr(context.Background(), workspace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteState(testState()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PersistState(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case got, ok := <-changes:
+			if !ok {
+				t.Fatal("the changes channel has been closed")
+			}
+			if got != want {
+				t.Fatalf("wrong workspace %q; want %q", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("the change of %q has not been received", want)
+		}
+	}
+
+	// Creating the workspace is a change of its state too
+	writeState("foo")
+	receive("foo")
+	receive("foo")
+
+	// The listening connection is reopened when it is lost
+	listeningPid := func() (pid int) {
+		t.Helper()
+		query := `SELECT coalesce(max(pid), 0) FROM pg_stat_activity WHERE query LIKE 'LISTEN %'`
+		if err := dbCleaner.QueryRow(query).Scan(&pid); err != nil {
+			t.Fatal(err)
+		}
+		return pid
+	}
+	pid := listeningPid()
+	if pid == 0 {
+		t.Fatal("no connection is listening")
+	}
+	if _, err := dbCleaner.Exec(`SELECT pg_terminate_backend($1)`, pid); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if newPid := listeningPid(); newPid != 0 && newPid != pid {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the listening connection has not been reopened")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	writeState("bar")
+	receive("bar")
+	receive("bar")
+
+	cancel()
+	for range changes {
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// partitionName returns the name of the hash partition of the states table
+// of the given name with the given remainder.
+func partitionName(tableName string, remainder int) string {
+	return fmt.Sprintf("%s_p%d", tableName, remainder)
+}
+
+// createPartitionedStatesTable creates the states table, unless it exists,
+// partitioned by the hash of the names of the workspaces into the given
+// quoted partitions, the one at index i holding the names of remainder i,
+// in the tablespace set by tablespace, if any.
+// The table and its partitions are created in a single transaction, so the
+// table never lacks a partition to write in. The statements go through the
+// table, which routes the rows to their partitions.
+//
+// An existing table is left as is, partitioned or not.
+func (b *Backend) createPartitionedStatesTable(ctx context.Context, db *sql.DB, columnType string, partitions []string) error {
+	var relkind string
+	query := `SELECT relkind FROM pg_class WHERE oid = to_regclass($1)`
+	err := db.QueryRowContext(ctx, query, fmt.Sprintf("%s.%s", b.schemaName, b.tableName)).Scan(&relkind)
+	switch {
+	case err == nil && relkind != "p":
+		log.Printf("[WARN] pg: hash_partitions is ignored, %s.%s already exists and isn't partitioned", b.schemaName, b.tableName)
+		return nil
+	case err == nil:
+		return nil
+	case err != sql.ErrNoRows:
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The primary key of a partitioned table must hold the partition key,
+	// the ids stay unique as they come from the sequence.
+	query = `CREATE TABLE IF NOT EXISTS %s.%s (
+		id bigint NOT NULL DEFAULT nextval('public.global_states_id_seq'),
+		%s text PRIMARY KEY%s,
+		%s %s
+		) PARTITION BY HASH (%s)%s`
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(query, b.schemaName, b.tableName, b.nameCol(), b.indexTablespaceClause(), b.dataCol(), columnType, b.nameCol(), b.tablespaceClause())); err != nil {
+		if isDuplicateObject(err) {
+			// Created along with its partitions by a concurrent
+			// configuration, in a single transaction as well.
+			return nil
+		}
+		return b.tablespaceError(err)
+	}
+	for i, partition := range partitions {
+		query = `CREATE TABLE IF NOT EXISTS %s.%s PARTITION OF %s.%s FOR VALUES WITH (MODULUS %d, REMAINDER %d)%s`
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(query, b.schemaName, partition, b.schemaName, b.tableName, len(partitions), i, b.tablespaceClause())); err != nil {
+			return b.tablespaceError(err)
+		}
+	}
+	return tx.Commit()
+}
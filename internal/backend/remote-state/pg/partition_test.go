@@ -0,0 +1,168 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+func TestBackendCreatePartitionedStatesTable(t *testing.T) {
+	partitions := []string{`"states_p0"`, `"states_p1"`, `"states_p2"`}
+	testCases := map[string]struct {
+		relkind string
+		want    []string
+		wantLog string
+	}{
+		"missing": {
+			want: []string{
+				`SELECT relkind FROM pg_class`,
+				`CREATE TABLE IF NOT EXISTS "s"."states"`,
+				`CREATE TABLE IF NOT EXISTS "s"."states_p0" PARTITION OF "s"."states" FOR VALUES WITH (MODULUS 3, REMAINDER 0)`,
+				`CREATE TABLE IF NOT EXISTS "s"."states_p1" PARTITION OF "s"."states" FOR VALUES WITH (MODULUS 3, REMAINDER 1)`,
+				`CREATE TABLE IF NOT EXISTS "s"."states_p2" PARTITION OF "s"."states" FOR VALUES WITH (MODULUS 3, REMAINDER 2)`,
+			},
+		},
+		"partitioned": {relkind: "p", want: []string{`SELECT relkind FROM pg_class`}},
+		"unpartitioned": {
+			relkind: "r",
+			want:    []string{`SELECT relkind FROM pg_class`},
+			wantLog: "hash_partitions is ignored",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, fake := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+				if strings.HasPrefix(query, "SELECT relkind") {
+					rows := &fakeRows{columns: []string{"relkind"}}
+					if tc.relkind != "" {
+						rows.values = [][]driver.Value{{tc.relkind}}
+					}
+					return rows, nil
+				}
+				return &fakeRows{}, nil
+			})
+			b := &Backend{schemaName: `"s"`, tableName: `"states"`}
+			logs := captureLog(t)
+
+			if err := b.createPartitionedStatesTable(context.Background(), db, "text", partitions); err != nil {
+				t.Fatal(err)
+			}
+			queries := fake.Queries()
+			if len(queries) != len(tc.want) {
+				t.Fatalf("wrong statements:\n%s", strings.Join(queries, "\n"))
+			}
+			for i, query := range queries {
+				if !strings.HasPrefix(query, tc.want[i]) {
+					t.Fatalf("wrong statement %d: %s; want %s", i, query, tc.want[i])
+				}
+			}
+			if len(queries) > 1 {
+				if !strings.Contains(queries[1], "PARTITION BY HASH (name)") {
+					t.Fatalf("the table isn't partitioned by name: %s", queries[1])
+				}
+				// The table and its partitions are created at once
+				if n := len(fake.Transactions()); n != 1 {
+					t.Fatalf("%d transactions; want 1", n)
+				}
+			}
+			if !strings.Contains(logs.String(), tc.wantLog) {
+				t.Fatalf("missing %q in the logs: %s", tc.wantLog, logs)
+			}
+		})
+	}
+}
+
+func TestBackendHashPartitions(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("partitioned", func(t *testing.T) {
+		schemaName := "terraform_hash_partitions"
+		defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+		config := backend.TestWrapConfig(map[string]interface{}{
+			"conn_str":        connStr,
+			"schema_name":     schemaName,
+			"hash_partitions": 4,
+		})
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+		bb := backend.TestBackendConfig(t, New(), config).(*Backend)
+		backend.TestBackendStates(t, b)
+		backend.TestBackendStateLocks(t, b, bb)
+
+		for i := 0; i < 20; i++ {
+			if err := b.remoteClient(fmt.Sprintf("workspace-%d", i)).Put(testStateFile(1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Each row is held by the partition of the hash of its name
+		table := fmt.Sprintf("%s.states", schemaName)
+		query := `SELECT t.name, t.tableoid::regclass::text, r
+			FROM %s t, generate_series(0, 3) r
+			WHERE satisfies_hash_partition($1::regclass, 4, r, t.name)`
+		rows, err := dbCleaner.Query(fmt.Sprintf(query, table), table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		used := make(map[string]bool)
+		var count int
+		for rows.Next() {
+			var name, partition string
+			var remainder int
+			if err := rows.Scan(&name, &partition, &remainder); err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf("%s.%s", schemaName, partitionName("states", remainder))
+			if partition != want {
+				t.Fatalf("workspace %q is in %s; want %s", name, partition, want)
+			}
+			used[partition] = true
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if count < 20 || len(used) < 2 {
+			t.Fatalf("%d workspaces in %d partitions", count, len(used))
+		}
+	})
+
+	t.Run("unpartitioned", func(t *testing.T) {
+		schemaName := "terraform_hash_partitions_unpartitioned"
+		defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+		// The table created without partitions is left as is
+		config := map[string]interface{}{
+			"conn_str":    connStr,
+			"schema_name": schemaName,
+		}
+		backend.TestBackendConfig(t, New(), backend.TestWrapConfig(config))
+		config["hash_partitions"] = 4
+		b := backend.TestBackendConfig(t, New(), backend.TestWrapConfig(config)).(*Backend)
+		backend.TestBackendStates(t, b)
+
+		var relkind string
+		query := `SELECT relkind FROM pg_class WHERE oid = to_regclass($1)`
+		if err := dbCleaner.QueryRow(query, schemaName+".states").Scan(&relkind); err != nil {
+			t.Fatal(err)
+		}
+		if relkind != "r" {
+			t.Fatalf("the existing table has been replaced by a %q relation", relkind)
+		}
+	})
+}
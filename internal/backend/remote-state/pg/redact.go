@@ -0,0 +1,83 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+// redacted replaces the credentials masked in the error messages.
+const redacted = "[redacted]"
+
+// credentialPatterns match the credentials embedded in connection strings,
+// in key/value or URL form, and in RDS IAM authentication tokens, which are
+// presigned URLs. The match is masked, except for the first and second
+// groups surrounding the credentials.
+var credentialPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(\b(?:ssl)?password\s*=\s*)(?:'(?:[^'\\]|\\.)*'|[^\s&"]+)`),
+	regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s"]*:)[^@\s"/]*(@)`),
+	regexp.MustCompile(`(?i)(\bX-Amz-(?:Signature|Security-Token|Credential)=)[^&\s"]+`),
+}
+
+// minSecretLength is the length under which the known secrets are not
+// masked on their own, as they would mask unrelated parts of the messages.
+// They are still masked by credentialPatterns.
+const minSecretLength = 4
+
+// redact masks the credentials in s: those matching credentialPatterns and
+// the given secrets.
+func redact(s string, secrets ...string) string {
+	for _, re := range credentialPatterns {
+		s = re.ReplaceAllString(s, "${1}"+redacted+"${2}")
+	}
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// connStrSecrets returns the secrets of the given connection string to mask
+// in the error messages, including the password of the environment.
+func connStrSecrets(connStr string) []string {
+	secrets := []string{os.Getenv("PGPASSWORD")}
+	if params, err := parseConnStr(connStr); err == nil {
+		secrets = append(secrets, params["password"], params["sslpassword"])
+	}
+	return secrets
+}
+
+// redactedError is an error whose message has the credentials masked. It
+// wraps the original error, so it can still be inspected with errors.Is and
+// errors.As.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactError returns err with the credentials masked in its message, see
+// redact. The errors whose message has nothing to mask are returned as is,
+// and the lock errors keep their type.
+func redactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	if lockErr, ok := err.(*statemgr.LockError); ok {
+		lockErr.Err = redactError(lockErr.Err, secrets...)
+		return lockErr
+	}
+	msg := redact(err.Error(), secrets...)
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
+}
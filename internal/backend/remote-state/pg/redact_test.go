@@ -0,0 +1,107 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+
+	"github.com/opentofu/opentofu/internal/backend"
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+func TestRedact(t *testing.T) {
+	testCases := map[string]string{
+		"host=db user=tofu password=hunter2 sslmode=disable":                                          "host=db user=tofu password=[redacted] sslmode=disable",
+		`host=db password='hunter 2\'s' dbname=tofu`:                                                  "host=db password=[redacted] dbname=tofu",
+		"host=db sslpassword = hunter2":                                                               "host=db sslpassword = [redacted]",
+		`parse "postgres://tofu:hunter2@db:5432/tofu": invalid port`:                                  `parse "postgres://tofu:[redacted]@db:5432/tofu": invalid port`,
+		"postgres://db/tofu?user=tofu&password=hunter2&sslmode=none":                                  "postgres://db/tofu?user=tofu&password=[redacted]&sslmode=none",
+		"db:5432/?Action=connect&DBUser=tofu&X-Amz-Credential=AKIA%2F20240101&X-Amz-Signature=abcdef": "db:5432/?Action=connect&DBUser=tofu&X-Amz-Credential=[redacted]&X-Amz-Signature=[redacted]",
+		"postgres://tofu@db/tofu":                                                                     "postgres://tofu@db/tofu",
+		`pq: password authentication failed`:                                                          `pq: password authentication failed`,
+		`relation "states" does not exist`:                                                            `relation "states" does not exist`,
+	}
+	for s, want := range testCases {
+		if got := redact(s); got != want {
+			t.Errorf("wrong redaction of %q\ngot:  %s\nwant: %s", s, got, want)
+		}
+	}
+
+	// The known secrets are masked wherever they are
+	if got := redact("the token is s3cr3t-token", "s3cr3t-token", "", "abc"); got != "the token is [redacted]" {
+		t.Errorf("wrong redaction of the secrets: %s", got)
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	if redactError(nil) != nil {
+		t.Fatal("nil is not kept")
+	}
+
+	plain := errors.New("no credentials")
+	if err := redactError(plain); err != plain {
+		t.Fatalf("the error has been wrapped: %#v", err)
+	}
+
+	cause := errors.New("password=hunter2 is wrong")
+	err := redactError(fmt.Errorf("failed: %w", cause))
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Fatalf("the password is not masked: %s", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Fatal("the original error is not wrapped")
+	}
+
+	lockErr := &statemgr.LockError{Info: statemgr.NewLockInfo(), Err: cause}
+	if _, ok := redactError(lockErr).(*statemgr.LockError); !ok {
+		t.Fatal("the lock error lost its type")
+	}
+	if strings.Contains(lockErr.Error(), "hunter2") {
+		t.Fatalf("the password is not masked: %s", lockErr)
+	}
+}
+
+func TestBackendConfigRedactsPassword(t *testing.T) {
+	const password = "hunter2-Secret"
+	t.Setenv("PGPASSWORD", "")
+
+	testCases := map[string]string{
+		// The URL cannot be parsed, the error shows it
+		"invalid-url": "postgres://tofu:" + password + "@127.0.0.1:badport/tofu?sslmode=disable",
+		// Nothing listens on this port
+		"connection-refused": "host=127.0.0.1 port=1 user=tofu password=" + password + " sslmode=disable connect_timeout=1",
+	}
+	for name, connStr := range testCases {
+		t.Run(name, func(t *testing.T) {
+			config := backend.TestWrapConfig(map[string]interface{}{
+				"conn_str":          connStr,
+				"verify_connection": true,
+			})
+			b := New().(*Backend)
+			spec := b.ConfigSchema(context.Background()).DecoderSpec()
+			obj, diags := hcldec.Decode(config, spec, nil)
+			if diags.HasErrors() {
+				t.Fatal(diags.Error())
+			}
+			obj, valDiags := b.PrepareConfig(context.Background(), obj)
+			if valDiags.HasErrors() {
+				t.Fatal(valDiags.ErrWithWarnings())
+			}
+
+			confDiags := b.Configure(context.Background(), obj)
+			if !confDiags.HasErrors() {
+				t.Fatal("error expected but got none")
+			}
+			if err := confDiags.ErrWithWarnings().Error(); strings.Contains(err, password) {
+				t.Fatalf("the password is in the error: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// readReplica is the connection pool of the read replica set by
+// read_conn_str, serving the listings of the workspaces and the reads of
+// the states.
+//
+// The replica may lag behind the primary, so the process keeps reading from
+// the primary what it changed: the states it wrote, and the listings once
+// it created or deleted a workspace.
+//
+// A nil replica routes everything to the primary.
+type readReplica struct {
+	db *sql.DB
+
+	mu                sync.Mutex
+	written           map[string]bool
+	workspacesChanged bool
+}
+
+func newReadReplica(db *sql.DB) *readReplica {
+	return &readReplica{db: db, written: make(map[string]bool)}
+}
+
+// stateDB returns the pool to read the state of the given workspace from.
+func (r *readReplica) stateDB(primary *sql.DB, name string) *sql.DB {
+	if r == nil {
+		return primary
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.written[name] {
+		return primary
+	}
+	return r.db
+}
+
+// workspacesDB returns the pool to list the workspaces from.
+func (r *readReplica) workspacesDB(primary *sql.DB) *sql.DB {
+	if r == nil {
+		return primary
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.workspacesChanged {
+		return primary
+	}
+	return r.db
+}
+
+// wroteStates records that the states of the given workspaces are written.
+// It is called before writing them, so they are never read from the replica
+// in between.
+func (r *readReplica) wroteStates(names ...string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range names {
+		r.written[name] = true
+	}
+}
+
+// changedWorkspaces records that workspaces are created or deleted.
+func (r *readReplica) changedWorkspaces() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.workspacesChanged = true
+}
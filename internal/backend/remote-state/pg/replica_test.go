@@ -0,0 +1,225 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+
+	"github.com/opentofu/opentofu/internal/backend"
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+// routingHandler is a fakeDB handler whose workspace and states are named
+// after source, so the reads tell which database served them.
+func routingHandler(source string) func(string, []driver.NamedValue) (*fakeRows, error) {
+	locks := tableLocksHandler()
+	state := []byte(fmt.Sprintf(`{"version": 4, "serial": 1, "lineage": %q}`, source))
+	return func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, `"states_locks"`):
+			return locks(query, args)
+		case strings.HasPrefix(query, "SELECT name"):
+			return &fakeRows{columns: []string{"name"}, values: [][]driver.Value{{source}}}, nil
+		case strings.HasPrefix(query, "SELECT EXISTS"):
+			return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{false}}}, nil
+		case strings.HasPrefix(query, "SELECT data"):
+			return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{state}}}, nil
+		default:
+			return &fakeRows{affected: 1}, nil
+		}
+	}
+}
+
+func TestBackendReadReplica(t *testing.T) {
+	primary, primaryFake := newFakeDB(t, routingHandler("primary"))
+	replica, replicaFake := newFakeDB(t, routingHandler("replica"))
+	b := &Backend{
+		db:            primary,
+		schemaName:    `"s"`,
+		tableName:     `"states"`,
+		lockTableName: `"states_locks"`,
+		tableLocks:    true,
+		replica:       newReadReplica(replica),
+	}
+	ctx := context.Background()
+
+	expectWorkspaces := func(source string) {
+		t.Helper()
+		workspaces, err := b.Workspaces(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{backend.DefaultStateName, source}; !reflect.DeepEqual(workspaces, want) {
+			t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+		}
+	}
+	expectState := func(c *RemoteClient, source string) {
+		t.Helper()
+		payload, err := c.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(payload.Data), fmt.Sprintf("%q", source)) {
+			t.Fatalf("the state of %s has been read from the wrong database: %s", c.Name, payload.Data)
+		}
+	}
+
+	// The reads are served by the replica
+	expectWorkspaces("replica")
+	foo := b.remoteClient("foo")
+	expectState(foo, "replica")
+
+	// Except while the state is locked, when it is read to be written over
+	id, err := foo.Lock(statemgr.NewLockInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectState(foo, "primary")
+	if err := foo.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+	expectState(foo, "replica")
+
+	// Once a state is written, it is read from the primary as the replica
+	// may lag behind
+	if err := b.remoteClient("foo").Put([]byte(`{"version": 4, "serial": 2, "lineage": "primary"}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectState(foo, "primary")
+	expectState(b.remoteClient("bar"), "replica")
+	expectWorkspaces("replica")
+
+	// Once a workspace is created, so are the workspaces
+	if _, err := b.StateMgr(ctx, "new"); err != nil {
+		t.Fatal(err)
+	}
+	expectState(b.remoteClient("new"), "primary")
+	expectWorkspaces("primary")
+	if err := b.DeleteWorkspace(ctx, "bar", false); err != nil {
+		t.Fatal(err)
+	}
+	expectState(b.remoteClient("bar"), "primary")
+
+	// The replica only served reads
+	for _, query := range replicaFake.Queries() {
+		if !strings.HasPrefix(query, "SELECT name") && !strings.HasPrefix(query, "SELECT data") {
+			t.Fatalf("the replica has been sent: %s", query)
+		}
+	}
+	var writes int
+	for _, query := range primaryFake.Queries() {
+		if strings.HasPrefix(query, "INSERT INTO") || strings.HasPrefix(query, "DELETE FROM") {
+			writes++
+		}
+	}
+	// The lock and its release, the state written and created, the
+	// workspace deleted while locked.
+	if writes != 7 {
+		t.Fatalf("%d writes sent to the primary; want 7: %q", writes, primaryFake.Queries())
+	}
+}
+
+func TestBackendWithoutReadReplica(t *testing.T) {
+	db, fake := newFakeDB(t, routingHandler("primary"))
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+
+	if _, err := b.Workspaces(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.remoteClient("foo").Get(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fake.Queries()); n != 2 {
+		t.Fatalf("%d statements sent to the primary; want 2", n)
+	}
+}
+
+func TestBackendConfigReadConnStr(t *testing.T) {
+	testCases := map[string]struct {
+		Config map[string]interface{}
+		Error  string
+	}{
+		"invalid": {
+			Config: map[string]interface{}{"read_conn_str": "host=replica password=supersecret port='5432"},
+			Error:  "invalid read_conn_str",
+		},
+		"cloudsql": {
+			Config: map[string]interface{}{
+				"read_conn_str":     "host=replica",
+				"auth_method":       authMethodCloudSQLIAM,
+				"cloudsql_instance": "project:region:instance",
+			},
+			Error: "read_conn_str cannot be used with auth_method",
+		},
+		"unlogged": {
+			Config: map[string]interface{}{"read_conn_str": "host=replica", "unlogged": true},
+			Error:  "unlogged can't be used with read_conn_str",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// The options are checked before connecting to the database
+			tc.Config["conn_str"] = "host=127.0.0.1 port=1 sslmode=disable"
+			config := backend.TestWrapConfig(tc.Config)
+
+			b := New().(*Backend)
+			spec := b.ConfigSchema(context.Background()).DecoderSpec()
+			obj, diags := hcldec.Decode(config, spec, nil)
+			if diags.HasErrors() {
+				t.Fatal(diags.Error())
+			}
+			obj, valDiags := b.PrepareConfig(context.Background(), obj)
+			if valDiags.HasErrors() {
+				t.Fatal(valDiags.ErrWithWarnings())
+			}
+
+			confDiags := b.Configure(context.Background(), obj)
+			if !confDiags.HasErrors() {
+				t.Fatal("error expected but got none")
+			}
+			err := confDiags.ErrWithWarnings().Error()
+			if !strings.Contains(err, tc.Error) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if strings.Contains(err, "supersecret") {
+				t.Fatalf("the password of read_conn_str is part of the error: %s", err)
+			}
+		})
+	}
+}
+
+func TestBackendReadConnStr(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	// The primary serves as its own replica
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":          connStr,
+		"read_conn_str":     connStr,
+		"schema_name":       schemaName,
+		"verify_connection": true,
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	if b.replica == nil {
+		t.Fatal("the read replica is not used")
+	}
+
+	backend.TestBackendStates(t, b)
+	backend.TestBackendStateLocks(t, b, backend.TestBackendConfig(t, New(), config))
+}
@@ -0,0 +1,107 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// serializationRetries is the number of times the transactions writing
+	// the states with serializable isolation are retried when they fail to
+	// serialize, whatever max_retries.
+	serializationRetries = 3
+
+	// retryBaseDelay is the delay before the first retry, doubled for each
+	// of the following ones up to retryMaxDelay.
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// retry calls fn until it succeeds, fails with an error that is not
+// transient, or has been retried maxRetries times, waiting with an
+// exponential backoff between the attempts. It stops waiting as soon as ctx
+// is done.
+func retry(ctx context.Context, maxRetries int, fn func() error) error {
+	return retryWhile(ctx, fn, func(attempt int, err error) bool {
+		return attempt < maxRetries && isTransientError(err)
+	})
+}
+
+// retryWrite is retry for the transactions writing the states with the
+// given isolation level. With serializable isolation, the serialization
+// failures are retried up to serializationRetries times even beyond
+// maxRetries.
+func retryWrite(ctx context.Context, maxRetries int, isolation sql.IsolationLevel, fn func() error) error {
+	return retryWhile(ctx, fn, func(attempt int, err error) bool {
+		if attempt < maxRetries && isTransientError(err) {
+			return true
+		}
+		return isolation == sql.LevelSerializable && attempt < serializationRetries && isSerializationFailure(err)
+	})
+}
+
+// retryWhile calls fn until it succeeds or shouldRetry returns false for the
+// error of the given attempt, counted from 0, with the backoff of retry.
+func retryWhile(ctx context.Context, fn func() error, shouldRetry func(attempt int, err error) bool) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !shouldRetry(attempt, err) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay = min(2*delay, retryMaxDelay)
+	}
+}
+
+// isTransientError reports whether err is caused by a failure that may not
+// happen again, such as a dropped connection, so the operation is worth
+// retrying.
+func isTransientError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code.Class() == "08": // connection_exception
+			return true
+		case pqErr.Code == "57P01": // admin_shutdown
+			return true
+		case pqErr.Code == "40001": // serialization_failure
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// isSerializationFailure reports whether err is caused by a transaction that
+// could not be serialized with the concurrent ones.
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "40001" // serialization_failure
+}
@@ -0,0 +1,257 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+func TestIsTransientError(t *testing.T) {
+	testCases := map[error]bool{
+		&pq.Error{Code: "57P01"}:                   true,
+		&pq.Error{Code: "40001"}:                   true,
+		&pq.Error{Code: "08006"}:                   true,
+		fmt.Errorf("read: %w", syscall.ECONNRESET): true,
+		driver.ErrBadConn:                          true,
+		&pq.Error{Code: "42601"}:                   false,
+		&pq.Error{Code: "42501"}:                   false,
+		errors.New("something else"):               false,
+	}
+	for err, want := range testCases {
+		if got := isTransientError(err); got != want {
+			t.Errorf("isTransientError(%v) = %t; want %t", err, got, want)
+		}
+	}
+}
+
+// failingHandler fails the first failures statements with err, then answers
+// the others with rows.
+func failingHandler(failures int, err error, rows func() *fakeRows) func(string, []driver.NamedValue) (*fakeRows, error) {
+	calls := 0
+	return func(string, []driver.NamedValue) (*fakeRows, error) {
+		calls++
+		if calls <= failures {
+			return nil, err
+		}
+		return rows(), nil
+	}
+}
+
+func TestBackendRetry(t *testing.T) {
+	names := func() *fakeRows {
+		return &fakeRows{columns: []string{"name"}, values: [][]driver.Value{{"bar"}, {"foo"}}}
+	}
+
+	t.Run("transient", func(t *testing.T) {
+		db, fake := newFakeDB(t, failingHandler(2, &pq.Error{Code: "57P01"}, names))
+		b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, maxRetries: 3}
+
+		workspaces, err := b.Workspaces(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{backend.DefaultStateName, "bar", "foo"}; !reflect.DeepEqual(workspaces, want) {
+			t.Fatalf("wrong workspaces\ngot:  %v\nwant: %v", workspaces, want)
+		}
+		if n := len(fake.Queries()); n != 3 {
+			t.Fatalf("%d attempts; want 3", n)
+		}
+	})
+
+	t.Run("max-retries", func(t *testing.T) {
+		db, fake := newFakeDB(t, failingHandler(10, &pq.Error{Code: "40001"}, names))
+		b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, maxRetries: 2}
+
+		if err := b.DeleteWorkspace(context.Background(), "foo", true); err == nil {
+			t.Fatal("error expected but got none")
+		}
+		if n := len(fake.Queries()); n != 3 {
+			t.Fatalf("%d attempts; want 3", n)
+		}
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		db, fake := newFakeDB(t, failingHandler(10, &pq.Error{Code: "42501", Message: "permission denied"}, names))
+		b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, maxRetries: 3}
+
+		_, err := b.Workspaces(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "permission denied") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := len(fake.Queries()); n != 1 {
+			t.Fatalf("%d attempts; want 1", n)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		db, fake := newFakeDB(t, failingHandler(10, &pq.Error{Code: "57P01"}, names))
+		b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, maxRetries: 3}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := b.Workspaces(ctx); err == nil {
+			t.Fatal("error expected but got none")
+		}
+		if n := len(fake.Queries()); n > 1 {
+			t.Fatalf("%d attempts after the context was canceled", n)
+		}
+	})
+
+	t.Run("client", func(t *testing.T) {
+		data := func() *fakeRows {
+			return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{[]byte("{}")}}, affected: 1}
+		}
+		db, fake := newFakeDB(t, failingHandler(1, syscall.ECONNRESET, data))
+		c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, maxRetries: 1}
+
+		payload, err := c.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload.Data) != "{}" {
+			t.Fatalf("wrong state %q", payload.Data)
+		}
+		if err := c.Put([]byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(fake.Queries()); n != 3 {
+			t.Fatalf("%d statements; want 3", n)
+		}
+	})
+}
+
+func TestRemoteClientIsolationLevel(t *testing.T) {
+	state := []byte(`{"version": 4, "serial": 1, "lineage": "foo"}`)
+	serializationFailure := &pq.Error{Code: "40001", Message: "could not serialize access due to concurrent update"}
+	affected := func() *fakeRows { return &fakeRows{affected: 1} }
+
+	for name, isolation := range isolationLevels {
+		t.Run(name, func(t *testing.T) {
+			db, fake := newFakeDB(t, failingHandler(0, nil, affected))
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, isolation: isolation}
+
+			if err := c.Put(state); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.create(context.Background(), state); err != nil {
+				t.Fatal(err)
+			}
+			txs := fake.Transactions()
+			if len(txs) != 2 {
+				t.Fatalf("%d transactions; want 2", len(txs))
+			}
+			for _, tx := range txs {
+				if got := sql.IsolationLevel(tx.Isolation); got != isolation {
+					t.Fatalf("wrong isolation level %s; want %s", got, isolation)
+				}
+			}
+		})
+	}
+
+	t.Run("serialization-failure", func(t *testing.T) {
+		db, fake := newFakeDB(t, failingHandler(2, serializationFailure, affected))
+		c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, isolation: sql.LevelSerializable}
+
+		// Retried without max_retries
+		if err := c.Put(state); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(fake.Transactions()); n != 3 {
+			t.Fatalf("%d attempts; want 3", n)
+		}
+	})
+
+	t.Run("serialization-retries", func(t *testing.T) {
+		db, fake := newFakeDB(t, failingHandler(10, serializationFailure, affected))
+		c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, isolation: sql.LevelSerializable}
+
+		if _, err := c.create(context.Background(), state); !errors.Is(err, serializationFailure) {
+			t.Fatalf("expected a serialization failure, got: %v", err)
+		}
+		if n := len(fake.Transactions()); n != serializationRetries+1 {
+			t.Fatalf("%d attempts; want %d", n, serializationRetries+1)
+		}
+	})
+
+	t.Run("read-committed", func(t *testing.T) {
+		db, fake := newFakeDB(t, failingHandler(10, serializationFailure, affected))
+		c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, isolation: sql.LevelReadCommitted}
+
+		// Only retried up to max_retries
+		if err := c.Put(state); err == nil {
+			t.Fatal("error expected but got none")
+		}
+		if n := len(fake.Transactions()); n != 1 {
+			t.Fatalf("%d attempts; want 1", n)
+		}
+	})
+}
+
+func TestRemoteClientWriteToken(t *testing.T) {
+	for _, hasWriteToken := range []bool{true, false} {
+		t.Run(fmt.Sprintf("write_token=%t", hasWriteToken), func(t *testing.T) {
+			var writes int
+			var token interface{}
+			db, fake := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+				switch {
+				case strings.HasPrefix(query, "SELECT EXISTS"):
+					return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{token != nil && args[1].Value == token}}}, nil
+				case strings.HasPrefix(query, "INSERT INTO"):
+					writes++
+					if hasWriteToken {
+						token = args[len(args)-1].Value
+					}
+					return &fakeRows{affected: 1}, nil
+				default:
+					return nil, fmt.Errorf("unexpected statement: %s", query)
+				}
+			})
+			// The first write is committed, but the connection is lost
+			// before its outcome is known.
+			commits := 0
+			fake.commitErr = func() error {
+				if commits++; commits == 1 {
+					return syscall.ECONNRESET
+				}
+				return nil
+			}
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, maxRetries: 1, hasWriteToken: hasWriteToken}
+
+			if err := c.Put(testStateFile(1)); err != nil {
+				t.Fatal(err)
+			}
+			if !hasWriteToken {
+				// Applied again by the retry
+				if writes != 2 {
+					t.Fatalf("%d writes; want 2", writes)
+				}
+				return
+			}
+			// The retry only finds out the write has been applied
+			if writes != 1 || fake.Commits() != 1 {
+				t.Fatalf("%d writes and %d commits; want 1", writes, fake.Commits())
+			}
+
+			// The next write has a token of its own
+			previous := token
+			if err := c.Put(testStateFile(2)); err != nil {
+				t.Fatal(err)
+			}
+			if writes != 2 || token == previous {
+				t.Fatalf("the next write has not been applied: %d writes, token %v", writes, token)
+			}
+		})
+	}
+}
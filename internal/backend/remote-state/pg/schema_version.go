@@ -0,0 +1,130 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// The changes of the layout of the tables made since they were first
+// created are the migrations below, applied in order when the backend is
+// configured. The version of the layout of a states table, the number of
+// migrations applied to it, is recorded in the tofu_backend_meta table of
+// its schema, so a layout migrated by a newer version of OpenTofu is
+// detected instead of being used as if it were a known one.
+
+// metaTableName is the table recording the version of the layout of each
+// states table of a schema.
+const metaTableName = "tofu_backend_meta"
+
+// ErrSchemaVersion is wrapped by the error returned by Configure when the
+// tables have been migrated by a newer version of OpenTofu.
+var ErrSchemaVersion = errors.New("unsupported version of the backend tables")
+
+// tableMigrations are the migrations of the tables, each made of
+// statements formatted with the quoted names of the schema, the states
+// table and the lock table. The statements are idempotent, so a migration
+// can be applied again to the tables migrated before their version was
+// recorded, or concurrently by another configuration.
+var tableMigrations = [][]string{
+	// 1: the timestamps are added without a default first, so the existing
+	// workspaces keep NULL timestamps instead of getting the time of the
+	// migration.
+	{
+		`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS created_at timestamptz`,
+		`ALTER TABLE %[1]s.%[2]s ALTER COLUMN created_at SET DEFAULT now()`,
+		`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS updated_at timestamptz`,
+		`ALTER TABLE %[1]s.%[2]s ALTER COLUMN updated_at SET DEFAULT now()`,
+	},
+	// 2: the checksums of the states.
+	{`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS checksum text`},
+	// 3: the serials of the states.
+	{`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS serial bigint`},
+	// 4: the OpenTofu version and host writing the states.
+	{
+		`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS writer_version text`,
+		`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS writer_host text`,
+	},
+	// 5: the expiry of the locks.
+	{`ALTER TABLE %[1]s.%[3]s ADD COLUMN IF NOT EXISTS expires_at timestamptz`},
+	// 6: the tokens of the last writes of the states.
+	{`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS write_token text`},
+	// 7: the lineages of the states.
+	{`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS lineage text`},
+	// 8: the tombstones of the soft-deleted workspaces.
+	{`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS deleted_at timestamptz`},
+	// 9: the format and OpenTofu versions of the states.
+	{
+		`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS state_version integer`,
+		`ALTER TABLE %[1]s.%[2]s ADD COLUMN IF NOT EXISTS terraform_version text`,
+	},
+}
+
+// tableVersion returns the recorded version of the layout of the states
+// table of the given unquoted name, 0 if none is, as for the tables created
+// before the versions were recorded. It returns an error wrapping
+// ErrSchemaVersion if the version is newer than the known ones.
+func (b *Backend) tableVersion(ctx context.Context, db *sql.DB, tableName string) (int, error) {
+	metaTable := fmt.Sprintf("%s.%s", b.schemaName, pq.QuoteIdentifier(metaTableName))
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, metaTable).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version int
+	query := `SELECT version FROM %s WHERE table_name = $1`
+	err := db.QueryRowContext(ctx, fmt.Sprintf(query, metaTable), tableName).Scan(&version)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	if version > len(tableMigrations) {
+		return 0, fmt.Errorf("%w: %s.%s has been migrated to version %d by a newer version of OpenTofu, this one only knows the versions up to %d; upgrade OpenTofu to use it",
+			ErrSchemaVersion, b.schemaName, b.tableName, version, len(tableMigrations))
+	}
+	return version, nil
+}
+
+// migrateTables applies the migrations newer than version to the states
+// table of the given unquoted name and to its lock table, and records the
+// version of its layout.
+func (b *Backend) migrateTables(ctx context.Context, db *sql.DB, tableName, quotedLockTableName string, version int) error {
+	if version == len(tableMigrations) {
+		return nil
+	}
+	for _, migration := range tableMigrations[version:] {
+		for _, statement := range migration {
+			if err := execIfNotExists(ctx, db, fmt.Sprintf(statement, b.schemaName, b.tableName, quotedLockTableName)); err != nil {
+				return err
+			}
+		}
+	}
+
+	metaTable := fmt.Sprintf("%s.%s", b.schemaName, pq.QuoteIdentifier(metaTableName))
+	query := `CREATE TABLE IF NOT EXISTS %s (
+		table_name text PRIMARY KEY,
+		version integer NOT NULL,
+		migrated_at timestamptz NOT NULL DEFAULT now()
+		)`
+	if err := execIfNotExists(ctx, db, fmt.Sprintf(query, metaTable)); err != nil {
+		return err
+	}
+	// The version is never lowered by a concurrent configuration of an
+	// older version of OpenTofu.
+	query = `INSERT INTO %[1]s AS meta (table_name, version) VALUES ($1, $2)
+		ON CONFLICT (table_name) DO UPDATE
+		SET version = GREATEST(meta.version, EXCLUDED.version), migrated_at = now()`
+	_, err := db.ExecContext(ctx, fmt.Sprintf(query, metaTable), tableName, len(tableMigrations))
+	return err
+}
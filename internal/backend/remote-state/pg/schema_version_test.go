@@ -0,0 +1,205 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+func TestBackendMigrateTables(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		return &fakeRows{affected: 1}, nil
+	})
+	b := &Backend{schemaName: `"s"`, tableName: `"states"`}
+	ctx := context.Background()
+
+	// Only the migrations newer than the version are applied
+	if err := b.migrateTables(ctx, db, "states", `"states_locks"`, 3); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`ALTER TABLE "s"."states" ADD COLUMN IF NOT EXISTS writer_version text`,
+		`ALTER TABLE "s"."states" ADD COLUMN IF NOT EXISTS writer_host text`,
+		`ALTER TABLE "s"."states_locks" ADD COLUMN IF NOT EXISTS expires_at timestamptz`,
+		`ALTER TABLE "s"."states" ADD COLUMN IF NOT EXISTS write_token text`,
+		`ALTER TABLE "s"."states" ADD COLUMN IF NOT EXISTS lineage text`,
+		`ALTER TABLE "s"."states" ADD COLUMN IF NOT EXISTS deleted_at timestamptz`,
+		`ALTER TABLE "s"."states" ADD COLUMN IF NOT EXISTS state_version integer`,
+		`ALTER TABLE "s"."states" ADD COLUMN IF NOT EXISTS terraform_version text`,
+		`CREATE TABLE IF NOT EXISTS "s"."tofu_backend_meta"`,
+		`INSERT INTO "s"."tofu_backend_meta"`,
+	}
+	queries := fake.Queries()
+	if len(queries) != len(want) {
+		t.Fatalf("wrong statements:\n%s", strings.Join(queries, "\n"))
+	}
+	for i, query := range queries {
+		if !strings.HasPrefix(query, want[i]) {
+			t.Fatalf("wrong statement %d: %s; want %s", i, query, want[i])
+		}
+	}
+
+	// Nothing is run for the current version
+	if err := b.migrateTables(ctx, db, "states", `"states_locks"`, len(tableMigrations)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fake.Queries()); n != len(want) {
+		t.Fatalf("%d statements run for the current version", n-len(want))
+	}
+}
+
+func TestBackendTableVersion(t *testing.T) {
+	testCases := map[string]struct {
+		exists  bool
+		version interface{}
+		want    int
+		wantErr error
+	}{
+		"no-meta-table": {want: 0},
+		"no-row":        {exists: true, want: 0},
+		"older":         {exists: true, version: int64(2), want: 2},
+		"current":       {exists: true, version: int64(len(tableMigrations)), want: len(tableMigrations)},
+		"newer":         {exists: true, version: int64(len(tableMigrations) + 1), wantErr: ErrSchemaVersion},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+				switch {
+				case strings.HasPrefix(query, "SELECT to_regclass"):
+					if args[0].Value != `"s"."tofu_backend_meta"` {
+						return nil, fmt.Errorf("wrong table %v", args[0].Value)
+					}
+					return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{tc.exists}}}, nil
+				case strings.HasPrefix(query, `SELECT version FROM "s"."tofu_backend_meta" WHERE table_name = $1`):
+					rows := &fakeRows{columns: []string{"version"}}
+					if tc.version != nil {
+						rows.values = [][]driver.Value{{tc.version}}
+					}
+					return rows, nil
+				default:
+					return nil, fmt.Errorf("unexpected statement: %s", query)
+				}
+			})
+			b := &Backend{schemaName: `"s"`, tableName: `"states"`}
+
+			version, err := b.tableVersion(context.Background(), db, "states")
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("expected an error wrapping %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tc.want {
+				t.Fatalf("wrong version %d; want %d", version, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackendTableMigrations(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	// The layout of the tables created before any migration, holding a
+	// state
+	for _, statement := range []string{
+		`CREATE SCHEMA %s`,
+		`CREATE TABLE %s.states (id bigserial PRIMARY KEY, name text UNIQUE, data text)`,
+		`CREATE TABLE %s.states_locks (name text PRIMARY KEY, info text NOT NULL, created_at timestamptz NOT NULL DEFAULT now())`,
+	} {
+		if _, err := dbCleaner.Exec(fmt.Sprintf(statement, schemaName)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dbCleaner.Exec(fmt.Sprintf(`INSERT INTO %s.states (name, data) VALUES ('foo', $1)`, schemaName), string(testStateFile(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	config := func(skipTableCreation bool) map[string]interface{} {
+		return map[string]interface{}{
+			"conn_str":            connStr,
+			"schema_name":         schemaName,
+			"skip_table_creation": skipTableCreation,
+		}
+	}
+	b := backend.TestBackendConfig(t, New(), backend.TestWrapConfig(config(false))).(*Backend)
+	if !b.hasTimestamps || !b.hasChecksum || !b.hasSerial || !b.hasWriter || !b.hasLineage || !b.hasDeletedAt || !b.hasStateVersion {
+		t.Fatal("the states table has not been migrated")
+	}
+	var version int
+	query := `SELECT version FROM %s.tofu_backend_meta WHERE table_name = 'states'`
+	if err := dbCleaner.QueryRow(fmt.Sprintf(query, schemaName)).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(tableMigrations) {
+		t.Fatalf("wrong version %d; want %d", version, len(tableMigrations))
+	}
+
+	// The state written before the migration is left as is, and the
+	// migrated columns are used once it is written again
+	payload, err := b.remoteClient("foo").Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload == nil || !bytes.Equal(payload.Data, testStateFile(1)) {
+		t.Fatal("the state has been lost by the migration")
+	}
+	if err := b.remoteClient("foo").Put(testStateFile(2)); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := b.StateMetadata(context.Background(), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Serial != 2 {
+		t.Fatalf("wrong serial %d; want 2", meta.Serial)
+	}
+
+	// Configuring again runs no migration
+	backend.TestBackendConfig(t, New(), backend.TestWrapConfig(config(false)))
+
+	// The tables migrated by a newer version are refused, even when
+	// nothing is created
+	query = `UPDATE %s.tofu_backend_meta SET version = version + 1`
+	if _, err := dbCleaner.Exec(fmt.Sprintf(query, schemaName)); err != nil {
+		t.Fatal(err)
+	}
+	for _, skipTableCreation := range []bool{false, true} {
+		b := New().(*Backend)
+		spec := b.ConfigSchema(context.Background()).DecoderSpec()
+		obj, diags := hcldec.Decode(backend.TestWrapConfig(config(skipTableCreation)), spec, nil)
+		if diags.HasErrors() {
+			t.Fatal(diags.Error())
+		}
+		obj, valDiags := b.PrepareConfig(context.Background(), obj)
+		if valDiags.HasErrors() {
+			t.Fatal(valDiags.ErrWithWarnings())
+		}
+		confDiags := b.Configure(context.Background(), obj)
+		if !confDiags.HasErrors() || !strings.Contains(confDiags.ErrWithWarnings().Error(), ErrSchemaVersion.Error()) {
+			t.Fatalf("expected an error about the version of the tables, got %v", confDiags.ErrWithWarnings())
+		}
+	}
+}
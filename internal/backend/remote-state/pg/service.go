@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// serviceEnvs are the libpq environment variables locating the connection
+// services, which the pq driver doesn't support: it panics when one of them
+// is set. The services are set by service and service_file instead.
+var serviceEnvs = []string{"PGSERVICE", "PGSERVICEFILE", "PGSYSCONFDIR"}
+
+// serviceConnStr returns connStr completed with the parameters of its
+// connection service, as libpq does: the service named service if not empty,
+// otherwise the one of the service parameter of connStr. The service is read
+// from serviceFile, or from ~/.pg_service.conf if empty.
+//
+// The parameters of connStr take precedence over the ones of the service.
+// The service parameter is removed, as the pq driver would send it to the
+// server as a run-time parameter.
+func serviceConnStr(connStr, service, serviceFile string) (string, error) {
+	params, err := parseConnStr(connStr)
+	if err != nil {
+		return "", err
+	}
+	service = firstNonEmpty(service, params["service"])
+	if service == "" {
+		return connStr, nil
+	}
+	delete(params, "service")
+
+	if serviceFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to find the connection service file: %w", err)
+		}
+		serviceFile = filepath.Join(home, ".pg_service.conf")
+	}
+	serviceParams, err := readService(serviceFile, service)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range serviceParams {
+		if _, ok := params[k]; !ok {
+			params[k] = v
+		}
+	}
+	return formatConnStr(params), nil
+}
+
+// readService returns the parameters of the given service of the connection
+// service file at path, made of sections named after the services, each
+// holding key=value lines.
+func readService(path, service string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the connection service file: %w", err)
+	}
+	defer f.Close()
+
+	var params map[string]string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || text[0] == '#':
+			continue
+		case text[0] == '[':
+			if params != nil {
+				// The section of the service is over.
+				return params, nil
+			}
+			if text[len(text)-1] != ']' {
+				return nil, fmt.Errorf("syntax error in service file %s, line %d", path, line)
+			}
+			if text[1:len(text)-1] == service {
+				params = make(map[string]string)
+			}
+		case params != nil:
+			k, v, ok := strings.Cut(text, "=")
+			k = strings.TrimSpace(k)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("syntax error in service file %s, line %d", path, line)
+			case k == "service":
+				return nil, fmt.Errorf("nested service specifications not supported in service file %s, line %d", path, line)
+			}
+			params[k] = strings.TrimSpace(v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the connection service file: %w", err)
+	}
+	if params == nil {
+		return nil, fmt.Errorf("definition of service %q not found in %s", service, path)
+	}
+	return params, nil
+}
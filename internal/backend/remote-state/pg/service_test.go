@@ -0,0 +1,216 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// writeServiceFile writes a connection service file with the given content
+// in a temporary directory, and returns its path.
+func writeServiceFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pg_service.conf")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServiceConnStr(t *testing.T) {
+	serviceFile := writeServiceFile(t, `
+# The states of the team
+[tofu]
+host = db.internal
+port=5433
+dbname=states
+user=tofu
+
+[broken]
+host
+`)
+	testCases := map[string]struct {
+		connStr string
+		service string
+		want    map[string]string
+		wantErr string
+	}{
+		"none": {
+			connStr: "host=localhost",
+			want:    map[string]string{"host": "localhost"},
+		},
+		"option": {
+			connStr: "sslmode=disable",
+			service: "tofu",
+			want:    map[string]string{"host": "db.internal", "port": "5433", "dbname": "states", "user": "tofu", "sslmode": "disable"},
+		},
+		"conn_str": {
+			connStr: "service=tofu",
+			want:    map[string]string{"host": "db.internal", "port": "5433", "dbname": "states", "user": "tofu"},
+		},
+		"url": {
+			connStr: "postgres://db.internal/other?service=tofu",
+			want:    map[string]string{"host": "db.internal", "port": "5433", "dbname": "other", "user": "tofu"},
+		},
+		"override": {
+			connStr: "service=tofu user=admin port=5434",
+			want:    map[string]string{"host": "db.internal", "port": "5434", "dbname": "states", "user": "admin"},
+		},
+		"option-over-conn_str": {
+			connStr: "service=other",
+			service: "tofu",
+			want:    map[string]string{"host": "db.internal", "port": "5433", "dbname": "states", "user": "tofu"},
+		},
+		"missing": {
+			service: "other",
+			wantErr: `definition of service "other" not found`,
+		},
+		"syntax-error": {
+			service: "broken",
+			wantErr: "syntax error in service file",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			connStr, err := serviceConnStr(tc.connStr, tc.service, serviceFile)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseConnStr(connStr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("wrong parameters %v; want %v", got, tc.want)
+			}
+		})
+	}
+
+	// The service file of the home directory by default
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.WriteFile(filepath.Join(home, ".pg_service.conf"), []byte("[tofu]\nhost=home.internal\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	connStr, err := serviceConnStr("", "tofu", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params, _ := parseConnStr(connStr); params["host"] != "home.internal" {
+		t.Fatalf("wrong connection string %q", connStr)
+	}
+}
+
+func TestBackendServiceCredentials(t *testing.T) {
+	server := newFakeLoginServer(t)
+	host, port := server.addr()
+
+	serviceFile := writeServiceFile(t, fmt.Sprintf(`
+[tofu]
+host=%[1]s
+port=%[2]s
+user=svc
+password=from-service
+sslmode=disable
+
+[nopassword]
+host=%[1]s
+port=%[2]s
+dbname=states
+user=svc
+sslmode=disable
+`, host, port))
+	passFile := filepath.Join(t.TempDir(), "pgpass")
+	if err := os.WriteFile(passFile, []byte(fmt.Sprintf("%s:%s:states:svc:from-pgpass\n", host, port)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PGPASSFILE", passFile)
+	// The password of the environment would take precedence over the
+	// password file.
+	t.Setenv("PGPASSWORD", "")
+	os.Unsetenv("PGPASSWORD")
+
+	configure := func(config map[string]interface{}) error {
+		t.Helper()
+		b := New().(*Backend)
+		spec := b.ConfigSchema(context.Background()).DecoderSpec()
+		obj, diags := hcldec.Decode(backend.TestWrapConfig(config), spec, nil)
+		if diags.HasErrors() {
+			t.Fatal(diags.Error())
+		}
+		obj, valDiags := b.PrepareConfig(context.Background(), obj)
+		if valDiags.HasErrors() {
+			t.Fatal(valDiags.ErrWithWarnings())
+		}
+		return b.Configure(context.Background(), obj).ErrWithWarnings()
+	}
+
+	testCases := map[string]struct {
+		config map[string]interface{}
+		want   Credentials
+	}{
+		"service": {
+			config: map[string]interface{}{"service": "tofu"},
+			want:   Credentials{User: "svc", Password: "from-service"},
+		},
+		"conn_str-over-service": {
+			config: map[string]interface{}{"conn_str": "service=tofu user=admin password=from-conn-str"},
+			want:   Credentials{User: "admin", Password: "from-conn-str"},
+		},
+		"pgpass": {
+			config: map[string]interface{}{"service": "nopassword"},
+			want:   Credentials{User: "svc", Password: "from-pgpass"},
+		},
+		"conn_str-over-pgpass": {
+			config: map[string]interface{}{"service": "nopassword", "conn_str": "password=from-conn-str"},
+			want:   Credentials{User: "svc", Password: "from-conn-str"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tc.config["service_file"] = serviceFile
+			before := len(server.Logins())
+
+			// The fake server refuses the login
+			err := configure(tc.config)
+			if err == nil || !strings.Contains(err.Error(), "fake login refused") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Contains(err.Error(), tc.want.Password) {
+				t.Fatalf("the password is in the error: %s", err)
+			}
+			logins := server.Logins()
+			if len(logins) == before {
+				t.Fatal("no connection has been made")
+			}
+			if got := logins[len(logins)-1]; got != tc.want {
+				t.Fatalf("logged in with %+v; want %+v", got, tc.want)
+			}
+		})
+	}
+
+	// The driver panics on PGSERVICE, which is refused
+	t.Setenv("PGSERVICE", "tofu")
+	err := configure(map[string]interface{}{"service": "tofu", "service_file": serviceFile})
+	if err == nil || !strings.Contains(err.Error(), "PGSERVICE") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
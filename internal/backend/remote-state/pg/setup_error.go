@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+// ErrMissingObject matches the SetupError of the operations failing because
+// the schema or a table of the backend doesn't exist.
+var ErrMissingObject = errors.New("missing schema or table")
+
+// ErrMissingDatabase matches the SetupError of the operations failing
+// because the database of the connection string doesn't exist.
+var ErrMissingDatabase = errors.New("missing database")
+
+// SetupError is the error of an operation failing because of how Postgres is
+// set up rather than of the operation itself: a missing object or a denied
+// privilege. Its message is the one of the Postgres error followed by a hint
+// telling how to fix the setup.
+type SetupError struct {
+	// Kind is ErrMissingObject, ErrPermission or ErrMissingDatabase, which
+	// the error matches with errors.Is.
+	Kind error
+	Hint string
+
+	// Err is the error returned by Postgres, a *pq.Error.
+	Err error
+}
+
+func (e *SetupError) Error() string { return e.Err.Error() + "; " + e.Hint }
+func (e *SetupError) Unwrap() error { return e.Err }
+func (e *SetupError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// classifyError returns err as a SetupError if it is the error of a missing
+// object or a denied privilege, and as is otherwise. The objects are not
+// created when skip_schema_creation or skip_table_creation is set,
+// typically because the role of OpenTofu isn't allowed to, so they are only
+// found missing once used.
+func classifyError(err error) error {
+	if lockErr, ok := err.(*statemgr.LockError); ok {
+		lockErr.Err = classifyError(lockErr.Err)
+		return lockErr
+	}
+	var pqErr *pq.Error
+	var setupErr *SetupError
+	if !errors.As(err, &pqErr) || errors.As(err, &setupErr) {
+		return err
+	}
+	var kind error
+	var hint string
+	switch pqErr.Code {
+	case "3F000": // invalid_schema_name
+		kind, hint = ErrMissingObject, "create it, or grant CREATE on the database to the role and unset skip_schema_creation so it is created"
+	case "42P01": // undefined_table
+		kind, hint = ErrMissingObject, "create it, or grant CREATE on the schema to the role and unset skip_table_creation so it is created"
+	case "42501": // insufficient_privilege
+		kind, hint = ErrPermission, "grant the missing privilege to the role; Diagnose reports the privileges the backend lacks on its schema and tables"
+	case "3D000": // invalid_catalog_name
+		kind, hint = ErrMissingDatabase, "create the database, or fix the dbname of conn_str"
+	default:
+		return err
+	}
+	return &SetupError{Kind: kind, Hint: hint, Err: err}
+}
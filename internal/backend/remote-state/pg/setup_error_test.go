@@ -0,0 +1,90 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := map[string]struct {
+		err      *pq.Error
+		wantKind error
+		wantHint string
+	}{
+		"undefined-schema": {
+			err:      &pq.Error{Code: "3F000", Message: `schema "s" does not exist`},
+			wantKind: ErrMissingObject,
+			wantHint: "skip_schema_creation",
+		},
+		"undefined-table": {
+			err:      &pq.Error{Code: "42P01", Message: `relation "s.states" does not exist`},
+			wantKind: ErrMissingObject,
+			wantHint: "skip_table_creation",
+		},
+		"insufficient-privilege": {
+			err:      &pq.Error{Code: "42501", Message: "permission denied for table states"},
+			wantKind: ErrPermission,
+			wantHint: "grant the missing privilege",
+		},
+		"invalid-catalog": {
+			err:      &pq.Error{Code: "3D000", Message: `database "tofu" does not exist`},
+			wantKind: ErrMissingDatabase,
+			wantHint: "dbname of conn_str",
+		},
+		"other": {
+			err: &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, _ := newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+				return nil, tc.err
+			})
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`}
+
+			_, err := c.Get()
+			var setupErr *SetupError
+			if tc.wantKind == nil {
+				if errors.As(err, &setupErr) || !errors.Is(err, tc.err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &setupErr) || !errors.Is(err, tc.wantKind) {
+				t.Fatalf("expected a SetupError of kind %v, got %T: %v", tc.wantKind, err, err)
+			}
+			want := tc.err.Error() + "; "
+			if msg := err.Error(); !strings.HasPrefix(msg, want) || !strings.Contains(msg, tc.wantHint) {
+				t.Fatalf("wrong message %q", msg)
+			}
+			// The error of Postgres is kept
+			if errors.Unwrap(setupErr) != tc.err {
+				t.Fatalf("the Postgres error isn't wrapped: %v", errors.Unwrap(setupErr))
+			}
+
+			// The lock errors keep their type
+			_, err = c.Lock(statemgr.NewLockInfo())
+			var lockErr *statemgr.LockError
+			if !errors.As(err, &lockErr) || !errors.Is(lockErr.Err, tc.wantKind) || !strings.Contains(lockErr.Err.Error(), tc.wantHint) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	// An error is only classified once
+	undefined := &pq.Error{Code: "42P01", Message: `relation "s.states" does not exist`}
+	err := classifyError(classifyError(undefined))
+	if n := strings.Count(err.Error(), "create it"); n != 1 {
+		t.Fatalf("hint repeated %d times: %s", n, err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// With soft_delete_retention, the deleted workspaces are tombstoned rather
+// than deleted: the deleted_at column of their row is set to the time of the
+// deletion, and their state is kept, but they are neither listed nor read,
+// and their name can't be reused until they are recovered or purged. The
+// tombstones older than the retention are purged by PurgeDeletedWorkspaces,
+// and along the way by DeleteWorkspace.
+
+// ErrWorkspaceDeleted is wrapped by the errors returned when the state of a
+// soft-deleted workspace is written or created, until it is recovered with
+// RecoverWorkspace or purged with PurgeWorkspace.
+var ErrWorkspaceDeleted = errors.New("workspace deleted")
+
+// notDeleted returns the condition, starting with AND, skipping the
+// tombstones of the soft-deleted workspaces, or an empty one if hasDeletedAt
+// isn't set.
+func notDeleted(hasDeletedAt bool) string {
+	if !hasDeletedAt {
+		return ""
+	}
+	return " AND deleted_at IS NULL"
+}
+
+// softDeleteStatesQuery is deleteStatesQuery for soft_delete_retention, the
+// states matching condition are tombstoned rather than deleted, so their
+// large objects are kept until they are purged.
+func (b *Backend) softDeleteStatesQuery(condition string, ctes []string) string {
+	query := fmt.Sprintf(`UPDATE %s.%s SET deleted_at = now() WHERE %s AND deleted_at IS NULL RETURNING %s`, b.schemaName, b.tableName, condition, b.nameCol())
+	if len(ctes) > 0 {
+		query = fmt.Sprintf(`WITH %s %s`, strings.Join(ctes, ", "), query)
+	}
+	return query
+}
+
+// checkNotDeleted returns an error wrapping ErrWorkspaceDeleted if the
+// workspace has been soft-deleted.
+func (c *RemoteClient) checkNotDeleted(ctx context.Context, tx *sql.Tx) error {
+	if !c.hasDeletedAt {
+		return nil
+	}
+	var deleted bool
+	query := `SELECT EXISTS(SELECT 1 FROM %s.%s WHERE %s = $1 AND deleted_at IS NOT NULL)`
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(query, c.SchemaName, c.TableName, c.nameCol()), c.Name).Scan(&deleted); err != nil {
+		return err
+	}
+	if deleted {
+		return fmt.Errorf("%w: %q, it must be recovered with RecoverWorkspace or purged with PurgeWorkspace to be used again", ErrWorkspaceDeleted, c.Name)
+	}
+	return nil
+}
+
+// RecoverWorkspace recovers the given workspace deleted by DeleteWorkspace
+// less than soft_delete_retention ago, with the state it had when it was
+// deleted. An error wrapping ErrWorkspaceNotFound is returned if there is no
+// such workspace, e.g. because it has been purged.
+func (b *Backend) RecoverWorkspace(ctx context.Context, name string) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "recover_workspace", tableAttrs(b.schemaName, b.tableName, name)...)
+	defer op.end(&err)
+
+	if b.readOnly {
+		return fmt.Errorf("can't recover state %q: %w", name, ErrReadOnly)
+	}
+	if b.softDeleteRetention <= 0 {
+		return fmt.Errorf("the deleted workspaces are not kept, soft_delete_retention is not set")
+	}
+
+	defer b.workspacesCache.invalidate()
+	b.replica.wroteStates(name)
+	b.replica.changedWorkspaces()
+
+	query := `UPDATE %s.%s SET deleted_at = NULL WHERE %s = $1 AND deleted_at > now() - $2 * interval '1 millisecond'`
+	var n int64
+	err = retry(ctx, b.maxRetries, func() error {
+		res, err := b.db.ExecContext(ctx, fmt.Sprintf(query, b.schemaName, b.tableName, b.nameCol()), name, b.softDeleteRetention.Milliseconds())
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %q has not been deleted within soft_delete_retention", ErrWorkspaceNotFound, name)
+	}
+	op.setRows(n)
+	return nil
+}
+
+// PurgeWorkspace deletes the state of the given workspace for good, as
+// DeleteWorkspace does without soft_delete_retention, whether it has been
+// soft-deleted or not.
+func (b *Backend) PurgeWorkspace(ctx context.Context, name string, force bool) (err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "purge_workspace", tableAttrs(b.schemaName, b.tableName, name)...)
+	defer op.end(&err)
+
+	return b.removeWorkspace(ctx, name, force, true)
+}
+
+// PurgeDeletedWorkspaces deletes for good the workspaces deleted by
+// DeleteWorkspace more than soft_delete_retention ago, and returns their
+// names ordered by name.
+func (b *Backend) PurgeDeletedWorkspaces(ctx context.Context) (_ []string, err error) {
+	ctx, op := startOperation(ctx, b.operations, b.logger, b.metrics, b.slowQueryThreshold, b.timeouts, "purge_deleted_workspaces", tableAttrs(b.schemaName, b.tableName, "")...)
+	defer op.end(&err)
+
+	if b.readOnly {
+		return nil, fmt.Errorf("can't purge the deleted states: %w", ErrReadOnly)
+	}
+	if b.softDeleteRetention <= 0 {
+		return nil, fmt.Errorf("the deleted workspaces are not kept, soft_delete_retention is not set")
+	}
+	purged, err := b.purgeDeletedWorkspaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	op.setRows(int64(len(purged)))
+	return purged, nil
+}
+
+func (b *Backend) purgeDeletedWorkspaces(ctx context.Context) ([]string, error) {
+	query := b.deleteStatesQuery(`deleted_at <= now() - $1 * interval '1 millisecond'`, nil)
+	purged, err := b.queryWorkspaces(ctx, b.db, nil, query, b.softDeleteRetention.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(purged)
+	return purged, nil
+}
@@ -0,0 +1,385 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// softDeleteTable is a states table of the fake driver with the deleted_at
+// column, whose clock is moved by hand.
+type softDeleteTable struct {
+	mu        sync.Mutex
+	now       time.Time
+	data      map[string][]byte
+	deletedAt map[string]time.Time
+}
+
+func newSoftDeleteTable(names ...string) *softDeleteTable {
+	table := &softDeleteTable{
+		now:       time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		data:      make(map[string][]byte),
+		deletedAt: make(map[string]time.Time),
+	}
+	for _, name := range names {
+		table.data[name] = testStateFile(1)
+	}
+	return table
+}
+
+func (h *softDeleteTable) advance(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.now = h.now.Add(d)
+}
+
+func (h *softDeleteTable) live(name string) bool {
+	_, deleted := h.deletedAt[name]
+	return h.data[name] != nil && !deleted
+}
+
+func (h *softDeleteTable) names(names []string) *fakeRows {
+	sort.Strings(names)
+	rows := &fakeRows{columns: []string{"name"}, affected: int64(len(names))}
+	for _, name := range names {
+		rows.values = append(rows.values, []driver.Value{name})
+	}
+	return rows
+}
+
+func (h *softDeleteTable) handle(query string, args []driver.NamedValue) (*fakeRows, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The cutoff of the retention given in milliseconds by the argument
+	cutoff := func(arg int) time.Time {
+		return h.now.Add(-time.Duration(args[arg].Value.(int64)) * time.Millisecond)
+	}
+	switch {
+	case strings.HasPrefix(query, `UPDATE "s"."states" SET deleted_at = now()`):
+		name := args[0].Value.(string)
+		if !h.live(name) {
+			return h.names(nil), nil
+		}
+		h.deletedAt[name] = h.now
+		return h.names([]string{name}), nil
+	case strings.HasPrefix(query, `UPDATE "s"."states" SET deleted_at = NULL`):
+		name := args[0].Value.(string)
+		if deletedAt, ok := h.deletedAt[name]; !ok || !deletedAt.After(cutoff(1)) {
+			return &fakeRows{}, nil
+		}
+		delete(h.deletedAt, name)
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, `DELETE FROM "s"."states" WHERE deleted_at <= now()`):
+		var purged []string
+		for name, deletedAt := range h.deletedAt {
+			if !deletedAt.After(cutoff(0)) {
+				purged = append(purged, name)
+				delete(h.data, name)
+				delete(h.deletedAt, name)
+			}
+		}
+		return h.names(purged), nil
+	case strings.HasPrefix(query, `DELETE FROM "s"."states" WHERE name = $1`):
+		name := args[0].Value.(string)
+		if h.data[name] == nil {
+			return h.names(nil), nil
+		}
+		delete(h.data, name)
+		delete(h.deletedAt, name)
+		return h.names([]string{name}), nil
+	case strings.HasPrefix(query, `INSERT INTO "s"."states"`):
+		name := args[0].Value.(string)
+		if h.data[name] != nil && !h.live(name) {
+			return &fakeRows{}, nil
+		}
+		h.data[name] = args[1].Value.([]byte)
+		return &fakeRows{affected: 1}, nil
+	case strings.Contains(query, "deleted_at IS NOT NULL"):
+		_, deleted := h.deletedAt[args[0].Value.(string)]
+		return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{deleted}}}, nil
+	case !strings.Contains(query, "deleted_at IS NULL"):
+		return nil, fmt.Errorf("statement reading the tombstones: %s", query)
+	case strings.HasPrefix(query, "SELECT name, coalesce(octet_length(data), 0) FROM"):
+		rows := &fakeRows{columns: []string{"name", "size"}}
+		for name, data := range h.data {
+			if h.live(name) {
+				rows.values = append(rows.values, []driver.Value{name, int64(len(data))})
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT coalesce(sum(coalesce(octet_length(data), 0)), 0) FROM"):
+		var total int64
+		for name, data := range h.data {
+			if h.live(name) {
+				total += int64(len(data))
+			}
+		}
+		return &fakeRows{columns: []string{"total"}, values: [][]driver.Value{{total}}}, nil
+	case strings.HasPrefix(query, "SELECT coalesce(octet_length(data), 0) FROM"):
+		rows := &fakeRows{columns: []string{"size"}}
+		if name := args[0].Value.(string); h.live(name) {
+			rows.values = [][]driver.Value{{int64(len(h.data[name]))}}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT substr(data, $2, $3) FROM"):
+		name, offset, size := args[0].Value.(string), args[1].Value.(int), args[2].Value.(int)
+		if !h.live(name) {
+			return &fakeRows{columns: []string{"chunk"}}, nil
+		}
+		data := h.data[name]
+		chunk := data[min(offset-1, len(data)):min(offset-1+size, len(data))]
+		return &fakeRows{columns: []string{"chunk"}, values: [][]driver.Value{{chunk}}}, nil
+	case strings.HasPrefix(query, "SELECT name FROM"):
+		var names []string
+		for name := range h.data {
+			if h.live(name) {
+				names = append(names, name)
+			}
+		}
+		return h.names(names), nil
+	case strings.HasPrefix(query, "SELECT EXISTS"):
+		return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{h.live(args[0].Value.(string))}}}, nil
+	case strings.HasPrefix(query, "SELECT data FROM"):
+		rows := &fakeRows{columns: []string{"data"}}
+		if name := args[0].Value.(string); h.live(name) {
+			rows.values = [][]driver.Value{{h.data[name]}}
+		}
+		return rows, nil
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	}
+}
+
+func newSoftDeleteBackend(t *testing.T, table *softDeleteTable) *Backend {
+	t.Helper()
+	db, _ := newFakeDB(t, table.handle)
+	return &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, hasDeletedAt: true, softDeleteRetention: time.Hour}
+}
+
+func TestBackendSoftDeleteRecover(t *testing.T) {
+	table := newSoftDeleteTable("foo", "bar")
+	b := newSoftDeleteBackend(t, table)
+	ctx := context.Background()
+
+	if err := b.DeleteWorkspace(ctx, "foo", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := table.deletedAt["foo"]; !ok || table.data["foo"] == nil {
+		t.Fatal("the state has not been tombstoned")
+	}
+
+	// The tombstone is neither listed nor read, nor written over
+	workspaces, err := b.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{backend.DefaultStateName, "bar"}; !reflect.DeepEqual(workspaces, want) {
+		t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+	}
+	if exists, err := b.WorkspaceExists(ctx, "foo"); err != nil || exists {
+		t.Fatalf("the deleted workspace exists: %t, %v", exists, err)
+	}
+	client := b.remoteClient("foo")
+	if payload, err := client.Get(); err != nil || payload != nil {
+		t.Fatalf("the deleted state has been read: %v, %v", payload, err)
+	}
+	if err := client.Put(testStateFile(2)); !errors.Is(err, ErrWorkspaceDeleted) {
+		t.Fatalf("expected an error wrapping %v, got %v", ErrWorkspaceDeleted, err)
+	}
+
+	// Nor is it counted in the sizes
+	sizes, err := b.WorkspaceSizes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"bar": int64(len(testStateFile(1)))}; !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("wrong sizes %v; want %v", sizes, want)
+	}
+	total, err := b.TotalSize(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != sizes["bar"] {
+		t.Fatalf("wrong total size %d; want the sum of the workspace sizes %d", total, sizes["bar"])
+	}
+
+	// Within the retention, the workspace is recovered with its state
+	table.advance(30 * time.Minute)
+	if err := b.RecoverWorkspace(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	workspaces, err = b.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{backend.DefaultStateName, "bar", "foo"}; !reflect.DeepEqual(workspaces, want) {
+		t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+	}
+	payload, err := client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload == nil || string(payload.Data) != string(testStateFile(1)) {
+		t.Fatal("the state has not been recovered")
+	}
+	r, err := client.GetReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil {
+		t.Fatal("the recovered state can't be streamed")
+	}
+	defer r.Close()
+	if data, err := io.ReadAll(r); err != nil || string(data) != string(testStateFile(1)) {
+		t.Fatalf("wrong streamed state %.80q, %v", data, err)
+	}
+
+	// A workspace that hasn't been deleted can't be recovered
+	if err := b.RecoverWorkspace(ctx, "bar"); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected an error wrapping %v, got %v", ErrWorkspaceNotFound, err)
+	}
+}
+
+func TestBackendSoftDeletePurge(t *testing.T) {
+	table := newSoftDeleteTable("foo", "bar", "baz")
+	b := newSoftDeleteBackend(t, table)
+	ctx := context.Background()
+
+	if err := b.DeleteWorkspace(ctx, "foo", true); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := b.PurgeDeletedWorkspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 0 {
+		t.Fatalf("workspaces purged within the retention: %v", purged)
+	}
+
+	// Past the retention, the workspace can't be recovered anymore, and is
+	// purged by the next deletion
+	table.advance(2 * time.Hour)
+	if err := b.RecoverWorkspace(ctx, "foo"); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected an error wrapping %v, got %v", ErrWorkspaceNotFound, err)
+	}
+	if err := b.DeleteWorkspace(ctx, "bar", true); err != nil {
+		t.Fatal(err)
+	}
+	if table.data["foo"] != nil {
+		t.Fatal("the expired tombstone has not been purged")
+	}
+	if _, ok := table.deletedAt["bar"]; !ok {
+		t.Fatal("the state has not been tombstoned")
+	}
+
+	table.advance(2 * time.Hour)
+	purged, err = b.PurgeDeletedWorkspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bar"}; !reflect.DeepEqual(purged, want) {
+		t.Fatalf("wrong purged workspaces %v; want %v", purged, want)
+	}
+
+	// The states are purged right away by PurgeWorkspace
+	if err := b.PurgeWorkspace(ctx, "baz", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(table.data) != 0 {
+		t.Fatalf("states left: %v", table.data)
+	}
+}
+
+func TestBackendSoftDeleteDisabled(t *testing.T) {
+	table := newSoftDeleteTable("foo")
+	b := newSoftDeleteBackend(t, table)
+	b.softDeleteRetention = 0
+	ctx := context.Background()
+
+	// The states are deleted right away, and nothing is kept to recover
+	if err := b.DeleteWorkspace(ctx, "foo", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(table.data) != 0 {
+		t.Fatalf("states left: %v", table.data)
+	}
+	if err := b.RecoverWorkspace(ctx, "foo"); err == nil || !strings.Contains(err.Error(), "soft_delete_retention is not set") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := b.PurgeDeletedWorkspaces(ctx); err == nil || !strings.Contains(err.Error(), "soft_delete_retention is not set") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBackendSoftDeleteRetention(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":              connStr,
+		"schema_name":           schemaName,
+		"soft_delete_retention": "1h",
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	ctx := context.Background()
+	if err := b.remoteClient("foo").Put(testStateFile(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.DeleteWorkspace(ctx, "foo", false); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := b.WorkspaceExists(ctx, "foo"); err != nil || exists {
+		t.Fatalf("the deleted workspace exists: %t, %v", exists, err)
+	}
+	if err := b.RecoverWorkspace(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := b.remoteClient("foo").Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload == nil || string(payload.Data) != string(testStateFile(1)) {
+		t.Fatal("the state has not been recovered")
+	}
+
+	// The tombstones expire with the deletion time moved back
+	if err := b.DeleteWorkspace(ctx, "foo", false); err != nil {
+		t.Fatal(err)
+	}
+	query := `UPDATE %s.states SET deleted_at = deleted_at - interval '2 hours'`
+	if _, err := dbCleaner.Exec(fmt.Sprintf(query, schemaName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RecoverWorkspace(ctx, "foo"); !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("expected an error wrapping %v, got %v", ErrWorkspaceNotFound, err)
+	}
+	purged, err := b.PurgeDeletedWorkspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"foo"}; !reflect.DeepEqual(purged, want) {
+		t.Fatalf("wrong purged workspaces %v; want %v", purged, want)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// statementCache holds the prepared statements of the hot queries, listing
+// the workspaces, checking their existence, and reading and writing the
+// states, when prepared_statements is set. database/sql prepares each of
+// them once on each connection of the pool it runs on, and reuses it for the
+// next runs on that connection.
+//
+// A nil cache prepares nothing, the statements are then parsed, bound and
+// run on each call.
+type statementCache struct {
+	mu    sync.Mutex
+	stmts map[statementKey]*sql.Stmt
+}
+
+type statementKey struct {
+	db    *sql.DB
+	query string
+}
+
+func newStatementCache() *statementCache {
+	return &statementCache{stmts: make(map[statementKey]*sql.Stmt)}
+}
+
+// prepared returns the statement of query prepared on db, preparing it on
+// its first use, or nil if c is nil or the statement cannot be prepared. A
+// statement failing to be prepared, e.g. because its table doesn't exist
+// yet, is run without being prepared, so its error is the one of the run,
+// and it is prepared again on its next use.
+func (c *statementCache) prepared(ctx context.Context, db *sql.DB, query string) *sql.Stmt {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := statementKey{db, query}
+	if stmt, ok := c.stmts[key]; ok {
+		return stmt
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil
+	}
+	c.stmts[key] = stmt
+	return stmt
+}
+
+func (c *statementCache) queryContext(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt := c.prepared(ctx, db, query); stmt != nil {
+		return stmt.QueryContext(ctx, args...)
+	}
+	return db.QueryContext(ctx, query, args...)
+}
+
+func (c *statementCache) queryRowContext(ctx context.Context, db *sql.DB, query string, args ...interface{}) *sql.Row {
+	if stmt := c.prepared(ctx, db, query); stmt != nil {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return db.QueryRowContext(ctx, query, args...)
+}
+
+// txExecContext runs query in tx with stmt, its statement returned by
+// prepared before tx was begun, as preparing it may wait for a connection
+// of the pool, or without a statement if stmt is nil. The statement is
+// prepared on the connection of tx if it isn't yet.
+func txExecContext(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, query string, args ...interface{}) (sql.Result, error) {
+	if stmt != nil {
+		return tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+	}
+	return tx.ExecContext(ctx, query, args...)
+}
+
+// close closes the prepared statements, deallocating them on the
+// connections they were prepared on.
+func (c *statementCache) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for key, stmt := range c.stmts {
+		err = errors.Join(err, stmt.Close())
+		delete(c.stmts, key)
+	}
+	return err
+}
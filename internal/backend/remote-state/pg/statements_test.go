@@ -0,0 +1,197 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// hotQueriesHandler answers the hot queries of a workspace "foo" holding a
+// state.
+func hotQueriesHandler(query string, _ []driver.NamedValue) (*fakeRows, error) {
+	switch {
+	case strings.HasPrefix(query, "SELECT name FROM"):
+		return &fakeRows{columns: []string{"name"}, values: [][]driver.Value{{"foo"}}}, nil
+	case strings.HasPrefix(query, "SELECT EXISTS"):
+		return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{true}}}, nil
+	case strings.HasPrefix(query, "SELECT data"):
+		return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{testStateFile(1)}}}, nil
+	case strings.HasPrefix(query, "INSERT INTO"):
+		return &fakeRows{affected: 1}, nil
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+}
+
+func TestBackendPreparedStatements(t *testing.T) {
+	for _, prepared := range []bool{true, false} {
+		t.Run(fmt.Sprintf("prepared_statements=%t", prepared), func(t *testing.T) {
+			db, fake := newFakeDB(t, hotQueriesHandler)
+			// A single connection, which the statements are prepared on
+			db.SetMaxOpenConns(1)
+			b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+			if prepared {
+				b.stmts = newStatementCache()
+			}
+			ctx := context.Background()
+
+			const runs = 3
+			for i := 0; i < runs; i++ {
+				if _, err := b.Workspaces(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := b.WorkspaceExists(ctx, "foo"); err != nil {
+					t.Fatal(err)
+				}
+				client := b.remoteClient("foo")
+				if _, err := client.Get(); err != nil {
+					t.Fatal(err)
+				}
+				if err := client.Put(testStateFile(1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := len(fake.Queries()); n != 4*runs {
+				t.Fatalf("%d statements run; want %d", n, 4*runs)
+			}
+
+			prepares := fake.Prepares()
+			if !prepared {
+				// The statements are sent as they are
+				if len(prepares) != 0 {
+					t.Fatalf("statements prepared: %v", prepares)
+				}
+				return
+			}
+			// Once each on the connection
+			if len(prepares) != 4 {
+				t.Fatalf("wrong prepared statements:\n%s", strings.Join(prepares, "\n"))
+			}
+			seen := make(map[string]bool)
+			for _, query := range prepares {
+				if seen[query] {
+					t.Fatalf("statement prepared twice: %s", query)
+				}
+				seen[query] = true
+			}
+			if err := b.stmts.close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBackendPreparedStatementsConfig(t *testing.T) {
+	server := newFakeLoginServer(t)
+	host, port := server.addr()
+
+	testCases := map[string]struct {
+		config   map[string]interface{}
+		env      string
+		prepared bool
+	}{
+		"default": {
+			prepared: true,
+		},
+		"disabled": {
+			config: map[string]interface{}{"prepared_statements": false},
+		},
+		"pgbouncer_compatible": {
+			config: map[string]interface{}{"pgbouncer_compatible": true},
+		},
+		"pgbouncer_compatible-enabled": {
+			// PgBouncer 1.21 and later keep track of the prepared
+			// statements
+			config:   map[string]interface{}{"pgbouncer_compatible": true, "prepared_statements": true},
+			prepared: true,
+		},
+		"env": {
+			env: "false",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("PG_PREPARED_STATEMENTS", tc.env)
+			config := map[string]interface{}{
+				"conn_str": fmt.Sprintf("host=%s port=%s user=tofu password=tofu sslmode=disable", host, port),
+			}
+			for k, v := range tc.config {
+				config[k] = v
+			}
+			b := New().(*Backend)
+
+			// The fake server refuses the login
+			if err := configureBackend(t, b, config); err == nil || !strings.Contains(err.Error(), "fake login refused") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := b.stmts != nil; got != tc.prepared {
+				t.Fatalf("prepared statements: %t; want %t", got, tc.prepared)
+			}
+			// The statements that aren't prepared are run in a single
+			// round trip, as all of them with pgbouncer_compatible
+			want := !tc.prepared || tc.config["pgbouncer_compatible"] == true
+			if got := strings.Contains(b.connStr, "binary_parameters"); got != want {
+				t.Fatalf("statements run in a single round trip: %t; want %t", got, want)
+			}
+		})
+	}
+}
+
+func BenchmarkPreparedStatements(b *testing.B) {
+	testACC(b)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", b.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	for _, prepared := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prepared_statements=%t", prepared), func(b *testing.B) {
+			config := backend.TestWrapConfig(map[string]interface{}{
+				"conn_str":            connStr,
+				"schema_name":         schemaName,
+				"prepared_statements": prepared,
+			})
+			be := New().(*Backend)
+			obj, diags := hcldec.Decode(config, be.ConfigSchema(context.Background()).DecoderSpec(), nil)
+			if diags.HasErrors() {
+				b.Fatal(diags.Error())
+			}
+			obj, valDiags := be.PrepareConfig(context.Background(), obj)
+			if valDiags.HasErrors() {
+				b.Fatal(valDiags.ErrWithWarnings())
+			}
+			if confDiags := be.Configure(context.Background(), obj); confDiags.HasErrors() {
+				b.Fatal(confDiags.ErrWithWarnings())
+			}
+			defer be.Close()
+			ctx := context.Background()
+			client := be.remoteClient("foo")
+			if err := client.Put(testStateFile(1)); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := be.WorkspaceExists(ctx, "foo"); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := client.Get(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
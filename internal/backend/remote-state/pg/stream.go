@@ -0,0 +1,171 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// stateChunkSize is the number of characters of a stored state read at once
+// by GetReader, and the number of bytes written at once in a large object.
+const stateChunkSize = 1 << 20
+
+// GetReader returns a reader of the state of the workspace, which is read
+// from the database by chunks as it is consumed instead of being loaded in
+// memory at once as Get does, from the first table holding the workspace. It
+// returns nil if the workspace has no state.
+//
+// The chunks are read in a read-only, repeatable read transaction so they
+// all come from the same version of the state, the reader must be closed to
+// end it and release its connection.
+func (c *RemoteClient) GetReader(ctx context.Context) (_ io.ReadCloser, err error) {
+	ctx, op := c.startOperation(ctx, "get_reader")
+	defer op.end(&err)
+
+	tx, err := c.Client.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// The state is read from the first table holding the workspace.
+	var size int64
+	var checksum sql.NullString
+	var table fallbackTable
+	err = sql.ErrNoRows
+	for _, table = range c.stateTables() {
+		query := `SELECT %s FROM %s.%s WHERE %s = $1%s`
+		dest := []interface{}{&size}
+		if table.hasChecksum {
+			query = `SELECT %s, checksum FROM %s.%s WHERE %s = $1%s`
+			dest = append(dest, &checksum)
+		}
+		err = tx.QueryRowContext(ctx, fmt.Sprintf(query, stateSizeColumn(c.dataCol(), table.hasDataOid), table.schemaName, c.TableName, c.nameCol(), notDeleted(table.hasDeletedAt)), c.Name).Scan(dest...)
+		if err != sql.ErrNoRows {
+			break
+		}
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		tx.Rollback()
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	op.setStateSize(int(size))
+
+	chunks := &stateChunkReader{ctx: ctx, tx: tx, client: c, table: table, offset: 1, chunkSize: stateChunkSize}
+	r, err := c.decodeStateReader(bufio.NewReader(chunks))
+	if err != nil {
+		return nil, err
+	}
+	if checksum.Valid {
+		r = &checksumReader{r: r, name: c.Name, hash: sha256.New(), want: checksum.String}
+	}
+	// The chunks are read once the operation ends, within its timeout.
+	return &stateReader{Reader: r, tx: tx, cancel: op.keepContext()}, nil
+}
+
+// stateChunkReader reads the stored state of a workspace from table by
+// chunks of chunkSize characters.
+type stateChunkReader struct {
+	ctx       context.Context
+	tx        *sql.Tx
+	client    *RemoteClient
+	table     fallbackTable
+	chunkSize int
+
+	// offset is the position of the next chunk, in characters starting at
+	// 1 as substr expects.
+	offset int
+	buf    []byte
+	eof    bool
+}
+
+func (r *stateChunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads the next chunk of the state, from the data column or from the
+// large object of the state, whose offsets are in bytes starting at 0. The
+// row is selected as by the query of its size, so it is the same row.
+func (r *stateChunkReader) next() error {
+	c := r.client
+	query := `SELECT substr(%[1]s, $2, $3) FROM %[2]s.%[3]s WHERE %[4]s = $1%[5]s`
+	var chunk, large []byte
+	dest := []interface{}{&chunk}
+	if r.table.hasDataOid {
+		query = `SELECT substr(%[1]s, $2, $3), lo_get(data_oid, $2 - 1, $3) FROM %[2]s.%[3]s WHERE %[4]s = $1%[5]s`
+		dest = append(dest, &large)
+	}
+	err := r.tx.QueryRowContext(r.ctx, fmt.Sprintf(query, c.dataCol(), r.table.schemaName, c.TableName, c.nameCol(), notDeleted(r.table.hasDeletedAt)), c.Name, r.offset, r.chunkSize).Scan(dest...)
+	if err != nil {
+		return err
+	}
+	if large != nil {
+		chunk = large
+	}
+	r.offset += r.chunkSize
+	r.buf = chunk
+	r.eof = len(chunk) == 0
+	return nil
+}
+
+// checksumReader verifies that the state read from r matches its checksum
+// once it has been read until the end.
+type checksumReader struct {
+	r    io.Reader
+	name string
+	hash hash.Hash
+	want string
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != r.want {
+			return n, fmt.Errorf("%w for workspace %q: the checksum of the stored state is %s, expected %s", ErrStateIntegrity, r.name, sum, r.want)
+		}
+	}
+	return n, err
+}
+
+// stateReader is the reader returned by GetReader, closing it ends the
+// transaction the state is read in and releases its context.
+type stateReader struct {
+	io.Reader
+	tx     *sql.Tx
+	cancel context.CancelFunc
+}
+
+func (r *stateReader) Close() error {
+	defer r.cancel()
+	if err := r.tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		return err
+	}
+	return nil
+}
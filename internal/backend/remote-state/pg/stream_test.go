@@ -0,0 +1,158 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// storedStateHandler returns a fakeDB handler serving stored as the state of
+// the workspace, with the given checksum. The payload is ASCII, so the
+// characters read by substr are bytes.
+func storedStateHandler(stored []byte, checksum driver.Value) func(string, []driver.NamedValue) (*fakeRows, error) {
+	return func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT substr"):
+			start := min(args[1].Value.(int)-1, len(stored))
+			end := min(start+args[2].Value.(int), len(stored))
+			return &fakeRows{columns: []string{"substr"}, values: [][]driver.Value{{stored[start:end]}}}, nil
+		case strings.HasPrefix(query, "SELECT coalesce(octet_length(data), 0), checksum"):
+			return &fakeRows{columns: []string{"size", "checksum"}, values: [][]driver.Value{{int64(len(stored)), checksum}}}, nil
+		case strings.HasPrefix(query, "SELECT data, checksum"):
+			return &fakeRows{columns: []string{"data", "checksum"}, values: [][]driver.Value{{stored, checksum}}}, nil
+		default:
+			return nil, fmt.Errorf("unexpected query: %s", query)
+		}
+	}
+}
+
+func TestRemoteClientGetReader(t *testing.T) {
+	// A state of several megabytes, read in several chunks
+	state := testStateFile(5000)
+	if len(state) < 3*stateChunkSize {
+		t.Fatalf("the state is too small: %d bytes", len(state))
+	}
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			stored, err := encodeState(state, compress, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, fake := newFakeDB(t, storedStateHandler(stored, stateChecksum(state)))
+			c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasChecksum: true}
+
+			payload, err := c.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := c.GetReader(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			streamed, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(streamed, payload.Data) {
+				t.Fatalf("the streamed state differs from the one read at once (%d and %d bytes)", len(streamed), len(payload.Data))
+			}
+
+			var chunks int
+			for _, query := range fake.Queries() {
+				if strings.HasPrefix(query, "SELECT substr") {
+					chunks++
+				}
+			}
+			if want := len(stored)/stateChunkSize + 2; chunks != want {
+				t.Fatalf("the state has been read in %d chunks; want %d", chunks, want)
+			}
+		})
+	}
+}
+
+func TestRemoteClientGetReaderChecksum(t *testing.T) {
+	state := testStateFile(10)
+	db, _ := newFakeDB(t, storedStateHandler(state, stateChecksum([]byte("{}"))))
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, hasChecksum: true}
+
+	r, err := c.GetReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrStateIntegrity) {
+		t.Fatalf("expected an integrity error, got: %v", err)
+	}
+}
+
+func TestRemoteClientGetReaderNoState(t *testing.T) {
+	db, _ := newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+		return &fakeRows{columns: []string{"size"}}, nil
+	})
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`}
+
+	r, err := c.GetReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != nil {
+		t.Fatal("expected no state")
+	}
+}
+
+func TestBackendGetReader(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	for _, compress := range []bool{false, true} {
+		config := backend.TestWrapConfig(map[string]interface{}{
+			"conn_str":    connStr,
+			"schema_name": schemaName,
+			"compress":    compress,
+		})
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+		client := b.remoteClient(fmt.Sprintf("compress-%t", compress))
+
+		state := testStateFile(5000)
+		if err := client.Put(state); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := client.GetReader(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(streamed, state) {
+			t.Fatalf("wrong streamed state with compress=%t (%d bytes, want %d)", compress, len(streamed), len(state))
+		}
+	}
+}
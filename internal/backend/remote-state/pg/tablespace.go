@@ -0,0 +1,63 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// tablespaceClause returns the clause placing a new table in the tablespace
+// set by tablespace, empty if unset.
+func (b *Backend) tablespaceClause() string {
+	if b.tablespace == "" {
+		return ""
+	}
+	return " TABLESPACE " + b.tablespace
+}
+
+// indexTablespaceClause returns the clause placing the index of a UNIQUE or
+// PRIMARY KEY constraint of a new table in the tablespace set by
+// tablespace, empty if unset.
+func (b *Backend) indexTablespaceClause() string {
+	if b.tablespace == "" {
+		return ""
+	}
+	return " USING INDEX TABLESPACE " + b.tablespace
+}
+
+// tablespaceError returns err with a hint if it is caused by the tablespace
+// set by tablespace, which doesn't exist or can't be used by the role, and
+// as is otherwise.
+func (b *Backend) tablespaceError(err error) error {
+	var pqErr *pq.Error
+	if b.tablespace == "" || !errors.As(err, &pqErr) {
+		return err
+	}
+	switch pqErr.Code {
+	case "42704": // undefined_object
+		return fmt.Errorf("%w; create tablespace %s, or fix the tablespace option", err, b.tablespace)
+	case "42501": // insufficient_privilege
+		return fmt.Errorf("%w; run GRANT CREATE ON TABLESPACE %s TO the role, or unset the tablespace option", err, b.tablespace)
+	}
+	return err
+}
+
+// createStatesTable creates the states table, unless it exists, with a data
+// column of the given type, in the tablespace set by tablespace, if any, and
+// UNLOGGED if unlogged is set. An existing table is left as is, wherever it
+// is, see checkUnlogged.
+func (b *Backend) createStatesTable(ctx context.Context, db *sql.DB, columnType string) error {
+	query := `CREATE %sTABLE IF NOT EXISTS %s.%s (
+		id bigint NOT NULL DEFAULT nextval('public.global_states_id_seq') PRIMARY KEY%s,
+		%s text UNIQUE%s,
+		%s %s
+		)%s`
+	err := execIfNotExists(ctx, db, fmt.Sprintf(query, b.unloggedClause(), b.schemaName, b.tableName, b.indexTablespaceClause(), b.nameCol(), b.indexTablespaceClause(), b.dataCol(), columnType, b.tablespaceClause()))
+	return b.tablespaceError(err)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestBackendTablespace(t *testing.T) {
+	t.Run("create", func(t *testing.T) {
+		for _, tablespace := range []string{"", `"fast_ssd"`} {
+			db, fake := newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+				return &fakeRows{}, nil
+			})
+			b := &Backend{schemaName: `"s"`, tableName: `"states"`, tablespace: tablespace}
+			if err := b.createStatesTable(context.Background(), db, "text"); err != nil {
+				t.Fatal(err)
+			}
+			query := fake.Queries()[0]
+			if !strings.HasPrefix(query, `CREATE TABLE IF NOT EXISTS "s"."states"`) {
+				t.Fatalf("wrong statement %s", query)
+			}
+			if tablespace == "" {
+				if strings.Contains(query, "TABLESPACE") {
+					t.Fatalf("a tablespace is set: %s", query)
+				}
+				continue
+			}
+			// The indexes of the constraints as well
+			if !strings.HasSuffix(query, `) TABLESPACE "fast_ssd"`) || strings.Count(query, `USING INDEX TABLESPACE "fast_ssd"`) != 2 {
+				t.Fatalf("the tablespace is not set: %s", query)
+			}
+		}
+	})
+
+	t.Run("partitioned", func(t *testing.T) {
+		db, fake := newFakeDB(t, func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+			if strings.HasPrefix(query, "SELECT relkind") {
+				return &fakeRows{columns: []string{"relkind"}}, nil
+			}
+			return &fakeRows{}, nil
+		})
+		b := &Backend{schemaName: `"s"`, tableName: `"states"`, tablespace: `"fast_ssd"`}
+		if err := b.createPartitionedStatesTable(context.Background(), db, "text", []string{`"states_p0"`, `"states_p1"`}); err != nil {
+			t.Fatal(err)
+		}
+		for _, query := range fake.Queries()[1:] {
+			if !strings.HasSuffix(query, ` TABLESPACE "fast_ssd"`) {
+				t.Fatalf("the tablespace is not set: %s", query)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		testCases := map[string]struct {
+			err  error
+			want string
+		}{
+			"missing": {
+				err:  &pq.Error{Code: "42704", Message: `tablespace "fast_ssd" does not exist`},
+				want: `create tablespace "fast_ssd"`,
+			},
+			"denied": {
+				err:  &pq.Error{Code: "42501", Message: `permission denied for tablespace fast_ssd`},
+				want: `GRANT CREATE ON TABLESPACE "fast_ssd" TO the role`,
+			},
+		}
+		for name, tc := range testCases {
+			t.Run(name, func(t *testing.T) {
+				db, _ := newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+					return nil, tc.err
+				})
+				b := &Backend{schemaName: `"s"`, tableName: `"states"`, tablespace: `"fast_ssd"`}
+				err := b.createStatesTable(context.Background(), db, "text")
+				if err == nil || !strings.Contains(err.Error(), tc.want) || !errors.Is(err, tc.err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			})
+		}
+	})
+}
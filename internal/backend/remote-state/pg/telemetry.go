@@ -0,0 +1,192 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/opentofu/opentofu/internal/states/statemgr"
+)
+
+var tracer trace.Tracer
+
+func init() {
+	tracer = otel.Tracer("github.com/opentofu/opentofu/internal/backend/remote-state/pg")
+}
+
+// SetLogger makes the backend log each of its operations to logger, with
+// the op, workspace, duration and, when known, rows attributes: the
+// successful ones at the debug level, the failed ones at the warn level for
+// a lock held by someone else and at the error level otherwise, with the
+// credentials masked in the error attribute. Nothing is logged if logger is
+// nil, the default.
+//
+// It must be called before the backend is configured.
+func (b *Backend) SetLogger(logger *slog.Logger) {
+	b.logger = logger
+}
+
+// operation is a traced and measured backend operation.
+type operation struct {
+	name    string
+	start   time.Time
+	span    trace.Span
+	metrics *metrics
+	logger  *slog.Logger
+
+	// rows is the number of rows the operation returned or affected, once
+	// set by setRows.
+	rows    int64
+	hasRows bool
+
+	// slowThreshold is the duration beyond which the operation is logged
+	// as slow, it never is if zero.
+	slowThreshold time.Duration
+	workspace     string
+
+	// cancel releases the default timeout of the operation.
+	cancel context.CancelFunc
+
+	// tracker tracks the operation, which is refused if closed is set.
+	tracker *operationTracker
+	closed  bool
+}
+
+// startOperation starts the operation with the given name, as a child span
+// of the one in ctx. It returns the context of the operation, and the
+// operation which must be ended once done. The operation is logged if it
+// takes longer than slowThreshold, and to logger if not nil, and the context
+// is bounded by the default timeout of the operation in timeouts if it has no
+// deadline.
+//
+// The operation is tracked by tracker. Once the tracker is closed, the
+// context is canceled so nothing is run, and the operation ends with an
+// error wrapping ErrClosed.
+func startOperation(ctx context.Context, tracker *operationTracker, logger *slog.Logger, m *metrics, slowThreshold time.Duration, timeouts operationTimeouts, name string, attrs ...attribute.KeyValue) (context.Context, *operation) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracer.Start(ctx, "pg."+name, trace.WithAttributes(attrs...))
+	ctx, cancel := withDefaultTimeout(ctx, timeouts.forOperation(name))
+	op := &operation{
+		name:          name,
+		start:         time.Now(),
+		span:          span,
+		metrics:       m,
+		logger:        logger,
+		slowThreshold: slowThreshold,
+		cancel:        cancel,
+		tracker:       tracker,
+	}
+	if !tracker.begin() {
+		closedCtx, cancelClosed := context.WithCancel(ctx)
+		cancelClosed()
+		ctx, op.closed = closedCtx, true
+	}
+	for _, attr := range attrs {
+		if attr.Key == "pg.workspace" {
+			op.workspace = attr.Value.AsString()
+		}
+	}
+	return ctx, op
+}
+
+// keepContext returns the function releasing the context of the operation,
+// which is then kept once the operation ends, for the readers it returns.
+func (o *operation) keepContext() context.CancelFunc {
+	cancel := o.cancel
+	o.cancel = func() {}
+	return cancel
+}
+
+// end ends the operation, which failed if *err is not nil. It is meant to be
+// deferred. The credentials in the message of *err are masked, and the
+// errors caused by the setup of Postgres are classified, see classifyError.
+func (o *operation) end(err *error) {
+	o.cancel()
+	if o.closed {
+		*err = fmt.Errorf("can't run operation %s: %w", o.name, ErrClosed)
+	} else {
+		defer o.tracker.done()
+	}
+	*err = redactError(classifyError(*err))
+	if *err != nil {
+		o.span.RecordError(*err)
+		o.span.SetStatus(codes.Error, (*err).Error())
+	}
+	o.span.End()
+	o.metrics.observe(o.name, o.start, err)
+	o.log(*err)
+
+	if elapsed := time.Since(o.start); o.slowThreshold > 0 && elapsed > o.slowThreshold {
+		on := ""
+		if o.workspace != "" {
+			on = fmt.Sprintf(" on workspace %q", o.workspace)
+		}
+		log.Printf("[WARN] pg: slow operation %s%s took %s, beyond slow_query_threshold %s", o.name, on, elapsed.Round(time.Millisecond), o.slowThreshold)
+	}
+}
+
+// log logs the operation, which failed with err if not nil, to its logger.
+func (o *operation) log(err error) {
+	if o.logger == nil {
+		return
+	}
+	attrs := []slog.Attr{slog.String("op", o.name)}
+	if o.workspace != "" {
+		attrs = append(attrs, slog.String("workspace", o.workspace))
+	}
+	attrs = append(attrs, slog.Duration("duration", time.Since(o.start)))
+	if o.hasRows {
+		attrs = append(attrs, slog.Int64("rows", o.rows))
+	}
+	if err == nil {
+		o.logger.LogAttrs(context.Background(), slog.LevelDebug, "pg: operation done", attrs...)
+		return
+	}
+
+	// The locks held by someone else are expected while several runs use
+	// the same workspace.
+	level := slog.LevelError
+	var lockErr *statemgr.LockError
+	if errors.As(err, &lockErr) {
+		level = slog.LevelWarn
+	}
+	attrs = append(attrs, slog.String("error", err.Error()))
+	o.logger.LogAttrs(context.Background(), level, "pg: operation failed", attrs...)
+}
+
+// setRows records the number of rows the operation returned or affected.
+func (o *operation) setRows(n int64) {
+	o.rows, o.hasRows = n, true
+	o.span.SetAttributes(attribute.Int64("pg.rows", n))
+}
+
+// setStateSize records the size of the state read or written.
+func (o *operation) setStateSize(size int) {
+	o.span.SetAttributes(attribute.Int("pg.state.bytes", size))
+}
+
+// tableAttrs returns the span attributes of the given schema and table,
+// given as quoted identifiers, and workspace.
+func tableAttrs(schemaName, tableName, workspace string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("pg.schema", unquoteIdentifier(schemaName)),
+		attribute.String("pg.table", unquoteIdentifier(tableName)),
+	}
+	if workspace != "" {
+		attrs = append(attrs, attribute.String("pg.workspace", workspace))
+	}
+	return attrs
+}
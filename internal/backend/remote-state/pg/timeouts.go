@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"time"
+)
+
+// operationTimeouts are the default timeouts of the operations by class,
+// applied when the context of an operation has no deadline, so a caller
+// passing context.Background() doesn't wait forever. A zero timeout applies
+// none.
+type operationTimeouts struct {
+	list  time.Duration
+	read  time.Duration
+	write time.Duration
+	lock  time.Duration
+}
+
+// The classes of the operations with a default timeout.
+const (
+	listOperation  = "list"
+	readOperation  = "read"
+	writeOperation = "write"
+	lockOperation  = "lock"
+)
+
+// operationClasses are the classes of the operations by name. The bulk
+// operations, such as export_all, import_all and migrate_from, have none,
+// as their duration depends on the number of workspaces.
+var operationClasses = map[string]string{
+	"workspaces":             listOperation,
+	"count_workspaces":       listOperation,
+	"workspace_sizes":        listOperation,
+	"total_size":             listOperation,
+	"workspaces_page":        listOperation,
+	"workspaces_with_prefix": listOperation,
+
+	"get":            readOperation,
+	"get_reader":     readOperation,
+	"state_metadata": readOperation,
+	"get_raw":        readOperation,
+	"lock_info":      readOperation,
+	"health_check":   readOperation,
+	"state_mgr_read": readOperation,
+	"state_at":       readOperation,
+	"workspace_info": readOperation,
+	"state_history":  readOperation,
+
+	"put":               writeOperation,
+	"create":            writeOperation,
+	"delete":            writeOperation,
+	"delete_workspace":  writeOperation,
+	"purge_workspace":   writeOperation,
+	"recover_workspace": writeOperation,
+	"reset_workspace":   writeOperation,
+	"delete_workspaces": writeOperation,
+	"rename_workspace":  writeOperation,
+	"copy_workspace":    writeOperation,
+	"state_mgr":         writeOperation,
+	"state_mgrs":        writeOperation,
+
+	"lock":             lockOperation,
+	"unlock":           lockOperation,
+	"force_unlock":     lockOperation,
+	"unlock_workspace": lockOperation,
+	"lock_heartbeat":   lockOperation,
+}
+
+// forOperation returns the default timeout of the operation of the given
+// name, zero if it has none.
+func (t operationTimeouts) forOperation(name string) time.Duration {
+	switch operationClasses[name] {
+	case listOperation:
+		return t.list
+	case readOperation:
+		return t.read
+	case writeOperation:
+		return t.write
+	case lockOperation:
+		return t.lock
+	}
+	return 0
+}
+
+// withDefaultTimeout returns ctx bounded by timeout if it has no deadline
+// and timeout isn't zero, and the function releasing it. The deadline of
+// the caller always wins, even if it is later.
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
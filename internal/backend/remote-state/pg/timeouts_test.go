@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestWithDefaultTimeout(t *testing.T) {
+	// A context without deadline gets the default timeout
+	start := time.Now()
+	ctx, cancel := withDefaultTimeout(context.Background(), time.Minute)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("no deadline")
+	}
+	if deadline.Before(start.Add(time.Minute)) || deadline.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("wrong deadline %s", deadline)
+	}
+
+	// The deadline of the caller wins, be it shorter or longer
+	for _, timeout := range []time.Duration{time.Second, time.Hour} {
+		parent, cancelParent := context.WithTimeout(context.Background(), timeout)
+		defer cancelParent()
+		want, _ := parent.Deadline()
+		ctx, cancel := withDefaultTimeout(parent, time.Minute)
+		defer cancel()
+		if deadline, _ := ctx.Deadline(); !deadline.Equal(want) {
+			t.Fatalf("wrong deadline %s; want %s", deadline, want)
+		}
+	}
+
+	// A zero timeout applies none
+	ctx, cancel = withDefaultTimeout(context.Background(), 0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("deadline applied without timeout")
+	}
+}
+
+func TestOperationTimeouts(t *testing.T) {
+	timeouts := operationTimeouts{list: time.Second, read: 2 * time.Second, write: 3 * time.Second, lock: 4 * time.Second}
+	for name, want := range map[string]time.Duration{
+		"workspaces":             time.Second,
+		"workspaces_with_prefix": time.Second,
+		"get":                    2 * time.Second,
+		"state_history":          2 * time.Second,
+		"put":                    3 * time.Second,
+		"delete_workspaces":      3 * time.Second,
+		"force_unlock":           4 * time.Second,
+		"export_all":             0,
+	} {
+		if got := timeouts.forOperation(name); got != want {
+			t.Errorf("wrong timeout of %s %s; want %s", name, got, want)
+		}
+	}
+}
+
+func TestRemoteClientOperationTimeout(t *testing.T) {
+	data := func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		return &fakeRows{columns: []string{"data"}, values: [][]driver.Value{{[]byte("{}")}}, affected: 1}, nil
+	}
+
+	// The statements of a state read without deadline get the read timeout
+	db, fake := newFakeDB(t, data)
+	c := &RemoteClient{Client: db, Name: "foo", SchemaName: `"s"`, TableName: `"states"`, timeouts: operationTimeouts{read: time.Hour}}
+	start := time.Now()
+	if _, err := c.Get(); err != nil {
+		t.Fatal(err)
+	}
+	deadlines := fake.Deadlines()
+	if len(deadlines) == 0 {
+		t.Fatal("no statement run")
+	}
+	for _, deadline := range deadlines {
+		if deadline.Before(start.Add(time.Hour)) || deadline.After(time.Now().Add(time.Hour)) {
+			t.Fatalf("wrong deadline %s", deadline)
+		}
+	}
+
+	// A tighter deadline of the caller is kept
+	db, fake = newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		return &fakeRows{columns: []string{"name"}, values: [][]driver.Value{{"foo"}}}, nil
+	})
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, timeouts: operationTimeouts{list: time.Hour}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	if _, err := b.Workspaces(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadlines = fake.Deadlines()
+	if len(deadlines) == 0 {
+		t.Fatal("no statement run")
+	}
+	for _, deadline := range deadlines {
+		if !deadline.Equal(want) {
+			t.Fatalf("wrong deadline %s; want %s", deadline, want)
+		}
+	}
+}
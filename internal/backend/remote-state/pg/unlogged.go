@@ -0,0 +1,44 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// unloggedClause returns the clause creating the states table UNLOGGED when
+// unlogged is set, empty otherwise. The writes to an unlogged table skip the
+// write-ahead log, so they are faster, but the table is truncated when
+// Postgres recovers from a crash, and isn't replicated.
+func (b *Backend) unloggedClause() string {
+	if !b.unlogged {
+		return ""
+	}
+	return "UNLOGGED "
+}
+
+// checkUnlogged logs a warning if the states table, which is only made
+// unlogged when it is created, isn't unlogged as set by unlogged.
+func (b *Backend) checkUnlogged(ctx context.Context, db *sql.DB) error {
+	var persistence string
+	query := `SELECT relpersistence FROM pg_class WHERE oid = to_regclass($1)`
+	err := db.QueryRowContext(ctx, query, fmt.Sprintf("%s.%s", b.schemaName, b.tableName)).Scan(&persistence)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	switch unlogged := persistence == "u"; {
+	case b.unlogged && !unlogged:
+		log.Printf("[WARN] pg: unlogged is ignored, %[1]s.%[2]s already exists and is logged; run ALTER TABLE %[1]s.%[2]s SET UNLOGGED to make it unlogged", b.schemaName, b.tableName)
+	case !b.unlogged && unlogged:
+		log.Printf("[WARN] pg: %[1]s.%[2]s is unlogged, its states are lost if Postgres crashes; run ALTER TABLE %[1]s.%[2]s SET LOGGED to make it durable, or set unlogged if this is intended", b.schemaName, b.tableName)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestBackendUnlogged(t *testing.T) {
+	t.Run("create", func(t *testing.T) {
+		for _, unlogged := range []bool{false, true} {
+			db, fake := newFakeDB(t, func(string, []driver.NamedValue) (*fakeRows, error) {
+				return &fakeRows{}, nil
+			})
+			b := &Backend{schemaName: `"s"`, tableName: `"states"`, unlogged: unlogged}
+			if err := b.createStatesTable(context.Background(), db, "text"); err != nil {
+				t.Fatal(err)
+			}
+			want := `CREATE TABLE IF NOT EXISTS "s"."states"`
+			if unlogged {
+				want = `CREATE UNLOGGED TABLE IF NOT EXISTS "s"."states"`
+			}
+			if query := fake.Queries()[0]; !strings.HasPrefix(query, want) {
+				t.Fatalf("wrong statement %s; want %s", query, want)
+			}
+		}
+	})
+
+	t.Run("existing", func(t *testing.T) {
+		testCases := map[string]struct {
+			unlogged    bool
+			persistence string
+			want        string
+		}{
+			"logged":          {persistence: "p"},
+			"unlogged":        {unlogged: true, persistence: "u"},
+			"missing":         {unlogged: true},
+			"logged-existing": {unlogged: true, persistence: "p", want: `ALTER TABLE "s"."states" SET UNLOGGED`},
+			"unlogged-unset":  {persistence: "u", want: `its states are lost if Postgres crashes; run ALTER TABLE "s"."states" SET LOGGED`},
+			"temporary":       {persistence: "t"},
+		}
+		for name, tc := range testCases {
+			t.Run(name, func(t *testing.T) {
+				db, _ := newFakeDB(t, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+					if args[0].Value != `"s"."states"` {
+						t.Fatalf("wrong table %v", args[0].Value)
+					}
+					rows := &fakeRows{columns: []string{"relpersistence"}}
+					if tc.persistence != "" {
+						rows.values = [][]driver.Value{{tc.persistence}}
+					}
+					return rows, nil
+				})
+				b := &Backend{schemaName: `"s"`, tableName: `"states"`, unlogged: tc.unlogged}
+				logs := captureLog(t)
+
+				if err := b.checkUnlogged(context.Background(), db); err != nil {
+					t.Fatal(err)
+				}
+				if tc.want == "" {
+					if logs.Len() > 0 {
+						t.Fatalf("unexpected warning: %s", logs)
+					}
+					return
+				}
+				if !strings.Contains(logs.String(), "[WARN] pg: ") || !strings.Contains(logs.String(), tc.want) {
+					t.Fatalf("expected a warning containing %q, got: %s", tc.want, logs)
+				}
+			})
+		}
+	})
+}
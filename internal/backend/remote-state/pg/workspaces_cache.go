@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// workspacesCache keeps the result of Workspaces for ttl, so the workspaces
+// are not listed again by each operation of a process. It is invalidated by
+// the operations of the backend creating, renaming or deleting workspaces,
+// the changes made by other processes are seen once it expires.
+//
+// A nil cache caches nothing.
+type workspacesCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	names     []string
+	expiresAt time.Time
+
+	// generation is incremented by invalidate, so a listing made before
+	// an invalidation isn't cached.
+	generation uint64
+}
+
+func newWorkspacesCache(ttl time.Duration) *workspacesCache {
+	return &workspacesCache{ttl: ttl, now: time.Now}
+}
+
+// get returns the cached workspaces, if they haven't expired, and the
+// generation to cache a new listing with.
+func (c *workspacesCache) get() (names []string, generation uint64, ok bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.names == nil || !c.now().Before(c.expiresAt) {
+		return nil, c.generation, false
+	}
+	return slices.Clone(c.names), c.generation, true
+}
+
+// set caches names, listed at the given generation, unless the cache has
+// been invalidated since.
+func (c *workspacesCache) set(names []string, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	c.names = slices.Clone(names)
+	c.expiresAt = c.now().Add(c.ttl)
+}
+
+// contains reports whether name is one of the cached workspaces. ok is
+// false if there are none.
+func (c *workspacesCache) contains(name string) (found, ok bool) {
+	names, _, ok := c.get()
+	if !ok {
+		return false, false
+	}
+	return slices.Contains(names, name), true
+}
+
+func (c *workspacesCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.names = nil
+	c.generation++
+}
@@ -0,0 +1,259 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/opentofu/opentofu/internal/backend"
+)
+
+// workspacesHandler is a fakeDB handler keeping the names of the stored
+// workspaces, and counting how many times they are listed.
+type workspacesHandler struct {
+	mu       sync.Mutex
+	names    map[string]bool
+	listings int
+}
+
+func (h *workspacesHandler) handle(query string, args []driver.NamedValue) (*fakeRows, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(query, "SELECT name") && strings.HasSuffix(query, "= ANY($1)"):
+		rows := &fakeRows{columns: []string{"name"}}
+		for _, name := range *args[0].Value.(*pq.StringArray) {
+			if h.names[name] {
+				rows.values = append(rows.values, []driver.Value{name})
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT name"):
+		h.listings++
+		var names []string
+		for name := range h.names {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rows := &fakeRows{columns: []string{"name"}}
+		for _, name := range names {
+			rows.values = append(rows.values, []driver.Value{name})
+		}
+		return rows, nil
+	case strings.HasPrefix(query, "SELECT EXISTS"):
+		return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{h.names[args[0].Value.(string)]}}}, nil
+	case strings.HasPrefix(query, "INSERT INTO"):
+		h.names[args[0].Value.(string)] = true
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, "UPDATE"):
+		delete(h.names, args[0].Value.(string))
+		h.names[args[1].Value.(string)] = true
+		return &fakeRows{affected: 1}, nil
+	case strings.HasPrefix(query, "DELETE FROM"):
+		delete(h.names, args[0].Value.(string))
+		return &fakeRows{affected: 1}, nil
+	default:
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	}
+}
+
+func (h *workspacesHandler) Listings() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.listings
+}
+
+func TestBackendWorkspacesCache(t *testing.T) {
+	h := &workspacesHandler{names: map[string]bool{"foo": true}}
+	db, _ := newFakeDB(t, h.handle)
+	now := time.Now()
+	cache := newWorkspacesCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, workspacesCache: cache}
+	ctx := context.Background()
+
+	expectWorkspaces := func(listings int, want ...string) {
+		t.Helper()
+		workspaces, err := b.Workspaces(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append([]string{backend.DefaultStateName}, want...)
+		if !reflect.DeepEqual(workspaces, want) {
+			t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+		}
+		if got := h.Listings(); got != listings {
+			t.Fatalf("the workspaces have been listed %d times; want %d", got, listings)
+		}
+	}
+
+	expectWorkspaces(1, "foo")
+	expectWorkspaces(1, "foo")
+
+	// The cached workspaces are copies
+	workspaces, err := b.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaces[1] = "modified"
+	expectWorkspaces(1, "foo")
+
+	// The existence checks use the cache
+	if exists, err := b.WorkspaceExists(ctx, "foo"); err != nil || !exists {
+		t.Fatalf("foo should exist: %t, %v", exists, err)
+	}
+
+	// Creating a workspace invalidates the cache
+	if _, err := b.StateMgr(ctx, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	expectWorkspaces(2, "bar", "foo")
+
+	// So does renaming and deleting one
+	if err := b.renameWorkspace(ctx, "bar", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	expectWorkspaces(3, "baz", "foo")
+	if err := b.DeleteWorkspace(ctx, "baz", true); err != nil {
+		t.Fatal(err)
+	}
+	expectWorkspaces(4, "foo")
+	if exists, err := b.WorkspaceExists(ctx, "baz"); err != nil || exists {
+		t.Fatalf("baz should not exist: %t, %v", exists, err)
+	}
+
+	// The workspaces created by another process are seen once the cache
+	// expires
+	h.mu.Lock()
+	h.names["qux"] = true
+	h.mu.Unlock()
+	now = now.Add(59 * time.Second)
+	expectWorkspaces(4, "foo")
+	now = now.Add(time.Second)
+	expectWorkspaces(5, "foo", "qux")
+}
+
+func TestBackendWorkspacesNotCached(t *testing.T) {
+	h := &workspacesHandler{names: map[string]bool{"foo": true}}
+	db, _ := newFakeDB(t, h.handle)
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`}
+
+	for i := 0; i < 3; i++ {
+		if _, err := b.Workspaces(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := h.Listings(); got != 3 {
+		t.Fatalf("the workspaces have been listed %d times; want 3", got)
+	}
+}
+
+func TestWorkspacesCacheInvalidatedListing(t *testing.T) {
+	cache := newWorkspacesCache(time.Minute)
+
+	// A listing started before an invalidation isn't cached, it may miss
+	// the change invalidating the cache.
+	_, generation, _ := cache.get()
+	cache.invalidate()
+	cache.set([]string{"default"}, generation)
+	if _, _, ok := cache.get(); ok {
+		t.Fatal("a listing made before an invalidation has been cached")
+	}
+
+	_, generation, _ = cache.get()
+	cache.set([]string{"default"}, generation)
+	if names, _, ok := cache.get(); !ok || !reflect.DeepEqual(names, []string{"default"}) {
+		t.Fatalf("wrong cached workspaces %v, %t", names, ok)
+	}
+}
+
+func TestBackendWorkspacesCacheConcurrent(t *testing.T) {
+	h := &workspacesHandler{names: map[string]bool{}}
+	db, _ := newFakeDB(t, h.handle)
+	b := &Backend{db: db, schemaName: `"s"`, tableName: `"states"`, workspacesCache: newWorkspacesCache(time.Minute)}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("ws%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := b.StateMgr(ctx, name); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := b.Workspaces(ctx); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// None of the created workspaces is missing from the cache
+	workspaces, err := b.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workspaces) != 11 {
+		t.Fatalf("wrong workspaces %v", workspaces)
+	}
+}
+
+func TestBackendWorkspacesCacheTTL(t *testing.T) {
+	testACC(t)
+	connStr := getDatabaseUrl()
+	schemaName := fmt.Sprintf("terraform_%s", t.Name())
+	dbCleaner, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbCleaner.Query(fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName))
+
+	config := backend.TestWrapConfig(map[string]interface{}{
+		"conn_str":             connStr,
+		"schema_name":          schemaName,
+		"workspaces_cache_ttl": "1s",
+	})
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	other := backend.TestBackendConfig(t, New(), config).(*Backend)
+	backend.TestBackendStates(t, b)
+
+	ctx := context.Background()
+	if _, err := b.Workspaces(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.StateMgr(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The workspace created by the other backend is seen once the cache
+	// expires
+	time.Sleep(1100 * time.Millisecond)
+	workspaces, err := b.Workspaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{backend.DefaultStateName, "foo"}; !reflect.DeepEqual(workspaces, want) {
+		t.Fatalf("wrong workspaces %v; want %v", workspaces, want)
+	}
+}